@@ -7,37 +7,76 @@
    Display one or more subtrees in the cgroups v2 hierarchy.  The following
    info is displayed for each cgroup: the cgroup type, the controllers enabled
    in the cgroup, and the process and thread members of the cgroup.
+
+   By default, color is used, and the lists of PIDs and TIDs are wrapped to
+   the width of the terminal, only if standard output is a terminal; the
+   "--color" and "--width" options override these defaults.
+
+   Default values for the options can be set in the configuration file
+   $XDG_CONFIG_HOME/tlpi-tools/config (see loadConfig()); the "--no-config"
+   option causes the file to be ignored.
 */
 
 package main
 
 import (
+	"archive/tar"
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 	"unsafe"
 )
 
-// Info from command-line options
+// Info from command-line options, along with the statistics gathered while
+// walking the cgroups (see 'walkStats')
 
 type CmdLineOptions struct {
-	useColor  bool // Use color in the output
-	showPids  bool // Show member PIDs for each cgroup
-	showTids  bool // Show member TIDs for each cgroup
-	showOwner bool // Show cgroup ownership
+	useColor  bool   // Use color in the output
+	showPids  bool   // Show member PIDs for each cgroup
+	showTids  bool   // Show member TIDs for each cgroup
+	showOwner bool   // Show cgroup ownership
+	capture   string // Write a snapshot archive to this file
+	replay    string // Display from this snapshot archive
+	showStats bool   // Report the cost of the walk
+	width     int    // Wrap output to this width (0: don't wrap)
+
+	stats walkStats // Cost of the walk, for "--stats"
 }
 
 var opts CmdLineOptions
 
+// While walking the cgroup subtrees, we count the work done, so that it can
+// be reported by the "--stats" option. Each cgroup is displayed as soon as it
+// is visited, so the time taken to scan and to display the cgroups is
+// measured as a single figure.
+
+type walkStats struct {
+	walkTime     time.Duration // Wall time taken to walk and display
+	cgroups      int           // Cgroup directories visited
+	filesRead    int           // Cgroup and /proc files read
+	ioctls       int           // ioctl() operations performed
+	schedQueries int           // sched_getscheduler() calls
+}
+
 // 'rootSlashCnt' is the number of slashes in the pathname of the cgroup that
 // is the root of the subtree that is currently being displayed.  This is used
 // for calculating the indent for displaying the descendant cgroups under this
@@ -86,22 +125,128 @@ var cgroupAbbrev = map[string]string{
 func main() {
 	opts = parseCmdLineOptions()
 
+	handleSignals(opts.useColor)
+
 	if len(flag.Args()) == 0 {
 		showUsageAndExit(1)
 	}
 
+	if opts.replay != "" {
+		err := loadReplay(opts.replay)
+		if err != nil {
+			logMessage(LOG_QUIET, err)
+			os.Exit(1)
+		}
+	}
+
+	if opts.capture != "" {
+		err := openCapture(opts.capture)
+		if err != nil {
+			logMessage(LOG_QUIET, err)
+			os.Exit(1)
+		}
+	}
+
 	// Walk the directory trees specified in the command-line arguments.
+	// Since each cgroup is displayed as it is visited, an interrupted
+	// walk leaves the partial results already displayed.
+
+	ctx := startScan()
+	defer cancelScan()
+
+	walkStart := time.Now()
 
 	for _, f := range flag.Args() {
 		f = filepath.Clean(f) // Remove consecutive + trailing slashes
 		rootSlashCnt = len(strings.Split(f, "/"))
 
-		err := filepath.Walk(f, walkFn)
+		logMessage(LOG_VERBOSE, "Walking cgroup subtree:", f)
+
+		err := walkCgroups(ctx, f)
+		if errors.Is(err, context.Canceled) {
+			break
+		}
+		if err != nil {
+			output.Flush()
+			logMessage(LOG_QUIET, err)
+			os.Exit(1)
+		}
+	}
+
+	if opts.capture != "" {
+		err := closeCapture()
 		if err != nil {
-			fmt.Println(err)
+			logMessage(LOG_QUIET, err)
 			os.Exit(1)
 		}
 	}
+
+	flushOutput()
+
+	opts.stats.walkTime = time.Since(walkStart)
+
+	if opts.showStats {
+		opts.stats.report()
+	}
+
+	if endScan(ctx) {
+		logMessage(LOG_QUIET, "Scan interrupted: the results above "+
+			"are partial")
+		os.Exit(EXIT_INTERRUPTED)
+	}
+}
+
+// walkCgroups() displays the cgroup subtree rooted at 'root', either by
+// walking the live cgroup filesystem or, in replay mode, the directories
+// recorded in the snapshot archive. If 'ctx' is canceled, the walk stops,
+// returning the context's error.
+
+func walkCgroups(ctx context.Context, root string) error {
+	if replayDirs == nil {
+		return filepath.Walk(root, func(path string, fi os.FileInfo,
+			e error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return walkFn(path, fi, e)
+		})
+	}
+
+	abs := replayPath(root)
+	if _, found := replayDirs[abs]; !found {
+		return &os.PathError{Op: "lstat", Path: root,
+			Err: syscall.ENOENT}
+	}
+
+	return replayWalk(ctx, root, abs)
+}
+
+// replayWalk() displays the cgroup 'path' (whose absolute pathname is 'abs')
+// and, recursively, its descendants, as recorded in the snapshot archive.
+// As with filepath.Walk(), the children of each cgroup are visited in
+// lexical order.
+
+func replayWalk(ctx context.Context, path string, abs string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	logMessage(LOG_DEBUG, "Visiting cgroup:", path)
+
+	err := displayCgroup(path)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range replayChildren[abs] {
+		err = replayWalk(ctx, filepath.Join(path, name),
+			filepath.Join(abs, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // Callback function used by filepath.Walk() to visit each file
@@ -114,6 +259,13 @@ func walkFn(path string, fi os.FileInfo, e error) error {
 	}
 
 	if fi.IsDir() { // We're only interested in the cgroup directories
+		logMessage(LOG_DEBUG, "Visiting cgroup:", path)
+		if captureTar != nil {
+			err := captureDir(path, fi)
+			if err != nil {
+				return err
+			}
+		}
 		err := displayCgroup(path)
 		if err != nil {
 			return err
@@ -130,11 +282,13 @@ func displayCgroup(path string) (err error) {
 
 	var cgroupType string
 
+	opts.stats.cgroups++
+
 	// Get the cgroup type. If this fails, the most likely reason is that
 	// the 'cgroup.type' file does not exist because this is the root
 	// cgroup.
 
-	ct, err := ioutil.ReadFile(path + "/" + "cgroup.type")
+	ct, err := readFile(path + "/" + "cgroup.type")
 	if err != nil {
 		cgroupType = "root"
 	} else {
@@ -155,11 +309,15 @@ func displayCgroup(path string) (err error) {
 	if level > 0 {
 		p = filepath.Base(path)
 	}
+	p = escapeName(p)
 
 	// We show each cgroup type with a distinctive color/style.
 
-	fmt.Print(indent + cgroupColor[cgroupType] + p + NORMAL + " " +
-		cgroupAbbrev[cgroupType])
+	if opts.useColor {
+		p = cgroupColor[cgroupType] + p + NORMAL
+	}
+
+	fmt.Fprint(output, indent+p+" "+cgroupAbbrev[cgroupType])
 
 	// Display controllers that are enabled for this group.
 
@@ -168,17 +326,17 @@ func displayCgroup(path string) (err error) {
 		return err
 	}
 
-	fmt.Println()
+	fmt.Fprintln(output)
 
 	// Display cgroup ownership
 
 	if opts.showOwner {
-		fmt.Print(indent + "    ")
+		fmt.Fprint(output, indent+"    ")
 		err = displayCgroupOwnership(path)
 		if err != nil {
 			return err
 		}
-		fmt.Println()
+		fmt.Fprintln(output)
 	}
 
 	// Display member processes and threads
@@ -191,6 +349,58 @@ func displayCgroup(path string) (err error) {
 	return nil
 }
 
+// parseArgs() parses the command line in the same way as flag.Parse(), except
+// that options may also appear after (or among) the nonoption arguments, so
+// that, for example, "view_v2_cgroups /sys/fs/cgroup --no-color" works as
+// expected. An argument of "--" ends the options: all later arguments are
+// nonoption arguments. A negative number, and a lone "-", are nonoption
+// arguments. Any other argument that starts with '-' is treated as an option,
+// so that the flag package diagnoses it if it is unrecognized.
+
+func parseArgs() {
+	var options, nonOptions []string
+
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if arg == "--" {
+			nonOptions = append(nonOptions, args[i+1:]...)
+			break
+		}
+
+		if _, err := strconv.Atoi(arg); err == nil || len(arg) < 2 ||
+			arg[0] != '-' {
+			nonOptions = append(nonOptions, arg)
+			continue
+		}
+
+		options = append(options, arg)
+
+		// An option that takes a value may have the value in the
+		// following argument, which must stay with the option.
+
+		name := strings.TrimLeft(arg, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+
+		f := flag.Lookup(name)
+		if f == nil || i+1 == len(args) {
+			continue
+		}
+
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		if !ok || !b.IsBoolFlag() {
+			i++
+			options = append(options, args[i])
+		}
+	}
+
+	options = append(options, "--")
+	flag.CommandLine.Parse(append(options, nonOptions...))
+}
+
 // parseCmdLineOptions() parses command-line options and returns them
 // conveniently packaged in a structure.
 
@@ -201,6 +411,11 @@ func parseCmdLineOptions() CmdLineOptions {
 	// Parse command-line options.
 
 	helpPtr := flag.Bool("help", false, "Show detailed usage message")
+	completionPtr := flag.String("generate-completion", "",
+		"Write a bash or zsh completion script")
+	quietPtr := flag.Bool("q", false, "Display only error messages")
+	flag.Var(logLevelFlag{}, "v", "Display progress messages "+
+		"(repeat for debugging messages)")
 	noColorPtr := flag.Bool("no-color", false,
 		"Don't use color in output display")
 	noPidsPtr := flag.Bool("no-pids", false,
@@ -209,37 +424,643 @@ func parseCmdLineOptions() CmdLineOptions {
 		"Don't show TIDs that are members of each cgroup")
 	showOwnerPtr := flag.Bool("show-owner", false,
 		"Show owner UID for cgroup")
-
-	flag.Parse()
+	capturePtr := flag.String("capture", "",
+		"Write a snapshot of the files that were read to this file")
+	replayPtr := flag.String("replay", "",
+		"Display from a snapshot instead of the live system")
+	statsPtr := flag.Bool("stats", false, "Report the cost of the walk")
+	colorPtr := flag.String("color", "auto", "When to use color "+
+		"(\"auto\", \"always\", or \"never\")")
+	widthPtr := flag.Int("width", 0, "Wrap output to this many columns")
+	noConfigPtr := flag.Bool("no-config", false, "Don't read the "+
+		"configuration file")
+
+	parseArgs()
+
+	if !*noConfigPtr {
+		loadConfig()
+	}
 
 	if *helpPtr {
 		showUsageAndExit(0)
 	}
 
-	opts.useColor = !*noColorPtr
+	if *completionPtr != "" {
+		if *completionPtr != "bash" && *completionPtr != "zsh" {
+			logMessage(LOG_QUIET, "Bad value for "+
+				"--generate-completion option: "+
+				*completionPtr)
+			showUsageAndExit(1)
+		}
+		generateCompletion(*completionPtr)
+		os.Exit(0)
+	}
+
+	if *quietPtr {
+		if logLevel != LOG_NORMAL {
+			logMessage(LOG_QUIET, "'-q' can't be combined with "+
+				"'-v'")
+			showUsageAndExit(1)
+		}
+		logLevel = LOG_QUIET
+	}
+
+	// By default, color is used, and output is wrapped to the width of the
+	// terminal, only if standard output is a terminal. The "--color" and
+	// "--width" options override these defaults.
+
+	isTTY := isTerminal(syscall.Stdout)
+
+	if *colorPtr != "auto" && *noColorPtr {
+		logMessage(LOG_QUIET, "'--no-color' can't be combined with "+
+			"'--color'")
+		showUsageAndExit(1)
+	}
+
+	switch *colorPtr {
+	case "auto":
+		opts.useColor = isTTY && !*noColorPtr
+	case "always":
+		opts.useColor = true
+	case "never":
+		opts.useColor = false
+	default:
+		logMessage(LOG_QUIET, "Bad value for --color option: "+
+			*colorPtr)
+		showUsageAndExit(1)
+	}
+
+	if *widthPtr < 0 {
+		logMessage(LOG_QUIET, "Bad value for --width option: "+
+			strconv.Itoa(*widthPtr))
+		showUsageAndExit(1)
+	}
+
+	opts.width = *widthPtr
+	if opts.width == 0 && isTTY {
+		opts.width = getTerminalWidth(80)
+	}
+
 	opts.showPids = !*noPidsPtr
 	opts.showTids = !*noTidsPtr
 	opts.showOwner = *showOwnerPtr
+	opts.capture = *capturePtr
+	opts.replay = *replayPtr
+	opts.showStats = *statsPtr
+
+	if opts.capture != "" && opts.replay != "" {
+		logMessage(LOG_QUIET, "'--capture' can't be combined with "+
+			"'--replay'")
+		showUsageAndExit(1)
+	}
 
 	return opts
 }
 
+// Display output is accumulated in 'output' and written to standard output
+// in large chunks, rather than with a write() for each of the many small
+// fmt.Fprint() calls that build it. Operations on the buffer are serialized,
+// so that the signal handler can safely write out what has been buffered if
+// the program is interrupted.
+
+type lineWriter struct {
+	mu  sync.Mutex
+	buf []byte
+	out io.Writer
+}
+
+const outputBufSize = 64 * 1024
+
+var output = &lineWriter{out: os.Stdout}
+
+// Write() appends 'p' to the buffer. Once the buffer has grown large, the
+// complete lines that it contains are written out.
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= outputBufSize {
+		err := w.writeLines()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// writeLines() writes out the complete lines in the buffer, keeping any
+// partial last line. The caller must hold 'w.mu'.
+
+func (w *lineWriter) writeLines() error {
+	n := bytes.LastIndexByte(w.buf, '\n') + 1
+	_, err := w.out.Write(w.buf[:n])
+	w.buf = w.buf[:copy(w.buf, w.buf[n:])]
+	return err
+}
+
+// Flush() writes out everything in the buffer.
+
+func (w *lineWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, err := w.out.Write(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+// interrupt() is called when the program is interrupted by a signal. It
+// writes out the complete lines in the buffer, discarding any partial last
+// line so that the output doesn't stop part way through a line, and then
+// writes 'trailer'. 'w.mu' is left locked, so that no further output is
+// written before the program exits.
+
+func (w *lineWriter) interrupt(trailer string) {
+	w.mu.Lock()
+	w.writeLines()
+	io.WriteString(w.out, trailer)
+}
+
+// flushOutput() writes out any output still buffered in 'output'. An error is
+// fatal, except for EPIPE (the reader of our output went away), which is
+// treated as a successful exit.
+
+func flushOutput() {
+	err := output.Flush()
+	if errors.Is(err, syscall.EPIPE) {
+		os.Exit(0)
+	}
+	if err != nil {
+		logMessage(LOG_QUIET, "Error writing standard output:", err)
+		os.Exit(1)
+	}
+}
+
+// While the scan is in progress, SIGINT and SIGTERM cancel it (see
+// handleSignals()) rather than terminating the program, so that the results
+// gathered so far can still be displayed. 'scanInProgress' (which is
+// accessed atomically) is 1 while the scan can be canceled.
+
+var scanInProgress int32
+var cancelScan context.CancelFunc
+
+// The exit status used when the scan was interrupted, so that only
+// partial results were displayed.
+
+const EXIT_INTERRUPTED = 3
+
+// startScan() returns the context to be checked by the scan, which is canceled
+// if the program is interrupted before endScan() is called.
+
+func startScan() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelScan = cancel
+	atomic.StoreInt32(&scanInProgress, 1)
+	return ctx
+}
+
+// endScan() marks the end of the scan that uses 'ctx', and returns true if
+// the scan was interrupted.
+
+func endScan(ctx context.Context) bool {
+	atomic.StoreInt32(&scanInProgress, 0)
+	return ctx.Err() != nil
+}
+
+// handleSignals() arranges for the program to terminate cleanly if it is
+// interrupted. If a scan is in progress, SIGINT or SIGTERM cancels the scan
+// (see startScan()); otherwise, the complete lines of buffered output are
+// written out and the terminal color is reset (if we are using color), so that
+// the shell prompt isn't left colored, and the program exits with the
+// conventional status of 128 plus the signal number. On SIGPIPE (the reader of
+// our output went away, as in "view_v2_cgroups | head"), the program exits
+// silently with status 0.
+
+func handleSignals(useColor bool) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM,
+		syscall.SIGPIPE)
+
+	go func() {
+		for sig := range sigChan {
+			if sig == syscall.SIGPIPE {
+				os.Exit(0)
+			}
+
+			// While the scan is in progress, the first SIGINT
+			// or SIGTERM just cancels it.
+
+			if atomic.CompareAndSwapInt32(&scanInProgress, 1, 0) {
+				cancelScan()
+				continue
+			}
+
+			trailer := ""
+			if useColor {
+				trailer = NORMAL
+			}
+			output.interrupt(trailer)
+
+			os.Exit(128 + int(sig.(syscall.Signal)))
+		}
+	}()
+}
+
+// Diagnostic messages are written to stderr, so that they don't become mixed
+// with the program's output. Which messages are displayed depends on the
+// logging level, which is selected with the "-q" and "-v" options.
+
+const (
+	LOG_QUIET   = iota // Errors only
+	LOG_NORMAL         // Errors and warnings (the default)
+	LOG_VERBOSE        // Also progress messages
+	LOG_DEBUG          // Also debugging messages
+)
+
+var logLevel = LOG_NORMAL
+
+// logMessage() writes its arguments (formatted as for fmt.Println()) to
+// stderr, if 'level' is no higher than the current logging level.
+
+func logMessage(level int, a ...interface{}) {
+	if level <= logLevel {
+		fmt.Fprintln(os.Stderr, a...)
+	}
+}
+
+// 'logLevelFlag' implements the "-v" option, each occurrence of which raises
+// the logging level by one step.
+
+type logLevelFlag struct{}
+
+func (logLevelFlag) String() string   { return "" }
+func (logLevelFlag) IsBoolFlag() bool { return true }
+
+func (logLevelFlag) Set(value string) error {
+	v, err := strconv.ParseBool(value)
+	if err == nil && v && logLevel < LOG_DEBUG {
+		logLevel++
+	}
+	return err
+}
+
+// Shell completion. The "--generate-completion=bash|zsh" option (which is
+// deliberately left out of the usage message) writes a completion script for
+// this program to stdout. The script is built from the options registered
+// with the flag package, so that it can't drift from them.
+//
+// 'completionActions' says how the values of particular options are
+// completed, and 'argAction' says how command-line arguments are completed.
+// An action is "pid" (PIDs from /proc), "file", "dir", "cgroup" (directories
+// under the cgroup v2 mount), "" (no completion), or a space-separated list
+// of the words that are permitted.
+
+var completionActions = map[string]string{
+	"capture": "file",
+	"replay":  "file",
+	"color":   "auto always never",
+	"width":   "",
+}
+
+const argAction = "cgroup"
+
+// bashAction() returns bash code that completes the word in '$cur' according to
+// 'action'.
+
+func bashAction(action string) string {
+	switch action {
+	case "":
+		return ""
+	case "pid":
+		return `COMPREPLY=( $(compgen -W "$(ls /proc | ` +
+			`grep '^[0-9]')" -- "$cur") )`
+	case "file":
+		return `COMPREPLY=( $(compgen -f -- "$cur") )`
+	case "dir":
+		return `COMPREPLY=( $(compgen -d -- "$cur") )`
+	case "cgroup":
+		return `[ -z "$cur" ] && cur=$(awk '$3 == "cgroup2" ` +
+			`{ print $2; exit }' /proc/self/mounts)/` + "\n" +
+			`COMPREPLY=( $(compgen -d -- "$cur") )`
+	default:
+		return `COMPREPLY=( $(compgen -W "` + action + `" -- "$cur") )`
+	}
+}
+
+// zshAction() returns the zsh _arguments action corresponding to 'action'.
+
+func zshAction(action string) string {
+	switch action {
+	case "":
+		return " "
+	case "pid":
+		return "_pids"
+	case "file":
+		return "_files"
+	case "dir", "cgroup":
+		return "_files -/"
+	default:
+		return "(" + action + ")"
+	}
+}
+
+// generateCompletion() writes a completion script for 'shell' ("bash" or "zsh")
+// to stdout.
+
+func generateCompletion(shell string) {
+	const prog = "view_v2_cgroups"
+
+	// Options are completed with a double dash, except for the
+	// single-letter ones such as "-q".
+
+	dashes := func(name string) string {
+		if len(name) == 1 {
+			return "-" + name
+		}
+		return "--" + name
+	}
+
+	var names []string
+	var flags []*flag.Flag
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name != "generate-completion" {
+			names = append(names, dashes(f.Name))
+			flags = append(flags, f)
+		}
+	})
+
+	isBool := func(f *flag.Flag) bool {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		return ok && b.IsBoolFlag()
+	}
+
+	if shell == "zsh" {
+		quoter := strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`,
+			":", `\:`)
+
+		fmt.Println("#compdef " + prog)
+		fmt.Println()
+		fmt.Println("_arguments \\")
+		for _, f := range flags {
+			spec := dashes(f.Name)
+			if !isBool(f) {
+				spec += "="
+			}
+			spec += "[" + quoter.Replace(f.Usage) + "]"
+			if !isBool(f) {
+				spec += ":" + f.Name + ":" +
+					zshAction(completionActions[f.Name])
+			}
+			fmt.Println("\t'" + spec + "' \\")
+		}
+		fmt.Println("\t'*:argument:" + zshAction(argAction) + "'")
+		return
+	}
+
+	// Go's flag package accepts both "--opt=value" and "--opt value";
+	// bash splits the former into three words at the '='.
+
+	fmt.Println(`_` + prog + `()
+{
+	local cur prev opt
+	cur=${COMP_WORDS[COMP_CWORD]}
+	prev=${COMP_WORDS[COMP_CWORD-1]}
+	COMPREPLY=()
+
+	if [ "$cur" = "=" ]; then
+		opt=$prev
+		cur=
+	elif [ "$prev" = "=" ]; then
+		opt=${COMP_WORDS[COMP_CWORD-2]}
+	else
+		opt=$prev
+	fi
+
+	case $opt in`)
+
+	for _, f := range flags {
+		if !isBool(f) {
+			fmt.Println("\t-" + f.Name + "|--" + f.Name + ")")
+			action := bashAction(completionActions[f.Name])
+			if action != "" {
+				fmt.Println("\t\t" + strings.Replace(action,
+					"\n", "\n\t\t", -1))
+			}
+			fmt.Println("\t\treturn ;;")
+		}
+	}
+
+	fmt.Println(`	esac
+
+	case $cur in
+	-*)
+		COMPREPLY=( $(compgen -W "` + strings.Join(names, " ") + `" \
+			-- "$cur") )
+		return ;;
+	esac
+
+	` + strings.Replace(bashAction(argAction), "\n", "\n\t", -1) + `
+}
+complete -F _` + prog + ` ` + prog)
+}
+
+// Default values for command-line options can be supplied in a
+// configuration file that is shared with other programs. Each line of the
+// file has the form "option = value", and applies to the program named in
+// the most recent "[program]" section header; alternatively, an option can
+// be written as "program.option". Blank lines and lines that start with
+// '#' are ignored. The file is read after the command line has been parsed,
+// and supplies values only for the options that the command line didn't
+// set (see loadConfig()).
+
+const configProgram = "view_v2_cgroups"
+
+// configFilePath() returns the pathname of the configuration file.
+
+func configFilePath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+
+	return filepath.Join(dir, "tlpi-tools", "config")
+}
+
+// Groups of options that conflict with, or override, one another. For
+// example, "--no-color" on the command line overrides "color = never" in
+// the configuration file, rather than being rejected in combination with
+// it, and "-q" overrides "v = true".
+
+var configOptionGroups = [][]string{
+	{"q", "v"},
+	{"color", "no-color"},
+}
+
+// loadConfig() sets the options that the configuration file (if there is
+// one) specifies for this program, except for those that were set on the
+// command line, or that are in a group (see 'configOptionGroups') one of
+// whose options was set on the command line. Problems with the file, such
+// as unknown options or malformed lines, are reported as warnings, and the
+// offending lines are ignored.
+
+func loadConfig() {
+	path := configFilePath()
+
+	overridden := make(map[string]bool)
+
+	flag.Visit(func(f *flag.Flag) {
+		overridden[f.Name] = true
+
+		for _, group := range configOptionGroups {
+			for _, name := range group {
+				if name != f.Name {
+					continue
+				}
+				for _, other := range group {
+					overridden[other] = true
+				}
+			}
+		}
+	})
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logMessage(LOG_NORMAL, "Warning:", err)
+		}
+		return
+	}
+
+	section := ""
+
+	for i, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		where := path + ":" + strconv.Itoa(i+1) + ":"
+
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				logMessage(LOG_NORMAL, where,
+					"malformed section header")
+				section = ""
+				continue
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		// Malformed lines in other programs' sections are left for
+		// those programs to report.
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			if section == "" || section == configProgram {
+				logMessage(LOG_NORMAL, where,
+					"expected \"option = value\"")
+			}
+			continue
+		}
+
+		option := strings.TrimSpace(line[:eq])
+		value := strings.TrimSpace(line[eq+1:])
+
+		program := section
+		if dot := strings.Index(option, "."); dot >= 0 {
+			program = option[:dot]
+			option = option[dot+1:]
+		}
+
+		if program == "" {
+			logMessage(LOG_NORMAL, where, "option \""+option+
+				"\" is not in a [program] section")
+			continue
+		}
+
+		if program != configProgram {
+			continue
+		}
+
+		if flag.Lookup(option) == nil || option == "no-config" {
+			logMessage(LOG_NORMAL, where, "unknown option \""+
+				option+"\"")
+			continue
+		}
+
+		if overridden[option] {
+			continue
+		}
+
+		err = flag.Set(option, value)
+		if err != nil {
+			logMessage(LOG_NORMAL, where, "bad value for \""+
+				option+"\":", err)
+		}
+	}
+}
+
 // showUsageAndExit() prints a command-line usage message for this program and
 // terminates the program with the specified 'status' value.
 
 func showUsageAndExit(status int) {
-	fmt.Println(
+
+	// The usage message is a diagnostic, written to stderr, unless it
+	// was asked for with "--help".
+
+	out := os.Stdout
+	if status != 0 {
+		out = os.Stderr
+	}
+
+	fmt.Fprintln(out,
 		`Usage: view_v2_cgroups [options] <cgroup-dir-path>...
 
 Show the state (cgroup type, enabled controllers, member processes, member
 TIDs,and, optionally, owning UID) of the cgroups in the cgroup v2
 subhierarchies whose pathnames are supplied as the command line arguments.
 
+Error and progress messages are written to standard error.
+
+Default values for the options can be set in the file
+$XDG_CONFIG_HOME/tlpi-tools/config (or ~/.config/tlpi-tools/config), in
+lines of the form "option = value" that follow a "[view_v2_cgroups]" line.
+Options on the command line override those in the file.
+
 Options:
+-q              Display only error messages.
+-v              Display progress messages. If specified twice, also display
+                debugging messages.
+--capture=<file>
+                While displaying, record the cgroup and /proc files that
+                are read (along with cgroup ownership and thread scheduling
+                policies) in a tar archive written to <file>.
+--color=<when>  Use color in the displayed output "always", "never", or
+                only if standard output is a terminal ("auto", the
+                default). Can't be combined with '--no-color'.
 --no-color      Don't use color in the displayed output.
+--no-config     Don't read the configuration file.
 --no-pids       Don't show the member PIDs in each cgroup.
 --no-tids       Don't show the member TIDs in each cgroup.
+--replay=<file> Display the cgroups recorded in the snapshot archive <file>
+                instead of those on the live system. The pathnames given
+                on the command line are looked up in the snapshot; relative
+                pathnames are interpreted relative to the directory in
+                which the snapshot was captured.
 --show-owner    Show the user ID of each cgroup.
+--stats         After the output, report on standard error the time taken
+                to walk and display the cgroups, and the numbers of cgroups
+                visited, files read, ioctl() operations, and
+                sched_getscheduler() calls performed.
+--width=<n>     Wrap the lists of PIDs and TIDs to fit in <n> columns. By
+                default, the lists are wrapped to the width of the
+                terminal, or not at all if standard output is not a
+                terminal.
   `)
 
 	os.Exit(status)
@@ -249,28 +1070,22 @@ Options:
 
 func displayCgroupOwnership(path string) error {
 
-	fi, err := os.Stat(path)
+	uid, err := cgroupOwner(path)
 	if err != nil {
 		return err
 	}
 
-	stat, ok := fi.Sys().(*syscall.Stat_t)
-	if !ok {
-		return errors.New("fi.Sys() failure for " + path)
-		return err
-	}
-
 	if opts.useColor {
-		fmt.Print(MAGENTA)
+		fmt.Fprint(output, MAGENTA)
 	}
 
-	fmt.Print("<UID: " + strconv.Itoa(int(stat.Uid)))
-	//fmt.Print("; GID: " + strconv.Itoa(int(stat.Gid)))
-	//fmt.Print("; " + fmt.Sprint(fi.Mode())[1:])
-	fmt.Print(">")
+	fmt.Fprint(output, "<UID: "+strconv.Itoa(uid))
+	//fmt.Fprint(output, "; GID: " + strconv.Itoa(int(stat.Gid)))
+	//fmt.Fprint(output, "; " + fmt.Sprint(fi.Mode())[1:])
+	fmt.Fprint(output, ">")
 
 	if opts.useColor {
-		fmt.Print(NORMAL)
+		fmt.Fprint(output, NORMAL)
 	}
 
 	return nil
@@ -282,7 +1097,7 @@ func displayCgroupOwnership(path string) error {
 func displayControllers(path string) error {
 
 	scPath := path + "/" + "cgroup.subtree_control"
-	sc, err := ioutil.ReadFile(scPath)
+	sc, err := readFile(scPath)
 	if err != nil {
 		return err
 	}
@@ -293,7 +1108,7 @@ func displayControllers(path string) error {
 		if opts.useColor {
 			controllers = BRIGHT_YELLOW + controllers + NORMAL
 		}
-		fmt.Print("    " + controllers)
+		fmt.Fprint(output, "    "+controllers)
 	}
 
 	return nil
@@ -304,12 +1119,16 @@ func displayControllers(path string) error {
 
 func displayMembers(path string, cgroupType string, indent string) error {
 
-	// Calculate display width of PID and TID lists.
+	// Calculate display width of PID and TID lists. If output is not
+	// being wrapped, each list is displayed on a single line.
 
 	const minDisplayWidth = 32
-	width := getTerminalWidth() - len(indent)
-	if width < minDisplayWidth {
-		width = minDisplayWidth
+	width := math.MaxInt32
+	if opts.width > 0 {
+		width = opts.width - len(indent)
+		if width < minDisplayWidth {
+			width = minDisplayWidth
+		}
 	}
 
 	// If this cgroup has member processes, display them. The
@@ -334,9 +1153,23 @@ func displayMembers(path string, cgroupType string, indent string) error {
 	return nil
 }
 
-// Discover width of terminal, so that we can format output suitably.
+// isTerminal() returns true if the file descriptor 'fd' refers to
+// a terminal.
+
+func isTerminal(fd int) bool {
+	var t syscall.Termios
+
+	_, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		uintptr(syscall.TCGETS), uintptr(unsafe.Pointer(&t)))
+
+	return err == 0
+}
+
+// getTerminalWidth() returns the width of the terminal, so that we can
+// format output suitably. If the width can't be determined (perhaps
+// because stdout is not a terminal), 'fallback' is returned.
 
-func getTerminalWidth() int {
+func getTerminalWidth(fallback int) int {
 	type winsize struct {
 		row    uint16
 		col    uint16
@@ -345,12 +1178,14 @@ func getTerminalWidth() int {
 	}
 	var ws winsize
 
-	ret, _, _ := syscall.Syscall(syscall.SYS_IOCTL,
+	opts.stats.ioctls++
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL,
 		uintptr(syscall.Stdout), uintptr(syscall.TIOCGWINSZ),
 		uintptr(unsafe.Pointer(&ws)))
 
-	if int(ret) == -1 { // Call failed (perhaps stdout is not a terminal)
-		return 80
+	if errno != 0 || ws.col == 0 {
+		return fallback
 	}
 
 	return int(ws.col)
@@ -377,7 +1212,7 @@ func displayProcesses(path string, width int, indent string) error {
 			buf = colorEachLine(buf, LIGHT_BLUE)
 		}
 
-		fmt.Println(buf)
+		fmt.Fprintln(output, buf)
 	}
 
 	return nil
@@ -420,7 +1255,7 @@ func displayThreads(path string, width int, indent string) error {
 
 		isRealtime, err := getPolicy(t)
 		if err != nil {
-			return err
+			return fmt.Errorf("sched_getscheduler(%d): %w", t, err)
 		}
 
 		buf += fmt.Sprint(t)
@@ -438,14 +1273,13 @@ func displayThreads(path string, width int, indent string) error {
 
 		// Highlight the marker character used for realtime threads.
 
-		replacer := strings.NewReplacer("*", RED+REVERSE+"*"+
-			NORMAL+LIGHT_BLUE)
+		replacer := strings.NewReplacer("*", RED+REVERSE+"*"+NORMAL)
 		buf = replacer.Replace(buf)
 
 		buf = colorEachLine(buf, LIGHT_BLUE)
 	}
 
-	fmt.Println(buf)
+	fmt.Fprintln(output, buf)
 
 	return nil
 }
@@ -459,36 +1293,71 @@ func getPolicy(tid int) (bool, error) {
 	const SCHED_RR = 2
 	const SCHED_DEADLINE = 6
 
-	type sched_param struct {
-		sched_priority uint32
+	policy, err := schedPolicy(tid)
+	if err != nil {
+		return false, err
 	}
 
-	var sp sched_param
-	var policy int
+	isRealtime := policy == SCHED_DEADLINE || policy == SCHED_FIFO ||
+		policy == SCHED_RR
 
-	ret, _, e := syscall.Syscall6(syscall.SYS_SCHED_GETSCHEDULER,
-		uintptr(tid), uintptr(unsafe.Pointer(&sp)),
-		uintptr(0), uintptr(0), uintptr(0), uintptr(0))
+	return isRealtime, nil
+}
+
+// For each thread whose /proc/TID/status file we have parsed, we record
+// the fields of that file that are of interest to us.
+
+type procStatus struct {
+	tgid int // Thread group ID ('Tgid' field), or -1 if not found
+}
+
+// The parsed status file of each thread, cached so that the file is read
+// at most once per thread.
+
+var statusCache = make(map[int]*procStatus)
+
+// A regular expression used to split a /proc/TID/status line into the field
+// name and the field value.
+
+var statusFieldSepRE = regexp.MustCompile(":[ \t]*")
+
+// getProcStatus() returns the fields of interest from the /proc/TID/status
+// file of 'tid'. The whole file is read before any of it is parsed.
 
-	policy = int(ret)
+func getProcStatus(tid int) (*procStatus, error) {
 
-	if policy == -1 {
-		return false, e
+	if ps, fnd := statusCache[tid]; fnd {
+		return ps, nil
 	}
 
-	isRealtime := policy == SCHED_DEADLINE || policy == SCHED_FIFO ||
-		policy == SCHED_RR
+	buf, err := readFile("/proc/" + strconv.Itoa(tid) + "/status")
+	if err != nil {
+		return nil, err
+	}
 
-	return isRealtime, nil
+	// Scan file line by line, looking for the 'Tgid:' entry.
+
+	ps := &procStatus{tgid: -1}
+
+	s := bufio.NewScanner(bytes.NewReader(buf))
+	for s.Scan() {
+		if strings.HasPrefix(s.Text(), "Tgid:") {
+			tokens := statusFieldSepRE.Split(s.Text(), 2)
+			ps.tgid, _ = strconv.Atoi(tokens[1])
+		}
+	}
+
+	statusCache[tid] = ps
+
+	return ps, nil
 }
 
 // getTgid() obtains the thread group ID (PID) of the thread 'tid'
 // by looking up the appropriate field in the /proc/TID/status file.
 
 func getTgid(tid int) (int, error) {
-	sfile := "/proc/" + strconv.Itoa(tid) + "/status"
 
-	file, err := os.Open(sfile)
+	ps, err := getProcStatus(tid)
 	if err != nil {
 
 		// Probably, the thread terminated between the time we
@@ -498,28 +1367,16 @@ func getTgid(tid int) (int, error) {
 		return 0, err
 	}
 
-	defer file.Close() // Close file on return from this function.
-
-	// Scan file line by line, looking for 'Tgid:' entry.
-
-	re := regexp.MustCompile(":[ \t]*")
-
-	s := bufio.NewScanner(file)
-	for s.Scan() {
-		match, _ := regexp.MatchString("^Tgid:", s.Text())
-		if match {
-			tokens := re.Split(s.Text(), -1)
-			tgid, _ := strconv.Atoi(tokens[1])
-			return tgid, nil
-		}
-	}
-
 	// There should always be a 'Tgid:' entry, but just in case there
 	// is not...
 
-	e := errors.New("Error scanning )" + sfile +
-		": could not find 'Tgid' field")
-	return 0, e
+	if ps.tgid < 0 {
+		return 0, errors.New("Error scanning /proc/" +
+			strconv.Itoa(tid) + "/status: could not find " +
+			"'Tgid' field")
+	}
+
+	return ps.tgid, nil
 }
 
 // getSortedIntsFrom() reads the contents of 'path', which should be a file
@@ -527,7 +1384,7 @@ func getTgid(tid int) (int, error) {
 // a sorted slice.
 
 func getSortedIntsFrom(path string) ([]int, error) {
-	buf, err := ioutil.ReadFile(path)
+	buf, err := readFile(path)
 	if err != nil {
 		return nil, err
 	}
@@ -552,10 +1409,138 @@ func getSortedIntsFrom(path string) ([]int, error) {
 // colorEachLine() puts a terminal color sequence just before the first
 // non-white-space character in each line of 'buf', and places the terminal
 // sequence to return the terminal color to white at the end of each line.
+// Any color resets already present in a line are followed by 'color', so
+// that the rest of the line is still displayed in 'color'.
 
 func colorEachLine(buf string, color string) string {
-	re := regexp.MustCompile(`( *)(.*)`)
-	return re.ReplaceAllString(buf, "$1"+color+"$2"+NORMAL)
+	lines := strings.Split(buf, "\n")
+
+	for i, line := range lines {
+		text := strings.TrimLeft(line, " ")
+		if text == "" {
+			continue
+		}
+
+		spaces := line[:len(line)-len(text)]
+		text = strings.Replace(text, NORMAL, NORMAL+color, -1)
+		lines[i] = spaces + color + text + NORMAL
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// An expression that matches terminal escape sequences.
+
+var escapeSeqRE = regexp.MustCompile(ESC + `(\[[0-9;?]*[@-~]|[()][0-9A-Z])`)
+
+// visibleWidth() returns the number of terminal columns occupied by 's',
+// ignoring any terminal escape sequences.
+
+func visibleWidth(s string) int {
+	width := 0
+	for _, r := range escapeSeqRE.ReplaceAllString(s, "") {
+		width += runeWidth(r)
+	}
+	return width
+}
+
+// Ranges of characters that occupy two terminal columns: the East Asian
+// Wide and Fullwidth characters (see Unicode Standard Annex #11) and the
+// emoji. The table covers the commonly used blocks, rather than being
+// exhaustive.
+
+var wideRanges = [][2]rune{
+	{0x1100, 0x115F},   // Hangul Jamo initial consonants
+	{0x2E80, 0x303E},   // CJK radicals, symbols and punctuation
+	{0x3041, 0x33FF},   // Hiragana, Katakana, ..., CJK compatibility
+	{0x3400, 0x4DBF},   // CJK unified ideographs extension A
+	{0x4E00, 0x9FFF},   // CJK unified ideographs
+	{0xA000, 0xA4CF},   // Yi
+	{0xAC00, 0xD7A3},   // Hangul syllables
+	{0xF900, 0xFAFF},   // CJK compatibility ideographs
+	{0xFE30, 0xFE4F},   // CJK compatibility forms
+	{0xFF00, 0xFF60},   // Fullwidth forms
+	{0xFFE0, 0xFFE6},   // Fullwidth signs
+	{0x1F300, 0x1F64F}, // Pictographs and emoticons
+	{0x1F900, 0x1F9FF}, // Supplemental symbols and pictographs
+	{0x20000, 0x3FFFD}, // CJK unified ideographs extension B onward
+}
+
+// runeWidth() returns the number of terminal columns occupied by 'r': 0 for
+// combining marks and other zero-width characters, 2 for wide characters
+// (see 'wideRanges'), and 1 for everything else.
+
+func runeWidth(r rune) int {
+	if unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf) {
+		return 0
+	}
+
+	for _, wr := range wideRanges {
+		if r >= wr[0] && r <= wr[1] {
+			return 2
+		}
+	}
+
+	return 1
+}
+
+// escapeName() returns a copy of 'name' (a command name or a cgroup
+// pathname) in which control characters are replaced by C-style escapes,
+// so that they can't disturb the layout of the output or the terminal.
+
+func escapeName(name string) string {
+	var b strings.Builder
+
+	for _, r := range name {
+		switch {
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case unicode.IsControl(r):
+			fmt.Fprintf(&b, `\x%02x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+// splitWord() breaks 'word' into pieces that each have a visible width of
+// at most 'width' columns. Words are split only between characters (and not
+// before a combining mark), and terminal escape sequences are never split.
+
+func splitWord(word string, width int) []string {
+	var pieces []string
+	piece := ""
+	col := 0
+
+	for word != "" {
+		if strings.HasPrefix(word, ESC) {
+			loc := escapeSeqRE.FindStringIndex(word)
+			if loc != nil && loc[0] == 0 {
+				piece += word[:loc[1]]
+				word = word[loc[1]:]
+				continue
+			}
+		}
+
+		r, size := utf8.DecodeRuneInString(word)
+		w := runeWidth(r)
+
+		if col > 0 && col+w > width {
+			pieces = append(pieces, piece)
+			piece = ""
+			col = 0
+		}
+
+		piece += word[:size]
+		word = word[size:]
+		col += w
+	}
+
+	return append(pieces, piece)
 }
 
 // Return wrapped version of text in 'text' by adding newline characters
@@ -564,7 +1549,9 @@ func colorEachLine(buf string, color string) string {
 // included as part of 'width' for the purpose of the wrapping algorithm).
 // The first line of output is additionally prefixed by the string in 'prefix',
 // and subsequent lines are also additionally prefixed by an equal amount of
-// white space.
+// white space; the size of 'prefix' *is* included as part of 'width'. Widths
+// are measured with visibleWidth(), and a word that is longer than the
+// available width is broken across as many lines as are needed.
 
 func wrapText(text string, prefix string, width int, indent string) string {
 
@@ -578,20 +1565,395 @@ func wrapText(text string, prefix string, width int, indent string) string {
 		return ""
 	}
 
-	result := indent + prefix + words[0]
-	col := len(prefix) + len(words[0])
-	width -= len(prefix)
-	indent += strings.Repeat(" ", len(prefix))
-
-	for _, word := range words[1:] {
-		if col+len(word)+1 > width { // Overflow ==> start on new line
-			result += "\n" + indent + word
-			col = len(word)
-		} else {
-			result += " " + word
-			col += 1 + len(word)
+	result := indent + prefix
+	col := -1 // No words yet on the current line
+	width -= visibleWidth(prefix)
+	if width < 1 {
+		width = 1
+	}
+	indent += strings.Repeat(" ", visibleWidth(prefix))
+
+	for _, word := range words {
+		for _, piece := range splitWord(word, width) {
+			w := visibleWidth(piece)
+			if col < 0 { // First word of output
+				result += piece
+				col = w
+			} else if col+w+1 > width { // Overflow ==> new line
+				result += "\n" + indent + piece
+				col = w
+			} else {
+				result += " " + piece
+				col += 1 + w
+			}
 		}
 	}
 
 	return result
 }
+
+// A snapshot archive is a tar archive that records what the program read
+// while displaying the live system, so that the same display can later be
+// reproduced (perhaps on another machine) with '--replay'. Each file that
+// was read is stored under its absolute pathname (minus the leading slash),
+// and each cgroup directory is stored as a directory entry whose UID is the
+// owner of the cgroup. Information that is not obtained by reading a file
+// (currently, just thread scheduling policies) is recorded as lines of the
+// form "<key> <value>..." in a manifest entry. The manifest also records
+// the working directory at the time of the capture, so that relative
+// pathnames given to '--replay' refer to the same cgroups as they did when
+// the snapshot was captured, rather than depending on the working directory
+// on the replaying machine.
+
+const snapshotManifest = "view_v2_cgroups.manifest"
+
+// State used when capturing a snapshot.
+
+var captureFile *os.File
+var captureTar *tar.Writer
+var captured = make(map[string]bool) // Pathnames already in the archive
+var manifest []string                // Manifest lines
+
+// State used when replaying a snapshot. 'replayDirs' maps the absolute
+// pathname of each recorded cgroup to its owner UID; 'replayChildren' maps
+// a cgroup pathname to the sorted names of its child cgroups.
+
+var replayFiles map[string][]byte
+var replayDirs map[string]int
+var replayChildren map[string][]string
+var replayPolicies map[int]int
+var replayCwd string // Working directory when the snapshot was captured
+
+// archiveName() returns the name under which 'path' is recorded in a
+// snapshot archive.
+
+func archiveName(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(abs, "/"), nil
+}
+
+// replayPath() returns the absolute pathname in the snapshot being replayed
+// that corresponds to 'path'. A relative pathname is interpreted relative to
+// the working directory at the time of the capture.
+
+func replayPath(path string) string {
+	if filepath.IsAbs(path) || replayCwd == "" {
+		abs, err := filepath.Abs(path)
+		if err == nil {
+			return abs
+		}
+	}
+
+	return filepath.Join(replayCwd, path)
+}
+
+// openCapture() creates the snapshot archive 'path'.
+
+func openCapture(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	captureFile = f
+	captureTar = tar.NewWriter(f)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	manifest = append(manifest, "cwd "+cwd)
+
+	return nil
+}
+
+// closeCapture() writes the manifest to the snapshot archive and closes it.
+
+func closeCapture() error {
+	data := []byte(strings.Join(manifest, "\n") + "\n")
+	hdr := &tar.Header{Name: snapshotManifest, Mode: 0644,
+		Size: int64(len(data))}
+
+	err := captureTar.WriteHeader(hdr)
+	if err == nil {
+		_, err = captureTar.Write(data)
+	}
+	if err == nil {
+		err = captureTar.Close()
+	}
+
+	cerr := captureFile.Close()
+	if err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// captureDir() records the cgroup directory 'path' in the snapshot archive.
+
+func captureDir(path string, fi os.FileInfo) error {
+	name, err := archiveName(path)
+	if err != nil || captured[name+"/"] {
+		return err
+	}
+
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.New("fi.Sys() failure for " + path)
+	}
+
+	hdr := &tar.Header{Name: name + "/", Typeflag: tar.TypeDir,
+		Mode: int64(fi.Mode().Perm()), Uid: int(stat.Uid),
+		Gid: int(stat.Gid), ModTime: fi.ModTime()}
+
+	captured[name+"/"] = true
+
+	return captureTar.WriteHeader(hdr)
+}
+
+// captureFileContents() records the contents of the file 'path' in the
+// snapshot archive.
+
+func captureFileContents(path string, data []byte) error {
+	name, err := archiveName(path)
+	if err != nil || captured[name] {
+		return err
+	}
+
+	hdr := &tar.Header{Name: name, Mode: 0444, Size: int64(len(data))}
+
+	err = captureTar.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	captured[name] = true
+
+	_, err = captureTar.Write(data)
+	return err
+}
+
+// loadReplay() reads the snapshot archive 'path' into memory.
+
+func loadReplay(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	replayFiles = make(map[string][]byte)
+	replayDirs = make(map[string]int)
+	replayChildren = make(map[string][]string)
+	replayPolicies = make(map[int]int)
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.New(path + ": " + err.Error())
+		}
+
+		switch {
+		case hdr.Name == snapshotManifest:
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			parseManifest(string(data))
+
+		case hdr.Typeflag == tar.TypeDir:
+			dir := "/" + strings.TrimSuffix(hdr.Name, "/")
+			replayDirs[dir] = hdr.Uid
+
+		default:
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			replayFiles["/"+hdr.Name] = data
+		}
+	}
+
+	// Build the lists of child cgroups used by replayWalk().
+
+	for dir := range replayDirs {
+		parent := filepath.Dir(dir)
+		if _, found := replayDirs[parent]; found && parent != dir {
+			replayChildren[parent] = append(replayChildren[parent],
+				filepath.Base(dir))
+		}
+	}
+
+	for _, children := range replayChildren {
+		sort.Strings(children)
+	}
+
+	logMessage(LOG_VERBOSE, "Loaded snapshot "+path+": "+
+		strconv.Itoa(len(replayDirs))+" cgroups, "+
+		strconv.Itoa(len(replayFiles))+" files")
+
+	return nil
+}
+
+// parseManifest() parses the manifest of a snapshot archive. Unrecognized
+// lines are ignored.
+
+func parseManifest(data string) {
+	for _, line := range strings.Split(data, "\n") {
+		if strings.HasPrefix(line, "cwd /") {
+			replayCwd = strings.TrimPrefix(line, "cwd ")
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == "policy" {
+			tid, err1 := strconv.Atoi(fields[1])
+			policy, err2 := strconv.Atoi(fields[2])
+			if err1 == nil && err2 == nil {
+				replayPolicies[tid] = policy
+			}
+		}
+	}
+}
+
+// readFile() returns the contents of the file 'path', either from the live
+// system (recording the contents in the snapshot archive, if we are capturing)
+// or from the snapshot being replayed.
+
+func readFile(path string) ([]byte, error) {
+	opts.stats.filesRead++
+
+	if replayFiles != nil {
+		data, found := replayFiles[replayPath(path)]
+		if !found {
+			return nil, &os.PathError{Op: "open", Path: path,
+				Err: syscall.ENOENT}
+		}
+		return data, nil
+	}
+
+	data, err := sysOps.readFile(path)
+	if err == nil && captureTar != nil {
+		err = captureFileContents(path, data)
+	}
+
+	return data, err
+}
+
+// The operations on the live system (other than the walk of the cgroup
+// directories) that are used to display the cgroups. Tests substitute a fake
+// for 'sysOps', so that a cgroup tree can be displayed from fixtures.
+
+type systemOps interface {
+	// Return the contents of the file 'path'
+	readFile(path string) ([]byte, error)
+
+	// Return the UID of the owner of the file 'path'
+	owner(path string) (int, error)
+
+	// Return the scheduling policy of the thread 'tid'
+	schedPolicy(tid int) (int, error)
+}
+
+// 'liveSystemOps' implements 'systemOps' using the real files and system
+// calls.
+
+type liveSystemOps struct{}
+
+var sysOps systemOps = liveSystemOps{}
+
+func (liveSystemOps) readFile(path string) ([]byte, error) {
+	return ioutil.ReadFile(path)
+}
+
+func (liveSystemOps) owner(path string) (int, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, errors.New("fi.Sys() failure for " + path)
+	}
+
+	return int(stat.Uid), nil
+}
+
+func (liveSystemOps) schedPolicy(tid int) (int, error) {
+	type sched_param struct {
+		sched_priority uint32
+	}
+
+	var sp sched_param
+
+	ret, _, e := syscall.Syscall6(syscall.SYS_SCHED_GETSCHEDULER,
+		uintptr(tid), uintptr(unsafe.Pointer(&sp)),
+		uintptr(0), uintptr(0), uintptr(0), uintptr(0))
+
+	if e != 0 {
+		return -1, e
+	}
+
+	return int(ret), nil
+}
+
+// report() writes the statistics in 's' to standard error.
+
+func (s walkStats) report() {
+	fmt.Fprintf(os.Stderr, "Walk: %v (%d cgroups, %d files read, "+
+		"%d ioctls, %d sched_getscheduler() calls)\n",
+		s.walkTime.Round(time.Microsecond), s.cgroups, s.filesRead,
+		s.ioctls, s.schedQueries)
+}
+
+// cgroupOwner() returns the UID of the owner of the cgroup 'path'.
+
+func cgroupOwner(path string) (int, error) {
+	if replayDirs != nil {
+		uid, found := replayDirs[replayPath(path)]
+		if !found {
+			return 0, &os.PathError{Op: "stat", Path: path,
+				Err: syscall.ENOENT}
+		}
+		return uid, nil
+	}
+
+	return sysOps.owner(path)
+}
+
+// schedPolicy() returns the scheduling policy of the thread 'tid', either
+// from the live system (recording it in the snapshot manifest, if we are
+// capturing) or from the snapshot being replayed.
+
+func schedPolicy(tid int) (int, error) {
+	if replayPolicies != nil {
+		policy, found := replayPolicies[tid]
+		if !found {
+			return -1, syscall.ESRCH
+		}
+		return policy, nil
+	}
+
+	opts.stats.schedQueries++
+
+	policy, err := sysOps.schedPolicy(tid)
+	if err != nil {
+		return -1, err
+	}
+
+	if captureTar != nil {
+		manifest = append(manifest, "policy "+strconv.Itoa(tid)+" "+
+			strconv.Itoa(policy))
+	}
+
+	return policy, nil
+}
@@ -0,0 +1,283 @@
+//go:build integration
+
+package main
+
+// Integration tests, which run the built program against a cgroup subtree
+// that the tests create in the cgroup v2 hierarchy. They need root privilege
+// and a cgroup v2 mount (and are skipped without them), so they are built
+// only with the "integration" tag:
+//
+//	go test -tags integration view_v2_cgroups.go view_v2_cgroups_test.go \
+//		view_v2_cgroups_integration_test.go
+//
+// The member processes are killed, the cgroups removed, and any controller
+// enabled in the root cgroup disabled again when the test ends, even if it
+// fails.
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// requirePrivilege() skips the test unless it is run by root.
+
+func requirePrivilege(t *testing.T) {
+
+	if os.Geteuid() != 0 {
+		t.Skip("integration tests need root privilege")
+	}
+}
+
+// buildProgram() builds the program 'src' into a temporary directory, and
+// returns the pathname of the executable.
+
+func buildProgram(t *testing.T, src string) string {
+
+	bin := filepath.Join(t.TempDir(), strings.TrimSuffix(src, ".go"))
+
+	out, err := exec.Command("go", "build", "-o", bin, src).CombinedOutput()
+	if err != nil {
+		t.Fatalf("go build %s: %v\n%s", src, err, out)
+	}
+
+	return bin
+}
+
+// startHelper() starts the helper process 'cmd', which is killed when the
+// test ends, and returns its PID as a string. The helper's diagnostics go to
+// the test's standard error.
+
+func startHelper(t *testing.T, cmd *exec.Cmd) string {
+
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	return strconv.Itoa(cmd.Process.Pid)
+}
+
+// runProgram() runs 'bin' with the arguments 'args', and returns its
+// standard output, failing the test if the program fails.
+
+func runProgram(t *testing.T, bin string, args ...string) string {
+
+	var stderr strings.Builder
+
+	cmd := exec.Command(bin, args...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%s %s: %v\n%s", filepath.Base(bin),
+			strings.Join(args, " "), err, stderr.String())
+	}
+
+	return string(out)
+}
+
+// findLine() returns the index of the first line of 'lines' that contains
+// all of 'fragments', failing the test if there is none.
+
+func findLine(t *testing.T, lines []string, fragments ...string) int {
+
+	for i, line := range lines {
+		found := true
+		for _, f := range fragments {
+			if !strings.Contains(line, f) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return i
+		}
+	}
+
+	t.Fatalf("no line contains %q in:\n%s", fragments,
+		strings.Join(lines, "\n"))
+	return -1
+}
+
+// indentOf() returns the number of leading spaces in 'line'.
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// cgroup2Mount() returns the mount point of the cgroup v2 hierarchy,
+// skipping the test if there is none.
+
+func cgroup2Mount(t *testing.T) string {
+
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) > 2 && fields[2] == "cgroup2" {
+			return fields[1]
+		}
+	}
+
+	t.Skip("no cgroup v2 hierarchy is mounted")
+	return ""
+}
+
+// writeCgroupFile() writes 'value' to the cgroup interface file 'path'.
+
+func writeCgroupFile(t *testing.T, path string, value string) {
+
+	if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readCgroupFile() returns the contents of the cgroup interface file 'path',
+// less any trailing white space.
+
+func readCgroupFile(t *testing.T, path string) string {
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.TrimSpace(string(buf))
+}
+
+// makeCgroup() creates the cgroup 'path', which is removed when the test
+// ends. (Removal can briefly fail with EBUSY while killed members are
+// still exiting, so it is retried.)
+
+func makeCgroup(t *testing.T, path string) {
+
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for i := 0; i < 100; i++ {
+			if err := syscall.Rmdir(path); err != syscall.EBUSY {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("can't remove %s", path)
+	})
+}
+
+// rootController() returns the name of a controller that is enabled in the
+// root cgroup 'root', first enabling one if none is (in which case it is
+// disabled again when the test ends). The test is skipped if no controller
+// is available.
+
+func rootController(t *testing.T, root string) string {
+
+	control := root + "/cgroup.subtree_control"
+
+	enabled := strings.Fields(readCgroupFile(t, control))
+	if len(enabled) > 0 {
+		return enabled[0]
+	}
+
+	available := strings.Fields(readCgroupFile(t,
+		root+"/cgroup.controllers"))
+	if len(available) == 0 {
+		t.Skip("no cgroup controllers are available")
+	}
+
+	controller := available[0]
+	writeCgroupFile(t, control, "+"+controller)
+	t.Cleanup(func() {
+		err := ioutil.WriteFile(control, []byte("-"+controller), 0644)
+		if err != nil {
+			t.Errorf("can't disable %s: %v", controller, err)
+		}
+	})
+
+	return controller
+}
+
+// startMember() starts a process that is a member of the cgroup 'path' (and
+// is killed when the test ends), and returns its PID.
+
+func startMember(t *testing.T, path string) string {
+
+	pid := startHelper(t, exec.Command("sleep", "1000"))
+	writeCgroupFile(t, path+"/cgroup.procs", pid)
+
+	return pid
+}
+
+// TestIntegrationCgroupSubtree creates a cgroup with a controller enabled
+// and two child cgroups, each with one member process, one of which is
+// frozen. It checks the display of the subtree: the controller, the child
+// cgroups, and their members. (The program doesn't show whether a cgroup
+// is frozen, but a frozen cgroup must be displayed like any other.)
+
+func TestIntegrationCgroupSubtree(t *testing.T) {
+
+	requirePrivilege(t)
+	root := cgroup2Mount(t)
+	bin := buildProgram(t, "view_v2_cgroups.go")
+
+	// The controller is enabled in the root cgroup first, so that (since
+	// cleanups run in reverse order) it is disabled only after the test
+	// cgroups have been removed.
+
+	controller := rootController(t, root)
+
+	base := filepath.Join(root, "tlpi-test-"+strconv.Itoa(os.Getpid()))
+	makeCgroup(t, base)
+	writeCgroupFile(t, base+"/cgroup.subtree_control", "+"+controller)
+
+	makeCgroup(t, base+"/running")
+	makeCgroup(t, base+"/frozen")
+
+	running := startMember(t, base+"/running")
+	frozen := startMember(t, base+"/frozen")
+
+	if _, err := os.Stat(base + "/frozen/cgroup.freeze"); err != nil {
+		t.Skip("the cgroup freezer is not available:", err)
+	}
+	writeCgroupFile(t, base+"/frozen/cgroup.freeze", "1")
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !strings.Contains(readCgroupFile(t, base+"/frozen/cgroup.events"),
+		"frozen 1") {
+		if time.Now().After(deadline) {
+			t.Fatal("the cgroup was not frozen")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	out := runProgram(t, bin, "--no-config", "--color=never", "--no-tids",
+		base)
+	want := strings.Join([]string{
+		base + " [d]    (" + controller + ")",
+		"    frozen [d]",
+		"        PIDs: {" + frozen + "}",
+		"    running [d]",
+		"        PIDs: {" + running + "}",
+	}, "\n") + "\n"
+
+	if out != want {
+		t.Errorf("displayed:\n%s\nwant:\n%s", out, want)
+	}
+}
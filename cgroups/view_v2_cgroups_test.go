@@ -0,0 +1,1839 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// If VIEW_V2_CGROUPS_SIGNAL_TEST is set in the environment, the test
+// binary runs signalChild() instead of the tests, so that a test can check
+// how the program's signal handlers behave in a child process. Similarly,
+// if VIEW_V2_CGROUPS_INTERRUPT_TEST is set, it runs interruptChild(), and
+// if VIEW_V2_CGROUPS_REDIRECT_TEST is set, it runs redirectChild().
+
+func TestMain(m *testing.M) {
+
+	if mode := os.Getenv("VIEW_V2_CGROUPS_SIGNAL_TEST"); mode != "" {
+		signalChild(mode)
+	}
+
+	if dir := os.Getenv("VIEW_V2_CGROUPS_INTERRUPT_TEST"); dir != "" {
+		interruptChild(dir)
+	}
+
+	if dir := os.Getenv("VIEW_V2_CGROUPS_REDIRECT_TEST"); dir != "" {
+		redirectChild(dir)
+	}
+
+	os.Exit(m.Run())
+}
+
+// TestWrapText checks wrapText() with empty input, words that fit and words
+// that don't, words longer than the width, a prefix, an indent, terminal
+// escape sequences, and wide and combining characters.
+
+func TestWrapText(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		text   string
+		prefix string
+		width  int
+		indent string
+		want   string
+	}{
+		{"empty", "", "", 10, "", ""},
+		{"white space only", " \t\n ", "PIDs: ", 10, "    ", ""},
+		{"fits", "aaa bbb", "", 7, "", "aaa bbb"},
+		{"wraps", "aaa bbb ccc", "", 7, "", "aaa bbb\nccc"},
+		{"white space collapsed", "a \n\t b", "", 10, "", "a b"},
+		{"long word", "abcdefghij", "", 4, "", "abcd\nefgh\nij"},
+		{"long word after short", "a abcdefgh b", "", 6, "",
+			"a\nabcdef\ngh b"},
+		{"width 0", "ab c", "", 0, "", "a\nb\nc"},
+		{"indent", "aaa bbb ccc", "", 7, "  ",
+			"  aaa bbb\n  ccc"},
+		{"indent with long word", "abcdefgh", "", 4, "\t",
+			"\tabcd\n\tefgh"},
+		{"prefix", "1 2 3 4 5", "PIDs: ", 12, "",
+			"PIDs: 1 2 3\n      4 5"},
+		{"prefix and indent", "1 2 3 4 5", "PIDs: ", 12, "    ",
+			"    PIDs: 1 2 3\n          4 5"},
+		{"prefix wider than width", "ab", "xxxxx", 3, "",
+			"xxxxxa\n     b"},
+		{"escape sequences", RED + "aaa" + NORMAL + " bbb", "", 7, "",
+			RED + "aaa" + NORMAL + " bbb"},
+		{"long word with escape sequence",
+			"ab" + RED + "cd" + NORMAL, "", 2, "",
+			"ab" + RED + "\ncd" + NORMAL},
+		{"wide characters", "日本語 テスト", "", 6, "",
+			"日本語\nテスト"},
+		{"long wide word", "日本語テ", "", 5, "", "日本\n語テ"},
+		{"combining marks", "ééé", "", 2, "",
+			"éé\né"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			got := wrapText(tc.text, tc.prefix, tc.width, tc.indent)
+			if got != tc.want {
+				t.Errorf("wrapText(%q, %q, %d, %q) =\n"+
+					"%q\nwant\n%q", tc.text, tc.prefix,
+					tc.width, tc.indent, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestVisibleWidth checks that visibleWidth() ignores terminal escape
+// sequences and combining marks, and counts wide characters as two columns.
+
+func TestVisibleWidth(t *testing.T) {
+
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{RED + "abc" + NORMAL, 3},
+		{LIGHT_BLUE + NORMAL, 0},
+		{"é", 1},
+		{"日本語", 6},
+		{"a日b", 4},
+		{"\U0001F600", 2},
+	}
+
+	for _, tc := range tests {
+		if got := visibleWidth(tc.s); got != tc.want {
+			t.Errorf("visibleWidth(%q) = %d, want %d",
+				tc.s, got, tc.want)
+		}
+	}
+}
+
+// TestColorEachLine checks that colorEachLine() colors each line from its
+// first nonblank character, leaves empty lines alone, and restores the
+// color after any reset within a line.
+
+func TestColorEachLine(t *testing.T) {
+
+	tests := []struct {
+		name string
+		buf  string
+		want string
+	}{
+		{"empty", "", ""},
+		{"one line", "abc", RED + "abc" + NORMAL},
+		{"indent", "  abc", "  " + RED + "abc" + NORMAL},
+		{"blank line", "a\n\nb",
+			RED + "a" + NORMAL + "\n\n" + RED + "b" + NORMAL},
+		{"reset", "a" + NORMAL + "b",
+			RED + "a" + NORMAL + RED + "b" + NORMAL},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			if got := colorEachLine(tc.buf, RED); got != tc.want {
+				t.Errorf("colorEachLine(%q) = %q, want %q",
+					tc.buf, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestGetTerminalWidth checks that getTerminalWidth() returns the fallback
+// width when standard output is not a terminal.
+
+func TestGetTerminalWidth(t *testing.T) {
+
+	if isTerminal(syscall.Stdout) {
+		t.Skip("standard output is a terminal")
+	}
+
+	for _, fallback := range []int{0, 80, 132} {
+		if got := getTerminalWidth(fallback); got != fallback {
+			t.Errorf("getTerminalWidth(%d) = %d", fallback, got)
+		}
+	}
+}
+
+// Status files captured from a normal process, a kernel thread, and a process
+// in a PID namespace nested three levels below the initial PID namespace.
+// Only the fields that matter here are included (the kernel's files contain
+// about 60 lines).
+
+const statusNormal = `Name:	bash
+Umask:	0022
+State:	S (sleeping)
+Tgid:	4321
+Ngid:	0
+Pid:	4321
+PPid:	4300
+TracerPid:	0
+Uid:	1000	1000	1000	1000
+Gid:	1000	1000	1000	1000
+FDSize:	256
+Groups:	4 27 1000
+NStgid:	4321
+NSpid:	4321
+NSpgid:	4321
+NSsid:	4321
+Kthread:	0
+Threads:	1
+`
+
+const statusKthread = `Name:	kthreadd
+Umask:	0000
+State:	S (sleeping)
+Tgid:	2
+Ngid:	0
+Pid:	2
+PPid:	0
+TracerPid:	0
+Uid:	0	0	0	0
+Gid:	0	0	0	0
+FDSize:	64
+Groups:
+NStgid:	2
+NSpid:	2
+NSpgid:	0
+NSsid:	0
+Kthread:	1
+Threads:	1
+`
+
+const statusNested = `Name:	sleep
+Umask:	0022
+State:	S (sleeping)
+Tgid:	81234
+Ngid:	0
+Pid:	81234
+PPid:	81200
+TracerPid:	0
+Uid:	100000	100000	100000	100000
+Gid:	100000	100000	100000	100000
+FDSize:	64
+Groups:
+NStgid:	81234	4567	89	1
+NSpid:	81234	4567	89	1
+NSpgid:	81200	4500	1	0
+NSsid:	81200	4500	1	0
+Kthread:	0
+Threads:	1
+`
+
+// TestGetProcStatus checks the thread group ID that getProcStatus() parses
+// from captured status files (supplied by a fake system), and that getTgid()
+// reports a file that has no 'Tgid' field. It also checks that a file is read
+// only once: after the first read, the cached value is returned even though
+// the file has gone (as it does when the thread terminates), while a thread
+// that has gone before its file is first read gives an ENOENT error.
+
+func TestGetProcStatus(t *testing.T) {
+
+	f := fakeSystem{files: map[string]string{
+		"/proc/4321/status":  statusNormal,
+		"/proc/2/status":     statusKthread,
+		"/proc/81234/status": statusNested,
+		"/proc/7/status":     "Name:\tinit\n",
+	}}
+
+	savedOps, savedCache := sysOps, statusCache
+	defer func() { sysOps, statusCache = savedOps, savedCache }()
+
+	sysOps = f
+	statusCache = make(map[int]*procStatus)
+
+	tests := []struct {
+		name string
+		tid  int
+		tgid int
+	}{
+		{"normal process", 4321, 4321},
+		{"kernel thread", 2, 2},
+		{"nested PID namespaces", 81234, 81234},
+		{"no Tgid field", 7, -1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			ps, err := getProcStatus(tc.tid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ps.tgid != tc.tgid {
+				t.Errorf("tgid = %d, want %d", ps.tgid,
+					tc.tgid)
+			}
+		})
+	}
+
+	if _, err := getTgid(7); err == nil ||
+		!strings.Contains(err.Error(), "'Tgid'") {
+		t.Errorf("getTgid() without a Tgid field: err = %v", err)
+	}
+
+	delete(f.files, "/proc/81234/status")
+	if tgid, err := getTgid(81234); err != nil || tgid != 81234 {
+		t.Errorf("cached getTgid() = %d, %v; want 81234", tgid, err)
+	}
+
+	if _, err := getTgid(99999); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("getTgid() of a missing TID: err = %v", err)
+	}
+}
+
+// TestParseArgs checks that parseArgs() accepts options before, after, and
+// among the nonoption arguments, keeps the value of a nonboolean option given
+// as a separate argument with the option, stops at "--", treats negative
+// numbers and a lone "-" as nonoption arguments, and leaves an unrecognized
+// option to be diagnosed by the flag package. The command line is parsed
+// against a set of test options: a boolean "-b", a string "-s", and an
+// integer "-n".
+
+func TestParseArgs(t *testing.T) {
+
+	tests := []struct {
+		name string
+		args []string
+		want []string // Nonoption arguments
+		b    bool
+		s    string
+		n    int
+		err  string // Diagnostic from the flag package, if any
+	}{
+		{"options first", []string{"-b", "-s", "x", "a", "b"},
+			[]string{"a", "b"}, true, "x", 0, ""},
+		{"options last", []string{"a", "b", "--b", "--s=x"},
+			[]string{"a", "b"}, true, "x", 0, ""},
+		{"interleaved", []string{"a", "-b", "b", "-n", "3", "c"},
+			[]string{"a", "b", "c"}, true, "", 3, ""},
+		{"--opt value", []string{"1234", "--s", "val", "5678"},
+			[]string{"1234", "5678"}, false, "val", 0, ""},
+		{"value like an option", []string{"-s", "-b", "a"},
+			[]string{"a"}, false, "-b", 0, ""},
+		{"boolean then argument", []string{"--b", "x"},
+			[]string{"x"}, true, "", 0, ""},
+		{"--", []string{"a", "-b", "--", "-s", "x", "--"},
+			[]string{"a", "-s", "x", "--"}, true, "", 0, ""},
+		{"negative numbers", []string{"-1", "a", "-n", "-3", "-22"},
+			[]string{"-1", "a", "-22"}, false, "", -3, ""},
+		{"lone -", []string{"-", "-b", "-"},
+			[]string{"-", "-"}, true, "", 0, ""},
+		{"unrecognized option", []string{"a", "--bogus"}, nil,
+			false, "", 0, "flag provided but not defined: -bogus"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			savedArgs, savedFlags := os.Args, flag.CommandLine
+			defer func() {
+				os.Args, flag.CommandLine = savedArgs,
+					savedFlags
+			}()
+
+			var diag bytes.Buffer
+			os.Args = append([]string{"prog"}, tc.args...)
+			flag.CommandLine = flag.NewFlagSet("prog",
+				flag.ContinueOnError)
+			flag.CommandLine.SetOutput(&diag)
+
+			b := flag.Bool("b", false, "")
+			s := flag.String("s", "", "")
+			n := flag.Int("n", 0, "")
+
+			parseArgs()
+
+			if tc.err != "" {
+				if !strings.Contains(diag.String(), tc.err) {
+					t.Errorf("diagnostic %q, want %q",
+						diag.String(), tc.err)
+				}
+				return
+			}
+			if diag.Len() != 0 {
+				t.Errorf("unexpected diagnostic %q",
+					diag.String())
+			}
+
+			if got := flag.Args(); !reflect.DeepEqual(got,
+				tc.want) {
+				t.Errorf("arguments %q, want %q", got, tc.want)
+			}
+			if *b != tc.b || *s != tc.s || *n != tc.n {
+				t.Errorf("-b %v, -s %q, -n %d; want %v, %q, %d",
+					*b, *s, *n, tc.b, tc.s, tc.n)
+			}
+		})
+	}
+}
+
+// writeConfig() makes a temporary directory the value of XDG_CONFIG_HOME for
+// the rest of the test and, unless 'text' is empty, creates in it a
+// configuration file that contains 'text'. It returns the pathname of the
+// configuration file.
+
+func writeConfig(t *testing.T, text string) string {
+
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+
+	path := filepath.Join(dir, "tlpi-tools", "config")
+	if text == "" {
+		return path
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// parseOptions() returns the options that parseCmdLineOptions() produces for
+// the command-line arguments 'args'.
+
+func parseOptions(tb testing.TB, args ...string) CmdLineOptions {
+
+	savedArgs, savedFlags := os.Args, flag.CommandLine
+	defer func() { os.Args, flag.CommandLine = savedArgs, savedFlags }()
+
+	os.Args = append([]string{"view_v2_cgroups"}, args...)
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+	return parseCmdLineOptions()
+}
+
+// captureStderr() returns what 'fn' writes to standard error.
+
+func captureStderr(t *testing.T, fn func()) string {
+
+	f, err := ioutil.TempFile(t.TempDir(), "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	saved := os.Stderr
+	os.Stderr = f
+	fn()
+	os.Stderr = saved
+
+	buf, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(buf)
+}
+
+// defaultWidth() returns the output width that the options give by default:
+// that of the terminal if standard output is one, and otherwise 0 (no
+// limit).
+
+func defaultWidth() int {
+
+	if isTerminal(syscall.Stdout) {
+		return getTerminalWidth(80)
+	}
+
+	return 0
+}
+
+// TestConfigPrecedence checks that an option takes its built-in default
+// unless the configuration file sets it, and the value from the file unless
+// the command line sets it. "-q" on the command line also overrides "v =
+// true" in the file (rather than being rejected in combination with it);
+// options in another program's section are ignored; and "--no-config"
+// bypasses the file.
+
+func TestConfigPrecedence(t *testing.T) {
+
+	const config = "# Defaults\n" +
+		"[view_v2_cgroups]\n" +
+		"width = 60\n" +
+		"show-owner = true\n" +
+		"no-tids = true\n" +
+		"v = true\n" +
+		"\n" +
+		"[namespaces_of]\n" +
+		"width = 30\n"
+
+	width := defaultWidth()
+
+	tests := []struct {
+		name      string
+		config    string
+		args      []string
+		width     int
+		showOwner bool
+		showTids  bool
+		logLevel  int
+	}{
+		{"built-in defaults", "", nil, width, false, true,
+			LOG_NORMAL},
+		{"configuration file", config, nil, 60, true, false,
+			LOG_VERBOSE},
+		{"command line", config, []string{"--width=100",
+			"--show-owner=false", "--no-tids=false", "-q"},
+			100, false, true, LOG_QUIET},
+		{"partly overridden", config, []string{"--width=100"},
+			100, true, false, LOG_VERBOSE},
+		{"--no-config", config, []string{"--no-config"},
+			width, false, true, LOG_NORMAL},
+		{"prefixed options", "view_v2_cgroups.width = 50\n" +
+			"namespaces_of.width = 30\n", nil,
+			50, false, true, LOG_NORMAL},
+	}
+
+	defer func(level int) { logLevel = level }(logLevel)
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			writeConfig(t, tc.config)
+			logLevel = LOG_NORMAL
+
+			o := parseOptions(t, tc.args...)
+
+			if o.width != tc.width || o.showOwner != tc.showOwner ||
+				o.showTids != tc.showTids {
+				t.Errorf("width %d, show-owner %v, show TIDs "+
+					"%v; want %d, %v, %v", o.width,
+					o.showOwner, o.showTids, tc.width,
+					tc.showOwner, tc.showTids)
+			}
+			if logLevel != tc.logLevel {
+				t.Errorf("log level %d, want %d", logLevel,
+					tc.logLevel)
+			}
+		})
+	}
+}
+
+// TestConfigMalformed checks that each malformed line of the configuration
+// file is reported, with its line number, as a warning, and is otherwise
+// ignored, while the well-formed lines still take effect.
+
+func TestConfigMalformed(t *testing.T) {
+
+	path := writeConfig(t, "# Defaults\n"+
+		"[view_v2_cgroups\n"+
+		"no-pids = true\n"+
+		"[view_v2_cgroups]\n"+
+		"width 70\n"+
+		"bogus = 1\n"+
+		"width = wide\n"+
+		"show-owner = true\n")
+
+	defer func(level int) { logLevel = level }(logLevel)
+	logLevel = LOG_NORMAL
+
+	var o CmdLineOptions
+	stderr := captureStderr(t, func() { o = parseOptions(t) })
+
+	for _, want := range []string{
+		path + ":2: malformed section header",
+		path + ":3: option \"no-pids\" is not in a [program] " +
+			"section",
+		path + ":5: expected \"option = value\"",
+		path + ":6: unknown option \"bogus\"",
+		path + ":7: bad value for \"width\"",
+	} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("stderr doesn't contain %q:\n%s", want,
+				stderr)
+		}
+	}
+
+	if !o.showOwner || !o.showPids || o.width != defaultWidth() {
+		t.Errorf("show-owner %v, show PIDs %v, width %d; want "+
+			"true, true, %d", o.showOwner, o.showPids, o.width,
+			defaultWidth())
+	}
+}
+
+// A 'fakeSystem' implements the 'systemOps' interface from maps, so that a
+// cgroup tree can be displayed without touching the live system. (The cgroup
+// directories themselves are created in a temporary directory, since they
+// are walked with filepath.Walk().)
+
+type fakeSystem struct {
+	files     map[string]string // File contents, keyed by pathname
+	owners    map[string]int    // Owner UIDs, keyed by pathname
+	policies  map[int]int       // Scheduling policies, keyed by TID
+	policyErr error             // Error for TIDs not in 'policies'
+}
+
+func (f fakeSystem) readFile(path string) ([]byte, error) {
+	text, fnd := f.files[path]
+	if !fnd {
+		return nil, &os.PathError{Op: "open", Path: path,
+			Err: syscall.ENOENT}
+	}
+	return []byte(text), nil
+}
+
+func (f fakeSystem) owner(path string) (int, error) {
+	uid, fnd := f.owners[path]
+	if !fnd {
+		return 0, &os.PathError{Op: "stat", Path: path,
+			Err: syscall.ENOENT}
+	}
+	return uid, nil
+}
+
+func (f fakeSystem) schedPolicy(tid int) (int, error) {
+	policy, fnd := f.policies[tid]
+	if !fnd && f.policyErr != nil {
+		return -1, f.policyErr
+	}
+	if !fnd {
+		return -1, syscall.ESRCH
+	}
+	return policy, nil
+}
+
+// cgroupFixture() creates a cgroup tree in a temporary directory, and
+// returns the directory along with a fake system that supplies the cgroup
+// files, the /proc/TID/status files, the owners, and the scheduling
+// policies. The tree is:
+//
+//	root            PIDs 1 2; controllers cpu, memory
+//	    app         domain threaded; PID 300 (threads 300 301 302);
+//	                owner 1000
+//	        worker  threaded; thread 302 (SCHED_FIFO)
+//	    idle        domain; no members
+
+func cgroupFixture(tb testing.TB) (string, fakeSystem) {
+
+	root := tb.TempDir()
+
+	for _, dir := range []string{"app/worker", "idle"} {
+		err := os.MkdirAll(filepath.Join(root, dir), 0755)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	f := fakeSystem{
+		files: map[string]string{
+			"/proc/1/status":   "Name:\tsystemd\nTgid:\t1\n",
+			"/proc/2/status":   "Name:\tkthreadd\nTgid:\t2\n",
+			"/proc/300/status": "Name:\tapp\nTgid:\t300\n",
+			"/proc/301/status": "Name:\tapp\nTgid:\t300\n",
+			"/proc/302/status": "Name:\tworker\nTgid:\t300\n",
+		},
+		owners: map[string]int{
+			root:                              0,
+			filepath.Join(root, "app"):        1000,
+			filepath.Join(root, "app/worker"): 1000,
+			filepath.Join(root, "idle"):       0,
+		},
+		policies: map[int]int{1: 0, 2: 0, 300: 0, 301: 0, 302: 1},
+	}
+
+	cgroups := []struct {
+		dir, cgType, controllers, procs, threads string
+	}{
+		{"", "", "cpu memory", "2\n1\n", "1\n2\n"},
+		{"app", "domain threaded", "", "300\n", "300\n301\n"},
+		{"app/worker", "threaded", "", "", "302\n"},
+		{"idle", "domain", "", "", ""},
+	}
+
+	for _, cg := range cgroups {
+		path := filepath.Join(root, cg.dir)
+		if cg.cgType != "" {
+			f.files[path+"/cgroup.type"] = cg.cgType + "\n"
+		}
+		f.files[path+"/cgroup.subtree_control"] = cg.controllers + "\n"
+		f.files[path+"/cgroup.procs"] = cg.procs
+		f.files[path+"/cgroup.threads"] = cg.threads
+	}
+
+	return root, f
+}
+
+// TestDisplayCgroupTree walks the tree of cgroupFixture() and checks the
+// display, with and without the optional parts of it.
+
+func TestDisplayCgroupTree(t *testing.T) {
+
+	tests := []struct {
+		name string
+		opts CmdLineOptions
+		want []string
+	}{
+		{"members", CmdLineOptions{showPids: true, showTids: true},
+			[]string{
+				"ROOT [/]    (cpu memory)",
+				"    PIDs: {1 2}",
+				"    TIDs: {1 2}",
+				"    app [dt]",
+				"        PIDs: {300}",
+				"        TIDs: {300 301-[300]}",
+				"        worker [t]",
+				"            TIDs: {302*-[300]}",
+				"    idle [d]",
+			}},
+		{"owners only", CmdLineOptions{showOwner: true},
+			[]string{
+				"ROOT [/]    (cpu memory)",
+				"    <UID: 0>",
+				"    app [dt]",
+				"        <UID: 1000>",
+				"        worker [t]",
+				"            <UID: 1000>",
+				"    idle [d]",
+				"        <UID: 0>",
+			}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			root, f := cgroupFixture(t)
+
+			savedOps, savedOpts, savedOutput := sysOps, opts, output
+			defer func() {
+				sysOps, opts, output = savedOps, savedOpts,
+					savedOutput
+			}()
+
+			var buf bytes.Buffer
+			sysOps = f
+			opts = tc.opts
+			output = &lineWriter{out: &buf}
+			statusCache = make(map[int]*procStatus)
+			rootSlashCnt = len(strings.Split(root, "/"))
+
+			err := walkCgroups(context.Background(), root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			output.Flush()
+
+			got := strings.ReplaceAll(buf.String(), root, "ROOT")
+			want := strings.Join(tc.want, "\n") + "\n"
+			if got != want {
+				t.Errorf("displayed:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+// If "-update" is given to the test binary, TestGolden rewrites the golden
+// files instead of comparing the output with them.
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+// checkGolden() compares 'got' with the contents of the golden file 'path'
+// (or, with "-update", writes 'got' to the file), and reports the first line
+// that differs.
+
+func checkGolden(t *testing.T, path string, got string) {
+
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := ioutil.WriteFile(path, []byte(got), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run the test with -update to create it)", err)
+	}
+	want := string(buf)
+
+	if got == want {
+		return
+	}
+
+	gotLines := strings.Split(got, "\n")
+	wantLines := strings.Split(want, "\n")
+
+	i := 0
+	for i < len(gotLines) && i < len(wantLines) &&
+		gotLines[i] == wantLines[i] {
+		i++
+	}
+
+	var g, w string
+	if i < len(gotLines) {
+		g = gotLines[i]
+	}
+	if i < len(wantLines) {
+		w = wantLines[i]
+	}
+
+	t.Errorf("output differs from %s at line %d:\ngot:  %q\n"+
+		"want: %q\n(if the change is intended, rerun the test with "+
+		"-update)", path, i+1, g, w)
+}
+
+// goldenCgroupFixture() extends the tree of cgroupFixture() so that it has
+// a cgroup of every type and more than one kind of realtime thread: "app"
+// gains thread 303 (SCHED_RR, in "worker"), a "broken" cgroup has the type
+// "domain invalid", and the root gains processes 1000 to 1019, so that its
+// member lists are long enough to be wrapped.
+
+func goldenCgroupFixture(tb testing.TB) (string, fakeSystem) {
+
+	root, f := cgroupFixture(tb)
+
+	broken := filepath.Join(root, "broken")
+	if err := os.Mkdir(broken, 0755); err != nil {
+		tb.Fatal(err)
+	}
+	f.owners[broken] = 0
+	f.files[broken+"/cgroup.type"] = "domain invalid\n"
+	f.files[broken+"/cgroup.subtree_control"] = "\n"
+	f.files[broken+"/cgroup.procs"] = ""
+	f.files[broken+"/cgroup.threads"] = ""
+
+	worker := filepath.Join(root, "app/worker")
+	f.files[worker+"/cgroup.threads"] += "303\n"
+	f.files["/proc/303/status"] = "Name:\tworker\nTgid:\t300\n"
+	f.policies[303] = 2
+
+	for pid := 1000; pid <= 1019; pid++ {
+		f.files[root+"/cgroup.procs"] += strconv.Itoa(pid) + "\n"
+		f.files[root+"/cgroup.threads"] += strconv.Itoa(pid) + "\n"
+		f.files["/proc/"+strconv.Itoa(pid)+"/status"] =
+			"Name:\tworker\nTgid:\t" + strconv.Itoa(pid) + "\n"
+		f.policies[pid] = 0
+	}
+
+	return root, f
+}
+
+// TestGolden walks the tree of goldenCgroupFixture() and compares the
+// display (with the member PIDs and TIDs, and with the owners too), with
+// color and without, at two widths, with a golden file in
+// testdata/view_v2_cgroups. The pathname of the fixture, which varies, is
+// shown as "ROOT". After an intended change to the display, the golden files
+// are regenerated with:
+//
+//	go test view_v2_cgroups.go view_v2_cgroups_test.go -run TestGolden \
+//		-update
+
+func TestGolden(t *testing.T) {
+
+	goldenDir := filepath.Join("testdata", "view_v2_cgroups")
+
+	views := []struct {
+		name string
+		opts CmdLineOptions
+	}{
+		{"members", CmdLineOptions{showPids: true, showTids: true}},
+		{"owners", CmdLineOptions{showPids: true, showTids: true,
+			showOwner: true}},
+	}
+
+	for _, v := range views {
+		for _, useColor := range []bool{false, true} {
+			for _, width := range []int{80, 40} {
+				name := v.name
+				if useColor {
+					name += "_color"
+				}
+				name += "_" + strconv.Itoa(width)
+
+				o := v.opts
+				o.useColor = useColor
+				o.width = width
+
+				path := filepath.Join(goldenDir, name+".golden")
+
+				t.Run(name, func(t *testing.T) {
+					got := renderGolden(t, o)
+					checkGolden(t, path, got)
+				})
+			}
+		}
+	}
+}
+
+// renderGolden() walks the tree of goldenCgroupFixture() and returns the
+// display produced with the options 'o'.
+
+func renderGolden(t *testing.T, o CmdLineOptions) string {
+
+	root, f := goldenCgroupFixture(t)
+
+	savedOps, savedOpts, savedOutput := sysOps, opts, output
+	defer func() {
+		sysOps, opts, output = savedOps, savedOpts, savedOutput
+	}()
+
+	var buf bytes.Buffer
+	sysOps = f
+	opts = o
+	output = &lineWriter{out: &buf}
+	statusCache = make(map[int]*procStatus)
+	rootSlashCnt = len(strings.Split(root, "/"))
+
+	if err := walkCgroups(context.Background(), root); err != nil {
+		t.Fatal(err)
+	}
+	output.Flush()
+
+	return strings.ReplaceAll(buf.String(), root, "ROOT")
+}
+
+// TestWalkErrors checks that the errors that end a walk of the tree of
+// cgroupFixture() (ENOENT when a cgroup's files vanish, and EPERM from
+// sched_getscheduler()) identify the file or thread, and can be classified
+// with errors.Is() and errors.As().
+
+func TestWalkErrors(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		setup func(root string, f *fakeSystem) // Injects the failure
+		want  syscall.Errno
+		is    error  // Sentinel error that 'err' matches
+		text  string // Error text, with the root shown as ROOT
+	}{
+		{"ENOENT", func(root string, f *fakeSystem) {
+			delete(f.files, root+"/app/cgroup.threads")
+		}, syscall.ENOENT, os.ErrNotExist,
+			"open ROOT/app/cgroup.threads: " +
+				"no such file or directory"},
+		{"EPERM", func(root string, f *fakeSystem) {
+			delete(f.policies, 302)
+			f.policyErr = syscall.EPERM
+		}, syscall.EPERM, os.ErrPermission,
+			"sched_getscheduler(302): operation not permitted"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			root, f := cgroupFixture(t)
+			tc.setup(root, &f)
+
+			savedOps, savedOpts, savedOutput := sysOps, opts, output
+			defer func() {
+				sysOps, opts, output = savedOps, savedOpts,
+					savedOutput
+			}()
+
+			sysOps = f
+			opts = CmdLineOptions{showPids: true, showTids: true}
+			output = &lineWriter{out: ioutil.Discard}
+			statusCache = make(map[int]*procStatus)
+			rootSlashCnt = len(strings.Split(root, "/"))
+
+			err := walkCgroups(context.Background(), root)
+			if err == nil {
+				t.Fatal("the walk succeeded")
+			}
+
+			got := strings.ReplaceAll(err.Error(), root, "ROOT")
+			if got != tc.text {
+				t.Errorf("error %q, want %q", got, tc.text)
+			}
+			if !errors.Is(err, tc.is) || !errors.Is(err, tc.want) {
+				t.Errorf("error %q doesn't match %q and %v",
+					err, tc.is, tc.want)
+			}
+
+			var errno syscall.Errno
+			if !errors.As(err, &errno) || errno != tc.want {
+				t.Errorf("errors.As(%q) gave errno %v", err,
+					errno)
+			}
+		})
+	}
+}
+
+// largeCgroups() returns the pathnames of a tree of 'n' cgroups (the root,
+// 'root', included), in which each cgroup has up to ten children, along with
+// a fake system that supplies the cgroup files. Every fourth cgroup has a
+// member process with two threads.
+
+func largeCgroups(root string, n int) ([]string, fakeSystem) {
+
+	f := fakeSystem{
+		files:    make(map[string]string),
+		owners:   make(map[string]int),
+		policies: make(map[int]int),
+	}
+
+	paths := make([]string, n)
+	paths[0] = root
+
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			paths[i] = filepath.Join(paths[(i-1)/10],
+				"cg"+strconv.Itoa(i))
+			f.files[paths[i]+"/cgroup.type"] = "domain\n"
+		}
+
+		path := paths[i]
+		f.owners[path] = i % 3 * 1000
+		f.files[path+"/cgroup.subtree_control"] = "cpu memory\n"
+		f.files[path+"/cgroup.procs"] = ""
+		f.files[path+"/cgroup.threads"] = ""
+
+		if i%4 == 0 {
+			pid := 1000 + 2*i
+			tids := []int{pid, pid + 1}
+			f.files[path+"/cgroup.procs"] = strconv.Itoa(pid) + "\n"
+			for _, tid := range tids {
+				f.files[path+"/cgroup.threads"] +=
+					strconv.Itoa(tid) + "\n"
+				f.files["/proc/"+strconv.Itoa(tid)+"/status"] =
+					"Name:\tproc\nTgid:\t" +
+						strconv.Itoa(pid) + "\n"
+				f.policies[tid] = 0
+			}
+		}
+	}
+
+	return paths, f
+}
+
+// largeCgroupFixture() creates the tree of cgroups described by
+// largeCgroups() in a temporary directory, and returns the directory along
+// with the fake system.
+
+func largeCgroupFixture(tb testing.TB, n int) (string, fakeSystem) {
+
+	root := tb.TempDir()
+	paths, f := largeCgroups(root, n)
+
+	for _, path := range paths[1:] {
+		if err := os.Mkdir(path, 0755); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return root, f
+}
+
+// BenchmarkWalkCgroups measures the walk and display, with the member PIDs
+// and TIDs, of trees of cgroups built by largeCgroupFixture(). The cgroup
+// files are supplied by a fake system, so that only the directories are
+// read from the file system.
+
+func BenchmarkWalkCgroups(b *testing.B) {
+
+	for _, n := range []int{1000, 10000, 30000} {
+		root, f := largeCgroupFixture(b, n)
+
+		b.Run(strconv.Itoa(n)+" cgroups", func(b *testing.B) {
+
+			savedOps, savedOpts, savedOutput := sysOps, opts, output
+			defer func() {
+				sysOps, opts, output = savedOps, savedOpts,
+					savedOutput
+			}()
+
+			sysOps = f
+			opts = CmdLineOptions{showPids: true, showTids: true,
+				showOwner: true}
+			rootSlashCnt = len(strings.Split(root, "/"))
+
+			// Check that the walk finds every cgroup
+
+			var buf bytes.Buffer
+			output = &lineWriter{out: &buf}
+			statusCache = make(map[int]*procStatus)
+			err := walkCgroups(context.Background(), root)
+			if err != nil {
+				b.Fatal(err)
+			}
+			output.Flush()
+			got := strings.Count(buf.String(), " [d]")
+			if got != n-1 {
+				b.Fatalf("displayed %d cgroups, want %d", got,
+					n-1)
+			}
+
+			output = &lineWriter{out: ioutil.Discard}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				statusCache = make(map[int]*procStatus)
+				err := walkCgroups(context.Background(), root)
+				if err != nil {
+					b.Fatal(err)
+				}
+				output.Flush()
+			}
+		})
+	}
+}
+
+// countingSystem counts the file reads and scheduling-policy queries that the
+// walk makes, so that they can be compared with the walk's own statistics.
+
+type countingSystem struct {
+	systemOps
+	reads   int
+	queries int
+}
+
+func (c *countingSystem) readFile(path string) ([]byte, error) {
+	c.reads++
+	return c.systemOps.readFile(path)
+}
+
+func (c *countingSystem) schedPolicy(tid int) (int, error) {
+	c.queries++
+	return c.systemOps.schedPolicy(tid)
+}
+
+// TestWalkStats checks the counters that the "--stats" option reports after
+// a walk, with the member PIDs and TIDs, of a tree of 100 cgroups built by
+// largeCgroupFixture(). Every cgroup is visited; every file read and
+// scheduling-policy query is counted; four files (cgroup.type, which the
+// root lacks, cgroup.subtree_control, cgroup.procs, and cgroup.threads) are
+// read for each cgroup; and the status and the policy of each of the 50
+// member threads are read once.
+
+func TestWalkStats(t *testing.T) {
+
+	root, f := largeCgroupFixture(t, 100)
+	sys := &countingSystem{systemOps: f}
+
+	savedOps, savedOpts, savedOutput := sysOps, opts, output
+	defer func() {
+		sysOps, opts, output = savedOps, savedOpts, savedOutput
+	}()
+
+	sysOps = sys
+	opts = CmdLineOptions{showPids: true, showTids: true}
+	output = &lineWriter{out: ioutil.Discard}
+	rootSlashCnt = len(strings.Split(root, "/"))
+	statusCache = make(map[int]*procStatus)
+
+	if err := walkCgroups(context.Background(), root); err != nil {
+		t.Fatal(err)
+	}
+	output.Flush()
+
+	s := opts.stats
+
+	if s.cgroups == 0 || s.filesRead == 0 || s.schedQueries == 0 {
+		t.Fatalf("stats = %+v, want nonzero counters", s)
+	}
+
+	if s.cgroups != 100 {
+		t.Errorf("cgroups = %d, want 100", s.cgroups)
+	}
+	if s.filesRead != sys.reads || s.filesRead != 4*100+50 {
+		t.Errorf("filesRead = %d, with %d files read; want %d",
+			s.filesRead, sys.reads, 4*100+50)
+	}
+	if s.schedQueries != sys.queries || s.schedQueries != 50 {
+		t.Errorf("schedQueries = %d, with %d queries made; want 50",
+			s.schedQueries, sys.queries)
+	}
+}
+
+// TestWrapTextWideAndCombining wraps text containing double-width (CJK)
+// characters and characters with combining marks at a range of widths,
+// checking that no line overflows, and that no line starts with a
+// combining mark (that is, that a character is never separated from its
+// combining marks).
+
+func TestWrapTextWideAndCombining(t *testing.T) {
+
+	texts := []string{
+		"漢字漢字漢字漢字 ひらがな カタカナ 한국어",
+		"ééééé ññ ä",
+		"mixed漢é字x 全角ＡＢＣ",
+	}
+
+	for _, text := range texts {
+		for width := 2; width <= 20; width++ {
+			out := wrapText(text, "", width, "  ")
+			checkWrapped(t, out, text, "", width, "  ")
+
+			for _, line := range strings.Split(out, "\n") {
+				r, _ := utf8.DecodeRuneInString(
+					strings.TrimLeft(line, " "))
+				if unicode.Is(unicode.Mn, r) {
+					t.Errorf("width %d: line %q starts "+
+						"with a combining mark", width,
+						line)
+				}
+			}
+		}
+	}
+}
+
+// TestDisplayWideNames walks a tree of cgroups whose names contain double-width
+// (CJK) characters and combining marks, with a long list of member PIDs, at
+// an output width of 45 columns. The names must be shown unaltered (and
+// correctly indented), and no line other than that of the root (which shows
+// the full pathname) may be wider than the output width.
+
+func TestDisplayWideNames(t *testing.T) {
+
+	const width = 45
+
+	root := t.TempDir()
+	app := filepath.Join(root, "アプリ")
+	worker := filepath.Join(app, "cafe\u0301")
+
+	if err := os.MkdirAll(worker, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var pids []string
+	for pid := 1000; pid < 1040; pid++ {
+		pids = append(pids, strconv.Itoa(pid))
+	}
+
+	f := fakeSystem{files: map[string]string{
+		root + "/cgroup.subtree_control":   "\n",
+		root + "/cgroup.procs":             "",
+		app + "/cgroup.type":               "domain\n",
+		app + "/cgroup.subtree_control":    "\n",
+		app + "/cgroup.procs":              strings.Join(pids, "\n"),
+		worker + "/cgroup.type":            "domain\n",
+		worker + "/cgroup.subtree_control": "\n",
+		worker + "/cgroup.procs":           "",
+	}}
+
+	savedOps, savedOpts, savedOutput := sysOps, opts, output
+	defer func() {
+		sysOps, opts, output = savedOps, savedOpts, savedOutput
+	}()
+
+	var buf bytes.Buffer
+	sysOps = f
+	opts = CmdLineOptions{showPids: true, width: width}
+	output = &lineWriter{out: &buf}
+	statusCache = make(map[int]*procStatus)
+	rootSlashCnt = len(strings.Split(root, "/"))
+
+	if err := walkCgroups(context.Background(), root); err != nil {
+		t.Fatal(err)
+	}
+	output.Flush()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+
+	if len(lines) < 5 || lines[1] != "    アプリ [d]" ||
+		lines[len(lines)-1] != "        cafe\u0301 [d]" {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+	for _, line := range lines[1:] {
+		if visibleWidth(line) > width {
+			t.Errorf("line %q is wider than %d columns", line,
+				width)
+		}
+	}
+}
+
+// BenchmarkOutput measures the throughput of the display output, using as
+// the text the display of the 10000-cgroup tree of BenchmarkWalkCgroups.
+
+func BenchmarkOutput(b *testing.B) {
+
+	root, f := largeCgroupFixture(b, 10000)
+
+	savedOps, savedOpts, savedOutput := sysOps, opts, output
+	defer func() {
+		sysOps, opts, output = savedOps, savedOpts, savedOutput
+	}()
+
+	var buf bytes.Buffer
+	sysOps = f
+	opts = CmdLineOptions{showPids: true, showTids: true,
+		showOwner: true}
+	output = &lineWriter{out: &buf}
+	statusCache = make(map[int]*procStatus)
+	rootSlashCnt = len(strings.Split(root, "/"))
+
+	if err := walkCgroups(context.Background(), root); err != nil {
+		b.Fatal(err)
+	}
+	output.Flush()
+
+	benchmarkLineWriter(b, buf.Bytes())
+}
+
+// benchmarkLineWriter() measures the writing of 'text' to a pipe (whose
+// reader discards what it reads), as a series of small writes, one for each
+// word, like those made by the display functions: first with a write() for
+// each piece, as the program did before its output was buffered, and then
+// through a lineWriter.
+
+func benchmarkLineWriter(b *testing.B, text []byte) {
+
+	size := int64(len(text))
+
+	var pieces [][]byte
+	for len(text) > 0 {
+		i := bytes.IndexAny(text, " \n") + 1
+		if i == 0 {
+			i = len(text)
+		}
+		pieces = append(pieces, text[:i])
+		text = text[i:]
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, r)
+		close(done)
+	}()
+	defer func() {
+		w.Close()
+		<-done
+		r.Close()
+	}()
+
+	b.Run("unbuffered", func(b *testing.B) {
+
+		b.SetBytes(size)
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			for _, p := range pieces {
+				if _, err := w.Write(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("lineWriter", func(b *testing.B) {
+
+		lw := &lineWriter{out: w}
+
+		b.SetBytes(size)
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			for _, p := range pieces {
+				lw.Write(p)
+			}
+			if err := lw.Flush(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// checkWrapped() checks the output 'out' of wrapText() for 'text': no line
+// may be wider than 'width' plus the width of 'indent', and the output must
+// contain the words of 'text' (possibly broken), in order.
+
+func checkWrapped(t *testing.T, out string, text string, prefix string,
+	width int, indent string) {
+
+	for _, line := range strings.Split(out, "\n") {
+		if visibleWidth(line) > width+visibleWidth(indent) {
+			t.Errorf("line %q is wider than %d+%d columns", line,
+				width, visibleWidth(indent))
+		}
+	}
+
+	got := strings.Join(strings.Fields(strings.TrimPrefix(out,
+		indent+prefix)), "")
+	want := strings.Join(strings.Fields(text), "")
+	if got != want {
+		t.Errorf("wrapped words %q; want %q", got, want)
+	}
+}
+
+// FuzzWrapText checks the properties of wrapText() for arbitrary text (as
+// the programs display it, after escapeName()), prefixes, indents and
+// widths: see checkWrapped(). In addition, coloring the output with
+// colorEachLine() must not change the visible text. Widths too narrow for
+// the prefix and one double-width character are not checked, since the
+// output then necessarily overflows.
+
+func FuzzWrapText(f *testing.F) {
+
+	f.Add("aaa bbb ccc", "PIDs: ", uint8(10), uint8(4))
+	f.Add("1 2 3 4 5 6 7 8 9 10 11 12", "[ ", uint8(8), uint8(0))
+	f.Add(strings.Repeat("x", 300), "", uint8(40), uint8(8))
+	f.Add("漢字漢字漢字 かな ééé", "", uint8(5), uint8(2))
+	f.Add("a\tb\nc \x1b[31mred\x1b[m", "TIDs: ", uint8(9), uint8(1))
+
+	f.Fuzz(func(t *testing.T, text string, prefix string, width uint8,
+		indentLen uint8) {
+
+		text = escapeName(text)
+		prefix = escapeName(prefix)
+		indent := strings.Repeat(" ", int(indentLen%16))
+
+		w := int(width % 100)
+		if w < visibleWidth(prefix)+2 {
+			return
+		}
+
+		out := wrapText(text, prefix, w, indent)
+		checkWrapped(t, out, text, prefix, w, indent)
+
+		colored := colorEachLine(out, RED)
+		if escapeSeqRE.ReplaceAllString(colored, "") !=
+			escapeSeqRE.ReplaceAllString(out, "") {
+			t.Errorf("coloring %q changed the visible text: %q",
+				out, colored)
+		}
+	})
+}
+
+// FuzzEscapeName checks that the output of escapeName() contains no
+// control characters, and that escaping it again leaves it unchanged.
+
+func FuzzEscapeName(f *testing.F) {
+
+	f.Add("bash")
+	f.Add("a\tb\nc\x1b[31m\x7f\u0085")
+	f.Add("漢字 é")
+	f.Add("\xff\xfe")
+
+	f.Fuzz(func(t *testing.T, name string) {
+
+		escaped := escapeName(name)
+
+		for _, r := range escaped {
+			if unicode.IsControl(r) {
+				t.Errorf("escapeName(%q) = %q contains %U",
+					name, escaped, r)
+			}
+		}
+
+		if again := escapeName(escaped); again != escaped {
+			t.Errorf("escapeName(%q) = %q; escaping again "+
+				"gives %q", name, escaped, again)
+		}
+	})
+}
+
+// signalChild() is run (instead of the tests) in a child of the test
+// binary, by startSignalChild(). It installs the program's signal handlers
+// and, depending on 'mode', either leaves some output buffered ("display"),
+// or starts a scan that is canceled by the first signal and then leaves
+// some output buffered ("scan"), or writes to standard output until the
+// reader goes away ("pipe"). Each time that it is ready for a signal, it
+// writes "ready" to stderr.
+
+func signalChild(mode string) {
+
+	handleSignals(mode != "pipe")
+
+	switch mode {
+	case "scan":
+		ctx := startScan()
+		fmt.Fprintln(os.Stderr, "ready")
+		<-ctx.Done()
+		endScan(ctx)
+		fmt.Fprint(output, "scan canceled\npartial")
+	case "display":
+		fmt.Fprint(output, "complete line\npartial")
+	case "pipe":
+		fmt.Fprintln(os.Stderr, "ready")
+		for {
+			fmt.Println("line")
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "ready")
+	time.Sleep(10 * time.Second)
+	os.Exit(1)
+}
+
+// startSignalChild() starts the test binary as a child that runs
+// signalChild() in 'mode', with its standard output going to 'stdout'. It
+// returns the child, and a function that waits until the child is ready for
+// a signal.
+
+func startSignalChild(t *testing.T, mode string,
+	stdout io.Writer) (*exec.Cmd, func()) {
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "VIEW_V2_CGROUPS_SIGNAL_TEST="+mode)
+	cmd.Stdout = stdout
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(stderr)
+	waitReady := func() {
+		line, err := r.ReadString('\n')
+		if line != "ready\n" {
+			t.Fatalf("child wrote %q (%v), not \"ready\"", line,
+				err)
+		}
+	}
+
+	return cmd, waitReady
+}
+
+// exitStatus() waits for 'cmd' to terminate, and returns its exit status.
+
+func exitStatus(t *testing.T, cmd *exec.Cmd) int {
+
+	err := cmd.Wait()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	return 0
+}
+
+// TestSignals sends SIGINT and SIGTERM to a child that is displaying
+// output, and checks its exit status (128 plus the signal number), and that
+// its output ends with the last complete line followed by the color reset,
+// with no partial line. When a scan is in progress, the first signal
+// cancels just the scan, and the second terminates the program.
+
+func TestSignals(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		mode    string
+		signals []syscall.Signal
+		status  int
+		stdout  string
+	}{
+		{"SIGINT", "display", []syscall.Signal{syscall.SIGINT}, 130,
+			"complete line\n" + NORMAL},
+		{"SIGTERM", "display", []syscall.Signal{syscall.SIGTERM}, 143,
+			"complete line\n" + NORMAL},
+		{"scan", "scan", []syscall.Signal{syscall.SIGINT,
+			syscall.SIGINT}, 130, "scan canceled\n" + NORMAL},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			var stdout bytes.Buffer
+			cmd, waitReady := startSignalChild(t, tc.mode, &stdout)
+
+			for _, sig := range tc.signals {
+				waitReady()
+				if err := cmd.Process.Signal(sig); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if status := exitStatus(t, cmd); status != tc.status {
+				t.Errorf("exit status %d, want %d", status,
+					tc.status)
+			}
+			if got := stdout.String(); got != tc.stdout {
+				t.Errorf("stdout %q, want %q", got, tc.stdout)
+			}
+		})
+	}
+}
+
+// TestSignalBrokenPipe checks that a child whose standard output is a pipe
+// whose reader goes away (as in "view_v2_cgroups | head") exits silently with
+// status 0.
+
+func TestSignalBrokenPipe(t *testing.T) {
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd, waitReady := startSignalChild(t, "pipe", w)
+	w.Close()
+
+	waitReady()
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if line != "line\n" {
+		t.Fatalf("read %q (%v) from the child", line, err)
+	}
+	r.Close()
+
+	if status := exitStatus(t, cmd); status != 0 {
+		t.Errorf("exit status %d, want 0", status)
+	}
+}
+
+// 'interruptingSystem' is a 'systemOps' that, when a file of the cgroup
+// 'stop' is first read, sends SIGINT to the program (as the user would, by
+// typing Control-C) and waits until the signal has canceled the walk.
+
+type interruptingSystem struct {
+	systemOps
+	stop string
+	done bool
+}
+
+func (s *interruptingSystem) readFile(path string) ([]byte, error) {
+	if filepath.Dir(path) == s.stop && !s.done {
+		s.done = true
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+		for atomic.LoadInt32(&scanInProgress) != 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return s.systemOps.readFile(path)
+}
+
+// interruptChild() is run (instead of the tests) in a child of the test
+// binary, by TestInterruptedWalk. It runs the program over the tree of 100
+// cgroups that largeCgroupFixture() created in 'dir', interrupting the walk
+// when it reaches the cgroup "cg2". Since the children of each cgroup are
+// visited in lexical order, the walk has then displayed the cgroups in the
+// subtrees of "cg1" and "cg10", and "cg2" itself.
+
+func interruptChild(dir string) {
+
+	_, f := largeCgroups(dir, 100)
+	sysOps = &interruptingSystem{systemOps: f, stop: dir + "/cg2"}
+
+	os.Args = []string{"view_v2_cgroups", dir}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	main()
+
+	os.Exit(0)
+}
+
+// TestInterruptedWalk interrupts the program during its walk of a tree of
+// 100 cgroups, and checks that it displays the cgroups visited before the
+// interruption (and only those), followed by the banner that reports the
+// partial results on stderr, and that it exits with the status
+// EXIT_INTERRUPTED.
+
+func TestInterruptedWalk(t *testing.T) {
+
+	dir, _ := largeCgroupFixture(t, 100)
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "VIEW_V2_CGROUPS_INTERRUPT_TEST="+dir)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := exitStatus(t, cmd); status != EXIT_INTERRUPTED {
+		t.Fatalf("exit status %d, want %d; stderr:\n%s", status,
+			EXIT_INTERRUPTED, stderr.String())
+	}
+
+	banner := "Scan interrupted: the results above are partial"
+	if !strings.Contains(stderr.String(), banner) {
+		t.Errorf("stderr doesn't contain %q:\n%s", banner,
+			stderr.String())
+	}
+
+	// Before "cg2", the walk visited "cg1", its children "cg11" to
+	// "cg20", and "cg10" (which has no children), but not the children of
+	// "cg2", nor "cg3" to "cg9" and their subtrees.
+
+	want := []string{"cg1"}
+	for i := 11; i <= 20; i++ {
+		want = append(want, "cg"+strconv.Itoa(i))
+	}
+	want = append(want, "cg10", "cg2")
+
+	var got []string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[1] == "[d]" {
+			got = append(got, fields[0])
+		}
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("displayed cgroups %q, want %q:\n%s", got, want,
+			stdout.String())
+	}
+}
+
+// redirectChild() is run (instead of the tests) in a child of the test
+// binary, by TestRedirectedOutput. It runs the program, with the arguments
+// given to the binary, over the tree of 100 cgroups that
+// largeCgroupFixture() created in 'dir', with 50 single-threaded member
+// processes added to the root cgroup, so that its member lists are longer
+// than a line.
+
+func redirectChild(dir string) {
+
+	_, f := largeCgroups(dir, 100)
+
+	members := ""
+	for pid := 5000; pid < 5050; pid++ {
+		members += strconv.Itoa(pid) + "\n"
+		f.files["/proc/"+strconv.Itoa(pid)+"/status"] =
+			"Name:\tproc\nTgid:\t" + strconv.Itoa(pid) + "\n"
+		f.policies[pid] = 0
+	}
+	f.files[dir+"/cgroup.procs"] = members
+	f.files[dir+"/cgroup.threads"] = members
+	sysOps = f
+
+	os.Args = append([]string{"view_v2_cgroups"}, os.Args[1:]...)
+	os.Args = append(os.Args, dir)
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	main()
+
+	os.Exit(0)
+}
+
+// runRedirected() runs redirectChild() (over 'dir') with the arguments
+// 'args', with standard output redirected to a pipe or, if 'toFile' is
+// true, to a file, and returns the output. NO_COLOR is removed from the
+// environment, so that it can't be what suppresses color.
+
+func runRedirected(t *testing.T, dir string, toFile bool,
+	args ...string) string {
+
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "NO_COLOR=") {
+			env = append(env, e)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(env, "VIEW_V2_CGROUPS_REDIRECT_TEST="+dir)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	path := filepath.Join(t.TempDir(), "out")
+	if toFile {
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		cmd.Stdout = f
+	}
+
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%q: %v; stderr:\n%s", args, err, stderr.String())
+	}
+
+	if !toFile {
+		return stdout.String()
+	}
+
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(out)
+}
+
+// longestLine() returns the length, in characters, of the longest line of
+// 'text'.
+
+func longestLine(text string) int {
+
+	longest := 0
+	for _, line := range strings.Split(text, "\n") {
+		if n := utf8.RuneCountInString(line); n > longest {
+			longest = n
+		}
+	}
+
+	return longest
+}
+
+// TestRedirectedOutput runs the program with its standard output
+// redirected to a pipe and to a file. It checks that, by default, the
+// output contains no escape bytes and isn't wrapped (the fixture has lines
+// longer than 80 characters), while "--color=always" and "--width" still
+// apply.
+
+func TestRedirectedOutput(t *testing.T) {
+
+	dir, _ := largeCgroupFixture(t, 100)
+
+	for _, toFile := range []bool{false, true} {
+		name := "pipe"
+		if toFile {
+			name = "file"
+		}
+
+		t.Run(name, func(t *testing.T) {
+
+			out := runRedirected(t, dir, toFile)
+			if strings.Contains(out, "\x1b") {
+				t.Errorf("default output contains escape "+
+					"bytes:\n%q", out)
+			}
+			if longestLine(out) <= 80 {
+				t.Errorf("default output is wrapped:\n%s", out)
+			}
+
+			out = runRedirected(t, dir, toFile, "--color=always")
+			if !strings.Contains(out, "\x1b") {
+				t.Errorf("'--color=always' output contains "+
+					"no escape bytes:\n%s", out)
+			}
+
+			out = runRedirected(t, dir, toFile, "--width=60")
+			if strings.Contains(out, "\x1b") {
+				t.Errorf("'--width=60' output contains escape "+
+					"bytes:\n%q", out)
+			}
+			if n := longestLine(out); n > 60 {
+				t.Errorf("'--width=60' output has a line of "+
+					"%d characters:\n%s", n, out)
+			}
+		})
+	}
+}
@@ -17,22 +17,129 @@
      then the program shows the subtree of the PID or user namespace hierarchy
      that is rooted at the namespace of the specified PID.
 
+   In place of a PID, the command-line arguments and the "--subtree" option
+   may give the pathname of a namespace file (for example, a bind mount such
+   as /run/netns/foo, or /proc/PID/ns/user); any argument that contains a
+   '/' is treated as a pathname.
+
+   The "--self" option is shorthand for "--subtree=/proc/self/ns/user" (or,
+   with "--pidns", "--subtree=/proc/self/ns/pid"): it shows the subtree of
+   the hierarchy that is rooted at the namespace of the program itself,
+   which is convenient when the program is run inside a container.
+
+   Alternatively, the "--diff=<pidA>,<pidB>" option shows which namespaces
+   two processes share, and the "--translate=<pid>:<target-pid>" option
+   translates PIDs between our PID namespace and the PID namespace of
+   another process.
+
    By default, the program shows namespace memberships in the context of the
    user namespace hierarchy, showing also the nonuser namespaces owned by
    each user namespace. If the "--pidns" option is specified, the program
    instead shows just the PID namespace hierarchy.
 
+   On kernels older than Linux 4.9, which lack the ioctl() operations that
+   discover the relationships between namespaces, the program explains
+   this, and falls back to displaying a flat list of the namespaces (each
+   identified by device ID and inode number) and their member processes.
+
+   The "--summary" option displays, after the hierarchy, the number of
+   namespaces of each type, the number of member processes, the maximum
+   nesting depth of the user (or PID) namespaces, and the number of
+   namespaces that have no member processes.
+
+   The "--count" option displays, instead of the hierarchy, just the number
+   of namespaces of each type, and the minimum, median, and maximum number
+   of member processes in the namespaces of each type. Since the commands
+   of the processes and the UID and GID maps aren't needed, they are not
+   read, which makes this option faster than the full display.
+
+   The "--limits" option compares the number of namespaces created by each
+   UID against the limits in /proc/sys/user (for example,
+   max_user_namespaces), marks the user namespaces whose creator is near a
+   limit, and displays a table of the usage for each UID.
+
+   The "--user=<name>" and "--uid=<uid>" options restrict the displayed
+   member processes to those owned by a particular user, and prune the
+   parts of the hierarchy that contain none of that user's processes.
+
+   The "--no-kthreads" option omits kernel threads (which are all members
+   of the initial namespaces) from the lists of member processes.
+
+   The "--tree=unicode" and "--tree=ascii" options draw lines that connect
+   each namespace to its parent (or owner) and its siblings, rather than
+   showing the hierarchy by indentation alone.
+
+   The "--nonempty" option hides the namespaces that have no member
+   processes and no descendants with member processes (for example, a
+   parent user namespace that exists only to own a child), and the
+   "--empty-only" option shows only such namespaces (along with their
+   ancestors, as context), which is useful for spotting leaked namespaces.
+
+   The "--show-owner-ns" option shows, on the line for each nonuser
+   namespace, the user namespace that owns it, in the form
+   "owner=user:[4026531837]". This is most useful with "--pidns", where the
+   user namespaces aren't otherwise shown.
+
    The "--no-pids" option suppresses the display of the processes that
-   are members of each namespace.
+   are members of each namespace, and the "--changed-only" option
+   suppresses the display of the processes that are members only of the
+   initial namespaces.
 
-   The "--show-comm" option displays the command being run by each process.
+   The "--show-comm" option displays the command being run by each process,
+   and the "--show-cmdline" option displays its full command line.
+
+   The "--names" option displays, alongside the UID of the creator of each
+   user namespace, the corresponding user name.
+
+   The "--show-uts" option displays the hostname of each UTS namespace, and
+   the "--show-net" option displays the network interfaces in each network
+   namespace.
+
+   The "--pinned" option also discovers namespaces that are pinned into
+   existence by bind mounts or by open file descriptors, and thus may have
+   no member processes.
 
    The "--all-pids" option can be used in conjunction with "--pidns",
    so that for each process that is displayed, its PIDs in all of the PID
    namespaces of which it is a member are shown.
 
-   The "--no-color" option can be used to suppress the use of color
-   in the displayed output.
+   The "--json" option displays the namespace hierarchy as a JSON document,
+   rather than as indented text. The "--dot" option displays the hierarchy
+   as a Graphviz DOT digraph. The "--list" option displays a table, in the
+   style of lsns(8), with one row per namespace. The "--format=tsv" option
+   displays one tab-separated line for each member process of each
+   namespace, for use by scripts.
+
+   The "--color=never" option (or its older alias, "--no-color") can be
+   used to suppress the use of color in the displayed output. By default,
+   color is used (unless the NO_COLOR environment variable is set), and
+   the lists of PIDs are wrapped to the width of the terminal, only if
+   standard output is a terminal; the "--color=always" and "--width=<n>"
+   options override these defaults.
+
+   Default values for the options can be set in the configuration file
+   $XDG_CONFIG_HOME/tlpi-tools/config (see loadConfig()); the "--no-config"
+   option causes the file to be ignored.
+
+   The "--watch=<seconds>" option rescans the namespaces at the given
+   interval and redraws the display, highlighting the namespaces that
+   appeared since the previous scan and listing those that disappeared.
+
+   The "--procfs=<dir>" option causes the program to inspect the processes
+   in the procfs mounted at <dir>, rather than at /proc (for example, the
+   host's /proc bind mounted inside a container).
+
+   The "--capture=<file>" option writes, as well as displaying the results
+   of the scan, a snapshot (a tar archive) containing the /proc files that
+   the display needs and a manifest that records the namespaces that were
+   found and the relationships between them (which are discovered with
+   ioctl() operations, and so can't be recorded as files). The
+   "--replay=<file>" option displays such a snapshot, perhaps on another
+   machine, instead of scanning the live system.
+
+   The "--stats" option reports the cost of the scan (time taken, and the
+   numbers of directories visited, files opened, and ioctl() operations
+   performed) on standard error.
 
    When displaying the user namespace hierarchy, the "--namespaces=<list>"
    option can be used to specify a list of the nonuser namespace types to
@@ -44,42 +151,99 @@
    device IDs and inode numbers of those files using the operations described
    in ioctl_ns(2).  In cases where the program must inspect symlink files of
    processes that are owned by other users, the program must be run as
-   superuser.
+   superuser. (When scanning all processes, the processes whose symlink
+   files can't be inspected are skipped, and counted in a warning, unless
+   the "--strict" option is specified.)
 
    As described in clone(2), the CLONE_THREAD flag can't be specified in
    conjunction with either CLONE_NEWUSER or CLONE_NEWPID. This means that
    all of the threads in a multithreaded process must be in the same user
    and PID namespaces. Therefore, it is not necessary to scan the
    /proc/PID/task/TID/ns directories to discover any further information
-   about the shape of the user or PID namespace hierarchy.
+   about the shape of the user or PID namespace hierarchy. However, an
+   individual thread can use setns(2) to join a different mount, network,
+   UTS, IPC, or cgroup namespace; the "--threads" option additionally
+   scans the /proc/PID/task/TID/ns directories to discover such threads.
 */
 
 package main
 
 import (
+	"archive/tar"
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 	"unsafe"
 )
 
 // The following structure stores info from command-line options.
 
 type CmdLineOptions struct {
-	useColor           bool   // Use color in the output
-	showCommand        bool   // Show the command being run by each process
-	showPids           bool   // Show member PIDs for each namespace
-	showAllPids        bool   // Show all of a process's PIDs (PID NS only)
-	showPidnsHierarchy bool   // Display the PID namespace hierarchy
-	subtreePID         string // Display hierarchy rooted at specific PID
-	namespaces         int    // Bit mask of CLONE_NEW* values
+	useColor           bool     // Use color in the output
+	showCommand        bool     // Show the command run by each process
+	showCmdline        bool     // ... as the full command line
+	showPids           bool     // Show member PIDs for each namespace
+	showAllPids        bool     // Show all PIDs of each process (PID NS)
+	showPidnsHierarchy bool     // Display the PID namespace hierarchy
+	showStats          bool     // Report the cost of the scan
+	json               bool     // Display the hierarchy as JSON
+	dot                bool     // Display the hierarchy in DOT format
+	list               bool     // Display a table of namespaces
+	tsv                bool     // Display (namespace, PID) pairs as TSV
+	noHeader           bool     // Omit the TSV header line
+	listColumns        []string // Columns of the "--list" table
+	showNames          bool     // Show user names of namespace creators
+	watch              int      // Rescan at this interval (seconds)
+	showUTS            bool     // Show hostname of each UTS namespace
+	showNet            bool     // Show interfaces of each net namespace
+	showOwnerNS        bool     // Show owning user NS of nonuser NSs
+	pinned             bool     // Discover NSs pinned by mounts or FDs
+	threads            bool     // Scan the namespaces of each thread
+	strict             bool     // Fail if a process can't be inspected
+	procfs             string   // Directory where procfs is mounted
+	diffPIDs           []string // Compare the namespaces of two PIDs
+	translatePIDs      []string // Translate a PID into a PID namespace
+	changedOnly        bool     // Show only PIDs in noninitial NSs
+	mapRanges          bool     // Show UID/GID maps as ranges
+	summary            bool     // Show a summary after the hierarchy
+	count              bool     // Show only counts of namespaces
+	nonempty           bool     // Hide NSs with no members in subtree
+	emptyOnly          bool     // Show only NSs with no members in subtree
+	limits             bool     // Compare usage with /proc/sys/user
+	ownerUID           int      // Show only processes of this UID, or -1
+	noKthreads         bool     // Omit kernel threads from the scan
+	tree               string   // Tree-drawing style (see treeStyles)
+	width              int      // Wrap output to this width (0: don't wrap)
+	autoWidth          bool     // 'width' is the terminal width
+	nsFormat           string   // How to show NS IDs: "full"/"symlink"
+	subtreePID         string   // Display hierarchy rooted at PID or file
+	self               bool     // "--self" (which sets 'subtreePID')
+	capture            string   // Write a snapshot archive to this file
+	replay             string   // Display from this snapshot archive
+	namespaces         int      // Bit mask of CLONE_NEW* values
 }
 
 // A namespace is uniquely identified by the combination of a device ID
@@ -104,8 +268,25 @@ type NamespaceAttribs struct {
 	pids       []int         // Member processes
 	children   []NamespaceID // Child+owned namespaces (user/PID NSs only)
 	creatorUID int           // UID of creator (user NSs only)
+	owner      NamespaceID   // Owning user NS (nonuser NSs only)
 	uidMap     string        // UID map (user NSs only)
 	gidMap     string        // UID map (user NSs only)
+	pinnedBy   []string      // Bind mounts and open FDs that pin the NS
+	threads    []threadID    // Member threads whose process isn't a member
+}
+
+// A thread, identified by the PID of its process (i.e., the TID of the
+// thread group leader) and its own TID.
+
+type threadID struct {
+	pid int
+	tid int
+}
+
+// String() returns the "pid/tid" form in which threads are displayed.
+
+func (t threadID) String() string {
+	return strconv.Itoa(t.pid) + "/" + strconv.Itoa(t.tid)
 }
 
 type NamespaceList map[NamespaceID]*NamespaceAttribs
@@ -128,6 +309,53 @@ type NamespaceList map[NamespaceID]*NamespaceAttribs
 type NamespaceInfo struct {
 	nsList NamespaceList
 	rootNS NamespaceID
+	stats  scanStats
+	newNS  map[NamespaceID]bool // Namespaces new since last scan (--watch)
+
+	permDenied int // Processes skipped because of EACCES (full scans)
+	kthreads   int // Kernel threads skipped because of "--no-kthreads"
+
+	// For "--changed-only": the initial namespaces (those of PID 1),
+	// and the processes that are members of other namespaces.
+
+	initialNS   map[NamespaceID]bool
+	changedPIDs map[int]bool
+
+	// For "--limits": the limits in /proc/sys/user, indexed by
+	// CLONE_NEW* value, and the number of namespaces of each type
+	// created by each UID.
+
+	limits     map[int]int
+	limitUsage map[int]map[int]int
+
+	// For "--user" and "--uid": the (effective) UID of each scanned
+	// process, or -1 if it couldn't be determined.
+
+	owners map[int]int
+
+	// For kernels that lack some of the namespace ioctl() operations
+	// (which fail with ENOTTY): 'flat' records that the parent/owning
+	// namespaces can't be discovered, so that the namespaces are shown
+	// as a flat list, and 'noCreatorUIDs' that NS_GET_OWNER_UID failed.
+
+	flat          bool
+	noCreatorUIDs bool
+
+	// For "--nonempty" and "--empty-only": the namespaces whose subtree
+	// contains at least one member process.
+
+	nonempty map[NamespaceID]bool
+}
+
+// While scanning and displaying the namespaces, we count the work done, so
+// that it can be reported by the "--stats" option.
+
+type scanStats struct {
+	scanTime    time.Duration // Wall time taken to scan /proc
+	renderTime  time.Duration // Wall time taken to display the results
+	procDirs    int           // /proc/PID directories visited
+	filesOpened int           // Namespace and map files opened
+	ioctls      int           // Namespace ioctl() operations performed
 }
 
 var invisUserNS = NamespaceID{0, 0} // Const value
@@ -139,6 +367,12 @@ const NS_GET_PARENT = 0xb702    // Get parent NS (for user or PID NS)
 const NS_GET_NSTYPE = 0xb703    // Return namespace type (see below)
 const NS_GET_OWNER_UID = 0xb704 // Return creator UID for user NS
 
+// PID translation operations (Linux 6.11 and later), which, unlike the
+// operations above, encode the size and direction of their argument.
+
+const NS_GET_TGID_FROM_PIDNS = 0x8004b707 // PID in NS => PID in our NS
+const NS_GET_TGID_IN_PIDNS = 0x8004b709   // PID in our NS => PID in NS
+
 // Namespace types returned by NS_GET_NSTYPE.
 
 const CLONE_NEWNS = 0x00020000
@@ -149,6 +383,19 @@ const CLONE_NEWUSER = 0x10000000
 const CLONE_NEWPID = 0x20000000
 const CLONE_NEWNET = 0x40000000
 
+// The setns(2) system call number, which the syscall package doesn't define,
+// on each architecture (see the kernel's syscall tables).
+
+var setnsSyscall = map[string]uintptr{
+	"386":     346,
+	"amd64":   308,
+	"arm":     375,
+	"arm64":   268,
+	"ppc64le": 350,
+	"riscv64": 268,
+	"s390x":   339,
+}
+
 // A list of the names of the symlink files in the /proc/PID/ns directory that
 // define a process's namespace memberships.
 
@@ -168,6 +415,27 @@ var namespaceToStr = map[int]string{
 	CLONE_NEWUTS:    "uts",
 }
 
+// The strings used to draw the connecting lines of the hierarchy with the
+// "--tree" option: the connector for a child that has further siblings, the
+// connector for the last child, and the continuation of the vertical line
+// past a node (or the absence of one, after the last child).
+
+type treeStyle struct {
+	branch   string
+	last     string
+	vertical string
+	space    string
+}
+
+var treeStyles = map[string]treeStyle{
+	"unicode": {"├── ", "└── ", "│   ", "    "},
+	"ascii":   {"|-- ", "`-- ", "|   ", "    "},
+}
+
+// The characters that can appear in the tree-drawing prefix of a line.
+
+const treeChars = " │├└─|`-"
+
 // Some terminal escape sequences for displaying color output.
 
 const ESC = ""
@@ -175,27 +443,195 @@ const RED = ESC + "[31m"
 const YELLOW = ESC + "[93m"
 const BOLD = ESC + "[1m"
 const LIGHT_BLUE = ESC + "[38;5;51m"
+const GREEN = ESC + "[32m"
 const NORMAL = ESC + "(B" + ESC + "[m"
 const PID_COLOR = LIGHT_BLUE
 const USERNS_COLOR = YELLOW + BOLD
+const NEW_NS_COLOR = GREEN + BOLD
+const INIT_COLOR = BOLD
+const CLEAR_SCREEN = ESC + "[H" + ESC + "[2J"
+
+// Errors that occur while discovering namespaces are returned as a
+// '*namespaceError', which records the operation that failed and, where
+// known, the PID and file that were being examined. The underlying error
+// remains available via errors.Is() and errors.As(); for example,
+// errors.Is(err, os.ErrPermission) identifies EPERM and EACCES failures, and
+// errors.Is(err, errNotSupported) identifies a kernel that lacks the
+// namespace ioctl() operations (which fail with ENOTTY).
+
+var errNotSupported = errors.New("namespace ioctl() operations not supported")
+
+type namespaceError struct {
+	Op   string // Operation that failed, e.g., "ioctl(NS_GET_NSTYPE)"
+	PID  string // PID whose namespaces were being examined, if known
+	Path string // Namespace file that was being examined, if known
+	NS   string // Namespace being examined (see nsString()), if known
+	Err  error  // Underlying error
+}
+
+func (e *namespaceError) Error() string {
+	msg := ""
+	if e.PID != "" {
+		msg = "PID " + e.PID + ": "
+	}
+	msg += e.Op
+	if e.Path != "" {
+		msg += " " + e.Path
+	}
+	if e.NS != "" && e.Path != "" {
+		msg += " (" + e.NS + ")"
+	} else if e.NS != "" {
+		msg += " " + e.NS
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *namespaceError) Unwrap() error { return e.Err }
+
+func (e *namespaceError) Is(target error) bool {
+	return target == errNotSupported && errors.Is(e.Err, syscall.ENOTTY)
+}
+
+// withContext() returns 'err' with the PID 'pid' and the namespace file
+// 'path' recorded in it, if 'err' is a '*namespaceError' that doesn't
+// already record them.
+
+func withContext(err error, pid string, path string) error {
+	var nsErr *namespaceError
+	if errors.As(err, &nsErr) {
+		if nsErr.PID == "" {
+			nsErr.PID = pid
+		}
+		if nsErr.Path == "" {
+			nsErr.Path = path
+		}
+	}
+	return err
+}
+
+// exitWithError() displays a message describing 'err' (with a suggested
+// remedy, for the errors where there is an obvious one) and terminates the
+// program.
+
+func exitWithError(err error) {
+	msg := err.Error()
+
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		msg += " (rerun this program as superuser)"
+	case errors.Is(err, errNotSupported):
+		msg += " (Linux 4.11 or later is required)"
+	}
+
+	output.Flush()
+
+	logMessage(LOG_QUIET, msg)
+	os.Exit(1)
+}
+
+// nsString() returns the namespace 'ns', of type 'nsType', in the format
+// selected by the "--ns-format" option: either "type {dev inode}" or, in
+// the format shown by readlink(1) on a /proc/PID/ns symlink, "type:[inode]".
+
+func nsString(nsType int, ns NamespaceID, opts CmdLineOptions) string {
+
+	if opts.nsFormat == "symlink" {
+		return namespaceToStr[nsType] + ":[" +
+			strconv.FormatUint(ns.inode, 10) + "]"
+	}
+
+	return namespaceToStr[nsType] + " " + fmt.Sprint(ns)
+}
+
+// ownerString() returns the owning user namespace 'owner', as shown by the
+// "--show-owner-ns" option: in the format shown by readlink(1), regardless
+// of "--ns-format", or "invisible" if the owner is an invisible ancestor.
+
+func ownerString(owner NamespaceID) string {
+
+	if owner == invisUserNS {
+		return "invisible"
+	}
+
+	return nsString(CLONE_NEWUSER, owner,
+		CmdLineOptions{nsFormat: "symlink"})
+}
+
+// The 'namespaceOps' interface defines the operations that the scan of the
+// procfs performs on namespace files: opening them (or just using stat() to
+// identify the namespace), identifying the namespace that an open file refers
+// to, and the namespace ioctl() operations with which the hierarchy is
+// discovered. The scan performs these operations only via 'nsOps', so that
+// a fake namespace hierarchy can be substituted for the live one (the files
+// that the scan reads go via readFile()). Errors are returned as the bare
+// errno values of the failed system calls.
+
+type namespaceOps interface {
+	open(path string) (int, error)         // open() a namespace file
+	stat(path string) (NamespaceID, error) // stat() a namespace file
+	id(fd int) (NamespaceID, error)        // fstat() a namespace file
+	ioctl(fd int, op uintptr) (int, error) // See nsIoctl()
+	ownerUID(fd int) (int, error)          // See nsGetOwnerUID()
+	close(fd int)                          // close() a namespace file
+}
+
+// 'liveNamespaceOps' implements the 'namespaceOps' interface with the real
+// system calls.
+
+type liveNamespaceOps struct{}
+
+var nsOps namespaceOps = liveNamespaceOps{}
+
+func (liveNamespaceOps) open(path string) (int, error) {
+	return syscall.Open(path, syscall.O_RDONLY, 0)
+}
+
+func (liveNamespaceOps) stat(path string) (NamespaceID, error) {
+	var sb syscall.Stat_t
+
+	if err := syscall.Stat(path, &sb); err != nil {
+		return NamespaceID{}, err
+	}
+
+	return NamespaceID{sb.Dev, sb.Ino}, nil
+}
+
+func (liveNamespaceOps) id(fd int) (NamespaceID, error) {
+	var sb syscall.Stat_t
+
+	if err := syscall.Fstat(fd, &sb); err != nil {
+		return NamespaceID{}, err
+	}
+
+	return NamespaceID{sb.Dev, sb.Ino}, nil
+}
+
+func (liveNamespaceOps) ioctl(fd int, op uintptr) (int, error) {
+	return nsIoctl(fd, op)
+}
+
+func (liveNamespaceOps) ownerUID(fd int) (int, error) {
+	return nsGetOwnerUID(fd)
+}
+
+func (liveNamespaceOps) close(fd int) {
+	syscall.Close(fd)
+}
 
 // Create and return a new namespace ID using the device ID and inode
 // number of the namespace referred to by 'namespaceFD'.
 
-func newNamespaceID(namespaceFD int) NamespaceID {
-	var sb syscall.Stat_t
-	var err error
+func newNamespaceID(namespaceFD int) (NamespaceID, error) {
 
 	// Obtain the device ID and inode number of the namespace file.
 	// These values together form the key for the 'nsList' map entry.
 
-	err = syscall.Fstat(namespaceFD, &sb)
+	ns, err := nsOps.id(namespaceFD)
 	if err != nil {
-		fmt.Println("syscall.Fstat():", err)
-		os.Exit(1)
+		return NamespaceID{}, &namespaceError{Op: "fstat", Err: err}
 	}
 
-	return NamespaceID{sb.Dev, sb.Ino}
+	return ns, nil
 }
 
 // addNamespace() adds the namespace referred to by the file descriptor
@@ -220,18 +656,25 @@ func newNamespaceID(namespaceFD int) NamespaceID {
 //
 // The return value of the function is the ID of the namespace entry
 // (i.e., the device ID and inode number corresponding to the namespace
-// file referred to by 'namespaceFD').
+// file referred to by 'namespaceFD'), or an error if the namespace (or one
+// of its ancestors) could not be inspected.
 
 func (nsi *NamespaceInfo) addNamespace(namespaceFD int, pid int,
-	opts CmdLineOptions) NamespaceID {
+	opts CmdLineOptions) (NamespaceID, error) {
 
-	ns := newNamespaceID(namespaceFD)
+	ns, err := newNamespaceID(namespaceFD)
+	if err != nil {
+		return ns, err
+	}
 
 	// If this namespace is not already in the namespaces list of 'nsi',
 	// add it to the list.
 
 	if _, fnd := nsi.nsList[ns]; !fnd {
-		nsi.addNamespaceToList(ns, namespaceFD, opts)
+		err = nsi.addNamespaceToList(ns, namespaceFD, opts)
+		if err != nil {
+			return ns, err
+		}
 	}
 
 	// Add PID to PID list for this namespace entry.
@@ -240,7 +683,7 @@ func (nsi *NamespaceInfo) addNamespace(namespaceFD int, pid int,
 		nsi.nsList[ns].pids = append(nsi.nsList[ns].pids, pid)
 	}
 
-	return ns
+	return ns, nil
 }
 
 // addNamespaceToList() adds the namespace 'ns' to the namespaces list
@@ -248,31 +691,57 @@ func (nsi *NamespaceInfo) addNamespace(namespaceFD int, pid int,
 // for addNamespace().
 
 func (nsi *NamespaceInfo) addNamespaceToList(ns NamespaceID, namespaceFD int,
-	opts CmdLineOptions) {
+	opts CmdLineOptions) error {
 
 	// Namespace entry does not yet exist in 'nsList' map; create it.
 
+	nsType, err := namespaceType(namespaceFD)
+	nsi.stats.ioctls++
+	if err != nil {
+		return err
+	}
+
+	logMessage(LOG_DEBUG, "New namespace:", nsString(nsType, ns, opts))
+
 	nsi.nsList[ns] = new(NamespaceAttribs)
-	nsi.nsList[ns].nsType = namespaceType(namespaceFD)
+	nsi.nsList[ns].nsType = nsType
 
 	// If this is a user namespace, record the user ID of the creator of
 	// the namespace.
 
 	if nsi.nsList[ns].nsType == CLONE_NEWUSER {
-		var uid int
-
-		ret, _, err := syscall.Syscall(syscall.SYS_IOCTL,
-			uintptr(namespaceFD), uintptr(NS_GET_OWNER_UID),
-			uintptr(unsafe.Pointer(&uid)))
-
-		if (int)((uintptr)(unsafe.Pointer(ret))) == -1 {
-			fmt.Println("ioctl(NS_GET_OWNER_UID):", err)
-			os.Exit(1)
+		uid, err := nsOps.ownerUID(namespaceFD)
+		nsi.stats.ioctls++
+		if err == syscall.ENOTTY { // Linux 4.9 and 4.10
+			if !nsi.noCreatorUIDs {
+				logMessage(LOG_NORMAL, "Warning: this kernel "+
+					"doesn't support NS_GET_OWNER_UID "+
+					"(Linux 4.11 or later is required); "+
+					"creator UIDs are unknown")
+				nsi.noCreatorUIDs = true
+			}
+			uid, err = -1, nil
+		}
+		if err != nil {
+			return &namespaceError{Op: "ioctl(NS_GET_OWNER_UID)",
+				NS: nsString(nsType, ns, opts), Err: err}
 		}
 
 		nsi.nsList[ns].creatorUID = uid
 	}
 
+	// When handling only the PID namespace hierarchy, the owning user
+	// namespace of a nonuser namespace isn't discovered below, so look
+	// it up separately. (Otherwise, the owner is the parent/owning
+	// namespace found below.)
+
+	if nsType != CLONE_NEWUSER && opts.showPidnsHierarchy {
+		err := nsi.findOwnerNS(ns, namespaceFD, opts)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Get a file descriptor for the parent/owning namespace.
 	// NS_GET_USERNS returns the owning user namespace when its argument
 	// is a nonuser namespace, and (conveniently) returns the parent user
@@ -285,17 +754,41 @@ func (nsi *NamespaceInfo) addNamespaceToList(ns NamespaceID, namespaceFD int,
 		ioctlOp = NS_GET_PARENT
 	}
 
-	ret, _, err := syscall.Syscall(syscall.SYS_IOCTL,
-		uintptr(namespaceFD), uintptr(ioctlOp), 0)
-	parentFD := (int)((uintptr)(unsafe.Pointer(ret)))
+	parentFD, err := nsOps.ioctl(namespaceFD, uintptr(ioctlOp))
+	nsi.stats.ioctls++
 
 	if parentFD == -1 {
 
+		// ENOTTY means that the kernel doesn't support the
+		// operation, so that we can't discover the hierarchy. We
+		// still record the namespace (and its members), but it is
+		// displayed in a flat list, without its parent/owner.
+
+		if err == syscall.ENOTTY {
+			if opt := hierarchyOption(opts); opt != "" {
+				return flatOptionError(opt)
+			}
+			if !nsi.flat {
+				logMessage(LOG_NORMAL, "Warning: this kernel "+
+					"doesn't support the namespace "+
+					"ioctl() operations (Linux 4.9 or "+
+					"later is required), so the "+
+					"relationships between namespaces "+
+					"can't be shown")
+				nsi.flat = true
+			}
+			return nil
+		}
+
 		// Any error other than EPERM is unexpected; bail.
 
 		if err != syscall.EPERM {
-			fmt.Println("ioctl():", err)
-			os.Exit(1)
+			op := "ioctl(NS_GET_USERNS)"
+			if ioctlOp == NS_GET_PARENT {
+				op = "ioctl(NS_GET_PARENT)"
+			}
+			return &namespaceError{Op: op,
+				NS: nsString(nsType, ns, opts), Err: err}
 		}
 
 		// We got an EPERM error...
@@ -341,7 +834,11 @@ func (nsi *NamespaceInfo) addNamespaceToList(ns NamespaceID, namespaceFD int,
 		// PID to be recorded as being a member of the parent/owning
 		// namespace.
 
-		parent := nsi.addNamespace(parentFD, -1, opts)
+		parent, err := nsi.addNamespace(parentFD, -1, opts)
+		nsOps.close(parentFD)
+		if err != nil {
+			return err
+		}
 
 		// Make the current namespace entry a child of the
 		// parent/owning namespace entry.
@@ -349,53 +846,151 @@ func (nsi *NamespaceInfo) addNamespaceToList(ns NamespaceID, namespaceFD int,
 		nsi.nsList[parent].children =
 			append(nsi.nsList[parent].children, ns)
 
-		syscall.Close(parentFD)
+		if nsType != CLONE_NEWUSER && ioctlOp == NS_GET_USERNS {
+			nsi.nsList[ns].owner = parent
+		}
+	}
+
+	return nil
+}
+
+// findOwnerNS() records the owning user namespace of the nonuser namespace
+// 'ns', which is referred to by the file descriptor 'namespaceFD'. The owner
+// is not added to 'nsi.nsList'. If the owner is an invisible ancestor user
+// namespace, 'owner' is left as 'invisUserNS'.
+
+func (nsi *NamespaceInfo) findOwnerNS(ns NamespaceID, namespaceFD int,
+	opts CmdLineOptions) error {
+
+	ownerFD, err := nsOps.ioctl(namespaceFD, NS_GET_USERNS)
+	nsi.stats.ioctls++
+
+	if ownerFD == -1 {
+
+		// With ENOTTY (no kernel support), the owner is unknown; the
+		// NS_GET_PARENT operation that follows reports the problem.
+
+		if err == syscall.EPERM || err == syscall.ENOTTY {
+			return nil
+		}
+		return &namespaceError{Op: "ioctl(NS_GET_USERNS)",
+			NS: nsString(nsi.nsList[ns].nsType, ns, opts), Err: err}
+	}
+
+	owner, err := newNamespaceID(ownerFD)
+	nsOps.close(ownerFD)
+	if err != nil {
+		return err
+	}
+
+	nsi.nsList[ns].owner = owner
+
+	return nil
+}
+
+// nsIoctl() performs the namespace ioctl() operation 'op' (one of
+// the NS_GET_* constants) on the file descriptor 'fd'. On success, it
+// returns the (nonnegative) result of the operation. On failure, it
+// returns -1 and the error (a syscall.Errno, for example, EPERM or
+// ENOTTY). See ioctl_ns(2).
+
+func nsIoctl(fd int, op uintptr) (int, error) {
+
+	ret, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), op, 0)
+	if errno != 0 {
+		return -1, errno
 	}
+
+	return int(ret), nil
+}
+
+// nsTranslatePID() performs the PID translation ioctl() operation 'op'
+// (NS_GET_TGID_FROM_PIDNS or NS_GET_TGID_IN_PIDNS) for 'pid' on the PID
+// namespace referred to by 'fd', and returns the translated PID. On
+// failure, it returns -1 and the error (for example, ESRCH if the process
+// isn't visible in the target namespace, or ENOTTY if the kernel doesn't
+// support the operation).
+
+func nsTranslatePID(fd int, op uintptr, pid int) (int, error) {
+
+	ret, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), op,
+		uintptr(pid))
+	if errno != 0 {
+		return -1, errno
+	}
+
+	return int(ret), nil
+}
+
+// nsGetOwnerUID() returns the UID of the creator of the user namespace
+// referred to by 'fd' (the NS_GET_OWNER_UID operation). On failure, it
+// returns -1 and the error.
+
+func nsGetOwnerUID(fd int) (int, error) {
+	var uid uint32 // uid_t
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		uintptr(NS_GET_OWNER_UID), uintptr(unsafe.Pointer(&uid)))
+	if errno != 0 {
+		return -1, errno
+	}
+
+	return int(uid), nil
 }
 
 // namespaceType() returns a CLONE_NEW* constant telling us what kind of
-// namespace is referred to by 'namespaceFD'.
+// namespace is referred to by 'namespaceFD'. On kernels before Linux 4.11,
+// which lack NS_GET_NSTYPE, the type is instead taken from the link for the
+// file descriptor in /proc/self/fd, which has the form "type:[inode]".
 
-func namespaceType(namespaceFD int) int {
+func namespaceType(namespaceFD int) (int, error) {
 
-	ret, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(namespaceFD),
-		uintptr(NS_GET_NSTYPE), 0)
-	nsType := (int)((uintptr)(unsafe.Pointer(ret)))
-	if nsType == -1 {
-		fmt.Println("ioctl(NS_GET_NSTYPE)", err)
-		os.Exit(1)
+	nsType, err := nsOps.ioctl(namespaceFD, NS_GET_NSTYPE)
+	if err == nil {
+		return nsType, nil
+	}
+
+	if err == syscall.ENOTTY {
+		link, lerr := os.Readlink("/proc/self/fd/" +
+			strconv.Itoa(namespaceFD))
+		if lerr == nil {
+			name := strings.SplitN(link, ":", 2)[0]
+			for k, v := range namespaceToStr {
+				if v == name {
+					return k, nil
+				}
+			}
+		}
 	}
 
-	return nsType
+	return -1, &namespaceError{Op: "ioctl(NS_GET_NSTYPE)", Err: err}
 }
 
 // addProcessNamespace() processes a single /proc/PID/ns/* entry, creating a
 // namespace entry for that file and, as necessary, namespace entries for all
 // ancestor namespaces going back to the initial namespace. 'pid' is a
 // string containing a PID; 'nsFile' is a string identifying which namespace
-// symlink to open.
+// symlink to open. Any error that is returned records 'pid' and the
+// namespace file.
 
 func (nsi *NamespaceInfo) addProcessNamespace(pid string, nsFile string,
-	opts CmdLineOptions, isCmdLineArg bool) {
+	opts CmdLineOptions, isCmdLineArg bool) error {
 
 	// Obtain a file descriptor that refers to the namespace
 	// corresponding to 'pid' and 'nsFile'.
 
-	namespaceFD, err := syscall.Open("/proc/"+pid+"/ns/"+nsFile,
-		syscall.O_RDONLY, 0)
+	path := opts.procfs + "/" + pid + "/ns/" + nsFile
 
-	if namespaceFD < 0 {
+	namespaceFD, err := nsOps.open(path)
 
-		fmt.Print("Could not open " + "/proc/" + pid + "/ns/" +
-			nsFile + ": ")
+	if namespaceFD < 0 {
 
 		if err == syscall.EACCES {
 
 			// We didn't have permission to open /proc/PID/ns/*.
 
-			fmt.Println(err)
-			fmt.Println("Rerun this program as superuser")
-			os.Exit(1)
+			return &namespaceError{Op: "open", PID: pid, Path: path,
+				Err: err}
 
 		} else {
 
@@ -412,578 +1007,5136 @@ func (nsi *NamespaceInfo) addProcessNamespace(pid string, nsFile string,
 			// message and carry on.
 
 			if isCmdLineArg {
-				fmt.Println(err)
-				os.Exit(1)
+				return &namespaceError{Op: "open", PID: pid,
+					Path: path, Err: err}
 			} else {
-				fmt.Println("process terminated while we " +
+				logMessage(LOG_NORMAL, "Could not open "+path+
+					": process terminated while we "+
 					"were parsing?")
-				return
+				return nil
 			}
 		}
 	}
 
+	nsi.stats.filesOpened++
+
 	// Add entry for this namespace, and all of its ancestor namespaces.
 
 	npid, _ := strconv.Atoi(pid)
-	nsi.addNamespace(namespaceFD, npid, opts)
+	_, err = nsi.addNamespace(namespaceFD, npid, opts)
 
-	syscall.Close(namespaceFD)
+	nsOps.close(namespaceFD)
+
+	return withContext(err, pid, path)
 }
 
 // addNamespacesForAllProcesses() scans /proc/PID directories to build
-// namespace entries in 'nsi' for all processes on the system.
+// namespace entries in 'nsi' for all processes on the system. If 'ctx' is
+// canceled, the scan stops early, leaving the entries built so far.
+//
+// The PIDs are processed in batches of 'procBatchSize'. Within a batch, the
+// namespace symlinks of the processes are inspected in parallel (see
+// statProcessNamespaces()), and the results are then merged into 'nsi' in
+// PID order, so that the outcome is the same as for a sequential scan.
 
-func (nsi *NamespaceInfo) addNamespacesForAllProcesses(namespaces []string,
-	opts CmdLineOptions) {
+func (nsi *NamespaceInfo) addNamespacesForAllProcesses(ctx context.Context,
+	namespaces []string, opts CmdLineOptions) error {
+
+	// Process each /proc/PID.
+
+	var scanErr error
+	var batch []string
 
-	// Fetch a list of the filenames under /proc.
+	err := forEachPIDDir(opts.procfs, func(pid string) bool {
+		batch = append(batch, pid)
+		if len(batch) < procBatchSize {
+			return true
+		}
+
+		scanErr = nsi.addNamespacesForBatch(ctx, batch, namespaces,
+			opts)
+		batch = batch[:0]
 
-	procFiles, err := ioutil.ReadDir("/proc")
+		return scanErr == nil && ctx.Err() == nil
+	})
 	if err != nil {
-		fmt.Println("ioutil.Readdir():", err)
-		os.Exit(1)
+		return fmt.Errorf("scanning %s: %w", opts.procfs, err)
+	}
+	if scanErr == nil && ctx.Err() == nil {
+		scanErr = nsi.addNamespacesForBatch(ctx, batch, namespaces,
+			opts)
+	}
+	if scanErr != nil {
+		return scanErr
 	}
 
-	// Process each /proc/PID (PID starts with a digit).
+	logMessage(LOG_VERBOSE, "Scanned "+strconv.Itoa(nsi.stats.procDirs)+
+		" processes; found "+strconv.Itoa(len(nsi.nsList))+
+		" namespaces")
 
-	for _, f := range procFiles {
-		if f.Name()[0] >= '1' && f.Name()[0] <= '9' {
-			for _, nsFile := range namespaces {
-				nsi.addProcessNamespace(f.Name(),
-					nsFile, opts, false)
-			}
-		}
-	}
+	return nil
 }
 
-// printAllPIDsFor() looks up the 'NStgid' field in the /proc/PID/status
-// file of 'pid' and displays the set of PIDs contained in that field.
+// addPinnedNamespaces() adds to 'nsi' the namespaces that are pinned into
+// existence by nsfs bind mounts (found via /proc/self/mountinfo) or by file
+// descriptors that processes hold open on namespace files (found via
+// /proc/PID/fd), recording the mount point or /proc/PID/fd/N pathname as
+// pinning the namespace. Such namespaces may have no member processes. If
+// 'ctx' is canceled, the scan of /proc/PID/fd directories stops early.
 
-func printAllPIDsFor(pid int, opts CmdLineOptions) {
+func (nsi *NamespaceInfo) addPinnedNamespaces(ctx context.Context,
+	opts CmdLineOptions) error {
 
-	sfile := "/proc/" + strconv.Itoa(pid) + "/status"
+	var paths []string
 
-	file, err := os.Open(sfile)
+	buf, err := ioutil.ReadFile("/proc/self/mountinfo")
 	if err != nil {
-
-		// Probably, the process terminated between the time we
-		// accessed the namespace files and the time we tried to open
-		// /proc/PID/status. We print a diagnostic message and keep
-		// going.
-
-		fmt.Print("[can't open " + sfile + "]")
-		return
+		return fmt.Errorf("reading /proc/self/mountinfo: %w", err)
 	}
 
-	defer file.Close() // Close file on return from this function.
+	// Each line of mountinfo has the form:
+	//
+	//   ID PARENT-ID MAJ:MIN ROOT MOUNT-POINT OPTIONS [TAGS...] - FSTYPE ...
+	//
+	// See proc(5).
 
-	// Scan file line by line, looking for 'NStgid:' entry (not the
-	// misnamed 'NSpid' field!), and print the corresponding set of PIDs.
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
 
-	re := regexp.MustCompile(":[ \t]*")
-
-	s := bufio.NewScanner(file)
-	for s.Scan() {
-		match, _ := regexp.MatchString("^NStgid:", s.Text())
-		if match {
-			tokens := re.Split(s.Text(), -1)
-
-			if opts.useColor {
-				fmt.Print(PID_COLOR)
-			}
-			fmt.Print("{ ", tokens[1], " }")
-			if opts.useColor {
-				fmt.Print(NORMAL)
-			}
+		sep := 6
+		for sep < len(fields) && fields[sep] != "-" {
+			sep++
+		}
 
-			break
+		if len(fields) < 5 || sep+1 >= len(fields) ||
+			fields[sep+1] != "nsfs" {
+			continue
 		}
+
+		paths = append(paths, unescapeMountPath(fields[4]))
 	}
-}
 
-// Print a sorted list of the PIDs that are members of a namespace.
+	// A file descriptor refers to a namespace if the file that it refers
+	// to is on the nsfs filesystem, which we identify by its device ID.
 
-func displayMemberPIDs(indent string, pids []int, opts CmdLineOptions) {
+	var sb syscall.Stat_t
+	if err := syscall.Stat("/proc/self/ns/user", &sb); err != nil {
+		return fmt.Errorf("stat(/proc/self/ns/user): %w", err)
+	}
+	nsfsDev := sb.Dev
 
-	// If the namespace has no member PIDs, there's nothing to do. (This
-	// could happen if a parent namespace has no member processes, but has
-	// a child namespace that has a member process.)
+	// Our own PID, as seen in the PID namespace of 'opts.procfs', is given
+	// by its "self" symlink. (If 'opts.procfs' belongs to a PID namespace
+	// in which we aren't visible, the link can't be resolved, and none of
+	// the processes is us.)
 
-	if len(pids) == 0 {
-		return
+	self, err := os.Readlink(opts.procfs + "/self")
+	if err != nil {
+		self = ""
 	}
 
-	sort.Ints(pids)
+	err = forEachPIDDir(opts.procfs, func(pid string) bool {
+		dir := opts.procfs + "/" + pid + "/fd"
 
-	if opts.showCommand || opts.showAllPids {
-		displayPIDsOnePerLine(indent, pids, opts)
-	} else {
-		displayPIDsAsList(indent, pids, opts)
-	}
-}
+		// Skip our own file descriptors (perhaps inherited from the
+		// shell) and those of processes that terminated or that we
+		// lack permission to inspect.
 
-// displayPIDsOnePerLine() prints 'pids' in sorted order, one per line,
-// optionally with the name of the command being run by the process.  This
-// function is called because either 'opts.showCommand' or 'opts.showAllPids'
-// was true.
+		if pid == self {
+			return true
+		}
 
-func displayPIDsOnePerLine(indent string, pids []int, opts CmdLineOptions) {
+		f, err := os.Open(dir)
+		if err != nil {
+			logMessage(LOG_DEBUG, err)
+			return ctx.Err() == nil
+		}
+		fds, _ := f.Readdirnames(-1)
+		f.Close()
+
+		for _, fd := range fds {
+			var sb syscall.Stat_t
+			path := dir + "/" + fd
+			if syscall.Stat(path, &sb) == nil && sb.Dev == nsfsDev {
+				paths = append(paths, path)
+			}
+		}
 
-	for _, pid := range pids {
+		return ctx.Err() == nil
+	})
+	if err != nil {
+		return fmt.Errorf("scanning %s: %w", opts.procfs, err)
+	}
 
-		fmt.Print(indent + strings.Repeat(" ", 8))
+	for _, path := range paths {
+		if err := nsi.addPinnedNamespace(path, opts); err != nil {
+			return err
+		}
+	}
 
-		// If the "--show-all-pids" option was specified (which means
-		// that "--pidns" must also have been specified), then print
-		// all of the process's PIDs in each of the PID namespaces of
-		// which it is a member. Otherwise, print the PID in the
-		// current PID namespace.
+	return nil
+}
 
-		if opts.showAllPids {
-			printAllPIDsFor(pid, opts)
+// addPinnedNamespace() adds the namespace referred to by 'path' (a bind
+// mount or /proc/PID/fd/N), and its ancestors, to 'nsi', recording 'path' as
+// pinning the namespace. When only the PID namespace hierarchy is being
+// displayed, other types of namespace are ignored. Files that can't be
+// opened (for example, because the process that held the file descriptor
+// terminated) are reported, but are otherwise ignored.
 
-			if !opts.showCommand {
-				fmt.Println()
-			}
+func (nsi *NamespaceInfo) addPinnedNamespace(path string,
+	opts CmdLineOptions) error {
 
-		} else { // 'opts.showCommand' must be true
+	namespaceFD, err := syscall.Open(path, syscall.O_RDONLY, 0)
+	if err != nil {
+		logMessage(LOG_NORMAL, "Can't open pinned namespace "+path+
+			": "+err.Error())
+		return nil
+	}
+	defer syscall.Close(namespaceFD)
 
-			if opts.useColor {
-				fmt.Print(PID_COLOR)
-			}
-			fmt.Printf("%-5d", pid)
-			if opts.useColor {
-				fmt.Print(NORMAL)
-			}
+	nsi.stats.filesOpened++
+
+	if opts.showPidnsHierarchy {
+		nsType, err := namespaceType(namespaceFD)
+		nsi.stats.ioctls++
+		if err != nil || nsType != CLONE_NEWPID {
+			return nil
 		}
+	}
 
-		if opts.showCommand {
+	ns, err := nsi.addNamespace(namespaceFD, -1, opts)
+	if err != nil {
+		return withContext(err, "", path)
+	}
 
-			// Print the command being run by the process.
+	nsi.nsList[ns].pinnedBy = append(nsi.nsList[ns].pinnedBy,
+		escapeName(path))
 
-			commFile := "/proc/" + strconv.Itoa(pid) + "/comm"
+	return nil
+}
 
-			buf, err := ioutil.ReadFile(commFile)
-			if err != nil {
+// unescapeMountPath() converts the octal escapes (e.g., "\040" for a space)
+// that are used for special characters in the pathnames shown in
+// /proc/PID/mountinfo back into the characters that they represent.
 
-				// Probably, the process terminated between the
-				// time we accessed the namespace files and the
-				// time we tried to open /proc/PID/comm.
+func unescapeMountPath(path string) string {
 
-				fmt.Println("[can't open " + commFile + "]")
-			} else {
-				fmt.Print("  " + string(buf))
+	var result []byte
+
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			c, err := strconv.ParseUint(path[i+1:i+4], 8, 8)
+			if err == nil {
+				result = append(result, byte(c))
+				i += 3
+				continue
 			}
 		}
+		result = append(result, path[i])
 	}
+
+	return string(result)
 }
 
-// Discover width of terminal, so that we can format output suitably.
+// skippedWarning() returns a warning about the processes that were skipped
+// during a full scan because we lacked permission to inspect them, or ""
+// if no processes were skipped.
 
-func getTerminalWidth() int {
-	type winsize struct {
-		row    uint16
-		col    uint16
-		xpixel uint16
-		ypixel uint16
+func (nsi *NamespaceInfo) skippedWarning() string {
+	if nsi.permDenied == 0 {
+		return ""
 	}
-	var ws winsize
-
-	ret, _, _ := syscall.Syscall(syscall.SYS_IOCTL,
-		uintptr(syscall.Stdout), uintptr(syscall.TIOCGWINSZ),
-		uintptr(unsafe.Pointer(&ws)))
 
-	if int(ret) == -1 { // Call failed (perhaps stdout is not a terminal)
-		return 80
+	noun := " processes"
+	if nsi.permDenied == 1 {
+		noun = " process"
 	}
 
-	return int(ws.col)
+	return "Warning: " + strconv.Itoa(nsi.permDenied) + noun +
+		" skipped (permission denied)"
 }
 
-// colorEachLine() puts a terminal color sequence just before the first
-// non-white-space character in each line of 'buf', and places the terminal
-// sequence to return the terminal color to white at the end of each line.
-
-func colorEachLine(buf string, color string) string {
-	re := regexp.MustCompile(`( *)(.*)`)
-	return re.ReplaceAllString(buf, "$1"+color+"$2"+NORMAL)
-}
+// The number of /proc/PID directories whose namespace symlinks are
+// inspected in parallel before the results are merged.
 
-// Return wrapped version of text in 'text' by adding newline characters
-// on white space boundaries at most 'width' characters apart. Each
-// wrapped line is prefixed by the specified 'indent' (whose size is *not*
-// included as part of 'width' for the purpose of the wrapping algorithm).
+const procBatchSize = 512
 
-func wrapText(text string, width int, indent string) string {
+// addNamespacesForBatch() adds the namespaces of the processes whose PIDs
+// are in 'pids' to 'nsi'. If 'ctx' is canceled, the remaining processes in
+// the batch are skipped.
 
-	// Break up text on white space to produce a slice of words
+func (nsi *NamespaceInfo) addNamespacesForBatch(ctx context.Context,
+	pids []string, namespaces []string, opts CmdLineOptions) error {
 
-	words := strings.Fields(text)
+	ids := statProcessNamespaces(opts.procfs, pids, namespaces)
 
-	// If there were no words, return an empty string.
+	for i, pid := range pids {
+		if ctx.Err() != nil {
+			break
+		}
 
-	if len(words) == 0 {
-		return ""
-	}
+		if opts.noKthreads && isKernelThread(opts.procfs, pid) {
+			nsi.kthreads++
+			continue
+		}
 
-	result := indent + words[0]
-	col := len(words[0])
+		skipped := false
 
-	for _, word := range words[1:] {
-		if col+len(word)+1 > width { // Overflow ==> start on new line
-			result += "\n" + indent + word
-			col = len(word)
-		} else {
-			result += " " + word
-			col += 1 + len(word)
-		}
-	}
+		for j, nsFile := range namespaces {
 
-	return result
-}
+			// If the namespace is already known, we need only
+			// record that the process is a member. Otherwise
+			// (or if the stat() failed), we take the slow path of
+			// opening the namespace file, which also diagnoses
+			// any error.
 
-// displayPIDsAsList() prints the PIDs in 'pids' as a sorted list, with
-// multiple PIDs per line. We produce a list of PIDs that is suitably wrapped
-// and indented, rather than a long single-line list.  The output is targeted
-// for the terminal width, but even when deeply indenting, a minimum number of
-// characters is displayed on each line.
+			attribs, fnd := nsi.nsList[ids[i][j]]
+			if fnd && ids[i][j] != invisUserNS {
+				npid, _ := strconv.Atoi(pid)
+				attribs.pids = append(attribs.pids, npid)
+				continue
+			}
 
-func displayPIDsAsList(indent string, pids []int, opts CmdLineOptions) {
+			// Unless "--strict" was specified, a process whose
+			// namespace files we don't have permission to open
+			// is counted and skipped, rather than ending the scan.
 
-	// Even if deeply indenting, always display at least 'minDisplayWidth'
-	// characters on each line.
+			err := nsi.addProcessNamespace(pid, nsFile, opts, false)
+			if err != nil && !opts.strict &&
+				errors.Is(err, syscall.EACCES) {
+				logMessage(LOG_DEBUG, err)
+				skipped = true
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
 
-	const minDisplayWidth = 32
+		// The process may already have been recorded as a member of
+		// the namespaces whose files came before the one that we
+		// couldn't open; a skipped process is a member of none.
 
-	totalIndent := indent + strings.Repeat(" ", 8)
+		if skipped {
+			npid, _ := strconv.Atoi(pid)
+			nsi.dropMember(npid)
+			nsi.permDenied++
+			continue
+		}
 
-	outputWidth := getTerminalWidth() - len(totalIndent)
-	if outputWidth < minDisplayWidth {
-		outputWidth = minDisplayWidth
-	}
+		if opts.threads {
+			err := nsi.addThreadNamespaces(pid, namespaces, opts)
+			if err != nil {
+				return err
+			}
+		}
 
-	// Convert slice of ints to a string of space-delimited words
+		if opts.ownerUID >= 0 {
+			nsi.recordOwner(pid, opts)
+		}
 
-	res := "[ " + strconv.Itoa(pids[0])
-	for _, pid := range pids[1:] {
-		res += " " + strconv.Itoa(pid)
+		nsi.stats.procDirs++
 	}
-	res += " ]"
 
-	if opts.useColor {
-		fmt.Print(PID_COLOR)
-	}
+	return nil
+}
 
-	res = wrapText(res, outputWidth, totalIndent)
-	if opts.useColor {
-		res = colorEachLine(res, PID_COLOR)
-	}
+// dropMember() removes 'pid' from the member lists of all of the namespaces
+// in 'nsi'. Since members are appended to the lists as they are found, 'pid'
+// can only be the last member of each list.
 
-	fmt.Println(res)
+func (nsi *NamespaceInfo) dropMember(pid int) {
+	for _, attribs := range nsi.nsList {
+		n := len(attribs.pids)
+		if n > 0 && attribs.pids[n-1] == pid {
+			attribs.pids = attribs.pids[:n-1]
+		}
+	}
 }
 
-// displayNamespaceTree() recursively displays the namespace subtree inside
-// 'nsi.nsList' that is rooted at 'ns'.
+// The PF_KTHREAD bit in the 'flags' field of /proc/PID/stat, which marks a
+// kernel thread.
 
-func (nsi *NamespaceInfo) displayNamespaceTree(ns NamespaceID, level int,
-	opts CmdLineOptions) {
+const PF_KTHREAD = 0x00200000
 
-	// Display 'ns' if its type is one of those specified in
-	// 'opts.namespaces', but always display user namespaces.
+// isKernelThread() returns true if the process 'pid' is a kernel thread. We
+// check the PF_KTHREAD flag, rather than (say) looking for an empty
+// /proc/PID/cmdline, since the command line of a user process is also
+// momentarily empty while it is execing. A process whose stat file can't be
+// read (probably because it has terminated) is not a kernel thread.
 
-	if nsi.nsList[ns].nsType == CLONE_NEWUSER ||
-		nsi.nsList[ns].nsType&opts.namespaces != 0 {
+func isKernelThread(procfs string, pid string) bool {
 
-		nsi.displayNamespace(ns, level, opts)
+	buf, err := ioutil.ReadFile(procfs + "/" + pid + "/stat")
+	if err != nil {
+		return false
 	}
 
-	// Recursively display the child namespaces.
+	// The command name (field 2) is in parentheses and may contain
+	// spaces and parentheses, so we start after the last ')'. The
+	// following fields are state, ppid, pgrp, session, tty_nr, tpgid,
+	// and flags.
 
-	for _, child := range nsi.nsList[ns].children {
-		nsi.displayNamespaceTree(child, level+1, opts)
+	end := bytes.LastIndexByte(buf, ')')
+	if end < 0 {
+		return false
+	}
+
+	fields := strings.Fields(string(buf[end+1:]))
+	if len(fields) < 7 {
+		return false
 	}
+
+	flags, err := strconv.ParseUint(fields[6], 10, 64)
+	return err == nil && flags&PF_KTHREAD != 0
 }
 
-// Display the namespace node with the key 'ns'. 'level' is our current level
-// in the tree, and is used to produce suitably indented output.
+// recordOwner() records, for the "--user" and "--uid" options, the
+// effective UID of the process 'pid' (from the 'Uid' field of its
+// /proc/PID/status file) in 'nsi.owners'.
 
-func (nsi *NamespaceInfo) displayNamespace(ns NamespaceID, level int,
-	opts CmdLineOptions) {
+func (nsi *NamespaceInfo) recordOwner(pid string, opts CmdLineOptions) {
 
-	indent := strings.Repeat(" ", level*4)
+	npid, _ := strconv.Atoi(pid)
 
-	// Display the namespace type and ID (device ID + inode number).
+	if nsi.owners == nil {
+		nsi.owners = make(map[int]int)
+	}
 
-	colorUserNS := nsi.nsList[ns].nsType == CLONE_NEWUSER && opts.useColor
+	// If the process has already terminated, we can't say who owned it.
 
-	if colorUserNS {
-		fmt.Print(USERNS_COLOR)
+	ps, err := getProcStatus(opts.procfs, npid)
+	if err != nil {
+		nsi.owners[npid] = -1
+		return
 	}
 
-	if ns == invisUserNS {
-		fmt.Println("[invisible ancestor user NS]")
-	} else {
-		fmt.Print(indent+namespaceToStr[nsi.nsList[ns].nsType]+" ", ns)
+	nsi.owners[npid] = ps.uid
+}
 
-		// For user namespaces, display creator UID.
+// isShownOwner() returns true if the process 'pid' is to be displayed
+// according to the "--user" and "--uid" options; that is, if neither option
+// was specified, or if the process is owned by the specified user.
 
-		if nsi.nsList[ns].nsType == CLONE_NEWUSER {
-			fmt.Print(" <UID: ", nsi.nsList[ns].creatorUID)
-			if len(flag.Args()) == 0 {
-				fmt.Print(";  ")
-				fmt.Print("u: ", nsi.nsList[ns].uidMap, ";   ")
-				fmt.Print("g: ", nsi.nsList[ns].gidMap)
-			}
-			fmt.Print(">")
-		}
+func (nsi *NamespaceInfo) isShownOwner(pid int, opts CmdLineOptions) bool {
 
-		fmt.Println()
+	if opts.ownerUID < 0 {
+		return true
 	}
 
-	if colorUserNS {
-		fmt.Print(NORMAL)
+	uid, fnd := nsi.owners[pid]
+	return fnd && uid == opts.ownerUID
+}
+
+// hasOwnedProcesses() returns true if the namespace tree rooted at 'ns'
+// contains a member process (or thread) that is owned by the user specified
+// in the "--user" or "--uid" option.
+
+func (nsi *NamespaceInfo) hasOwnedProcesses(ns NamespaceID,
+	opts CmdLineOptions) bool {
+
+	for _, pid := range nsi.nsList[ns].pids {
+		if nsi.isShownOwner(pid, opts) {
+			return true
+		}
 	}
 
-	// Optionally display member PIDs for the namespace.
+	for _, t := range nsi.nsList[ns].threads {
+		if nsi.isShownOwner(t.pid, opts) {
+			return true
+		}
+	}
 
-	if opts.showPids {
-		displayMemberPIDs(indent, nsi.nsList[ns].pids, opts)
+	for _, child := range nsi.nsList[ns].children {
+		if nsi.hasOwnedProcesses(child, opts) {
+			return true
+		}
 	}
-}
 
-// displayNamespaceHierarchies() displays the namespace hierarchy/hierarchies
-// specified by the command-line options.
+	return false
+}
 
-func (nsi *NamespaceInfo) displayNamespaceHierarchies(opts CmdLineOptions) {
+// addThreadNamespaces() adds to 'nsi' the namespaces, among the nonuser,
+// non-PID namespaces named in 'namespaces', that threads of the process 'pid'
+// have joined with setns(2): that is, the namespaces of which a thread is a
+// member, but the process (i.e., its thread group leader) is not. Each such
+// thread is recorded as a member of the namespace. Threads that terminate
+// while we inspect them are silently skipped.
 
-	if opts.subtreePID == "" { // No "--subtree" option was specified
+func (nsi *NamespaceInfo) addThreadNamespaces(pid string,
+	namespaces []string, opts CmdLineOptions) error {
 
-		// Display the namespace tree rooted at the initial namespace.
+	taskDir := opts.procfs + "/" + pid + "/task"
 
-		nsi.displayNamespaceTree(nsi.rootNS, 0, opts)
+	d, err := os.Open(taskDir)
+	if err != nil {
+		return nil // The process terminated
+	}
+	tids, _ := d.Readdirnames(-1)
+	d.Close()
 
-		// Display the namespaces owned by (invisible) ancestor user
-		// namespaces.
+	npid, _ := strconv.Atoi(pid)
 
-		if _, fnd := nsi.nsList[invisUserNS]; fnd {
-			nsi.displayNamespaceTree(invisUserNS, 0, opts)
+	for _, tid := range tids {
+		if tid == pid {
+			continue // The thread group leader
 		}
 
-	} else {
+		for _, nsFile := range namespaces {
+			if nsFile == "user" || nsFile == "pid" {
+				continue // Shared by all threads
+			}
 
-		// Display subtree of the namespace hierarchy rooted at the
-		// namespace of the PID specified in the "--subtree" option.
+			var psb, tsb syscall.Stat_t
 
-		nsFile := "user"
-		if opts.showPidnsHierarchy {
-			nsFile = "pid"
-		}
+			procPath := opts.procfs + "/" + pid + "/ns/" + nsFile
+			path := taskDir + "/" + tid + "/ns/" + nsFile
+			if syscall.Stat(procPath, &psb) != nil ||
+				syscall.Stat(path, &tsb) != nil {
+				continue
+			}
 
-		namespaceFD := openNamespaceSymlink(opts.subtreePID, nsFile)
+			if psb.Dev == tsb.Dev && psb.Ino == tsb.Ino {
+				continue
+			}
 
-		nsi.displayNamespaceTree(newNamespaceID(namespaceFD), 0, opts)
+			namespaceFD, err := syscall.Open(path,
+				syscall.O_RDONLY, 0)
+			if err != nil {
+				continue
+			}
+			nsi.stats.filesOpened++
 
-		syscall.Close(namespaceFD)
+			ns, err := nsi.addNamespace(namespaceFD, -1, opts)
+			syscall.Close(namespaceFD)
+			if err != nil {
+				return withContext(err, pid, path)
+			}
+
+			ntid, _ := strconv.Atoi(tid)
+			nsi.nsList[ns].threads = append(nsi.nsList[ns].threads,
+				threadID{npid, ntid})
+		}
 	}
+
+	return nil
 }
 
-// openNamespaceSymlink() opens a user or PID namespace symlink (specified in
-// 'nsFile') for the process with the specified 'pid' and returns the resulting
-// file descriptor.
+// statProcessNamespaces() uses stat() to obtain the IDs of the namespaces
+// named in 'namespaces' for each of the processes in 'pids' (whose PID
+// directories are in 'procfs'). Element [i][j] of the returned slice is the
+// ID of namespace 'namespaces[j]' of process 'pids[i]', or the zero ID if
+// the stat() failed. Since most processes are members of namespaces that
+// have already been seen, this is the bulk of the work of scanning /proc,
+// and it is shared among GOMAXPROCS goroutines.
 
-func openNamespaceSymlink(pid string, nsFile string) int {
+func statProcessNamespaces(procfs string, pids []string,
+	namespaces []string) [][]NamespaceID {
 
-	symlinkPath := "/proc/" + pid + "/ns/" + nsFile
+	ids := make([][]NamespaceID, len(pids))
+	next := int32(-1)
 
-	namespaceFD, err := syscall.Open(symlinkPath, syscall.O_RDONLY, 0)
+	var wg sync.WaitGroup
 
-	if namespaceFD < 0 {
-		fmt.Println("Error finding namespace subtree for PID"+
-			pid+":", err)
-		os.Exit(1)
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				i := int(atomic.AddInt32(&next, 1))
+				if i >= len(pids) {
+					return
+				}
+
+				ids[i] = make([]NamespaceID, len(namespaces))
+				for j, nsFile := range namespaces {
+					ids[i][j], _ = nsOps.stat(procfs + "/" +
+						pids[i] + "/ns/" + nsFile)
+				}
+			}
+		}()
 	}
 
-	return namespaceFD
+	wg.Wait()
+
+	return ids
 }
 
-// showUsageAndExit() prints a command-line usage message for this program and
-// terminates the program with the specified 'status' value.
+// forEachPIDDir() calls 'fn' with the name of each PID directory under 'dir'.
+// The directory is read in batches, rather than being read (and sorted) in
+// its entirety before the first PID is processed, since on a large system
+// it may contain very many entries. The PIDs are thus processed in the order
+// in which the kernel returns them. If 'fn' returns false, no further PIDs
+// are processed.
 
-func showUsageAndExit(status int) {
-	fmt.Println(
-		`Usage: namespaces_of [options] [--subtree=<pid> | <pid>...]
+func forEachPIDDir(dir string, fn func(name string) bool) error {
 
-Show the namespace memberships of one or more processes in the context of the
-user or PID namespace hierarchy.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
 
-This program does one of the following:
-* If provided with one or more PID command-line arguments, the program shows
-  the namespace memberships of those processes.
-* Otherwise, if the '--subtree=<pid>' option is specified, then the program
-  shows the subtree of the user or PID namespace hierarchy that is rooted at
-  the namespace of the specified PID.
-* Otherwise, the program shows the namespace memberships of all processes on
-  the system.
+	defer d.Close()
 
-By default, the program shows namespace memberships in the context of the user
-namespace hierarchy, showing also the nonuser namespaces owned by each user
-namespace. If the '--pidns' option is specified, the program shows only
-the PID namespace hierarchy, omitting other types of namespace.
+	for {
+		names, err := d.Readdirnames(512)
 
-Options:
+		for _, name := range names {
+			if name[0] >= '1' && name[0] <= '9' {
+				if !fn(name) {
+					return nil
+				}
+			}
+		}
 
---all-pids	For each displayed process, show PIDs in all namespaces of
-		which the process is a member (used only in conjunction with
-		'--pidns').
---namespaces=<list>
-		Show just the listed namespace types when displaying the
-		user namespace hierarchy. <list> is a comma-separated list
-		containing one or more of "cgroup", "ipc", "mnt", "net",
-		"pid", "user", and "uts". (The default is to include all
-		nonuser namespace types in the display of the user namespace
-		hierarchy.) To see just the user namespace hierarchy, use
-		"--namespaces=user".
---no-color	Suppress the use of color in the displayed output.
---no-pids	Suppress the display of the processes that are members
-		of each namespace.
---pidns         Display the PID namespace hierarchy (rather than the user
-		namespace hierarchy).
---show-comm	Displays the command being run by each process.
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
 
-Syntax notes:
-* No PID command-line arguments may be supplied when using '--subtree=<pid>'.
-* At most one of '--namespaces' and '--pidns' may be specified.
-* '--all-pids' can be specified only in conjunction with '--pidns'.
-* '--no-pids' can't be specified in conjunction with either '--show-comm'
-  or '--all-pids'.`)
+// For each process whose /proc/PID/status file we have parsed, we record
+// the fields of that file that are of interest to us.
 
-	os.Exit(status)
+type procStatus struct {
+	nstgid []int // PIDs in each PID namespace ('NStgid' field)
+	uid    int   // Effective UID ('Uid' field)
 }
 
-// parseCmdLineOptions() parses command-line options and returns them
-// conveniently packaged in a structure.
-
-func parseCmdLineOptions() CmdLineOptions {
+// The parsed status file of each process, cached so that the file is read
+// at most once per process in each scan. ("--watch" empties the cache before
+// each rescan.)
 
-	var opts CmdLineOptions
+var statusCache = make(map[int]*procStatus)
 
-	// Parse command-line options.
+// A regular expression used to split a /proc/PID/status line into the field
+// name and the field value.
 
-	helpPtr := flag.Bool("help", false, "Show detailed usage message")
-	noColorPtr := flag.Bool("no-color", false,
-		"Don't use color in output display")
-	noPidsPtr := flag.Bool("no-pids", false,
-		"Don't show PIDs that are members of each namespace")
-	showCommandPtr := flag.Bool("show-comm", false,
-		"Show command run by each PID")
-	allPidsPtr := flag.Bool("all-pids", false,
-		"Show all PIDs of each process")
-	pidnsPtr := flag.Bool("pidns", false, "Show PID "+
-		"namespace hierarchy (instead of user namespace hierarchy)")
-	subtreePtr := flag.String("subtree", "", "Show namespace subtree "+
-		"rooted at namespace of specified process")
-	namespacesPtr := flag.String("namespaces", "", "Show just the "+
-		"specified namespaces")
+var statusFieldSepRE = regexp.MustCompile(":[ \t]*")
 
-	flag.Parse()
+// getProcStatus() returns the fields of interest from the /proc/PID/status
+// file of 'pid'. The whole file is read before any of it is parsed. If the
+// file has no 'NStgid' field (before Linux 4.1), the returned 'nstgid' is
+// empty.
 
-	opts.useColor = !*noColorPtr
-	opts.showPids = !*noPidsPtr
-	opts.showPidnsHierarchy = *pidnsPtr
-	opts.showCommand = *showCommandPtr
-	opts.showAllPids = *allPidsPtr
-	opts.subtreePID = *subtreePtr
+func getProcStatus(procfs string, pid int) (*procStatus, error) {
 
-	if *helpPtr {
-		showUsageAndExit(0)
+	if ps, fnd := statusCache[pid]; fnd {
+		return ps, nil
 	}
 
-	if *namespacesPtr != "" && opts.showPidnsHierarchy {
-		fmt.Println("'--namespaces=<list>' can't be specified " +
-			"with '--pidns'")
-		showUsageAndExit(1)
+	buf, err := readFile(procfs + "/" + strconv.Itoa(pid) + "/status")
+	if err != nil {
+		return nil, err
 	}
 
-	if opts.showAllPids && !opts.showPidnsHierarchy {
-		fmt.Println("'--all-pids' can be specified only with '--pidns'")
-		showUsageAndExit(1)
-	}
+	// Scan file line by line, looking for the 'NStgid:' entry (not the
+	// misnamed 'NSpid' field!) and the 'Uid:' entry, whose second field
+	// is the effective UID.
 
-	if !opts.showPids && (opts.showCommand || opts.showAllPids) {
-		fmt.Println("'--no-pids' can't be combined with " +
-			"'--show-comm' or '--all-pids'")
-		showUsageAndExit(1)
-	}
+	ps := &procStatus{}
 
-	if opts.subtreePID != "" && len(flag.Args()) > 0 {
-		fmt.Println("No PID arguments may specified in combination " +
-			"with the '--subtree=<pid>' option")
-		showUsageAndExit(1)
+	s := bufio.NewScanner(bytes.NewReader(buf))
+	for s.Scan() {
+		if strings.HasPrefix(s.Text(), "NStgid:") {
+			tokens := statusFieldSepRE.Split(s.Text(), 2)
+			for _, f := range strings.Fields(tokens[1]) {
+				p, _ := strconv.Atoi(f)
+				ps.nstgid = append(ps.nstgid, p)
+			}
+		} else if strings.HasPrefix(s.Text(), "Uid:") {
+			fields := strings.Fields(s.Text())
+			if len(fields) > 2 {
+				ps.uid, _ = strconv.Atoi(fields[2])
+			}
+		}
 	}
 
-	// If "--namespaces=<list>" was specified, parse list of namespaces
-	// to display, by tokenizing <list> on comma delimiters, finding each
-	// token string in 'namespaceToStr', and adding corresponding key
-	// (a CLONE_NEW* value) to 'opts.namespaces'.
+	statusCache[pid] = ps
 
-	list := allNamespaceSymlinkNames // Default is all namespaces
+	return ps, nil
+}
 
-	if *namespacesPtr != "" {
-		list = strings.Split(*namespacesPtr, ",")
+// namespacePIDs() returns the PIDs of the process 'pid' in each of the PID
+// namespaces of which it is a member (from the 'NStgid' field of its
+// /proc/PID/status file), starting with the PID namespace of the procfs
+// mount and ending with the PID namespace of the process itself.
+
+func namespacePIDs(procfs string, pid int) ([]int, error) {
+
+	ps, err := getProcStatus(procfs, pid)
+	if err != nil {
+		return nil, err
 	}
 
-	opts.namespaces = 0
+	return ps.nstgid, nil
+}
 
-	for _, nsName := range list {
-		nsFlag := 0
-		for k, v := range namespaceToStr {
-			if v == nsName {
-				nsFlag = k
-			}
-		}
+// printAllPIDsFor() looks up the 'NStgid' field in the /proc/PID/status
+// file of 'pid' and displays the set of PIDs contained in that field. The
+// displayed text (without any color escapes) is returned. If the file has
+// no 'NStgid' field, nothing is displayed.
 
-		if nsFlag == 0 {
-			fmt.Println("Bad namespace for --namespaces " +
-				"option: " + nsName)
-			showUsageAndExit(1)
-		}
+func printAllPIDsFor(pid int, opts CmdLineOptions) string {
 
-		opts.namespaces |= nsFlag
-	}
+	nspids, err := namespacePIDs(opts.procfs, pid)
+	if err != nil {
 
-	return opts
-}
+		// Probably, the process terminated between the time we
+		// accessed the namespace files and the time we tried to open
+		// /proc/PID/status. We print a diagnostic message and keep
+		// going.
 
-// Read the contents of the UID or GID map of the process with the specified
-// 'pid'. ''mapName' is either "uid_map" or "gid_map". The returned string
-// contains the map with white space compressed.
+		msg := "[can't open " + opts.procfs + "/" + strconv.Itoa(pid) +
+			"/status]"
+		fmt.Fprint(output, msg)
+		return msg
+	}
 
-func readMap(pid int, mapName string) (bool, string) {
+	if len(nspids) == 0 {
+		return ""
+	}
 
-	mapFile := "/proc/" + strconv.Itoa(pid) + "/" + mapName
+	// The PIDs are separated by tabs, as in the status file itself.
 
-	buf, err := ioutil.ReadFile(mapFile)
-	if err != nil {
+	pids := make([]string, len(nspids))
+	for i, p := range nspids {
+		pids[i] = strconv.Itoa(p)
+	}
 
-		// Probably, the process terminated between the
-		// time we accessed the namespace files and the
-		// time we tried to open the map file.
+	text := "{ " + strings.Join(pids, "\t") + " }"
 
-		return false, "deleted"
-	} else {
-		space := regexp.MustCompile(`\s+`)
-		return true, space.ReplaceAllString(strings.TrimSpace(string(buf)), " ")
+	if opts.useColor {
+		fmt.Fprint(output, PID_COLOR)
+	}
+	fmt.Fprint(output, text)
+	if opts.useColor {
+		fmt.Fprint(output, NORMAL)
 	}
 
+	return text
 }
 
-// Add UID and GID maps for all of the user namespaces in 'nsi'
+// Print a sorted list of the PIDs that are members of a namespace, followed
+// by the member threads (in "pid/tid" form) found by the "--threads" option.
+// Each line is prefixed by 'indent', which may include tree-drawing
+// characters (see displayNamespaceTree()). If 'initPID' is nonzero, it is
+// the init process of a PID namespace, and is listed first, marked
+// "(init)". If 'note' is not empty, it is displayed at the end of the list.
 
-func (nsi *NamespaceInfo) addUidGidPMaps() {
+func displayMemberPIDs(indent string, pids []int, threads []threadID,
+	initPID int, note string, opts CmdLineOptions) {
 
-	for _, ns := range nsi.nsList {
-		if ns.nsType == CLONE_NEWUSER {
-			ns.uidMap = "deleted"
+	// If the namespace has no member PIDs, there's nothing to do. (This
+	// could happen if a parent namespace has no member processes, but has
+	// a child namespace that has a member process.)
+
+	if len(pids) == 0 && len(threads) == 0 {
+		if note != "" {
+			fmt.Fprintln(output, indent+note)
+		}
+		return
+	}
+
+	sort.Slice(pids, func(i, j int) bool {
+		if pids[i] == initPID || pids[j] == initPID {
+			return pids[i] == initPID && pids[j] != initPID
+		}
+		return pids[i] < pids[j]
+	})
+	sort.Slice(threads, func(i, j int) bool {
+		if threads[i].pid != threads[j].pid {
+			return threads[i].pid < threads[j].pid
+		}
+		return threads[i].tid < threads[j].tid
+	})
+
+	if opts.showCommand || opts.showAllPids {
+		displayPIDsOnePerLine(indent, pids, threads, initPID, opts)
+		if note != "" {
+			fmt.Fprintln(output, indent+note)
+		}
+	} else {
+		displayPIDsAsList(indent, pids, threads, initPID, note, opts)
+	}
+}
+
+// displayPIDsOnePerLine() prints 'pids', and then 'threads', in sorted order,
+// one per line, optionally with the name of the command being run by the
+// process or thread.  This function is called because either
+// 'opts.showCommand' or 'opts.showAllPids' was true. (Since "--threads" can't
+// be combined with "--pidns", 'threads' is empty if 'opts.showAllPids' is
+// true.)
+
+func displayPIDsOnePerLine(indent string, pids []int, threads []threadID,
+	initPID int, opts CmdLineOptions) {
+
+	// 'col' tracks the terminal column reached on each line, so that a
+	// command line can be truncated to fit the remaining width.
+
+	for _, pid := range pids {
+
+		fmt.Fprint(output, indent)
+		col := visibleWidth(indent)
+
+		// If the "--show-all-pids" option was specified (which means
+		// that "--pidns" must also have been specified), then print
+		// all of the process's PIDs in each of the PID namespaces of
+		// which it is a member. Otherwise, print the PID in the
+		// current PID namespace.
+
+		if opts.showAllPids {
+			col = columnAfter(col, printAllPIDsFor(pid, opts))
+		} else { // 'opts.showCommand' must be true
+
+			field := fmt.Sprintf("%-5d", pid)
+			if opts.useColor {
+				fmt.Fprint(output, PID_COLOR)
+			}
+			fmt.Fprint(output, field)
+			if opts.useColor {
+				fmt.Fprint(output, NORMAL)
+			}
+			col += len(field)
+		}
+
+		if pid == initPID {
+			if opts.useColor {
+				fmt.Fprint(output,
+					" "+INIT_COLOR+"(init)"+NORMAL)
+			} else {
+				fmt.Fprint(output, " (init)")
+			}
+			col += len(" (init)")
+		}
+
+		if !opts.showCommand {
+			fmt.Fprintln(output)
+		}
+
+		if opts.showCommand {
+			displayCommand(opts.procfs+"/"+strconv.Itoa(pid), col,
+				opts)
+		}
+	}
+
+	for _, t := range threads {
+		fmt.Fprint(output, indent)
+
+		field := fmt.Sprintf("%-5s", t)
+		if opts.useColor {
+			fmt.Fprint(output, PID_COLOR)
+		}
+		fmt.Fprint(output, field)
+		if opts.useColor {
+			fmt.Fprint(output, NORMAL)
+		}
+
+		displayCommand(opts.procfs+"/"+strconv.Itoa(t.pid)+"/task/"+
+			strconv.Itoa(t.tid), visibleWidth(indent)+len(field),
+			opts)
+	}
+}
+
+// Even on a narrow terminal, at least this many columns of a command line
+// are displayed.
+
+const minCommandWidth = 16
+
+// displayCommand() prints the command being run by the process (or thread)
+// whose /proc directory is 'dir', and terminates the output line. 'col' is
+// the terminal column that the line has reached. If the "--show-cmdline"
+// option was specified, the full command line is shown, truncated to fit
+// 'opts.width' (if that is nonzero); otherwise the command name is shown.
+
+func displayCommand(dir string, col int, opts CmdLineOptions) {
+
+	if !opts.showCmdline {
+		displayComm(dir + "/comm")
+		return
+	}
+
+	cmd := processCommand(dir)
+
+	if opts.width > 0 {
+		avail := opts.width - col - 2
+		if avail < minCommandWidth {
+			avail = minCommandWidth
+		}
+		cmd = truncateText(cmd, avail)
+	}
+
+	fmt.Fprintln(output, "  "+cmd)
+}
+
+// displayComm() prints the command name in 'commFile' (a /proc/PID/comm or
+// /proc/PID/task/TID/comm file), and terminates the output line.
+
+func displayComm(commFile string) {
+
+	buf, err := readFile(commFile)
+	if err != nil {
+
+		// Probably, the process terminated between the time we
+		// accessed the namespace files and the time we tried to open
+		// the comm file.
+
+		fmt.Fprintln(output, "[can't open "+commFile+"]")
+	} else {
+		comm := strings.TrimSuffix(string(buf), "\n")
+		fmt.Fprintln(output, "  "+escapeName(comm))
+	}
+}
+
+// columnAfter() returns the terminal column reached by displaying 's' starting
+// at column 'col', taking account of tab stops (every eight columns).
+
+func columnAfter(col int, s string) int {
+	for _, r := range s {
+		if r == '\t' {
+			col = (col/8 + 1) * 8
+		} else {
+			col += runeWidth(r)
+		}
+	}
+	return col
+}
+
+// truncateText() returns 's' truncated so that it occupies at most 'width'
+// terminal columns, using an ellipsis to indicate that truncation occurred.
+// 's' is cut only between characters, and a character is never separated
+// from any combining marks that follow it.
+
+func truncateText(s string, width int) string {
+
+	if visibleWidth(s) <= width {
+		return s
+	}
+
+	result := ""
+	col := 0
+	for _, r := range s {
+		w := runeWidth(r)
+		if col+w > width-1 { // Leave room for the ellipsis
+			break
+		}
+		result += string(r)
+		col += w
+	}
+
+	return result + "…"
+}
+
+// isTerminal() returns true if the file descriptor 'fd' refers to
+// a terminal.
+
+func isTerminal(fd int) bool {
+	var t syscall.Termios
+
+	_, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		uintptr(syscall.TCGETS), uintptr(unsafe.Pointer(&t)))
+
+	return err == 0
+}
+
+// getTerminalWidth() returns the width of the terminal, so that we can
+// format output suitably. If the width can't be determined (perhaps
+// because stdout is not a terminal), the width given by the COLUMNS
+// environment variable is returned, or, failing that, 'fallback'.
+
+func getTerminalWidth(fallback int) int {
+	type winsize struct {
+		row    uint16
+		col    uint16
+		xpixel uint16
+		ypixel uint16
+	}
+	var ws winsize
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL,
+		uintptr(syscall.Stdout), uintptr(syscall.TIOCGWINSZ),
+		uintptr(unsafe.Pointer(&ws)))
+
+	if errno != 0 || ws.col == 0 {
+		cols, err := strconv.Atoi(os.Getenv("COLUMNS"))
+		if err != nil || cols <= 0 {
+			return fallback
+		}
+		return cols
+	}
+
+	return int(ws.col)
+}
+
+// colorEachLine() puts a terminal color sequence just before the first
+// character in each line of 'buf' that is neither white space nor a
+// tree-drawing character, and places the terminal
+// sequence to return the terminal color to white at the end of each line.
+// Any color resets already present in a line are followed by 'color', so
+// that the rest of the line is still displayed in 'color'.
+
+func colorEachLine(buf string, color string) string {
+	lines := strings.Split(buf, "\n")
+
+	for i, line := range lines {
+		text := strings.TrimLeft(line, treeChars)
+		if text == "" {
+			continue
+		}
+
+		spaces := line[:len(line)-len(text)]
+		text = strings.Replace(text, NORMAL, NORMAL+color, -1)
+		lines[i] = spaces + color + text + NORMAL
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// An expression that matches terminal escape sequences.
+
+var escapeSeqRE = regexp.MustCompile(ESC + `(\[[0-9;?]*[@-~]|[()][0-9A-Z])`)
+
+// visibleWidth() returns the number of terminal columns occupied by 's',
+// ignoring any terminal escape sequences.
+
+func visibleWidth(s string) int {
+	width := 0
+	for _, r := range escapeSeqRE.ReplaceAllString(s, "") {
+		width += runeWidth(r)
+	}
+	return width
+}
+
+// Ranges of characters that occupy two terminal columns: the East Asian
+// Wide and Fullwidth characters (see Unicode Standard Annex #11) and the
+// emoji. The table covers the commonly used blocks, rather than being
+// exhaustive.
+
+var wideRanges = [][2]rune{
+	{0x1100, 0x115F},   // Hangul Jamo initial consonants
+	{0x2E80, 0x303E},   // CJK radicals, symbols and punctuation
+	{0x3041, 0x33FF},   // Hiragana, Katakana, ..., CJK compatibility
+	{0x3400, 0x4DBF},   // CJK unified ideographs extension A
+	{0x4E00, 0x9FFF},   // CJK unified ideographs
+	{0xA000, 0xA4CF},   // Yi
+	{0xAC00, 0xD7A3},   // Hangul syllables
+	{0xF900, 0xFAFF},   // CJK compatibility ideographs
+	{0xFE30, 0xFE4F},   // CJK compatibility forms
+	{0xFF00, 0xFF60},   // Fullwidth forms
+	{0xFFE0, 0xFFE6},   // Fullwidth signs
+	{0x1F300, 0x1F64F}, // Pictographs and emoticons
+	{0x1F900, 0x1F9FF}, // Supplemental symbols and pictographs
+	{0x20000, 0x3FFFD}, // CJK unified ideographs extension B onward
+}
+
+// runeWidth() returns the number of terminal columns occupied by 'r': 0 for
+// combining marks and other zero-width characters, 2 for wide characters
+// (see 'wideRanges'), and 1 for everything else.
+
+func runeWidth(r rune) int {
+	if unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf) {
+		return 0
+	}
+
+	for _, wr := range wideRanges {
+		if r >= wr[0] && r <= wr[1] {
+			return 2
+		}
+	}
+
+	return 1
+}
+
+// escapeName() returns a copy of 'name' (a command name or a cgroup
+// pathname) in which control characters are replaced by C-style escapes,
+// so that they can't disturb the layout of the output or the terminal.
+
+func escapeName(name string) string {
+	var b strings.Builder
+
+	for _, r := range name {
+		switch {
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case unicode.IsControl(r):
+			fmt.Fprintf(&b, `\x%02x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+// splitWord() breaks 'word' into pieces that each have a visible width of
+// at most 'width' columns. Words are split only between characters (and not
+// before a combining mark), and terminal escape sequences are never split.
+
+func splitWord(word string, width int) []string {
+	var pieces []string
+	piece := ""
+	col := 0
+
+	for word != "" {
+		if strings.HasPrefix(word, ESC) {
+			loc := escapeSeqRE.FindStringIndex(word)
+			if loc != nil && loc[0] == 0 {
+				piece += word[:loc[1]]
+				word = word[loc[1]:]
+				continue
+			}
+		}
+
+		r, size := utf8.DecodeRuneInString(word)
+		w := runeWidth(r)
+
+		if col > 0 && col+w > width {
+			pieces = append(pieces, piece)
+			piece = ""
+			col = 0
+		}
+
+		piece += word[:size]
+		word = word[size:]
+		col += w
+	}
+
+	return append(pieces, piece)
+}
+
+// Return wrapped version of text in 'text' by adding newline characters
+// on white space boundaries at most 'width' characters apart. Each
+// wrapped line is prefixed by the specified 'indent' (whose size is *not*
+// included as part of 'width' for the purpose of the wrapping algorithm).
+// The first line of output is additionally prefixed by the string in 'prefix',
+// and subsequent lines are also additionally prefixed by an equal amount of
+// white space; the size of 'prefix' *is* included as part of 'width'. Widths
+// are measured with visibleWidth(), and a word that is longer than the
+// available width is broken across as many lines as are needed.
+
+func wrapText(text string, prefix string, width int, indent string) string {
+
+	// Break up text on white space to produce a slice of words.
+
+	words := strings.Fields(text)
+
+	// If there were no words, return an empty string.
+
+	if len(words) == 0 {
+		return ""
+	}
+
+	result := indent + prefix
+	col := -1 // No words yet on the current line
+	width -= visibleWidth(prefix)
+	if width < 1 {
+		width = 1
+	}
+	indent += strings.Repeat(" ", visibleWidth(prefix))
+
+	for _, word := range words {
+		for _, piece := range splitWord(word, width) {
+			w := visibleWidth(piece)
+			if col < 0 { // First word of output
+				result += piece
+				col = w
+			} else if col+w+1 > width { // Overflow ==> new line
+				result += "\n" + indent + piece
+				col = w
+			} else {
+				result += " " + piece
+				col += 1 + w
+			}
+		}
+	}
+
+	return result
+}
+
+// displayPIDsAsList() prints the PIDs in 'pids', followed by the threads in
+// 'threads', as a sorted list, with multiple PIDs per line. We produce a list
+// of PIDs that is suitably wrapped and indented, rather than a long
+// single-line list.  The output is targeted for 'opts.width', but even when
+// deeply indenting, a minimum number of characters is displayed on each line.
+// If 'opts.width' is 0, the list is displayed on a single line. A nonempty
+// 'note' is appended to the list.
+
+func displayPIDsAsList(indent string, pids []int, threads []threadID,
+	initPID int, note string, opts CmdLineOptions) {
+
+	// Even if deeply indenting, always display at least 'minDisplayWidth'
+	// characters on each line.
+
+	const minDisplayWidth = 32
+
+	outputWidth := math.MaxInt32
+	if opts.width > 0 {
+		outputWidth = opts.width - visibleWidth(indent)
+		if outputWidth < minDisplayWidth {
+			outputWidth = minDisplayWidth
+		}
+	}
+
+	// Convert slice of ints to a string of space-delimited words
+
+	res := "["
+	for _, pid := range pids {
+		res += " " + strconv.Itoa(pid)
+		if pid == initPID {
+			res += " (init)"
+		}
+	}
+	for _, t := range threads {
+		res += " " + t.String()
+	}
+	res += " ]"
+	if note != "" {
+		res += " " + note
+	}
+
+	res = wrapText(res, "", outputWidth, indent)
+	if opts.useColor {
+		res = colorEachLine(res, PID_COLOR)
+	}
+
+	fmt.Fprintln(output, res)
+}
+
+// displayNamespaceTree() recursively displays the namespace subtree inside
+// 'nsi.nsList' that is rooted at 'ns'. 'level' is our current level in the
+// tree. 'linePrefix' is displayed before the namespace itself, and
+// 'childPrefix' before each line that follows it (its member PIDs, and the
+// lines of its subtree). Without "--tree", both prefixes are simply
+// indentation; with "--tree", they also include the connecting lines, and
+// the vertical line for an ancestor is continued only if that ancestor has
+// further children still to be displayed.
+
+func (nsi *NamespaceInfo) displayNamespaceTree(ns NamespaceID, level int,
+	linePrefix string, childPrefix string, opts CmdLineOptions) {
+
+	if nsi.isPruned(ns, level, opts) {
+		return
+	}
+
+	children := nsi.shownChildren(ns, level, opts)
+
+	style, drawTree := treeStyles[opts.tree]
+
+	if nsi.isDisplayed(ns, opts) {
+		pidIndent := childPrefix + strings.Repeat(" ", 8)
+		if drawTree && len(children) > 0 {
+			pidIndent = childPrefix + style.vertical +
+				strings.Repeat(" ", 4)
+		}
+
+		nsi.displayNamespace(ns, linePrefix, pidIndent, opts)
+	}
+
+	// Recursively display the child namespaces.
+
+	for i, child := range children {
+		if !drawTree {
+			indent := childPrefix + strings.Repeat(" ", 4)
+			nsi.displayNamespaceTree(child, level+1, indent, indent,
+				opts)
+		} else if i < len(children)-1 {
+			nsi.displayNamespaceTree(child, level+1,
+				childPrefix+style.branch,
+				childPrefix+style.vertical, opts)
+		} else {
+			nsi.displayNamespaceTree(child, level+1,
+				childPrefix+style.last,
+				childPrefix+style.space, opts)
+		}
+	}
+}
+
+// isPruned() returns true if the subtree rooted at 'ns', at 'level' in the
+// tree, is not to be displayed at all.
+
+func (nsi *NamespaceInfo) isPruned(ns NamespaceID, level int,
+	opts CmdLineOptions) bool {
+
+	// With "--changed-only", subtrees that contain nothing but initial
+	// namespaces and their (unchanged) members are pruned, except that
+	// the root of the tree is always displayed, as context.
+
+	if opts.changedOnly && (level > 0 || ns == invisUserNS) &&
+		!nsi.hasChanges(ns, opts) {
+		return true
+	}
+
+	// Likewise, with "--user" or "--uid", subtrees that contain none of
+	// the specified user's processes are pruned.
+
+	if opts.ownerUID >= 0 && (level > 0 || ns == invisUserNS) &&
+		!nsi.hasOwnedProcesses(ns, opts) {
+		return true
+	}
+
+	// With "--nonempty", subtrees that have no member processes are
+	// pruned; with "--empty-only", subtrees that contain no such
+	// empty subtree are pruned.
+
+	if opts.nonempty && !nsi.nonempty[ns] {
+		return true
+	}
+
+	if opts.emptyOnly && !nsi.hasEmptyNamespaces(ns, opts) {
+		return true
+	}
+
+	// A subtree that contains no displayed namespaces (because of
+	// "--namespaces") produces no output.
+
+	if nsi.isDisplayed(ns, opts) {
+		return false
+	}
+
+	return len(nsi.shownChildren(ns, level, opts)) == 0
+}
+
+// shownChildren() returns the children of the namespace 'ns' (which is at
+// 'level' in the tree) whose subtrees produce some output. (With "--tree",
+// we need to know which child is displayed last.)
+
+func (nsi *NamespaceInfo) shownChildren(ns NamespaceID, level int,
+	opts CmdLineOptions) []NamespaceID {
+
+	var children []NamespaceID
+
+	for _, child := range nsi.nsList[ns].children {
+		if !nsi.isPruned(child, level+1, opts) {
+			children = append(children, child)
+		}
+	}
+
+	return children
+}
+
+// findChangedProcesses() records, for the "--changed-only" option, the
+// initial namespaces (those of PID 1) in 'nsi.initialNS', and the processes
+// that are members of at least one other (displayed) namespace in
+// 'nsi.changedPIDs'.
+
+func (nsi *NamespaceInfo) findChangedProcesses(opts CmdLineOptions) error {
+
+	nsi.initialNS = make(map[NamespaceID]bool)
+
+	// Usually, PID 1 was scanned, and the initial namespaces are those of
+	// which it is a member. Otherwise (if PIDs were named on the command
+	// line), we stat() its namespace files. An unprivileged user can do
+	// neither, since PID 1 belongs to root; in that case (or when
+	// replaying a snapshot), we use the namespaces of the lowest-numbered
+	// process that was scanned, which is one of the first processes
+	// started on the system.
+
+	refPID := 1
+
+	if !nsi.isMember(refPID) {
+		err := nsi.statInitialNamespaces(opts)
+		if err == nil {
+			refPID = 0
+		} else {
+			refPID = nsi.lowestMember()
+			if refPID == 0 {
+				return err
+			}
+			logMessage(LOG_VERBOSE, "Using the namespaces of PID",
+				refPID, "as the initial namespaces:", err)
+		}
+	}
+
+	if refPID != 0 {
+		for ns, attribs := range nsi.nsList {
+			for _, pid := range attribs.pids {
+				if pid == refPID && ns != invisUserNS {
+					nsi.initialNS[ns] = true
+				}
+			}
+		}
+	}
+
+	nsi.changedPIDs = make(map[int]bool)
+
+	for ns, attribs := range nsi.nsList {
+		if ns != invisUserNS && !nsi.initialNS[ns] &&
+			nsi.isDisplayed(ns, opts) {
+			for _, pid := range attribs.pids {
+				nsi.changedPIDs[pid] = true
+			}
+		}
+	}
+
+	return nil
+}
+
+// statInitialNamespaces() records in 'nsi.initialNS' the namespaces of PID 1,
+// which it obtains with stat() on the live system.
+
+func (nsi *NamespaceInfo) statInitialNamespaces(opts CmdLineOptions) error {
+
+	if replayFiles != nil {
+		return errors.New("PID 1 is not in the snapshot")
+	}
+
+	nsFiles := allNamespaceSymlinkNames
+	if opts.showPidnsHierarchy {
+		nsFiles = []string{"pid"}
+	}
+
+	for _, nsFile := range nsFiles {
+		var sb syscall.Stat_t
+
+		path := opts.procfs + "/1/ns/" + nsFile
+		if err := syscall.Stat(path, &sb); err != nil {
+			return &namespaceError{Op: "stat", PID: "1", Path: path,
+				Err: err}
+		}
+		nsi.initialNS[NamespaceID{sb.Dev, sb.Ino}] = true
+	}
+
+	return nil
+}
+
+// isMember() returns true if 'pid' is a member of any namespace in 'nsi'.
+
+func (nsi *NamespaceInfo) isMember(pid int) bool {
+	for _, attribs := range nsi.nsList {
+		for _, p := range attribs.pids {
+			if p == pid {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// lowestMember() returns the lowest PID that is a member of a namespace in
+// 'nsi', or 0 if there are no members.
+
+func (nsi *NamespaceInfo) lowestMember() int {
+	lowest := 0
+
+	for _, attribs := range nsi.nsList {
+		for _, pid := range attribs.pids {
+			if lowest == 0 || pid < lowest {
+				lowest = pid
+			}
+		}
+	}
+
+	return lowest
+}
+
+// hasChanges() returns true if the namespace tree rooted at 'ns' contains a
+// displayed noninitial namespace, or a process that is a member of one (see
+// findChangedProcesses()).
+
+func (nsi *NamespaceInfo) hasChanges(ns NamespaceID,
+	opts CmdLineOptions) bool {
+
+	if ns != invisUserNS && !nsi.initialNS[ns] &&
+		nsi.isDisplayed(ns, opts) {
+		return true
+	}
+
+	for _, pid := range nsi.nsList[ns].pids {
+		if nsi.changedPIDs[pid] {
+			return true
+		}
+	}
+
+	for _, child := range nsi.nsList[ns].children {
+		if nsi.hasChanges(child, opts) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// findNonemptyNamespaces() records in 'nsi.nonempty' each namespace in the
+// tree rooted at 'ns' that has a member process (or thread), or a
+// descendant that has one, and returns true if 'ns' is such a namespace.
+// With "--user" or "--uid", only the members owned by the selected user
+// are counted.
+
+func (nsi *NamespaceInfo) findNonemptyNamespaces(ns NamespaceID,
+	opts CmdLineOptions) bool {
+
+	attribs := nsi.nsList[ns]
+
+	nonempty := nsi.hasShownMembers(ns, opts)
+
+	// Visit all of the children, even once we know the answer for 'ns',
+	// so that every namespace in the tree is recorded.
+
+	for _, child := range attribs.children {
+		if nsi.findNonemptyNamespaces(child, opts) {
+			nonempty = true
+		}
+	}
+
+	nsi.nonempty[ns] = nonempty
+
+	return nonempty
+}
+
+// hasEmptyNamespaces() returns true if the tree rooted at 'ns' contains a
+// displayed namespace whose subtree has no member processes.
+
+func (nsi *NamespaceInfo) hasEmptyNamespaces(ns NamespaceID,
+	opts CmdLineOptions) bool {
+
+	if ns != invisUserNS && !nsi.nonempty[ns] &&
+		nsi.isDisplayed(ns, opts) {
+		return true
+	}
+
+	for _, child := range nsi.nsList[ns].children {
+		if nsi.hasEmptyNamespaces(child, opts) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isDisplayed() returns true if the namespace 'ns' is to be displayed, that
+// is, if its type is one of those specified in 'opts.namespaces'. User
+// namespaces are always displayed.
+
+func (nsi *NamespaceInfo) isDisplayed(ns NamespaceID,
+	opts CmdLineOptions) bool {
+
+	return nsi.nsList[ns].nsType == CLONE_NEWUSER ||
+		nsi.nsList[ns].nsType&opts.namespaces != 0
+}
+
+// Usernames that have already been looked up, indexed by UID. An empty
+// string records that the UID has no user name.
+
+var usernameCache = make(map[int]string)
+
+// userName() returns the user name corresponding to 'uid', and true, or
+// false if the UID has no user name. A user namespace may be created by a
+// UID that is mapped from another user namespace, and so has no entry in
+// the password database; that is not an error.
+
+func userName(uid int) (string, bool) {
+
+	name, fnd := usernameCache[uid]
+	if !fnd {
+		if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+			name = u.Username
+		}
+		usernameCache[uid] = name
+	}
+
+	return name, name != ""
+}
+
+// creatorString() returns 'uid' as a string, followed, if the "--names"
+// option was specified and the UID has a user name, by the user name in
+// parentheses. A negative 'uid' means that the creator is unknown.
+
+func creatorString(uid int, opts CmdLineOptions) string {
+
+	if uid < 0 { // NS_GET_OWNER_UID isn't supported
+		return "unknown"
+	}
+
+	s := strconv.Itoa(uid)
+
+	if opts.showNames {
+		if name, ok := userName(uid); ok {
+			s += " (" + escapeName(name) + ")"
+		}
+	}
+
+	return s
+}
+
+// utsHostname() returns the hostname in the UTS namespace of which the
+// processes in 'pids' are members, with control characters escaped, or "?"
+// if it can't be obtained from any of those processes. The hostname of
+// another UTS namespace can be discovered only from inside the namespace
+// (/proc/sys/kernel/hostname shows the reader's hostname), so we briefly join
+// the namespace with setns(2).
+
+func utsHostname(procfs string, pids []int) string {
+
+	for _, pid := range pids {
+		name, err := readUTSHostname(procfs, pid)
+		if err == nil {
+			return escapeName(name)
+		}
+		logMessage(LOG_VERBOSE, "Can't get hostname from PID "+
+			strconv.Itoa(pid)+": "+err.Error())
+	}
+
+	return "?"
+}
+
+// readUTSHostname() returns the hostname in the UTS namespace of 'pid'.
+
+func readUTSHostname(procfs string, pid int) (string, error) {
+
+	var name []byte
+
+	err := runInNamespace(procfs, pid, "uts", CLONE_NEWUTS, func() error {
+		var uts syscall.Utsname
+		if err := syscall.Uname(&uts); err != nil {
+			return fmt.Errorf("uname(): %w", err)
+		}
+
+		for _, c := range uts.Nodename {
+			if c == 0 {
+				break
+			}
+			name = append(name, byte(c))
+		}
+
+		return nil
+	})
+
+	return string(name), err
+}
+
+// netInterfaces() returns a description of the network interfaces in the
+// network namespace of which the processes in 'pids' are members: a list
+// of interface names, in which the interfaces that are up are marked with
+// '*'. If the interfaces can't be obtained from any of those processes, "?"
+// is returned.
+
+func netInterfaces(procfs string, pids []int) string {
+
+	for _, pid := range pids {
+		ifaces, err := readNetInterfaces(procfs, pid)
+		if err == nil {
+			var names []string
+			for _, iface := range ifaces {
+				name := escapeName(iface.Name)
+				if iface.Flags&net.FlagUp != 0 {
+					name += "*"
+				}
+				names = append(names, name)
+			}
+			return strings.Join(names, ", ")
+		}
+		logMessage(LOG_VERBOSE, "Can't get interfaces from PID "+
+			strconv.Itoa(pid)+": "+err.Error())
+	}
+
+	return "?"
+}
+
+// readNetInterfaces() returns the network interfaces in the network namespace
+// of 'pid'.
+
+func readNetInterfaces(procfs string, pid int) ([]net.Interface, error) {
+
+	var ifaces []net.Interface
+
+	err := runInNamespace(procfs, pid, "net", CLONE_NEWNET, func() error {
+		var err error
+		ifaces, err = net.Interfaces()
+		return err
+	})
+
+	return ifaces, err
+}
+
+// runInNamespace() calls 'fn' in the namespace of type 'nsType' (a CLONE_NEW*
+// value) of which 'pid' is a member; 'nsFile' names the corresponding
+// /proc/PID/ns symlink (under 'procfs'). The namespace is joined with
+// setns(2) by a dedicated goroutine that is locked to its OS thread, so that
+// no other goroutine runs in the namespace. That goroutine exits without
+// unlocking the thread, so that the Go runtime discards the thread rather
+// than reusing it.
+
+func runInNamespace(procfs string, pid int, nsFile string, nsType int,
+	fn func() error) error {
+
+	fd, err := openNamespaceSymlink(procfs, strconv.Itoa(pid), nsFile)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	sysno, fnd := setnsSyscall[runtime.GOARCH]
+	if !fnd {
+		return errors.New("setns() not supported on " + runtime.GOARCH)
+	}
+
+	ch := make(chan error)
+
+	go func() {
+		runtime.LockOSThread()
+
+		_, _, errno := syscall.Syscall(sysno, uintptr(fd),
+			uintptr(nsType), 0)
+		if errno != 0 {
+			ch <- fmt.Errorf("setns(): %w", errno)
+			return
+		}
+
+		ch <- fn()
+	}()
+
+	return <-ch
+}
+
+// Display the namespace node with the key 'ns'. 'linePrefix' is displayed
+// before the node (to indent it, and perhaps connect it to its parent), and
+// 'pidIndent' before each line of the list of member PIDs.
+
+func (nsi *NamespaceInfo) displayNamespace(ns NamespaceID, linePrefix string,
+	pidIndent string, opts CmdLineOptions) {
+
+	// Display the namespace type and ID (device ID + inode number). In
+	// "--watch" mode, namespaces that appeared since the previous scan
+	// are highlighted.
+
+	color := ""
+	if opts.useColor {
+		if nsi.newNS[ns] {
+			color = NEW_NS_COLOR
+		} else if nsi.nsList[ns].nsType == CLONE_NEWUSER {
+			color = USERNS_COLOR
+		}
+	}
+
+	fmt.Fprint(output, linePrefix)
+
+	if color != "" {
+		fmt.Fprint(output, color)
+	}
+
+	// When displaying the PID namespace hierarchy, find the init process
+	// of each PID namespace, so that it can be listed first among the
+	// member processes.
+
+	initPID := 0
+	if opts.showPidnsHierarchy {
+		initPID = nsi.namespaceInit(ns, opts)
+	}
+
+	if ns == invisUserNS {
+		fmt.Fprintln(output, "[invisible ancestor user NS]")
+	} else {
+		fmt.Fprint(output, nsString(nsi.nsList[ns].nsType, ns, opts))
+
+		// For user namespaces, display creator UID.
+
+		if nsi.nsList[ns].nsType == CLONE_NEWUSER {
+			fmt.Fprint(output, " <UID: ",
+				creatorString(nsi.nsList[ns].creatorUID, opts))
+			fmt.Fprint(output, ";  ")
+			fmt.Fprint(output, "u: ",
+				mapString(nsi.nsList[ns].uidMap, opts), ";   ")
+			fmt.Fprint(output, "g: ",
+				mapString(nsi.nsList[ns].gidMap, opts))
+			fmt.Fprint(output, ">")
+
+			// With "--limits", flag the namespace if its creator
+			// is near one of the limits in /proc/sys/user.
+
+			if opts.limits &&
+				nsi.nearLimit(nsi.nsList[ns].creatorUID) {
+				if opts.useColor {
+					fmt.Fprint(output, " "+RED+
+						"[near limit]"+NORMAL+color)
+				} else {
+					fmt.Fprint(output, " [near limit]")
+				}
+			}
+		}
+
+		// For nonuser namespaces, optionally display the owning user
+		// namespace.
+
+		if nsi.nsList[ns].nsType != CLONE_NEWUSER && opts.showOwnerNS {
+			fmt.Fprint(output, " owner="+
+				ownerString(nsi.nsList[ns].owner))
+		}
+
+		// For UTS namespaces, optionally display the hostname.
+
+		if nsi.nsList[ns].nsType == CLONE_NEWUTS && opts.showUTS {
+			fmt.Fprint(output, " \""+
+				utsHostname(opts.procfs,
+					nsi.nsList[ns].pids)+"\"")
+		}
+
+		// For network namespaces that have member processes,
+		// optionally display the network interfaces.
+
+		if nsi.nsList[ns].nsType == CLONE_NEWNET && opts.showNet &&
+			len(nsi.nsList[ns].pids) > 0 {
+			fmt.Fprint(output, " ("+
+				netInterfaces(opts.procfs,
+					nsi.nsList[ns].pids)+")")
+		}
+
+		// If the namespace is pinned by bind mounts or open file
+		// descriptors, say so.
+
+		if len(nsi.nsList[ns].pinnedBy) > 0 {
+			fmt.Fprint(output, "  (pinned by ",
+				strings.Join(nsi.nsList[ns].pinnedBy, ", "))
+			if len(nsi.nsList[ns].pids) == 0 {
+				fmt.Fprint(output, ", no processes")
+			}
+			fmt.Fprint(output, ")")
+		}
+
+		// With "--changed-only", the member processes of the initial
+		// namespaces that aren't members of any other namespace are
+		// not displayed; say how many there were in the root
+		// namespace.
+
+		if opts.changedOnly && ns == nsi.rootNS {
+			elided := 0
+			for _, pid := range nsi.nsList[ns].pids {
+				if !nsi.changedPIDs[pid] {
+					elided++
+				}
+			}
+			if elided > 0 {
+				fmt.Fprintf(output, " (%d processes elided)",
+					elided)
+			}
+		}
+
+		// If we scanned all processes (and none were skipped), but
+		// didn't find the init process of a PID namespace, then it has
+		// exited, and the namespace is kept alive by other means.
+
+		if opts.showPidnsHierarchy && initPID == 0 &&
+			len(flag.Args()) == 0 && nsi.permDenied == 0 {
+			fmt.Fprint(output, " <init exited>")
+		}
+
+		if nsi.newNS[ns] && !opts.useColor {
+			fmt.Fprint(output, " [new]")
+		}
+
+		fmt.Fprintln(output)
+	}
+
+	if color != "" {
+		fmt.Fprint(output, NORMAL)
+	}
+
+	// Optionally display member PIDs for the namespace.
+
+	if opts.showPids {
+		pids := nsi.shownMembers(ns, opts)
+
+		var threads []threadID
+
+		for _, t := range nsi.nsList[ns].threads {
+			if nsi.isShownOwner(t.pid, opts) {
+				threads = append(threads, t)
+			}
+		}
+
+		// With "--no-kthreads", say how many kernel threads were
+		// omitted from the member processes of the root namespace.
+
+		note := ""
+		if ns == nsi.rootNS && nsi.kthreads > 0 {
+			note = "[+" + strconv.Itoa(nsi.kthreads) +
+				" kernel threads]"
+		}
+
+		displayMemberPIDs(pidIndent, pids, threads, initPID, note,
+			opts)
+	}
+}
+
+// shownMembers() returns the member processes of 'ns' that are displayed in
+// the hierarchy: those that are owned by the user selected by "--user" or
+// "--uid", less, with "--changed-only", the unchanged members of an initial
+// namespace.
+
+func (nsi *NamespaceInfo) shownMembers(ns NamespaceID,
+	opts CmdLineOptions) []int {
+
+	var pids []int
+
+	for _, pid := range nsi.nsList[ns].pids {
+		if opts.changedOnly && nsi.initialNS[ns] &&
+			!nsi.changedPIDs[pid] {
+			continue
+		}
+		if nsi.isShownOwner(pid, opts) {
+			pids = append(pids, pid)
+		}
+	}
+
+	return pids
+}
+
+// hasShownMembers() returns true if 'ns' has a member process (or thread)
+// that is owned by the user selected by "--user" or "--uid" (or any member,
+// if neither option was specified).
+
+func (nsi *NamespaceInfo) hasShownMembers(ns NamespaceID,
+	opts CmdLineOptions) bool {
+
+	attribs := nsi.nsList[ns]
+
+	for _, pid := range attribs.pids {
+		if nsi.isShownOwner(pid, opts) {
+			return true
+		}
+	}
+
+	for _, t := range attribs.threads {
+		if nsi.isShownOwner(t.pid, opts) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// namespaceInit() returns the member process of the PID namespace 'ns' that
+// is the namespace's init process (i.e., has the PID 1 in the namespace), or
+// 0 if there is no such member.
+
+func (nsi *NamespaceInfo) namespaceInit(ns NamespaceID,
+	opts CmdLineOptions) int {
+
+	for _, pid := range nsi.nsList[ns].pids {
+		nspids, err := namespacePIDs(opts.procfs, pid)
+		if err == nil && len(nspids) > 0 && nspids[len(nspids)-1] == 1 {
+			return pid
+		}
+	}
+
+	return 0
+}
+
+// displayNamespaceHierarchies() displays the namespace hierarchy/hierarchies
+// specified by the command-line options.
+
+func (nsi *NamespaceInfo) displayNamespaceHierarchies(
+	opts CmdLineOptions) error {
+
+	nsi.sortChildren()
+
+	if nsi.flat {
+		return nsi.displayFlatNamespaces(opts)
+	}
+
+	roots, err := nsi.hierarchyRoots(opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.json {
+		return nsi.displayNamespacesJSON(roots, opts)
+	}
+
+	if opts.dot {
+		nsi.displayNamespacesDot(roots, opts)
+		return nil
+	}
+
+	if opts.tsv {
+		nsi.displayNamespacesTSV(roots, opts)
+		return nil
+	}
+
+	if opts.count {
+		nsi.displayCounts(roots, opts)
+		return nil
+	}
+
+	if opts.list {
+		nsi.displayNamespaceTable(roots, opts)
+	} else {
+		if opts.changedOnly {
+			err := nsi.findChangedProcesses(opts)
+			if err != nil {
+				return err
+			}
+		}
+
+		if opts.limits {
+			nsi.findLimitUsage(opts)
+		}
+
+		if opts.nonempty || opts.emptyOnly {
+			nsi.nonempty = make(map[NamespaceID]bool)
+			for _, ns := range roots {
+				nsi.findNonemptyNamespaces(ns, opts)
+			}
+		}
+
+		for _, ns := range roots {
+			nsi.displayNamespaceTree(ns, 0, "", "", opts)
+		}
+
+		if opts.limits {
+			nsi.displayLimitUsage()
+		}
+	}
+
+	if opts.summary {
+		nsi.displaySummary(roots, opts)
+	}
+
+	return nil
+}
+
+// displayFlatNamespaces() displays the namespaces in 'nsi.nsList' as a flat
+// list, sorted by type and inode number, for a kernel on which the
+// relationships between namespaces can't be discovered (see 'nsi.flat').
+// The options that depend on the hierarchy were rejected when 'nsi.flat'
+// was set (see hierarchyOption()).
+
+func (nsi *NamespaceInfo) displayFlatNamespaces(opts CmdLineOptions) error {
+
+	var namespaces []NamespaceID
+	for ns := range nsi.nsList {
+		if ns != invisUserNS && nsi.isDisplayed(ns, opts) {
+			namespaces = append(namespaces, ns)
+		}
+	}
+
+	nsi.sortNamespaces(namespaces)
+
+	for _, ns := range namespaces {
+		nsi.displayNamespace(ns, "", strings.Repeat(" ", 8), opts)
+	}
+
+	// Without the hierarchy, there is no root namespace whose member
+	// list could carry the "--no-kthreads" note, so show it separately.
+
+	if opts.showPids && nsi.kthreads > 0 {
+		fmt.Fprintln(output, "[+"+strconv.Itoa(nsi.kthreads)+
+			" kernel threads]")
+	}
+
+	return nil
+}
+
+// hierarchyOption() returns the name of the first of the options specified
+// in 'opts' that depend on the relationships between namespaces, which
+// can't be discovered on a kernel that lacks the namespace ioctl()
+// operations, or "" if no such option was specified.
+
+func hierarchyOption(opts CmdLineOptions) string {
+
+	options := []struct {
+		set  bool
+		name string
+	}{
+		{opts.json, "--json"},
+		{opts.dot, "--dot"},
+		{opts.list, "--list"},
+		{opts.tsv, "--format"},
+		{opts.count, "--count"},
+		{opts.summary, "--summary"},
+		{opts.limits, "--limits"},
+		{opts.changedOnly, "--changed-only"},
+		{opts.nonempty, "--nonempty"},
+		{opts.emptyOnly, "--empty-only"},
+		{opts.showOwnerNS, "--show-owner-ns"},
+		{opts.self, "--self"},
+		{opts.subtreePID != "" && !opts.self, "--subtree"},
+	}
+
+	for _, o := range options {
+		if o.set {
+			return o.name
+		}
+	}
+
+	return ""
+}
+
+// flatOptionError() returns the error for the option 'opt' (as returned by
+// hierarchyOption()) on a kernel that lacks the namespace ioctl() operations.
+
+func flatOptionError(opt string) error {
+	return errors.New("'" + opt + "' requires the namespace ioctl() " +
+		"operations (Linux 4.9 or later)")
+}
+
+// The order in which namespaces of different types are displayed, when they
+// are siblings in the hierarchy or in the flat list: user namespaces first,
+// followed by the other types in alphabetical order.
+
+var namespaceTypeRank = map[int]int{
+	CLONE_NEWUSER:   0,
+	CLONE_NEWCGROUP: 1,
+	CLONE_NEWIPC:    2,
+	CLONE_NEWNS:     3,
+	CLONE_NEWNET:    4,
+	CLONE_NEWPID:    5,
+	CLONE_NEWUTS:    6,
+}
+
+// sortNamespaces() sorts 'namespaces' by type (see 'namespaceTypeRank') and
+// then by inode number.
+
+func (nsi *NamespaceInfo) sortNamespaces(namespaces []NamespaceID) {
+	sort.Slice(namespaces, func(i, j int) bool {
+		ri := namespaceTypeRank[nsi.nsList[namespaces[i]].nsType]
+		rj := namespaceTypeRank[nsi.nsList[namespaces[j]].nsType]
+		if ri != rj {
+			return ri < rj
+		}
+		return namespaces[i].inode < namespaces[j].inode
+	})
+}
+
+// sortChildren() sorts the children of every namespace in 'nsi', so that
+// the output doesn't depend on the order in which the scan discovered them
+// (which follows the order of the /proc directory entries).
+
+func (nsi *NamespaceInfo) sortChildren() {
+	for _, attribs := range nsi.nsList {
+		nsi.sortNamespaces(attribs.children)
+	}
+}
+
+// findLimitUsage() implements the first part of the "--limits" option: it
+// reads the per-user limits on the number of namespaces of each type from
+// /proc/sys/user/max_*_namespaces into 'nsi.limits', and counts the
+// namespaces of each type that have been created by each UID into
+// 'nsi.limitUsage'. A user namespace is charged to its creator; since the
+// creator of a nonuser namespace isn't recorded, it is charged to the
+// creator of the owning user namespace, which usually (though not always)
+// gives the same result. The initial user namespace ('nsi.rootNS') was
+// created by no one, so neither it nor the namespaces that it owns are
+// counted; nor are the namespaces owned by invisible user namespaces.
+
+func (nsi *NamespaceInfo) findLimitUsage(opts CmdLineOptions) {
+
+	nsi.limits = make(map[int]int)
+
+	for nsType, name := range namespaceToStr {
+		path := opts.procfs + "/sys/user/max_" + name + "_namespaces"
+
+		buf, err := readFile(path)
+		if err != nil {
+			logMessage(LOG_NORMAL, "Can't read limit:", err)
+			continue
+		}
+
+		limit, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+		if err == nil {
+			nsi.limits[nsType] = limit
+		}
+	}
+
+	nsi.limitUsage = make(map[int]map[int]int)
+
+	for ns, attribs := range nsi.nsList {
+		if ns == invisUserNS || ns == nsi.rootNS ||
+			attribs.nsType != CLONE_NEWUSER ||
+			attribs.creatorUID < 0 {
+			continue
+		}
+
+		uid := attribs.creatorUID
+		if nsi.limitUsage[uid] == nil {
+			nsi.limitUsage[uid] = make(map[int]int)
+		}
+
+		nsi.limitUsage[uid][CLONE_NEWUSER]++
+		for _, child := range attribs.children {
+			if t := nsi.nsList[child].nsType; t != CLONE_NEWUSER {
+				nsi.limitUsage[uid][t]++
+			}
+		}
+	}
+}
+
+// nearLimit() returns true if the UID 'uid' has created more than 80% of
+// the permitted number of namespaces of any type.
+
+func (nsi *NamespaceInfo) nearLimit(uid int) bool {
+
+	for nsType, count := range nsi.limitUsage[uid] {
+		if limit, fnd := nsi.limits[nsType]; fnd && count*5 > limit*4 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// displayLimitUsage() implements the second part of the "--limits" option:
+// it displays a table with one row for each UID that has created
+// namespaces, showing, for each type of namespace, the number created and
+// the limit, in the form "count/limit".
+
+func (nsi *NamespaceInfo) displayLimitUsage() {
+
+	nsTypes := []int{CLONE_NEWUSER, CLONE_NEWCGROUP, CLONE_NEWIPC,
+		CLONE_NEWNS, CLONE_NEWNET, CLONE_NEWPID, CLONE_NEWUTS}
+
+	header := []string{"UID"}
+	for _, nsType := range nsTypes {
+		header = append(header, namespaceToStr[nsType])
+	}
+
+	var uids []int
+	for uid := range nsi.limitUsage {
+		uids = append(uids, uid)
+	}
+	sort.Ints(uids)
+
+	rows := [][]string{header}
+
+	for _, uid := range uids {
+		row := []string{strconv.Itoa(uid)}
+
+		for _, nsType := range nsTypes {
+			limit := "?"
+			if n, fnd := nsi.limits[nsType]; fnd {
+				limit = strconv.Itoa(n)
+			}
+			row = append(row, strconv.Itoa(
+				nsi.limitUsage[uid][nsType])+"/"+limit)
+		}
+
+		if nsi.nearLimit(uid) {
+			row = append(row, "[near limit]")
+		}
+
+		rows = append(rows, row)
+	}
+
+	fmt.Fprintln(output)
+	for _, line := range formatColumns(rows, columnWidths(rows)) {
+		fmt.Fprintln(output, line)
+	}
+}
+
+// The counts displayed by the "--summary" option.
+
+type namespaceSummary struct {
+	nsCount  map[int]int  // Number of namespaces of each CLONE_NEW* type
+	members  map[int]bool // The member processes
+	maxDepth int          // Deepest nesting of user (or PID) namespaces
+	empty    int          // Number of namespaces with no member processes
+}
+
+// displaySummary() implements the "--summary" option: it displays counts
+// of the namespaces in the trees rooted at 'roots' that were displayed,
+// either in the hierarchy or in the "--list" table.
+
+func (nsi *NamespaceInfo) displaySummary(roots []NamespaceID,
+	opts CmdLineOptions) {
+
+	sum := namespaceSummary{nsCount: make(map[int]int),
+		members: make(map[int]bool)}
+
+	for _, ns := range roots {
+		nsi.summarizeTree(ns, 0, 0, &sum, opts)
+	}
+
+	// Show the counts for user namespaces first, then the other types
+	// in alphabetical order.
+
+	var counts []string
+	for _, nsType := range []int{CLONE_NEWUSER, CLONE_NEWCGROUP,
+		CLONE_NEWIPC, CLONE_NEWNS, CLONE_NEWNET, CLONE_NEWPID,
+		CLONE_NEWUTS} {
+
+		if n := sum.nsCount[nsType]; n > 0 {
+			counts = append(counts, fmt.Sprintf("%s: %d",
+				namespaceToStr[nsType], n))
+		}
+	}
+
+	hierarchy := "user"
+	if opts.showPidnsHierarchy {
+		hierarchy = "PID"
+	}
+
+	fmt.Fprintln(output)
+	fmt.Fprintln(output, "Namespaces:", strings.Join(counts, ", "))
+	fmt.Fprintln(output, "Member processes:", len(sum.members))
+	fmt.Fprintf(output, "Maximum %s namespace nesting depth: %d\n",
+		hierarchy, sum.maxDepth)
+	fmt.Fprintln(output, "Namespaces with no member processes:", sum.empty)
+}
+
+// summarizeTree() adds the counts for the namespace tree rooted at 'ns' (at
+// 'level' in the tree) to 'sum'. 'depth' is the number of user (or, with
+// "--pidns", PID) namespaces that are ancestors of 'ns'. Only what was
+// displayed is counted: the hierarchy omits the subtrees pruned by
+// isPruned() and the members elided by shownMembers(), and the "--list"
+// table omits the namespaces that have no members (see
+// collectTableNamespaces()).
+
+func (nsi *NamespaceInfo) summarizeTree(ns NamespaceID, level int,
+	depth int, sum *namespaceSummary, opts CmdLineOptions) {
+
+	attribs := nsi.nsList[ns]
+
+	if !opts.list && nsi.isPruned(ns, level, opts) {
+		return
+	}
+
+	if ns != invisUserNS && nsi.isDisplayed(ns, opts) {
+		hierarchyType := CLONE_NEWUSER
+		if opts.showPidnsHierarchy {
+			hierarchyType = CLONE_NEWPID
+		}
+
+		if attribs.nsType == hierarchyType {
+			depth++
+			if depth > sum.maxDepth {
+				sum.maxDepth = depth
+			}
+		}
+	}
+
+	if opts.list {
+		if ns != invisUserNS && len(attribs.pids) > 0 {
+			sum.nsCount[attribs.nsType]++
+			for _, pid := range attribs.pids {
+				sum.members[pid] = true
+			}
+		}
+	} else if ns != invisUserNS && nsi.isDisplayed(ns, opts) {
+		sum.nsCount[attribs.nsType]++
+
+		if !nsi.hasShownMembers(ns, opts) {
+			sum.empty++
+		}
+		for _, pid := range nsi.shownMembers(ns, opts) {
+			sum.members[pid] = true
+		}
+	}
+
+	for _, child := range attribs.children {
+		if !opts.list || nsi.isDisplayed(child, opts) {
+			nsi.summarizeTree(child, level+1, depth, sum, opts)
+		}
+	}
+}
+
+// displayCounts() implements the "--count" option: for each type of
+// namespace in the trees rooted at 'roots', it displays the number of
+// namespaces and the minimum, median, and maximum number of member
+// processes in those namespaces.
+
+func (nsi *NamespaceInfo) displayCounts(roots []NamespaceID,
+	opts CmdLineOptions) {
+
+	sizes := make(map[int][]int) // Member counts, indexed by CLONE_NEW*
+
+	for _, ns := range roots {
+		nsi.countTree(ns, sizes, opts)
+	}
+
+	for _, nsType := range []int{CLONE_NEWUSER, CLONE_NEWCGROUP,
+		CLONE_NEWIPC, CLONE_NEWNS, CLONE_NEWNET, CLONE_NEWPID,
+		CLONE_NEWUTS} {
+
+		n := len(sizes[nsType])
+		if n == 0 {
+			continue
+		}
+
+		sort.Ints(sizes[nsType])
+
+		noun := "namespaces"
+		if n == 1 {
+			noun = "namespace"
+		}
+
+		fmt.Fprintf(output, "%s: %d %s, members min/median/max = "+
+			"%d/%d/%d\n", namespaceToStr[nsType], n, noun,
+			sizes[nsType][0], sizes[nsType][(n-1)/2],
+			sizes[nsType][n-1])
+	}
+}
+
+// countTree() appends to 'sizes' the number of member processes of each
+// displayed namespace in the tree rooted at 'ns'.
+
+func (nsi *NamespaceInfo) countTree(ns NamespaceID, sizes map[int][]int,
+	opts CmdLineOptions) {
+
+	attribs := nsi.nsList[ns]
+
+	if ns != invisUserNS && nsi.isDisplayed(ns, opts) {
+		members := 0
+		for _, pid := range attribs.pids {
+			if nsi.isShownOwner(pid, opts) {
+				members++
+			}
+		}
+
+		sizes[attribs.nsType] = append(sizes[attribs.nsType], members)
+	}
+
+	for _, child := range attribs.children {
+		nsi.countTree(child, sizes, opts)
+	}
+}
+
+// hierarchyRoots() returns the namespaces at the roots of the trees that are
+// to be displayed.
+
+func (nsi *NamespaceInfo) hierarchyRoots(opts CmdLineOptions) (
+	[]NamespaceID, error) {
+
+	if opts.subtreePID == "" { // No "--subtree" option was specified
+
+		// Display the namespace tree rooted at the initial namespace,
+		// and then the namespaces owned by (invisible) ancestor user
+		// namespaces.
+
+		roots := []NamespaceID{nsi.rootNS}
+
+		if _, fnd := nsi.nsList[invisUserNS]; fnd {
+			roots = append(roots, invisUserNS)
+		}
+
+		return roots, nil
+	}
+
+	// Display subtree of the namespace hierarchy rooted at the
+	// namespace of the PID (or the namespace file) specified in the
+	// "--subtree" option.
+
+	nsFile, nsType := "user", CLONE_NEWUSER
+	if opts.showPidnsHierarchy {
+		nsFile, nsType = "pid", CLONE_NEWPID
+	}
+
+	namespaceFD, err := openNamespaceTarget(opts.procfs, opts.subtreePID,
+		nsFile, nsType)
+	if err != nil {
+		return nil, err
+	}
+
+	// The namespace may have no member processes (for example, if it is
+	// pinned by a bind mount), so make sure that it has an entry.
+
+	ns, err := nsi.addNamespace(namespaceFD, -1, opts)
+	syscall.Close(namespaceFD)
+	if err != nil {
+		return nil, withContext(err, opts.subtreePID, "")
+	}
+
+	return []NamespaceID{ns}, nil
+}
+
+// The 'namespaceJSON' structure is used to produce the JSON representation
+// of a namespace and (recursively) its descendants. The entry for the
+// namespaces owned by invisible ancestor user namespaces has no ID; instead,
+// it is marked "invisible".
+
+type namespaceJSON struct {
+	Type        string           `json:"type"`
+	Invisible   bool             `json:"invisible,omitempty"`
+	Device      uint64           `json:"device,omitempty"`
+	Inode       uint64           `json:"inode,omitempty"`
+	Hostname    string           `json:"hostname,omitempty"`
+	Interfaces  []interfaceJSON  `json:"interfaces,omitempty"`
+	PinnedBy    []string         `json:"pinned_by,omitempty"`
+	CreatorUID  *int             `json:"creator_uid,omitempty"`
+	CreatorName string           `json:"creator_name,omitempty"`
+	UidMap      *string          `json:"uid_map,omitempty"`
+	GidMap      *string          `json:"gid_map,omitempty"`
+	PIDs        []int            `json:"pids,omitempty"`
+	Threads     []string         `json:"threads,omitempty"`
+	Children    []*namespaceJSON `json:"children"`
+}
+
+// The JSON representation of a network interface ("--show-net").
+
+type interfaceJSON struct {
+	Name string `json:"name"`
+	Up   bool   `json:"up"`
+}
+
+// buildInterfacesJSON() returns the JSON representation of the network
+// interfaces in the network namespace of which the processes in 'pids' are
+// members, or nil if they can't be obtained from any of those processes.
+
+func buildInterfacesJSON(procfs string, pids []int) []interfaceJSON {
+
+	for _, pid := range pids {
+		ifaces, err := readNetInterfaces(procfs, pid)
+		if err != nil {
+			continue
+		}
+
+		list := []interfaceJSON{}
+		for _, iface := range ifaces {
+			list = append(list, interfaceJSON{Name: iface.Name,
+				Up: iface.Flags&net.FlagUp != 0})
+		}
+		return list
+	}
+
+	return nil
+}
+
+// buildNamespaceJSON() returns the JSON representation of the namespace
+// tree rooted at 'ns'. As in the text display, the children of each
+// namespace are included only if isDisplayed() says so.
+
+func (nsi *NamespaceInfo) buildNamespaceJSON(ns NamespaceID,
+	opts CmdLineOptions) *namespaceJSON {
+
+	attribs := nsi.nsList[ns]
+
+	nj := &namespaceJSON{Type: namespaceToStr[attribs.nsType],
+		Children: []*namespaceJSON{}}
+
+	if ns == invisUserNS {
+		nj.Invisible = true
+	} else {
+		nj.Device = ns.device
+		nj.Inode = ns.inode
+
+		if attribs.nsType == CLONE_NEWUSER {
+			nj.CreatorUID = &attribs.creatorUID
+			if opts.showNames {
+				nj.CreatorName, _ = userName(attribs.creatorUID)
+			}
+			nj.UidMap = &attribs.uidMap
+			nj.GidMap = &attribs.gidMap
+		}
+
+		if attribs.nsType == CLONE_NEWUTS && opts.showUTS {
+			nj.Hostname = utsHostname(opts.procfs, attribs.pids)
+		}
+
+		if attribs.nsType == CLONE_NEWNET && opts.showNet {
+			nj.Interfaces = buildInterfacesJSON(opts.procfs,
+				attribs.pids)
+		}
+
+		nj.PinnedBy = attribs.pinnedBy
+
+		if opts.showPids {
+			sort.Ints(attribs.pids)
+			nj.PIDs = attribs.pids
+			for _, t := range attribs.threads {
+				nj.Threads = append(nj.Threads, t.String())
+			}
+		}
+	}
+
+	for _, child := range attribs.children {
+		if nsi.isDisplayed(child, opts) {
+			nj.Children = append(nj.Children,
+				nsi.buildNamespaceJSON(child, opts))
+		}
+	}
+
+	return nj
+}
+
+// displayNamespacesJSON() displays the namespace trees rooted at 'roots' as
+// a JSON array.
+
+func (nsi *NamespaceInfo) displayNamespacesJSON(roots []NamespaceID,
+	opts CmdLineOptions) error {
+
+	trees := []*namespaceJSON{}
+	for _, ns := range roots {
+		trees = append(trees, nsi.buildNamespaceJSON(ns, opts))
+	}
+
+	buf, err := json.MarshalIndent(trees, "", "    ")
+	if err != nil {
+		return fmt.Errorf("json.MarshalIndent(): %w", err)
+	}
+
+	fmt.Fprintln(output, string(buf))
+
+	return nil
+}
+
+// displayNamespacesDot() displays the namespace trees rooted at 'roots' as a
+// Graphviz DOT digraph. If member PIDs are being shown, each node is a
+// record, with the PIDs in a second field below the namespace's label.
+
+func (nsi *NamespaceInfo) displayNamespacesDot(roots []NamespaceID,
+	opts CmdLineOptions) {
+
+	shape := "box"
+	if opts.showPids {
+		shape = "record"
+	}
+
+	fmt.Fprintln(output, "digraph namespaces {")
+	fmt.Fprintln(output, "    node [shape="+shape+"];")
+
+	for _, ns := range roots {
+		nsi.displayNamespaceDotNodes(ns, opts)
+	}
+
+	fmt.Fprintln(output, "}")
+}
+
+// displayNamespaceDotNodes() recursively displays the DOT node and edge
+// statements for the namespace tree rooted at 'ns'. The edges from a user
+// namespace to the nonuser namespaces that it owns are dashed, to
+// distinguish ownership from parenthood.
+
+func (nsi *NamespaceInfo) displayNamespaceDotNodes(ns NamespaceID,
+	opts CmdLineOptions) {
+
+	attribs := nsi.nsList[ns]
+
+	label := "[invisible ancestor user NS]"
+	attrs := ", style=dashed"
+
+	if ns != invisUserNS {
+		label = namespaceToStr[attribs.nsType] + " " +
+			strconv.FormatUint(ns.inode, 10)
+		if opts.nsFormat == "symlink" {
+			label = nsString(attribs.nsType, ns, opts)
+		}
+		if attribs.nsType == CLONE_NEWUSER {
+			label += "\\nUID: " +
+				creatorString(attribs.creatorUID, opts)
+		}
+		attrs = ""
+
+		if opts.showPids && len(attribs.pids) > 0 {
+			label = "{" + label + "|" + dotPIDList(attribs.pids) +
+				"}"
+		}
+	}
+
+	fmt.Fprintf(output, "    %s [label=\"%s\"%s];\n", dotNodeName(ns),
+		label, attrs)
+
+	var children []NamespaceID
+	for _, child := range attribs.children {
+		if nsi.isDisplayed(child, opts) {
+			children = append(children, child)
+		}
+	}
+
+	for _, child := range children {
+		style := ""
+		if nsi.nsList[child].nsType != CLONE_NEWUSER &&
+			!opts.showPidnsHierarchy {
+			style = " [style=dashed]"
+		}
+
+		fmt.Fprintf(output, "    %s -> %s%s;\n", dotNodeName(ns),
+			dotNodeName(child), style)
+	}
+
+	for _, child := range children {
+		nsi.displayNamespaceDotNodes(child, opts)
+	}
+}
+
+// dotPIDList() returns the PIDs in 'pids', sorted, as the text of a DOT
+// label, with at most eight PIDs per line.
+
+func dotPIDList(pids []int) string {
+	sort.Ints(pids)
+
+	list := "PIDs:"
+	for i, pid := range pids {
+		if i > 0 && i%8 == 0 {
+			list += "\\n"
+		}
+		list += " " + strconv.Itoa(pid)
+	}
+
+	return list
+}
+
+// dotNodeName() returns the name used for the namespace 'ns' in DOT output.
+
+func dotNodeName(ns NamespaceID) string {
+	if ns == invisUserNS {
+		return "ns_invisible"
+	}
+
+	return "ns_" + strconv.FormatUint(ns.device, 10) + "_" +
+		strconv.FormatUint(ns.inode, 10)
+}
+
+// The columns that may be shown by the "--list" option, in their default
+// order.
+
+var listColumnNames = []string{"NS", "TYPE", "NPROCS", "PID", "USER",
+	"COMMAND"}
+
+// displayNamespaceTable() displays a table, in the style of lsns(8), with
+// one row for each namespace in the trees rooted at 'roots' (and selected
+// by isDisplayed()) that has at least one member process. The rows are
+// sorted by inode number. The PID, USER, and COMMAND columns describe the
+// lowest-numbered member process.
+
+func (nsi *NamespaceInfo) displayNamespaceTable(roots []NamespaceID,
+	opts CmdLineOptions) {
+
+	var namespaces []NamespaceID
+	for _, ns := range roots {
+		namespaces = nsi.collectTableNamespaces(ns, opts, namespaces)
+	}
+
+	sort.Slice(namespaces, func(i, j int) bool {
+		if namespaces[i].inode != namespaces[j].inode {
+			return namespaces[i].inode < namespaces[j].inode
+		}
+		return namespaces[i].device < namespaces[j].device
+	})
+
+	rows := [][]string{opts.listColumns}
+
+	for _, ns := range namespaces {
+		attribs := nsi.nsList[ns]
+
+		sort.Ints(attribs.pids)
+		pid := attribs.pids[0]
+
+		var row []string
+		for _, col := range opts.listColumns {
+			var field string
+
+			switch col {
+			case "NS":
+				field = strconv.FormatUint(ns.inode, 10)
+				if opts.nsFormat == "symlink" {
+					field = nsString(attribs.nsType, ns,
+						opts)
+				}
+			case "TYPE":
+				field = namespaceToStr[attribs.nsType]
+			case "NPROCS":
+				field = strconv.Itoa(len(attribs.pids))
+			case "PID":
+				field = strconv.Itoa(pid)
+			case "USER":
+				field = processUser(opts.procfs, pid)
+			case "COMMAND":
+				field = processCommand(opts.procfs + "/" +
+					strconv.Itoa(pid))
+			}
+
+			row = append(row, field)
+		}
+
+		rows = append(rows, row)
+	}
+
+	for _, line := range formatColumns(rows, columnWidths(rows)) {
+		fmt.Fprintln(output, line)
+	}
+}
+
+// displayNamespacesTSV() implements "--format=tsv": it displays, for the
+// trees rooted at 'roots', one line of tab-separated fields for each
+// (namespace, member process) pair, in the order in which the namespaces
+// would be displayed in the hierarchy. Namespaces that have no member
+// processes are displayed as a single line whose PID and COMM are "-".
+
+func (nsi *NamespaceInfo) displayNamespacesTSV(roots []NamespaceID,
+	opts CmdLineOptions) {
+
+	if !opts.noHeader {
+		fmt.Fprintln(output, "TYPE\tDEVICE\tINODE\tPARENT\tCREATOR\t"+
+			"PID\tCOMM")
+	}
+
+	for _, ns := range roots {
+		nsi.displayTreeTSV(ns, "-", opts)
+	}
+}
+
+// displayTreeTSV() displays the lines of "--format=tsv" output for the tree
+// rooted at 'ns', whose parent (or owner) has the inode number 'parent'.
+
+func (nsi *NamespaceInfo) displayTreeTSV(ns NamespaceID, parent string,
+	opts CmdLineOptions) {
+
+	attribs := nsi.nsList[ns]
+
+	if ns != invisUserNS && nsi.isDisplayed(ns, opts) {
+		creator := "-"
+		if attribs.nsType == CLONE_NEWUSER {
+			creator = strconv.Itoa(attribs.creatorUID)
+		}
+
+		prefix := strings.Join([]string{namespaceToStr[attribs.nsType],
+			strconv.FormatUint(ns.device, 10),
+			strconv.FormatUint(ns.inode, 10), parent, creator},
+			"\t") + "\t"
+
+		sort.Ints(attribs.pids)
+		for _, pid := range attribs.pids {
+			fmt.Fprintln(output, prefix+strconv.Itoa(pid)+"\t"+
+				tsvComm(opts.procfs+"/"+strconv.Itoa(pid)))
+		}
+
+		for _, t := range attribs.threads {
+			fmt.Fprintln(output, prefix+t.String()+"\t"+
+				tsvComm(opts.procfs+"/"+strconv.Itoa(t.pid)+
+					"/task/"+strconv.Itoa(t.tid)))
+		}
+
+		if len(attribs.pids) == 0 && len(attribs.threads) == 0 {
+			fmt.Fprintln(output, prefix+"-\t-")
+		}
+	}
+
+	// The namespaces owned by an invisible user namespace have no
+	// (visible) parent.
+
+	childParent := "-"
+	if ns != invisUserNS {
+		childParent = strconv.FormatUint(ns.inode, 10)
+	}
+
+	for _, child := range attribs.children {
+		nsi.displayTreeTSV(child, childParent, opts)
+	}
+}
+
+// tsvComm() returns the command name of the process (or thread) whose /proc
+// directory is 'dir', escaped so that it contains no tabs or other control
+// characters, or "-" if it can't be read.
+
+func tsvComm(dir string) string {
+
+	buf, err := readFile(dir + "/comm")
+	if err != nil {
+		return "-"
+	}
+
+	return escapeName(strings.TrimSuffix(string(buf), "\n"))
+}
+
+// collectTableNamespaces() appends to 'list', and returns, the namespaces in
+// the tree rooted at 'ns' that are to be shown by displayNamespaceTable().
+
+func (nsi *NamespaceInfo) collectTableNamespaces(ns NamespaceID,
+	opts CmdLineOptions, list []NamespaceID) []NamespaceID {
+
+	attribs := nsi.nsList[ns]
+
+	if ns != invisUserNS && len(attribs.pids) > 0 {
+		list = append(list, ns)
+	}
+
+	for _, child := range attribs.children {
+		if nsi.isDisplayed(child, opts) {
+			list = nsi.collectTableNamespaces(child, opts, list)
+		}
+	}
+
+	return list
+}
+
+// processUser() returns the user name (or, if it has none, the UID) of the
+// effective UID of 'pid', or "?" if the process has terminated.
+
+func processUser(procfs string, pid int) string {
+	ps, err := getProcStatus(procfs, pid)
+	if err != nil {
+		return "?"
+	}
+
+	if name, ok := userName(ps.uid); ok {
+		return escapeName(name)
+	}
+
+	return strconv.Itoa(ps.uid)
+}
+
+// processCommand() returns the command line of the process (or thread) whose
+// /proc directory is 'dir', with its arguments separated by spaces. For a
+// kernel thread, which has no command line, the command name is returned in
+// square brackets, as ps(1) does. If the process has terminated, "?" is
+// returned.
+
+func processCommand(dir string) string {
+
+	buf, err := readFile(dir + "/cmdline")
+	if err != nil {
+		return "?"
+	}
+
+	cmd := strings.TrimRight(string(buf), "\x00")
+	if cmd != "" {
+		return escapeName(strings.ReplaceAll(cmd, "\x00", " "))
+	}
+
+	buf, err = readFile(dir + "/comm")
+	if err != nil {
+		return "?"
+	}
+
+	return "[" + escapeName(strings.TrimSuffix(string(buf), "\n")) + "]"
+}
+
+// columnWidths() returns the display width of each column of 'rows'.
+
+func columnWidths(rows [][]string) []int {
+	var widths []int
+
+	for _, row := range rows {
+		for i, field := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			if w := visibleWidth(field); w > widths[i] {
+				widths[i] = w
+			}
+		}
+	}
+
+	return widths
+}
+
+// formatColumns() returns the lines of a table made from 'rows', with each
+// column padded to the corresponding width in 'widths' and separated from
+// the next by two spaces. The last column is not padded.
+
+func formatColumns(rows [][]string, widths []int) []string {
+	var lines []string
+
+	for _, row := range rows {
+		line := ""
+		for i, field := range row {
+			if i < len(row)-1 {
+				field += strings.Repeat(" ",
+					widths[i]-visibleWidth(field)+2)
+			}
+			line += field
+		}
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// The error returned when a pathname that is given in place of a PID doesn't
+// refer to a namespace file.
+
+var errNotNamespace = errors.New("not a namespace file")
+
+// openNamespaceTarget() returns a file descriptor that refers to the namespace
+// named by 'target'. If 'target' contains a '/', it is the pathname of a
+// namespace file, which is opened directly; if 'nsType' is not zero, the
+// namespace must be of that type (a CLONE_NEW* value). Otherwise, 'target' is
+// a PID, and the namespace symlink 'nsFile' of that process (under 'procfs')
+// is opened.
+
+func openNamespaceTarget(procfs string, target string, nsFile string,
+	nsType int) (int, error) {
+
+	if !strings.Contains(target, "/") {
+		return openNamespaceSymlink(procfs, target, nsFile)
+	}
+
+	namespaceFD, err := syscall.Open(target, syscall.O_RDONLY, 0)
+	if err != nil {
+		return -1, &namespaceError{Op: "open", Path: target, Err: err}
+	}
+
+	// A namespace file is on the nsfs filesystem, which we identify by
+	// the device ID of our own namespace symlinks. (Checking this first
+	// means that we don't mistake an ordinary file for a sign that the
+	// kernel lacks the namespace ioctl() operations.)
+
+	var sb, nsfs syscall.Stat_t
+
+	err = syscall.Fstat(namespaceFD, &sb)
+	if err == nil {
+		err = syscall.Stat("/proc/self/ns/user", &nsfs)
+	}
+	if err == nil && sb.Dev != nsfs.Dev {
+		err = errNotNamespace
+	}
+
+	if err == nil && nsType != 0 {
+		var t int
+		t, err = namespaceType(namespaceFD)
+		if err == nil && t != nsType {
+			err = fmt.Errorf("is a %s namespace, not a %s "+
+				"namespace", namespaceToStr[t],
+				namespaceToStr[nsType])
+		}
+	}
+
+	if err != nil {
+		syscall.Close(namespaceFD)
+
+		var nsErr *namespaceError
+		if errors.As(err, &nsErr) {
+			return -1, withContext(err, "", target)
+		}
+		return -1, fmt.Errorf("%s: %w", target, err)
+	}
+
+	return namespaceFD, nil
+}
+
+// addNamespaceFile() adds the namespace referred to by the namespace file
+// 'path' (given as a command-line argument), and its ancestors, to 'nsi'.
+// When only the PID namespace hierarchy is being displayed, the namespace
+// must be a PID namespace.
+
+func (nsi *NamespaceInfo) addNamespaceFile(path string,
+	opts CmdLineOptions) error {
+
+	nsType := 0
+	if opts.showPidnsHierarchy {
+		nsType = CLONE_NEWPID
+	}
+
+	namespaceFD, err := openNamespaceTarget(opts.procfs, path, "", nsType)
+	if err != nil {
+		return err
+	}
+	nsi.stats.filesOpened++
+
+	_, err = nsi.addNamespace(namespaceFD, -1, opts)
+	syscall.Close(namespaceFD)
+
+	return withContext(err, "", path)
+}
+
+// openNamespaceSymlink() opens a namespace symlink (specified in 'nsFile') for
+// the process with the specified 'pid', whose PID directory is under
+// 'procfs', and returns the resulting file descriptor.
+
+func openNamespaceSymlink(procfs string, pid string,
+	nsFile string) (int, error) {
+
+	symlinkPath := procfs + "/" + pid + "/ns/" + nsFile
+
+	namespaceFD, err := syscall.Open(symlinkPath, syscall.O_RDONLY, 0)
+
+	if namespaceFD < 0 {
+		return -1, &namespaceError{Op: "open", PID: pid,
+			Path: symlinkPath, Err: err}
+	}
+
+	return namespaceFD, nil
+}
+
+// Display output is accumulated in 'output' and written to standard output
+// in large chunks, rather than with a write() for each of the many small
+// fmt.Fprint() calls that build it. Operations on the buffer are serialized,
+// so that the signal handler can safely write out what has been buffered if
+// the program is interrupted.
+
+type lineWriter struct {
+	mu  sync.Mutex
+	buf []byte
+	out io.Writer
+}
+
+const outputBufSize = 64 * 1024
+
+var output = &lineWriter{out: os.Stdout}
+
+// Write() appends 'p' to the buffer. Once the buffer has grown large, the
+// complete lines that it contains are written out.
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= outputBufSize {
+		err := w.writeLines()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// writeLines() writes out the complete lines in the buffer, keeping any
+// partial last line. The caller must hold 'w.mu'.
+
+func (w *lineWriter) writeLines() error {
+	n := bytes.LastIndexByte(w.buf, '\n') + 1
+	_, err := w.out.Write(w.buf[:n])
+	w.buf = w.buf[:copy(w.buf, w.buf[n:])]
+	return err
+}
+
+// Flush() writes out everything in the buffer.
+
+func (w *lineWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, err := w.out.Write(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+// interrupt() is called when the program is interrupted by a signal. It
+// writes out the complete lines in the buffer, discarding any partial last
+// line so that the output doesn't stop part way through a line, and then
+// writes 'trailer'. 'w.mu' is left locked, so that no further output is
+// written before the program exits.
+
+func (w *lineWriter) interrupt(trailer string) {
+	w.mu.Lock()
+	w.writeLines()
+	io.WriteString(w.out, trailer)
+}
+
+// flushOutput() writes out any output still buffered in 'output'. An error is
+// fatal, except for EPIPE (the reader of our output went away), which is
+// treated as a successful exit.
+
+func flushOutput() {
+	err := output.Flush()
+	if errors.Is(err, syscall.EPIPE) {
+		os.Exit(0)
+	}
+	if err != nil {
+		logMessage(LOG_QUIET, "Error writing standard output:", err)
+		os.Exit(1)
+	}
+}
+
+// While the scan is in progress, SIGINT and SIGTERM cancel it (see
+// handleSignals()) rather than terminating the program, so that the results
+// gathered so far can still be displayed. 'scanInProgress' (which is
+// accessed atomically) is 1 while the scan can be canceled.
+
+var scanInProgress int32
+var cancelScan context.CancelFunc
+
+// The exit status used when the scan was interrupted, so that only
+// partial results were displayed.
+
+const EXIT_INTERRUPTED = 3
+
+// The exit status used by "--diff" when the two processes don't share all of
+// their namespaces.
+
+const EXIT_DIFFERENT = 4
+
+// startScan() returns the context to be checked by the scan, which is canceled
+// if the program is interrupted before endScan() is called.
+
+func startScan() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelScan = cancel
+	atomic.StoreInt32(&scanInProgress, 1)
+	return ctx
+}
+
+// endScan() marks the end of the scan that uses 'ctx', and returns true if
+// the scan was interrupted.
+
+func endScan(ctx context.Context) bool {
+	atomic.StoreInt32(&scanInProgress, 0)
+	return ctx.Err() != nil
+}
+
+// handleSignals() arranges for the program to terminate cleanly if it is
+// interrupted. If a scan is in progress, SIGINT or SIGTERM cancels the scan
+// (see startScan()); otherwise, the complete lines of buffered output are
+// written out and the terminal color is reset (if we are using color), so that
+// the shell prompt isn't left colored, and the program exits with the
+// conventional status of 128 plus the signal number. On SIGPIPE (the reader of
+// our output went away, as in "namespaces_of | head"), the program exits
+// silently with status 0.
+
+func handleSignals(useColor bool) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM,
+		syscall.SIGPIPE)
+
+	go func() {
+		for sig := range sigChan {
+			if sig == syscall.SIGPIPE {
+				os.Exit(0)
+			}
+
+			// While the scan is in progress, the first SIGINT
+			// or SIGTERM just cancels it.
+
+			if atomic.CompareAndSwapInt32(&scanInProgress, 1, 0) {
+				cancelScan()
+				continue
+			}
+
+			trailer := ""
+			if useColor {
+				trailer = NORMAL
+			}
+			output.interrupt(trailer)
+
+			os.Exit(128 + int(sig.(syscall.Signal)))
+		}
+	}()
+}
+
+// Diagnostic messages are written to stderr, so that they don't become mixed
+// with the program's output. Which messages are displayed depends on the
+// logging level, which is selected with the "-q" and "-v" options.
+
+const (
+	LOG_QUIET   = iota // Errors only
+	LOG_NORMAL         // Errors and warnings (the default)
+	LOG_VERBOSE        // Also progress messages
+	LOG_DEBUG          // Also debugging messages
+)
+
+var logLevel = LOG_NORMAL
+
+// logMessage() writes its arguments (formatted as for fmt.Println()) to
+// stderr, if 'level' is no higher than the current logging level.
+
+func logMessage(level int, a ...interface{}) {
+	if level <= logLevel {
+		fmt.Fprintln(os.Stderr, a...)
+	}
+}
+
+// 'logLevelFlag' implements the "-v" option, each occurrence of which raises
+// the logging level by one step.
+
+type logLevelFlag struct{}
+
+func (logLevelFlag) String() string   { return "" }
+func (logLevelFlag) IsBoolFlag() bool { return true }
+
+func (logLevelFlag) Set(value string) error {
+	v, err := strconv.ParseBool(value)
+	if err == nil && v && logLevel < LOG_DEBUG {
+		logLevel++
+	}
+	return err
+}
+
+// Shell completion. The "--generate-completion=bash|zsh" option (which is
+// deliberately left out of the usage message) writes a completion script for
+// this program to stdout. The script is built from the options registered
+// with the flag package, so that it can't drift from them.
+//
+// 'completionActions' says how the values of particular options are
+// completed, and 'argAction' says how command-line arguments are completed.
+// An action is "pid" (PIDs from /proc), "file", "dir", "user" (user names),
+// "" (no completion), or a space-separated list of the words that are
+// permitted.
+
+var completionActions = map[string]string{
+	"subtree":    "pid",
+	"namespaces": strings.Join(allNamespaceSymlinkNames, " "),
+	"color":      "auto always never",
+	"map-format": "raw ranges",
+	"ns-format":  "full symlink",
+	"tree":       "none unicode ascii",
+	"width":      "",
+	"output":     "",
+	"format":     "tsv",
+	"watch":      "",
+	"procfs":     "dir",
+	"capture":    "file",
+	"replay":     "file",
+	"diff":       "",
+	"translate":  "",
+	"user":       "user",
+	"uid":        "",
+}
+
+const argAction = "pid"
+
+// bashAction() returns bash code that completes the word in '$cur' according to
+// 'action'.
+
+func bashAction(action string) string {
+	switch action {
+	case "":
+		return ""
+	case "pid":
+		return `COMPREPLY=( $(compgen -W "$(ls /proc | ` +
+			`grep '^[0-9]')" -- "$cur") )`
+	case "file":
+		return `COMPREPLY=( $(compgen -f -- "$cur") )`
+	case "dir":
+		return `COMPREPLY=( $(compgen -d -- "$cur") )`
+	case "user":
+		return `COMPREPLY=( $(compgen -u -- "$cur") )`
+	default:
+		return `COMPREPLY=( $(compgen -W "` + action + `" -- "$cur") )`
+	}
+}
+
+// zshAction() returns the zsh _arguments action corresponding to 'action'.
+
+func zshAction(action string) string {
+	switch action {
+	case "":
+		return " "
+	case "pid":
+		return "_pids"
+	case "file":
+		return "_files"
+	case "dir":
+		return "_files -/"
+	case "user":
+		return "_users"
+	default:
+		return "(" + action + ")"
+	}
+}
+
+// generateCompletion() writes a completion script for 'shell' ("bash" or "zsh")
+// to stdout.
+
+func generateCompletion(shell string) {
+	const prog = "namespaces_of"
+
+	// Options are completed with a double dash, except for the
+	// single-letter ones such as "-q".
+
+	dashes := func(name string) string {
+		if len(name) == 1 {
+			return "-" + name
+		}
+		return "--" + name
+	}
+
+	var names []string
+	var flags []*flag.Flag
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name != "generate-completion" {
+			names = append(names, dashes(f.Name))
+			flags = append(flags, f)
+		}
+	})
+
+	isBool := func(f *flag.Flag) bool {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		return ok && b.IsBoolFlag()
+	}
+
+	if shell == "zsh" {
+		quoter := strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`,
+			":", `\:`)
+
+		fmt.Println("#compdef " + prog)
+		fmt.Println()
+		fmt.Println("_arguments \\")
+		for _, f := range flags {
+			spec := dashes(f.Name)
+			if !isBool(f) {
+				spec += "="
+			}
+			spec += "[" + quoter.Replace(f.Usage) + "]"
+			if !isBool(f) {
+				spec += ":" + f.Name + ":" +
+					zshAction(completionActions[f.Name])
+			}
+			fmt.Println("\t'" + spec + "' \\")
+		}
+		fmt.Println("\t'*:argument:" + zshAction(argAction) + "'")
+		return
+	}
+
+	// Go's flag package accepts both "--opt=value" and "--opt value";
+	// bash splits the former into three words at the '='.
+
+	fmt.Println(`_` + prog + `()
+{
+	local cur prev opt
+	cur=${COMP_WORDS[COMP_CWORD]}
+	prev=${COMP_WORDS[COMP_CWORD-1]}
+	COMPREPLY=()
+
+	if [ "$cur" = "=" ]; then
+		opt=$prev
+		cur=
+	elif [ "$prev" = "=" ]; then
+		opt=${COMP_WORDS[COMP_CWORD-2]}
+	else
+		opt=$prev
+	fi
+
+	case $opt in`)
+
+	for _, f := range flags {
+		if !isBool(f) {
+			fmt.Println("\t-" + f.Name + "|--" + f.Name + ")")
+			action := bashAction(completionActions[f.Name])
+			if action != "" {
+				fmt.Println("\t\t" + strings.Replace(action,
+					"\n", "\n\t\t", -1))
+			}
+			fmt.Println("\t\treturn ;;")
+		}
+	}
+
+	fmt.Println(`	esac
+
+	case $cur in
+	-*)
+		COMPREPLY=( $(compgen -W "` + strings.Join(names, " ") + `" \
+			-- "$cur") )
+		return ;;
+	esac
+
+	` + strings.Replace(bashAction(argAction), "\n", "\n\t", -1) + `
+}
+complete -F _` + prog + ` ` + prog)
+}
+
+// showUsageAndExit() prints a command-line usage message for this program and
+// terminates the program with the specified 'status' value.
+
+func showUsageAndExit(status int) {
+
+	// The usage message is a diagnostic, written to stderr, unless it
+	// was asked for with "--help".
+
+	out := os.Stdout
+	if status != 0 {
+		out = os.Stderr
+	}
+
+	fmt.Fprintln(out,
+		`Usage: namespaces_of [options] [--subtree=<pid> | <pid>...]
+
+Show the namespace memberships of one or more processes in the context of the
+user or PID namespace hierarchy.
+
+This program does one of the following:
+* If provided with one or more PID command-line arguments, the program shows
+  the namespace memberships of those processes.
+* Otherwise, if the '--subtree=<pid>' option is specified, then the program
+  shows the subtree of the user or PID namespace hierarchy that is rooted at
+  the namespace of the specified PID.
+* Otherwise, the program shows the namespace memberships of all processes on
+  the system.
+
+In place of a PID, the command-line arguments and the '--subtree' option may
+give the pathname of a namespace file, for example, a bind mount such as
+/run/netns/foo, or /proc/1/ns/user; any argument that contains a '/' is
+treated as a pathname. The namespace file named by '--subtree' must be a user
+namespace (or, with '--pidns', a PID namespace); with '--pidns', the files
+named by the command-line arguments must be PID namespaces. The '--self'
+option is equivalent to '--subtree=$$' in the shell that runs the program:
+it shows the subtree rooted at the program's own user (or PID) namespace.
+
+By default, the program shows namespace memberships in the context of the user
+namespace hierarchy, showing also the nonuser namespaces owned by each user
+namespace. If the '--pidns' option is specified, the program shows only
+the PID namespace hierarchy, omitting other types of namespace.
+
+Error, warning, and progress messages are written to standard error.
+
+On kernels older than Linux 4.9, the relationships between namespaces can't
+be discovered; the program then displays a flat list of the namespaces and
+their member processes. (On Linux 4.9 and 4.10, the creator UIDs of user
+namespaces are shown as "unknown".)
+
+Default values for the options can be set in the file
+$XDG_CONFIG_HOME/tlpi-tools/config (or ~/.config/tlpi-tools/config), in
+lines of the form "option = value" that follow a "[namespaces_of]" line.
+Options on the command line override those in the file.
+
+Options:
+
+-q		Don't display warning messages (for example, about processes
+		that terminated during the scan). Error messages are still
+		displayed.
+-v		Display progress messages. If specified twice, also display
+		debugging messages.
+
+--all-pids	For each displayed process, show PIDs in all namespaces of
+		which the process is a member (used only in conjunction with
+		'--pidns').
+--capture=<file>
+		As well as displaying the results of the scan, write a
+		snapshot of the scan to <file>, as a tar archive that
+		contains the /proc files (status, comm, cmdline, uid_map,
+		and so on) of the member processes and a manifest that
+		records the namespaces and the relationships between them.
+		The snapshot can be displayed with '--replay'.
+--changed-only	Show only the processes that are members of at least one
+		namespace other than the initial namespaces (those of PID
+		1), and only the parts of the hierarchy that contain such
+		processes or noninitial namespaces. The root namespace is
+		always shown, with a note of the number of its member
+		processes that were elided.
+--color=<when>	Use color in the displayed output "always", "never", or
+		only if standard output is a terminal ("auto", the default).
+		In "auto" mode, color is not used if the NO_COLOR
+		environment variable is set to a nonempty value.
+--count		Instead of displaying the hierarchy, display, for each type
+		of namespace, the number of namespaces and the minimum,
+		median, and maximum number of member processes in those
+		namespaces, for example:
+		    net: 23 namespaces, members min/median/max = 0/1/412
+		(With an even number of namespaces, the lower of the two
+		middle values is shown as the median.) This is faster than
+		displaying the hierarchy, since the commands of processes
+		and the UID and GID maps of user namespaces aren't read.
+--diff=<pidA>,<pidB>
+		Instead of displaying a namespace hierarchy, display a table
+		that compares the namespaces of two processes: for each
+		type of namespace, the inode numbers of the two processes'
+		namespaces, and whether they are the "same" or "different".
+		A namespace type that isn't supported by the kernel is shown
+		as "n/a". A summary line follows the table. The exit status
+		is 0 if the processes share all of their namespaces, or 4 if
+		they don't.
+--dot		Display the namespace hierarchy as a Graphviz DOT digraph,
+		suitable for rendering with, for example, "dot -Tpng". Each
+		namespace is a node labeled with its type, inode number,
+		and (for user namespaces) creator UID, and, unless
+		'--no-pids' is specified, its member PIDs. Edges from a
+		user namespace to the nonuser namespaces that it owns are
+		dashed.
+--empty-only	Show only the namespaces that have no member processes
+		and no descendant namespaces that have member processes,
+		along with their ancestors, which are shown as context.
+		With '--user' or '--uid', only the processes owned by
+		the selected user are counted as members.
+--format=tsv	Instead of displaying the hierarchy, display one line for
+		each pair of a namespace and one of its member processes
+		(or one line for a namespace that has no members), with
+		the tab-separated fields TYPE, DEVICE, INODE, PARENT (the
+		inode number of the parent or owning namespace), CREATOR
+		(the creator UID of a user namespace), PID, and COMM. A
+		field that doesn't apply is shown as "-". The output is
+		preceded by a header line, unless '--no-header' is
+		specified, and is never colored or wrapped. Because each
+		line names a process, '--no-pids' can't be specified.
+--json		Display the namespace hierarchy as a JSON array containing
+		the topmost namespace of each displayed tree. Each namespace
+		is an object containing its type, device ID, inode number,
+		member PIDs, and child (or owned) namespaces; user
+		namespaces also include the creator UID and the UID and
+		GID maps ("unknown" if the namespace has no member processes
+		from which the maps can be read). Namespaces owned by
+		invisible ancestor user namespaces are children of an
+		object marked "invisible". With '--show-uts' and
+		'--show-net', UTS namespaces include the hostname and
+		network namespaces include the list of interfaces.
+--limits	Compare the number of namespaces of each type created by
+		each UID with the per-user limits in /proc/sys/user (for
+		example, max_user_namespaces). User namespaces whose
+		creator has used more than 80% of any of the limits are
+		marked "[near limit]" (in red, if color is used), and a
+		table showing, for each UID, the number of namespaces of
+		each type and the limit ("count/limit") is displayed after
+		the hierarchy. Nonuser namespaces are charged to the
+		creator of their owning user namespace; the initial user
+		namespace, and the namespaces that it owns, aren't
+		charged to anyone.
+--list		Display a table with one row for each namespace that has
+		member processes, in the style of lsns(8). The columns are
+		the namespace's inode number (NS), type (TYPE), number of
+		member processes (NPROCS), and the PID, user (USER), and
+		command line (COMMAND) of its lowest-numbered member
+		process. The rows are sorted by inode number.
+--map-format=<fmt>
+		Show the UID and GID maps of user namespaces in the format
+		<fmt>: "raw" (the default), as in /proc/PID/uid_map, with
+		white space compressed, or "ranges", in which each line of
+		a map is shown as a pair of ranges, for example,
+		"container 0-65535 => host 100000-165535", and the map that
+		maps all IDs to themselves is shown as "identity". This
+		option doesn't affect the '--json' output.
+--names		Show the user name of the creator of each user namespace
+		after its UID, for example, "<UID: 1000 (mtk)>". A UID that
+		has no user name (perhaps because it is mapped from another
+		user namespace) is shown just as a number.
+--namespaces=<list>
+		Show just the listed namespace types when displaying the
+		user namespace hierarchy. <list> is a comma-separated list
+		containing one or more of "cgroup", "ipc", "mnt", "net",
+		"pid", "user", and "uts". (The default is to include all
+		nonuser namespace types in the display of the user namespace
+		hierarchy.) To see just the user namespace hierarchy, use
+		"--namespaces=user".
+--no-color	Suppress the use of color in the displayed output (the
+		same as '--color=never').
+--no-config	Don't read the configuration file.
+--no-header	Omit the header line from the output of '--format'.
+--no-kthreads	Omit kernel threads (processes with the PF_KTHREAD flag in
+		/proc/PID/stat) from the scan of all processes. The number
+		of kernel threads that were omitted is shown at the end of
+		the list of member processes of the root namespace, for
+		example, "[+312 kernel threads]" (or, if the hierarchy
+		can't be discovered, on a line of its own).
+--no-pids	Suppress the display of the processes that are members
+		of each namespace.
+--nonempty	Hide the namespaces that have no member processes and no
+		descendant namespaces that have member processes. With
+		'--user' or '--uid', only the processes owned by the
+		selected user are counted as members.
+--ns-format=<fmt>
+		Show namespace IDs in the format <fmt>: "full" (the
+		default), which shows the device ID and inode number, for
+		example, 'user {4 4026531837}', or "symlink", which shows
+		the type and inode number in the form used by the kernel
+		for the contents of the /proc/PID/ns symlinks, for example,
+		'user:[4026531837]'. The format applies to the hierarchy,
+		and to the NS column of '--list', the '--diff' table, the
+		'--dot' labels, and messages that refer to namespaces.
+--output=<cols>	Show just the listed columns, in the listed order, in the
+		'--list' table. <cols> is a comma-separated list of column
+		names (case is ignored), for example, "TYPE,NS,PID".
+--pidns         Display the PID namespace hierarchy (rather than the user
+		namespace hierarchy). The init process of each PID
+		namespace (the member whose PID in the namespace is 1) is
+		listed first, marked "(init)"; if all processes were
+		scanned and the namespace has no init process (because it
+		has exited), the namespace is marked "<init exited>".
+--pinned	Also discover namespaces that are pinned into existence by
+		bind mounts (found via /proc/self/mountinfo) or by file
+		descriptors that processes hold open (found via
+		/proc/PID/fd). Each such namespace is annotated with the
+		mount point or /proc/PID/fd/N pathname that pins it, for
+		example, "(pinned by /run/netns/foo)". Such namespaces may
+		have no member processes.
+--procfs=<dir>	Inspect the processes in the procfs mounted at <dir>,
+		rather than at /proc. This allows, for example, inspection
+		of the host's processes from inside a container that has
+		the host's /proc bind mounted at /host/proc.
+--replay=<file>	Instead of scanning the live system, display the snapshot
+		that was written to <file> by '--capture'. The snapshot
+		records either the user namespace hierarchy or (if it was
+		captured with '--pidns') the PID namespace hierarchy, and
+		'--pidns' must be specified accordingly. Options that need
+		the live system (PID arguments, '--subtree', '--self',
+		'--watch', '--diff', '--translate', '--show-uts',
+		'--show-net', and '--procfs') can't be used, and threads
+		and pinned namespaces are shown only if '--threads' or
+		'--pinned' was given to '--capture'.
+--self		Show the subtree of the hierarchy that is rooted at the
+		user namespace (or, with '--pidns', the PID namespace) of
+		this program. All processes are still scanned, so that the
+		member processes of the subtree are shown.
+--show-cmdline	Display the full command line of each process (from
+		/proc/PID/cmdline), truncated with an ellipsis if it doesn't
+		fit in the width of the terminal (or the width given by
+		'--width'). For kernel threads, which have no command line,
+		the command name is shown in square brackets.
+--show-comm	Displays the command being run by each process.
+--show-net	Show the network interfaces in each network namespace that
+		has member processes, for example,
+		'net {4 4026531840} (lo*, eth0*, veth3ab1)'. Interfaces
+		that are up are marked with '*'. If the interfaces can't
+		be discovered (for example, because we lack the privilege
+		to join the namespace), "?" is shown.
+--show-owner-ns	On the line for each nonuser namespace, show the user
+		namespace that owns it, for example,
+		'pid {4 4026531836} owner=user:[4026531837]'. If the owner
+		is an invisible ancestor user namespace, "owner=invisible"
+		is shown.
+--show-uts	Show the hostname of each UTS namespace, for example,
+		'uts {4 4026531838} "myhost"'. If the hostname can't be
+		discovered (for example, because we lack the privilege to
+		join the namespace), "?" is shown.
+--stats		After the output, report on standard error the time taken
+		to scan and to display the namespaces, and the numbers of
+		/proc/PID directories visited, files opened, and ioctl()
+		operations performed.
+--strict	When scanning all processes, terminate with an error if
+		the namespace files of a process can't be opened because
+		of a lack of permission. (By default, such processes are
+		skipped, and a warning reports how many were skipped.)
+--summary	After the hierarchy (or the '--list' table), display the
+		number of namespaces of each type, the number of distinct
+		member processes, the maximum nesting depth of the user
+		namespaces (or, with '--pidns', the PID namespaces), and
+		the number of namespaces that have no member processes.
+		Only what was displayed is counted, so that the summary
+		respects '--namespaces', '--subtree', '--changed-only',
+		'--user', '--uid', '--nonempty', and '--empty-only', and,
+		with '--list', counts just the namespaces in the table
+		(which omits the namespaces that have no members).
+--threads	Also scan the namespace memberships of each thread, so that
+		threads that have joined a mount, network, UTS, IPC, or
+		cgroup namespace with setns(2) are shown as members of that
+		namespace, in the form "pid/tid". (A thread that is in the
+		same namespace as its process is not listed separately.)
+--translate=<pid>:<target-pid>
+		Instead of displaying a namespace hierarchy, report the PID
+		that the process <target-pid> has inside the PID namespace
+		of the process <pid> (for example, the PID of a host
+		process as seen from inside a container), and the PID in
+		our PID namespace of the process that has the PID
+		<target-pid> inside the PID namespace of <pid> (for
+		example, the host PID of "container PID 7"). The
+		translation uses the NS_GET_TGID_IN_PIDNS and
+		NS_GET_TGID_FROM_PIDNS ioctl() operations where they are
+		available (Linux 6.11 and later, and not with '--procfs'),
+		and otherwise the 'NStgid' fields in /proc/PID/status. The
+		exit status is 0 if at least one of the translations
+		succeeded, or 1 if neither did.
+--tree=<style>	Draw lines that connect each namespace in the hierarchy to
+		its parent (or owner) and to its siblings. <style> is
+		"unicode" (using the box-drawing characters "├──", "│",
+		and "└──"), "ascii" (using "|--", "|", and similar ASCII
+		characters), or "none" (the default, in which the
+		hierarchy is shown just by indentation).
+--uid=<uid>	Display only the member processes whose effective UID is
+		<uid>, and only the parts of the hierarchy that contain
+		such processes. The root namespace is always shown.
+--user=<name>	The same as '--uid', but the user is specified by name.
+--watch=<seconds>
+		Rescan the namespaces every <seconds> seconds, and redraw
+		the display (clearing the screen first, if standard output
+		is a terminal). Namespaces that appeared since the previous
+		scan are highlighted in green (or, if color is not used,
+		marked "[new]"), and a line is displayed for each namespace
+		that disappeared. Type Control-C to stop.
+--width=<n>	Wrap the lists of PIDs to fit in <n> columns, or, if <n> is
+		0, don't wrap them at all, so that each list is displayed
+		on a single line. By default, the lists are wrapped to the
+		width of the terminal (or, if that can't be determined, to
+		the width given by the COLUMNS environment variable, or to
+		80 columns), or not at all if standard output is not a
+		terminal. With '--watch', the width of the terminal is
+		rechecked before each redisplay.
+
+Syntax notes:
+* No PID command-line arguments may be supplied when using '--subtree=<pid>'
+  or '--self', and '--self' can't be combined with '--subtree'.
+* At most one of '--namespaces' and '--pidns' may be specified.
+* '--no-color' can't be specified in conjunction with '--color=always'.
+* '--all-pids' can be specified only in conjunction with '--pidns'.
+* '--no-pids' can't be specified in conjunction with '--show-comm',
+  '--show-cmdline', or '--all-pids'.
+* At most one of '--show-comm' and '--show-cmdline' may be specified.
+* '--changed-only' can't be specified in conjunction with '--json', '--dot',
+  '--list', or '--format'.
+* '--summary' can't be specified in conjunction with '--json', '--dot', or
+  '--format'.
+* At most one of '--nonempty' and '--empty-only' may be specified, and
+  neither can be specified in conjunction with '--json', '--dot', '--list',
+  '--format', or '--count'.
+* '--show-owner-ns' can't be specified in conjunction with '--json',
+  '--dot', '--list', '--format', or '--count'.
+* '--count' can't be specified in conjunction with '--json', '--dot',
+  '--list', '--format', '--summary', '--limits', '--changed-only', '--watch',
+  '--show-comm', '--show-cmdline', or '--all-pids'.
+* At most one of '--user' and '--uid' may be specified, and neither can be
+  specified in conjunction with '--json', '--dot', '--list', or '--format'.
+* '--limits' can't be specified in conjunction with '--json', '--dot',
+  '--list', '--format', or '--pidns'.
+* At most one of '--json', '--dot', '--list', and '--format' may be
+  specified.
+* '--json', '--dot', '--list', and '--format' can't be specified in
+  conjunction with '--show-comm', '--show-cmdline', or '--all-pids'.
+* '--output' can be specified only in conjunction with '--list'.
+* At most one of '--capture' and '--replay' may be specified, and neither
+  can be specified in conjunction with '--watch', '--diff', or
+  '--translate'.
+* '--no-header' can be specified only in conjunction with '--format'.
+* '--format' can't be specified in conjunction with '--no-pids'.
+* No PID command-line arguments may be supplied when using '--pinned'.
+* '--diff' can't be specified in conjunction with PID command-line
+  arguments, '--subtree', '--watch', '--json', '--dot', '--list', or
+  '--format'.
+* '--translate' can't be specified in conjunction with PID command-line
+  arguments, '--subtree', '--watch', '--diff', '--json', '--dot', '--list',
+  or '--format'.
+* '--threads' can't be specified in conjunction with '--pidns'.
+* No PID command-line arguments may be supplied when using '--watch', and
+  '--watch' can't be specified in conjunction with '--json', '--dot',
+  '--list', '--format', or '--stats'.`)
+
+	os.Exit(status)
+}
+
+// parseArgs() parses the command line in the same way as flag.Parse(), except
+// that options may also appear after (or among) the nonoption arguments, so
+// that, for example, "namespaces_of 1234 --no-color" works as expected. An
+// argument of "--" ends the options: all later arguments are nonoption
+// arguments. A negative number, and a lone "-", are nonoption arguments. Any
+// other argument that starts with '-' is treated as an option, so that the flag
+// package diagnoses it if it is unrecognized.
+
+func parseArgs() {
+	var options, nonOptions []string
+
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if arg == "--" {
+			nonOptions = append(nonOptions, args[i+1:]...)
+			break
+		}
+
+		if _, err := strconv.Atoi(arg); err == nil || len(arg) < 2 ||
+			arg[0] != '-' {
+			nonOptions = append(nonOptions, arg)
+			continue
+		}
+
+		options = append(options, arg)
+
+		// An option that takes a value may have the value in the
+		// following argument, which must stay with the option.
+
+		name := strings.TrimLeft(arg, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+
+		f := flag.Lookup(name)
+		if f == nil || i+1 == len(args) {
+			continue
+		}
+
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		if !ok || !b.IsBoolFlag() {
+			i++
+			options = append(options, args[i])
+		}
+	}
+
+	options = append(options, "--")
+	flag.CommandLine.Parse(append(options, nonOptions...))
+}
+
+// parseCmdLineOptions() parses command-line options and returns them
+// conveniently packaged in a structure.
+
+func parseCmdLineOptions() CmdLineOptions {
+
+	var opts CmdLineOptions
+
+	// Parse command-line options.
+
+	helpPtr := flag.Bool("help", false, "Show detailed usage message")
+	completionPtr := flag.String("generate-completion", "",
+		"Write a bash or zsh completion script")
+	quietPtr := flag.Bool("q", false, "Display only error messages")
+	flag.Var(logLevelFlag{}, "v", "Display progress messages "+
+		"(repeat for debugging messages)")
+	noColorPtr := flag.Bool("no-color", false,
+		"Don't use color in output display")
+	noPidsPtr := flag.Bool("no-pids", false,
+		"Don't show PIDs that are members of each namespace")
+	showCommandPtr := flag.Bool("show-comm", false,
+		"Show command run by each PID")
+	flag.BoolVar(&opts.noKthreads, "no-kthreads", false, "Omit kernel "+
+		"threads from the lists of member processes")
+	flag.BoolVar(&opts.limits, "limits", false, "Compare namespace "+
+		"usage with the limits in /proc/sys/user")
+	flag.BoolVar(&opts.summary, "summary", false, "Show a summary of "+
+		"the namespace counts after the hierarchy")
+	flag.BoolVar(&opts.nonempty, "nonempty", false, "Hide namespaces "+
+		"whose subtree has no member processes")
+	flag.BoolVar(&opts.emptyOnly, "empty-only", false, "Show only "+
+		"namespaces whose subtree has no member processes")
+	flag.BoolVar(&opts.count, "count", false, "Show only the number "+
+		"and sizes of the namespaces of each type")
+	flag.BoolVar(&opts.changedOnly, "changed-only", false,
+		"Show only processes not solely in the initial namespaces")
+	flag.BoolVar(&opts.showCmdline, "show-cmdline", false,
+		"Show command line run by each PID")
+	allPidsPtr := flag.Bool("all-pids", false,
+		"Show all PIDs of each process")
+	pidnsPtr := flag.Bool("pidns", false, "Show PID "+
+		"namespace hierarchy (instead of user namespace hierarchy)")
+	subtreePtr := flag.String("subtree", "", "Show namespace subtree "+
+		"rooted at namespace of specified process")
+	selfPtr := flag.Bool("self", false, "Show namespace subtree "+
+		"rooted at namespace of this program")
+	namespacesPtr := flag.String("namespaces", "", "Show just the "+
+		"specified namespaces")
+	statsPtr := flag.Bool("stats", false, "Report the cost of the scan")
+	jsonPtr := flag.Bool("json", false, "Display namespace hierarchy "+
+		"as JSON")
+	dotPtr := flag.Bool("dot", false, "Display namespace hierarchy "+
+		"in Graphviz DOT format")
+	listPtr := flag.Bool("list", false, "Display a table of "+
+		"namespaces")
+	formatPtr := flag.String("format", "", "Display one line per "+
+		"namespace member in this format (\"tsv\")")
+	flag.BoolVar(&opts.noHeader, "no-header", false, "Omit the header "+
+		"line of the '--format' output")
+	outputPtr := flag.String("output", "", "Show just the specified "+
+		"columns in the table")
+	flag.BoolVar(&opts.strict, "strict", false, "Fail if any process "+
+		"can't be inspected")
+	flag.BoolVar(&opts.threads, "threads", false, "Also scan the "+
+		"namespaces of each thread")
+	flag.BoolVar(&opts.pinned, "pinned", false, "Also show namespaces "+
+		"pinned by bind mounts or open file descriptors")
+	flag.BoolVar(&opts.showNet, "show-net", false, "Show interfaces "+
+		"of each network namespace")
+	flag.BoolVar(&opts.showOwnerNS, "show-owner-ns", false, "Show "+
+		"owning user namespace of each nonuser namespace")
+	flag.BoolVar(&opts.showUTS, "show-uts", false, "Show hostname of "+
+		"each UTS namespace")
+	namesPtr := flag.Bool("names", false, "Show user names of "+
+		"namespace creators")
+	colorPtr := flag.String("color", "auto", "When to use color "+
+		"(\"auto\", \"always\", or \"never\")")
+	widthPtr := flag.Int("width", 0, "Wrap output to this many columns")
+	translatePtr := flag.String("translate", "", "Translate a PID into "+
+		"and out of the PID namespace of another (<pid>:<target-pid>)")
+	diffPtr := flag.String("diff", "", "Compare the namespaces of two "+
+		"processes (<pidA>,<pidB>)")
+	flag.StringVar(&opts.nsFormat, "ns-format", "full", "How to show "+
+		"namespace IDs (\"full\" or \"symlink\")")
+	mapFormatPtr := flag.String("map-format", "raw", "How to show UID "+
+		"and GID maps (\"raw\" or \"ranges\")")
+	treePtr := flag.String("tree", "none", "Draw the hierarchy with "+
+		"\"unicode\" or \"ascii\" lines, or \"none\"")
+	userPtr := flag.String("user", "", "Show only processes owned by "+
+		"this user")
+	uidPtr := flag.Int("uid", -1, "Show only processes owned by this UID")
+	flag.StringVar(&opts.capture, "capture", "", "Write a snapshot of "+
+		"the scan to this file")
+	flag.StringVar(&opts.replay, "replay", "", "Display from a snapshot "+
+		"instead of the live system")
+	procfsPtr := flag.String("procfs", "/proc", "Inspect the processes "+
+		"in the procfs mounted at this directory")
+	flag.IntVar(&opts.watch, "watch", 0, "Rescan and redisplay every "+
+		"this many seconds")
+	noConfigPtr := flag.Bool("no-config", false, "Don't read the "+
+		"configuration file")
+
+	parseArgs()
+
+	if !*noConfigPtr {
+		loadConfig()
+	}
+
+	opts.showPids = !*noPidsPtr
+	opts.procfs = filepath.Clean(*procfsPtr)
+	opts.showPidnsHierarchy = *pidnsPtr
+	opts.showCommand = *showCommandPtr || opts.showCmdline
+	opts.showAllPids = *allPidsPtr
+	opts.subtreePID = *subtreePtr
+	opts.showStats = *statsPtr
+	opts.json = *jsonPtr
+	opts.dot = *dotPtr
+	opts.list = *listPtr
+	opts.showNames = *namesPtr
+
+	if *helpPtr {
+		showUsageAndExit(0)
+	}
+
+	if *completionPtr != "" {
+		if *completionPtr != "bash" && *completionPtr != "zsh" {
+			logMessage(LOG_QUIET, "Bad value for "+
+				"--generate-completion option: "+
+				*completionPtr)
+			showUsageAndExit(1)
+		}
+		generateCompletion(*completionPtr)
+		os.Exit(0)
+	}
+
+	// "--self" is "--subtree" applied to our own namespace. The
+	// namespace is named via /proc/self, rather than via the "--procfs"
+	// directory, since our own PID may not be visible there.
+
+	if *selfPtr {
+		opts.self = true
+		if opts.subtreePID != "" {
+			logMessage(LOG_QUIET, "'--self' can't be combined "+
+				"with '--subtree'")
+			showUsageAndExit(1)
+		}
+		if len(flag.Args()) > 0 {
+			logMessage(LOG_QUIET, "No PID arguments may "+
+				"specified in combination with the '--self' "+
+				"option")
+			showUsageAndExit(1)
+		}
+
+		opts.subtreePID = "/proc/self/ns/user"
+		if opts.showPidnsHierarchy {
+			opts.subtreePID = "/proc/self/ns/pid"
+		}
+	}
+
+	if *quietPtr {
+		if logLevel != LOG_NORMAL {
+			logMessage(LOG_QUIET, "'-q' can't be combined with "+
+				"'-v'")
+			showUsageAndExit(1)
+		}
+		logLevel = LOG_QUIET
+	}
+
+	// By default, color is used, and output is wrapped to the width of the
+	// terminal, only if standard output is a terminal. The "--color" and
+	// "--width" options override these defaults. In addition, following
+	// the convention described at https://no-color.org, color is not used
+	// by default if the NO_COLOR environment variable is nonempty.
+	// "--no-color" is an alias for "--color=never".
+
+	isTTY := isTerminal(syscall.Stdout)
+
+	if *colorPtr == "always" && *noColorPtr {
+		logMessage(LOG_QUIET, "'--no-color' can't be combined with "+
+			"'--color=always'")
+		showUsageAndExit(1)
+	}
+
+	switch *colorPtr {
+	case "auto":
+		opts.useColor = isTTY && !*noColorPtr &&
+			os.Getenv("NO_COLOR") == ""
+	case "always":
+		opts.useColor = true
+	case "never":
+		opts.useColor = false
+	default:
+		logMessage(LOG_QUIET, "Bad value for --color option: "+
+			*colorPtr)
+		showUsageAndExit(1)
+	}
+
+	// "--user" and "--uid" both select the processes of a single user.
+
+	opts.ownerUID = *uidPtr
+
+	if *userPtr != "" {
+		if *uidPtr >= 0 {
+			logMessage(LOG_QUIET, "'--user' can't be combined "+
+				"with '--uid'")
+			showUsageAndExit(1)
+		}
+
+		u, err := user.Lookup(*userPtr)
+		if err != nil {
+			logMessage(LOG_QUIET, "Bad value for --user option: "+
+				*userPtr)
+			showUsageAndExit(1)
+		}
+		opts.ownerUID, _ = strconv.Atoi(u.Uid)
+	} else if *uidPtr < -1 {
+		logMessage(LOG_QUIET, "Bad value for --uid option: "+
+			strconv.Itoa(*uidPtr))
+		showUsageAndExit(1)
+	}
+
+	if _, fnd := treeStyles[*treePtr]; !fnd && *treePtr != "none" {
+		logMessage(LOG_QUIET, "Bad value for --tree option: "+
+			*treePtr)
+		showUsageAndExit(1)
+	}
+	opts.tree = *treePtr
+
+	if opts.nsFormat != "full" && opts.nsFormat != "symlink" {
+		logMessage(LOG_QUIET, "Bad value for --ns-format option: "+
+			opts.nsFormat)
+		showUsageAndExit(1)
+	}
+
+	switch *mapFormatPtr {
+	case "raw":
+		opts.mapRanges = false
+	case "ranges":
+		opts.mapRanges = true
+	default:
+		logMessage(LOG_QUIET, "Bad value for --map-format option: "+
+			*mapFormatPtr)
+		showUsageAndExit(1)
+	}
+
+	if *widthPtr < 0 {
+		logMessage(LOG_QUIET, "Bad value for --width option: "+
+			strconv.Itoa(*widthPtr))
+		showUsageAndExit(1)
+	}
+
+	// An explicit "--width" (even "--width=0", meaning "never wrap")
+	// overrides the terminal width. Otherwise, the terminal width is
+	// obtained just once (or, with "--watch", once per redisplay, so that
+	// changes in the size of the terminal are respected).
+
+	widthSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "width" {
+			widthSet = true
+		}
+	})
+
+	opts.width = *widthPtr
+	if !widthSet && isTTY {
+		opts.autoWidth = true
+		opts.width = getTerminalWidth(80)
+	}
+
+	if *namespacesPtr != "" && opts.showPidnsHierarchy {
+		logMessage(LOG_QUIET, "'--namespaces=<list>' can't be "+
+			"specified with '--pidns'")
+		showUsageAndExit(1)
+	}
+
+	if opts.showAllPids && !opts.showPidnsHierarchy {
+		logMessage(LOG_QUIET, "'--all-pids' can be specified only "+
+			"with '--pidns'")
+		showUsageAndExit(1)
+	}
+
+	if *showCommandPtr && opts.showCmdline {
+		logMessage(LOG_QUIET, "'--show-comm' can't be combined with "+
+			"'--show-cmdline'")
+		showUsageAndExit(1)
+	}
+
+	if !opts.showPids && (opts.showCommand || opts.showAllPids) {
+		logMessage(LOG_QUIET, "'--no-pids' can't be combined with "+
+			"'--show-comm', '--show-cmdline', or '--all-pids'")
+		showUsageAndExit(1)
+	}
+
+	switch *formatPtr {
+	case "":
+	case "tsv":
+		opts.tsv = true
+	default:
+		logMessage(LOG_QUIET, "Bad value for --format option: "+
+			*formatPtr)
+		showUsageAndExit(1)
+	}
+
+	if opts.noHeader && !opts.tsv {
+		logMessage(LOG_QUIET, "'--no-header' can be specified only "+
+			"with '--format'")
+		showUsageAndExit(1)
+	}
+
+	if opts.tsv && !opts.showPids {
+		logMessage(LOG_QUIET, "'--format' can't be combined with "+
+			"'--no-pids'")
+		showUsageAndExit(1)
+	}
+
+	formats := 0
+	for _, f := range []bool{opts.json, opts.dot, opts.list, opts.tsv} {
+		if f {
+			formats++
+		}
+	}
+
+	if formats > 1 {
+		logMessage(LOG_QUIET, "At most one of '--json', '--dot', "+
+			"'--list', and '--format' may be specified")
+		showUsageAndExit(1)
+	}
+
+	if opts.limits && (formats > 0 || opts.showPidnsHierarchy) {
+		logMessage(LOG_QUIET, "'--limits' can't be combined with "+
+			"'--json', '--dot', '--list', '--format', or "+
+			"'--pidns'")
+		showUsageAndExit(1)
+	}
+
+	if opts.summary && (opts.json || opts.dot || opts.tsv) {
+		logMessage(LOG_QUIET, "'--summary' can't be combined with "+
+			"'--json', '--dot', or '--format'")
+		showUsageAndExit(1)
+	}
+
+	if opts.count && (formats > 0 || opts.summary || opts.limits ||
+		opts.changedOnly || opts.watch != 0) {
+		logMessage(LOG_QUIET, "'--count' can't be combined with "+
+			"'--json', '--dot', '--list', '--format', "+
+			"'--summary', '--limits', '--changed-only', or "+
+			"'--watch'")
+		showUsageAndExit(1)
+	}
+
+	if opts.count && (opts.showCommand || opts.showAllPids) {
+		logMessage(LOG_QUIET, "'--count' can't be combined with "+
+			"'--show-comm', '--show-cmdline', or '--all-pids'")
+		showUsageAndExit(1)
+	}
+
+	if opts.nonempty && opts.emptyOnly {
+		logMessage(LOG_QUIET, "'--nonempty' can't be combined with "+
+			"'--empty-only'")
+		showUsageAndExit(1)
+	}
+
+	if (opts.nonempty || opts.emptyOnly) && (formats > 0 || opts.count) {
+		logMessage(LOG_QUIET, "'--nonempty' and '--empty-only' can't "+
+			"be combined with '--json', '--dot', '--list', "+
+			"'--format', or '--count'")
+		showUsageAndExit(1)
+	}
+
+	if opts.showOwnerNS && (formats > 0 || opts.count) {
+		logMessage(LOG_QUIET, "'--show-owner-ns' can't be combined "+
+			"with '--json', '--dot', '--list', '--format', or "+
+			"'--count'")
+		showUsageAndExit(1)
+	}
+
+	if formats > 0 && opts.ownerUID >= 0 {
+		logMessage(LOG_QUIET, "'--user' and '--uid' can't be "+
+			"combined with '--json', '--dot', '--list', or "+
+			"'--format'")
+		showUsageAndExit(1)
+	}
+
+	if formats > 0 && opts.changedOnly {
+		logMessage(LOG_QUIET, "'--changed-only' can't be combined "+
+			"with '--json', '--dot', '--list', or '--format'")
+		showUsageAndExit(1)
+	}
+
+	if formats > 0 && (opts.showCommand || opts.showAllPids) {
+		logMessage(LOG_QUIET, "'--json', '--dot', '--list', and "+
+			"'--format' can't be combined with '--show-comm', "+
+			"'--show-cmdline', or '--all-pids'")
+		showUsageAndExit(1)
+	}
+
+	if *outputPtr != "" && !opts.list {
+		logMessage(LOG_QUIET, "'--output' can be specified only with "+
+			"'--list'")
+		showUsageAndExit(1)
+	}
+
+	// Parse the list of columns for the "--list" table.
+
+	opts.listColumns = listColumnNames
+
+	if *outputPtr != "" {
+		opts.listColumns = nil
+		for _, col := range strings.Split(*outputPtr, ",") {
+			col = strings.ToUpper(strings.TrimSpace(col))
+
+			valid := false
+			for _, name := range listColumnNames {
+				if col == name {
+					valid = true
+				}
+			}
+
+			if !valid {
+				logMessage(LOG_QUIET, "Bad column for "+
+					"--output option: "+col)
+				showUsageAndExit(1)
+			}
+
+			opts.listColumns = append(opts.listColumns, col)
+		}
+	}
+
+	if opts.capture != "" && opts.replay != "" {
+		logMessage(LOG_QUIET, "'--capture' can't be combined with "+
+			"'--replay'")
+		showUsageAndExit(1)
+	}
+
+	if (opts.capture != "" || opts.replay != "") &&
+		(opts.watch != 0 || *diffPtr != "" || *translatePtr != "") {
+		logMessage(LOG_QUIET, "'--capture' and '--replay' can't be "+
+			"combined with '--watch', '--diff', or '--translate'")
+		showUsageAndExit(1)
+	}
+
+	// A snapshot records the results of a scan, and the procfs from which
+	// its files were read; the options that inspect the live system
+	// can't be applied to it.
+
+	if opts.replay != "" {
+		procfsSet := false
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "procfs" {
+				procfsSet = true
+			}
+		})
+
+		if len(flag.Args()) > 0 || opts.subtreePID != "" ||
+			opts.showUTS || opts.showNet || procfsSet {
+			logMessage(LOG_QUIET, "'--replay' can't be combined "+
+				"with PID arguments, '--subtree', '--self', "+
+				"'--show-uts', '--show-net', or '--procfs'")
+			showUsageAndExit(1)
+		}
+	} else if err := checkProcfs(opts.procfs); err != nil {
+		exitWithError(fmt.Errorf("--procfs=%s: %w", opts.procfs, err))
+	}
+
+	if *diffPtr != "" {
+		opts.diffPIDs = strings.Split(*diffPtr, ",")
+
+		for _, pid := range opts.diffPIDs {
+			if _, err := strconv.Atoi(pid); err != nil {
+				opts.diffPIDs = nil
+			}
+		}
+
+		if len(opts.diffPIDs) != 2 {
+			logMessage(LOG_QUIET, "Bad value for --diff option: "+
+				*diffPtr)
+			showUsageAndExit(1)
+		}
+
+		if len(flag.Args()) > 0 || opts.subtreePID != "" ||
+			opts.watch != 0 || formats > 0 {
+			logMessage(LOG_QUIET, "'--diff' can't be combined "+
+				"with PID arguments, '--subtree', '--watch', "+
+				"'--json', '--dot', '--list', or '--format'")
+			showUsageAndExit(1)
+		}
+	}
+
+	if *translatePtr != "" {
+		opts.translatePIDs = strings.Split(*translatePtr, ":")
+
+		for _, pid := range opts.translatePIDs {
+			if n, err := strconv.Atoi(pid); err != nil || n <= 0 {
+				opts.translatePIDs = nil
+			}
+		}
+
+		if len(opts.translatePIDs) != 2 {
+			logMessage(LOG_QUIET, "Bad value for --translate "+
+				"option: "+*translatePtr)
+			showUsageAndExit(1)
+		}
+
+		if len(flag.Args()) > 0 || opts.subtreePID != "" ||
+			opts.watch != 0 || formats > 0 || opts.diffPIDs != nil {
+			logMessage(LOG_QUIET, "'--translate' can't be "+
+				"combined with PID arguments, '--subtree', "+
+				"'--watch', '--diff', '--json', '--dot', "+
+				"'--list', or '--format'")
+			showUsageAndExit(1)
+		}
+	}
+
+	if opts.watch < 0 {
+		logMessage(LOG_QUIET, "Bad value for --watch option: "+
+			strconv.Itoa(opts.watch))
+		showUsageAndExit(1)
+	}
+
+	if opts.threads && opts.showPidnsHierarchy {
+		logMessage(LOG_QUIET, "'--threads' can't be specified with "+
+			"'--pidns'")
+		showUsageAndExit(1)
+	}
+
+	if opts.pinned && len(flag.Args()) > 0 {
+		logMessage(LOG_QUIET, "No PID arguments may specified in "+
+			"combination with the '--pinned' option")
+		showUsageAndExit(1)
+	}
+
+	if opts.watch > 0 && len(flag.Args()) > 0 {
+		logMessage(LOG_QUIET, "No PID arguments may specified in "+
+			"combination with the '--watch' option")
+		showUsageAndExit(1)
+	}
+
+	if opts.watch > 0 && (formats > 0 || opts.showStats) {
+		logMessage(LOG_QUIET, "'--watch' can't be combined with "+
+			"'--json', '--dot', '--list', '--format', or "+
+			"'--stats'")
+		showUsageAndExit(1)
+	}
+
+	if opts.subtreePID != "" && len(flag.Args()) > 0 {
+		logMessage(LOG_QUIET, "No PID arguments may specified in "+
+			"combination with the '--subtree=<pid>' option")
+		showUsageAndExit(1)
+	}
+
+	// If "--namespaces=<list>" was specified, parse list of namespaces
+	// to display, by tokenizing <list> on comma delimiters, finding each
+	// token string in 'namespaceToStr', and adding corresponding key
+	// (a CLONE_NEW* value) to 'opts.namespaces'.
+
+	list := allNamespaceSymlinkNames // Default is all namespaces
+
+	if *namespacesPtr != "" {
+		list = strings.Split(*namespacesPtr, ",")
+	}
+
+	opts.namespaces = 0
+
+	for _, nsName := range list {
+		nsFlag := 0
+		for k, v := range namespaceToStr {
+			if v == nsName {
+				nsFlag = k
+			}
+		}
+
+		if nsFlag == 0 {
+			logMessage(LOG_QUIET, "Bad namespace for "+
+				"--namespaces option: "+nsName)
+			showUsageAndExit(1)
+		}
+
+		opts.namespaces |= nsFlag
+	}
+
+	return opts
+}
+
+// report() writes the statistics in 's' to standard error.
+
+func (s scanStats) report() {
+	fmt.Fprintf(os.Stderr, "Scan:    %v (%d /proc/PID directories, "+
+		"%d files opened, %d ioctls)\n",
+		s.scanTime.Round(time.Microsecond), s.procDirs, s.filesOpened,
+		s.ioctls)
+	fmt.Fprintf(os.Stderr, "Display: %v\n",
+		s.renderTime.Round(time.Microsecond))
+}
+
+// A snapshot archive is a tar archive that records what the program read
+// while displaying the live system, so that the same display can later be
+// reproduced (perhaps on another machine) with '--replay'. Each /proc file
+// that was read is stored under its absolute pathname (minus the leading
+// slash); so that the replayed display can use options that the capturing
+// display didn't, we also store the status, comm, cmdline, and map files of
+// every member process. The namespaces themselves, and the relationships
+// between them, are discovered with ioctl() operations rather than by
+// reading files, and so are recorded as lines of the form "<key> <value>..."
+// in a manifest entry. Namespace IDs are written as "device:inode".
+
+const snapshotManifest = "namespaces_of.manifest"
+
+// State used when capturing a snapshot.
+
+var captureFile *os.File
+var captureTar *tar.Writer
+var captured = make(map[string]bool) // Pathnames already in the archive
+
+// State used when replaying a snapshot: the contents of the recorded files,
+// indexed by absolute pathname.
+
+var replayFiles map[string][]byte
+
+// archiveName() returns the name under which 'path' is recorded in a
+// snapshot archive.
+
+func archiveName(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(abs, "/"), nil
+}
+
+// readFile() returns the contents of the file 'path', either from the live
+// system (recording the contents in the snapshot archive, if we are
+// capturing) or from the snapshot being replayed. The pathnames used when
+// replaying are those recorded at the time of the capture (see
+// loadReplay()), so they are already absolute.
+
+func readFile(path string) ([]byte, error) {
+
+	if replayFiles != nil {
+		data, fnd := replayFiles[filepath.Clean(path)]
+		if !fnd {
+			return nil, &os.PathError{Op: "open", Path: path,
+				Err: syscall.ENOENT}
+		}
+		return data, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err == nil && captureTar != nil {
+		if cerr := captureFileContents(path, data); cerr != nil {
+			return nil, cerr
+		}
+	}
+
+	return data, err
+}
+
+// openCapture() creates the snapshot archive 'path'.
+
+func openCapture(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	captureFile = f
+	captureTar = tar.NewWriter(f)
+
+	return nil
+}
+
+// captureFileContents() records the contents of the file 'path' in the
+// snapshot archive.
+
+func captureFileContents(path string, data []byte) error {
+	name, err := archiveName(path)
+	if err != nil || captured[name] {
+		return err
+	}
+
+	hdr := &tar.Header{Name: name, Mode: 0444, Size: int64(len(data))}
+
+	err = captureTar.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	captured[name] = true
+
+	_, err = captureTar.Write(data)
+	return err
+}
+
+// captureExtraFile() records the file 'path' in the snapshot archive if it
+// isn't already there. Files that can't be read (for example, because the
+// process has terminated) are simply left out of the archive.
+
+func captureExtraFile(path string) error {
+	name, err := archiveName(path)
+	if err != nil || captured[name] {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	return captureFileContents(path, data)
+}
+
+// nsIDString() returns the "device:inode" form in which a namespace ID is
+// written in a snapshot manifest.
+
+func nsIDString(ns NamespaceID) string {
+	return strconv.FormatUint(ns.device, 10) + ":" +
+		strconv.FormatUint(ns.inode, 10)
+}
+
+// parseNSID() parses a namespace ID written by nsIDString().
+
+func parseNSID(s string) (NamespaceID, error) {
+	var ns NamespaceID
+
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return ns, errors.New("bad namespace ID: " + s)
+	}
+
+	dev, err1 := strconv.ParseUint(s[:i], 10, 64)
+	ino, err2 := strconv.ParseUint(s[i+1:], 10, 64)
+	if err1 != nil || err2 != nil {
+		return ns, errors.New("bad namespace ID: " + s)
+	}
+
+	return NamespaceID{dev, ino}, nil
+}
+
+// closeCapture() adds to the snapshot archive the files of the member
+// processes (and threads) that the display didn't read, and the limits in
+// /proc/sys/user, then writes the manifest that describes the namespaces in
+// 'nsi' and closes the archive.
+
+func (nsi *NamespaceInfo) closeCapture(opts CmdLineOptions) error {
+
+	var manifest []string
+
+	abs, err := filepath.Abs(opts.procfs)
+	if err != nil {
+		return err
+	}
+
+	manifest = append(manifest, "procfs "+strconv.Quote(abs),
+		"pidns "+strconv.FormatBool(opts.showPidnsHierarchy),
+		"root "+nsIDString(nsi.rootNS),
+		"kthreads "+strconv.Itoa(nsi.kthreads),
+		"permdenied "+strconv.Itoa(nsi.permDenied))
+
+	if nsi.flat {
+		manifest = append(manifest, "flat")
+	}
+	if nsi.noCreatorUIDs {
+		manifest = append(manifest, "nocreatoruids")
+	}
+
+	for _, name := range []string{"cgroup", "ipc", "mnt", "net", "pid",
+		"time", "user", "uts"} {
+		err := captureExtraFile(opts.procfs + "/sys/user/max_" + name +
+			"_namespaces")
+		if err != nil {
+			return err
+		}
+	}
+
+	for ns, attribs := range nsi.nsList {
+		id := nsIDString(ns)
+
+		manifest = append(manifest, "ns "+id+" "+
+			strconv.Itoa(attribs.nsType)+" "+
+			strconv.Itoa(attribs.creatorUID)+" "+
+			nsIDString(attribs.owner))
+
+		line := "pids " + id
+		for _, pid := range attribs.pids {
+			line += " " + strconv.Itoa(pid)
+
+			dir := opts.procfs + "/" + strconv.Itoa(pid)
+			for _, file := range []string{"status", "comm",
+				"cmdline", "uid_map", "gid_map"} {
+				if err := captureExtraFile(dir + "/" +
+					file); err != nil {
+					return err
+				}
+			}
+		}
+		manifest = append(manifest, line)
+
+		line = "children " + id
+		for _, child := range attribs.children {
+			line += " " + nsIDString(child)
+		}
+		manifest = append(manifest, line)
+
+		line = "threads " + id
+		for _, t := range attribs.threads {
+			line += " " + t.String()
+
+			dir := opts.procfs + "/" + strconv.Itoa(t.pid)
+			tdir := dir + "/task/" + strconv.Itoa(t.tid)
+			for _, path := range []string{dir + "/status",
+				tdir + "/comm", tdir + "/cmdline"} {
+				if err := captureExtraFile(path); err != nil {
+					return err
+				}
+			}
+		}
+		manifest = append(manifest, line)
+
+		for _, pin := range attribs.pinnedBy {
+			manifest = append(manifest, "pinned "+id+" "+
+				strconv.Quote(pin))
+		}
+	}
+
+	data := []byte(strings.Join(manifest, "\n") + "\n")
+	hdr := &tar.Header{Name: snapshotManifest, Mode: 0644,
+		Size: int64(len(data))}
+
+	err = captureTar.WriteHeader(hdr)
+	if err == nil {
+		_, err = captureTar.Write(data)
+	}
+	if err == nil {
+		err = captureTar.Close()
+	}
+
+	cerr := captureFile.Close()
+	if err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// loadReplay() reads the snapshot archive 'path' into memory, and rebuilds
+// 'nsi' from its manifest. The procfs pathname that was recorded at the time
+// of the capture (under which the recorded files are stored) is returned.
+
+func (nsi *NamespaceInfo) loadReplay(path string,
+	opts CmdLineOptions) (string, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	replayFiles = make(map[string][]byte)
+
+	var manifest string
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", errors.New(path + ": " + err.Error())
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return "", err
+		}
+
+		if hdr.Name == snapshotManifest {
+			manifest = string(data)
+		} else {
+			replayFiles["/"+hdr.Name] = data
+		}
+	}
+
+	if manifest == "" {
+		return "", errors.New(path + ": not a namespaces_of snapshot " +
+			"(no manifest)")
+	}
+
+	procfs, err := nsi.parseManifest(manifest, opts)
+	if err != nil {
+		return "", errors.New(path + ": " + err.Error())
+	}
+
+	if procfs == "" {
+		return "", errors.New(path + ": manifest doesn't record the " +
+			"procfs pathname")
+	}
+
+	return procfs, nil
+}
+
+// parseManifest() rebuilds 'nsi' from the manifest of a snapshot archive,
+// returning the recorded procfs pathname. An error is returned if the
+// snapshot records a different kind of hierarchy (user or PID) from the one
+// that 'opts' requests. Unrecognized lines are ignored.
+
+func (nsi *NamespaceInfo) parseManifest(data string,
+	opts CmdLineOptions) (string, error) {
+
+	procfs := ""
+	pidns := false
+
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "flat":
+			if opt := hierarchyOption(opts); opt != "" {
+				return "", flatOptionError(opt)
+			}
+			nsi.flat = true
+			continue
+		case "nocreatoruids":
+			nsi.noCreatorUIDs = true
+			continue
+		}
+
+		if len(fields) < 2 {
+			continue
+		}
+
+		var err error
+
+		switch fields[0] {
+		case "procfs":
+			procfs, err = strconv.Unquote(strings.TrimPrefix(line,
+				"procfs "))
+
+		case "pidns":
+			pidns, err = strconv.ParseBool(fields[1])
+
+		case "root":
+			nsi.rootNS, err = parseNSID(fields[1])
+
+		case "kthreads":
+			nsi.kthreads, err = strconv.Atoi(fields[1])
+
+		case "permdenied":
+			nsi.permDenied, err = strconv.Atoi(fields[1])
+
+		default:
+			err = nsi.parseNamespaceLine(line, fields)
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("manifest: %q: %w", line, err)
+		}
+	}
+
+	if pidns && !opts.showPidnsHierarchy {
+		return "", errors.New("the snapshot records the PID " +
+			"namespace hierarchy; '--pidns' is required")
+	}
+	if !pidns && opts.showPidnsHierarchy {
+		return "", errors.New("the snapshot records the user " +
+			"namespace hierarchy; '--pidns' can't be used")
+	}
+
+	return procfs, nil
+}
+
+// parseNamespaceLine() parses a manifest line ('fields' are its words) that
+// describes one of the attributes of a namespace.
+
+func (nsi *NamespaceInfo) parseNamespaceLine(line string,
+	fields []string) error {
+
+	ns, err := parseNSID(fields[1])
+	if err != nil {
+		return err
+	}
+
+	if fields[0] == "ns" {
+		if len(fields) != 5 {
+			return errors.New("wrong number of fields")
+		}
+
+		attribs := &NamespaceAttribs{}
+
+		attribs.nsType, err = strconv.Atoi(fields[2])
+		if err != nil {
+			return err
+		}
+		attribs.creatorUID, err = strconv.Atoi(fields[3])
+		if err != nil {
+			return err
+		}
+		attribs.owner, err = parseNSID(fields[4])
+		if err != nil {
+			return err
+		}
+
+		nsi.nsList[ns] = attribs
+		return nil
+	}
+
+	attribs, fnd := nsi.nsList[ns]
+	if !fnd {
+		return errors.New("namespace not yet described by an 'ns' line")
+	}
+
+	switch fields[0] {
+	case "pids":
+		for _, f := range fields[2:] {
+			pid, err := strconv.Atoi(f)
+			if err != nil {
+				return err
+			}
+			attribs.pids = append(attribs.pids, pid)
+		}
+
+	case "children":
+		for _, f := range fields[2:] {
+			child, err := parseNSID(f)
+			if err != nil {
+				return err
+			}
+			attribs.children = append(attribs.children, child)
+		}
+
+	case "threads":
+		for _, f := range fields[2:] {
+			var t threadID
+			_, err := fmt.Sscanf(f, "%d/%d", &t.pid, &t.tid)
+			if err != nil {
+				return err
+			}
+			attribs.threads = append(attribs.threads, t)
+		}
+
+	case "pinned":
+		pin, err := strconv.Unquote(strings.TrimPrefix(line,
+			"pinned "+fields[1]+" "))
+		if err != nil {
+			return err
+		}
+		attribs.pinnedBy = append(attribs.pinnedBy, pin)
+	}
+
+	return nil
+}
+
+// Default values for command-line options can be supplied in a
+// configuration file that is shared with other programs. Each line of the
+// file has the form "option = value", and applies to the program named in
+// the most recent "[program]" section header; alternatively, an option can
+// be written as "program.option". Blank lines and lines that start with
+// '#' are ignored. The file is read after the command line has been parsed,
+// and supplies values only for the options that the command line didn't
+// set (see loadConfig()).
+
+const configProgram = "namespaces_of"
+
+// configFilePath() returns the pathname of the configuration file.
+
+func configFilePath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+
+	return filepath.Join(dir, "tlpi-tools", "config")
+}
+
+// checkProcfs() returns an error if 'dir' is not a directory that contains at
+// least one PID directory, as a procfs mount does.
+
+func checkProcfs(dir string) error {
+
+	found := false
+
+	err := forEachPIDDir(dir, func(name string) bool {
+		found = true
+		return false
+	})
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return errors.New("no PID directories found (is this a " +
+			"procfs mount?)")
+	}
+
+	return nil
+}
+
+// Groups of options that conflict with, or override, one another. For
+// example, "--no-color" on the command line overrides "color = always" in
+// the configuration file, rather than being rejected in combination with
+// it, and "-q" overrides "v = true".
+
+var configOptionGroups = [][]string{
+	{"q", "v"},
+	{"color", "no-color"},
+	{"user", "uid"},
+	{"json", "dot", "list", "format"},
+}
+
+// loadConfig() sets the options that the configuration file (if there is
+// one) specifies for this program, except for those that were set on the
+// command line, or that are in a group (see 'configOptionGroups') one of
+// whose options was set on the command line. Problems with the file, such
+// as unknown options or malformed lines, are reported as warnings, and the
+// offending lines are ignored.
+
+func loadConfig() {
+	path := configFilePath()
+
+	overridden := make(map[string]bool)
+
+	flag.Visit(func(f *flag.Flag) {
+		overridden[f.Name] = true
+
+		for _, group := range configOptionGroups {
+			for _, name := range group {
+				if name != f.Name {
+					continue
+				}
+				for _, other := range group {
+					overridden[other] = true
+				}
+			}
+		}
+	})
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logMessage(LOG_NORMAL, "Warning:", err)
+		}
+		return
+	}
+
+	section := ""
+
+	for i, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		where := path + ":" + strconv.Itoa(i+1) + ":"
+
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				logMessage(LOG_NORMAL, where,
+					"malformed section header")
+				section = ""
+				continue
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		// Malformed lines in other programs' sections are left for
+		// those programs to report.
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			if section == "" || section == configProgram {
+				logMessage(LOG_NORMAL, where,
+					"expected \"option = value\"")
+			}
+			continue
+		}
+
+		option := strings.TrimSpace(line[:eq])
+		value := strings.TrimSpace(line[eq+1:])
+
+		program := section
+		if dot := strings.Index(option, "."); dot >= 0 {
+			program = option[:dot]
+			option = option[dot+1:]
+		}
+
+		if program == "" {
+			logMessage(LOG_NORMAL, where, "option \""+option+
+				"\" is not in a [program] section")
+			continue
+		}
+
+		if program != configProgram {
+			continue
+		}
+
+		if flag.Lookup(option) == nil || option == "no-config" {
+			logMessage(LOG_NORMAL, where, "unknown option \""+
+				option+"\"")
+			continue
+		}
+
+		if overridden[option] {
+			continue
+		}
+
+		err = flag.Set(option, value)
+		if err != nil {
+			logMessage(LOG_NORMAL, where, "bad value for \""+
+				option+"\":", err)
+		}
+	}
+}
+
+// Read the contents of the UID or GID map of the process with the specified
+// 'pid', whose PID directory is under 'procfs'. 'mapName' is either
+// "uid_map" or "gid_map". The returned string contains the map with white
+// space compressed.
+
+func readMap(procfs string, pid int, mapName string) (bool, string) {
+
+	mapFile := procfs + "/" + strconv.Itoa(pid) + "/" + mapName
+
+	buf, err := readFile(mapFile)
+	if err != nil {
+
+		// Probably, the process terminated between the
+		// time we accessed the namespace files and the
+		// time we tried to open the map file.
+
+		return false, "deleted"
+	} else {
+		space := regexp.MustCompile(`\s+`)
+		return true, space.ReplaceAllString(strings.TrimSpace(string(buf)), " ")
+	}
+
+}
+
+// mapString() returns the UID or GID map 'm' (as returned by readMap()) in
+// the form selected by the "--map-format" option: either unchanged, or with
+// each line of the map rendered as a pair of ID ranges, for example,
+// "container 0-65535 => host 100000-165535". The map that maps all IDs to
+// themselves is shown as "identity", and a map that has not been written
+// as "unmapped". A value that is not a map (such as "deleted" or "unknown")
+// is returned unchanged.
+
+func mapString(m string, opts CmdLineOptions) string {
+
+	if !opts.mapRanges || m == "deleted" || m == "unknown" {
+		return m
+	}
+
+	fields := strings.Fields(m)
+
+	if len(fields) == 0 {
+		return "unmapped"
+	}
+
+	if len(fields)%3 != 0 {
+		return m
+	}
+
+	if m == "0 0 4294967295" {
+		return "identity"
+	}
+
+	var ranges []string
+
+	for i := 0; i < len(fields); i += 3 {
+		var nums [3]uint64
+
+		for j := range nums {
+			n, err := strconv.ParseUint(fields[i+j], 10, 32)
+			if err != nil {
+				return m
+			}
+			nums[j] = n
+		}
+
+		inside, outside, count := nums[0], nums[1], nums[2]
+		if count == 0 {
+			return m
+		}
+
+		ranges = append(ranges, fmt.Sprintf("container %d-%d => "+
+			"host %d-%d", inside, inside+count-1, outside,
+			outside+count-1))
+	}
+
+	return strings.Join(ranges, ", ")
+}
+
+// Add UID and GID maps for all of the user namespaces in 'nsi'. The maps are
+// read via the member processes of each namespace; if a namespace has no
+// member processes (as is typically the case for the ancestors of the
+// namespaces of PIDs named on the command line), the maps are "unknown".
+
+func (nsi *NamespaceInfo) addUidGidPMaps(opts CmdLineOptions) {
+
+	for _, ns := range nsi.nsList {
+		if ns.nsType == CLONE_NEWUSER {
+			if len(ns.pids) == 0 {
+				ns.uidMap = "unknown"
+				ns.gidMap = "unknown"
+				continue
+			}
+
+			ns.uidMap = "deleted"
 			ns.gidMap = "deleted"
 
 			// Walk through the list of PIDs in the namespace
@@ -993,16 +6146,20 @@ func (nsi *NamespaceInfo) addUidGidPMaps() {
 			// terminated already.)
 
 			for _, pid := range ns.pids {
-				fnd, val := readMap(pid, "uid_map")
+				fnd, val := readMap(opts.procfs, pid,
+					"uid_map")
 				if fnd {
+					nsi.stats.filesOpened++
 					ns.uidMap = val
 					break
 				}
 			}
 
 			for _, pid := range ns.pids {
-				fnd, val := readMap(pid, "gid_map")
+				fnd, val := readMap(opts.procfs, pid,
+					"gid_map")
 				if fnd {
+					nsi.stats.filesOpened++
 					ns.gidMap = val
 					break
 				}
@@ -1011,12 +6168,479 @@ func (nsi *NamespaceInfo) addUidGidPMaps() {
 	}
 }
 
+// diffNamespaces() implements the "--diff" option: it displays a table that
+// compares the namespaces of the processes 'pidA' and 'pidB', with one row
+// for each of the symlinks in their /proc/PID/ns directories, and a summary
+// line. A namespace type that isn't supported by the kernel (so that a
+// process has no symlink for it) is shown as "n/a". The return value is the
+// program's exit status: 0 if the processes share all of their namespaces,
+// or EXIT_DIFFERENT if they don't.
+
+func diffNamespaces(pidA string, pidB string, opts CmdLineOptions) int {
+
+	// Find the union of the symlinks of the two processes, so that if
+	// the processes have different sets of symlinks (perhaps because one
+	// of them terminated), that is evident.
+
+	nsFiles := map[string]bool{}
+
+	for _, pid := range []string{pidA, pidB} {
+		dir := opts.procfs + "/" + pid + "/ns"
+
+		d, err := os.Open(dir)
+		if err != nil {
+			exitWithError(fmt.Errorf("PID %s: %w", pid, err))
+		}
+		names, err := d.Readdirnames(-1)
+		d.Close()
+		if err != nil {
+			exitWithError(fmt.Errorf("PID %s: %w", pid, err))
+		}
+
+		for _, name := range names {
+			nsFiles[name] = true
+		}
+	}
+
+	var names []string
+	for name := range nsFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rows := [][]string{{"NAMESPACE", "PID " + pidA, "PID " + pidB,
+		"RESULT"}}
+	differ := 0
+	compared := 0
+
+	for _, name := range names {
+		row := []string{name}
+		var ids []NamespaceID
+
+		for _, pid := range []string{pidA, pidB} {
+			var sb syscall.Stat_t
+
+			path := opts.procfs + "/" + pid + "/ns/" + name
+			err := syscall.Stat(path, &sb)
+			if err == syscall.ENOENT {
+				row = append(row, "n/a")
+				continue
+			}
+			if err != nil {
+				exitWithError(&namespaceError{Op: "stat",
+					PID: pid, Path: path, Err: err})
+			}
+
+			// With "--ns-format=symlink", show the namespace just
+			// as the kernel does, in the symlink's contents.
+
+			field := strconv.FormatUint(sb.Ino, 10)
+			if opts.nsFormat == "symlink" {
+				link, err := os.Readlink(path)
+				if err == nil {
+					field = link
+				}
+			}
+
+			row = append(row, field)
+			ids = append(ids, NamespaceID{sb.Dev, sb.Ino})
+		}
+
+		result := "n/a"
+		if len(ids) == 2 {
+			compared++
+			result = "same"
+			if ids[0] != ids[1] {
+				differ++
+				result = "different"
+				if opts.useColor {
+					result = RED + result + NORMAL
+				}
+			}
+		}
+
+		rows = append(rows, append(row, result))
+	}
+
+	for _, line := range formatColumns(rows, columnWidths(rows)) {
+		fmt.Fprintln(output, line)
+	}
+
+	fmt.Fprintln(output)
+	if differ == 0 {
+		fmt.Fprintf(output, "PIDs %s and %s share all %d namespaces\n",
+			pidA, pidB, compared)
+	} else {
+		fmt.Fprintf(output, "PIDs %s and %s differ in %d of %d "+
+			"namespaces\n", pidA, pidB, differ, compared)
+	}
+
+	flushOutput()
+
+	if differ > 0 {
+		return EXIT_DIFFERENT
+	}
+
+	return 0
+}
+
+// translatePID() implements the "--translate" option: it reports the PID
+// that the process 'target' (a PID in our PID namespace) has inside the PID
+// namespace of the process 'pid', and, conversely, the PID in our namespace
+// of the process that is known as 'target' inside the PID namespace of
+// 'pid'. The return value is the program's exit status: 0 if at least one
+// of the translations succeeded, or 1 if neither did.
+
+func translatePID(pid string, target string, opts CmdLineOptions) int {
+
+	namespaceFD, err := openNamespaceSymlink(opts.procfs, pid, "pid")
+	if err != nil {
+		exitWithError(err)
+	}
+	defer syscall.Close(namespaceFD)
+
+	ntarget, _ := strconv.Atoi(target)
+	found := 0
+
+	inNS, err := translateIntoPidns(namespaceFD, pid, ntarget, opts)
+	if err != nil {
+		exitWithError(err)
+	}
+	if inNS > 0 {
+		fmt.Fprintf(output, "PID %s is PID %d in the PID namespace "+
+			"of PID %s\n", target, inNS, pid)
+		found++
+	} else {
+		fmt.Fprintf(output, "PID %s is not visible in the PID "+
+			"namespace of PID %s\n", target, pid)
+	}
+
+	fromNS, err := translateFromPidns(namespaceFD, pid, ntarget, opts)
+	if err != nil {
+		exitWithError(err)
+	}
+	if fromNS > 0 {
+		fmt.Fprintf(output, "PID %s in the PID namespace of PID %s "+
+			"is PID %d in our PID namespace\n", target, pid, fromNS)
+		found++
+	} else {
+		fmt.Fprintf(output, "There is no PID %s in the PID namespace "+
+			"of PID %s\n", target, pid)
+	}
+
+	flushOutput()
+
+	if found == 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// The PID translation ioctl() operations translate PIDs to and from the PID
+// namespace of the caller, which is also the PID namespace of /proc only if
+// "--procfs" wasn't specified. When the operations can't be used, we fall
+// back to the 'NStgid' fields in /proc/PID/status.
+
+// translateIntoPidns() returns the PID that the process 'target' (a PID in
+// our PID namespace) has in the PID namespace referred to by 'namespaceFD',
+// which is the PID namespace of the process 'pid', or 0 if the process isn't
+// visible in that namespace.
+
+func translateIntoPidns(namespaceFD int, pid string, target int,
+	opts CmdLineOptions) (int, error) {
+
+	if opts.procfs == "/proc" {
+		n, err := nsTranslatePID(namespaceFD, NS_GET_TGID_IN_PIDNS,
+			target)
+		if err == nil {
+			return n, nil
+		}
+		if err == syscall.ESRCH {
+			return 0, nil
+		}
+		if err != syscall.ENOTTY && err != syscall.EINVAL {
+			return 0, &namespaceError{
+				Op: "ioctl(NS_GET_TGID_IN_PIDNS)", PID: pid,
+				Err: err}
+		}
+		logMessage(LOG_VERBOSE, "PID translation ioctl() not "+
+			"supported; using /proc/PID/status")
+	}
+
+	// The process is visible in the namespace if the namespace is the
+	// process's PID namespace or one of its ancestors, and then its PID
+	// there is the one at the namespace's level in the 'NStgid' field.
+
+	level, err := pidnsLevel(opts.procfs, pid)
+	if err != nil {
+		return 0, err
+	}
+
+	nspids, err := namespacePIDs(opts.procfs, target)
+	if err != nil {
+		return 0, &namespaceError{Op: "read status",
+			PID: strconv.Itoa(target), Err: err}
+	}
+
+	if len(nspids) <= level {
+		return 0, nil
+	}
+
+	inNS, err := inPidnsSubtree(namespaceFD, opts.procfs, target)
+	if err != nil || !inNS {
+		return 0, err
+	}
+
+	return nspids[level], nil
+}
+
+// translateFromPidns() returns the PID in our PID namespace of the process
+// that has the PID 'target' in the PID namespace referred to by
+// 'namespaceFD', which is the PID namespace of the process 'pid', or 0 if
+// there is no such process.
+
+func translateFromPidns(namespaceFD int, pid string, target int,
+	opts CmdLineOptions) (int, error) {
+
+	if opts.procfs == "/proc" {
+		n, err := nsTranslatePID(namespaceFD, NS_GET_TGID_FROM_PIDNS,
+			target)
+		if err == nil {
+			return n, nil
+		}
+		if err == syscall.ESRCH {
+			return 0, nil
+		}
+		if err != syscall.ENOTTY && err != syscall.EINVAL {
+			return 0, &namespaceError{
+				Op: "ioctl(NS_GET_TGID_FROM_PIDNS)", PID: pid,
+				Err: err}
+		}
+	}
+
+	// Look for a process whose 'NStgid' field has 'target' at the level
+	// of the namespace, and that is a member of the namespace or one of
+	// its descendants.
+
+	level, err := pidnsLevel(opts.procfs, pid)
+	if err != nil {
+		return 0, err
+	}
+
+	found := 0
+
+	err = forEachPIDDir(opts.procfs, func(name string) bool {
+		p, _ := strconv.Atoi(name)
+
+		nspids, err := namespacePIDs(opts.procfs, p)
+		if err != nil || len(nspids) <= level ||
+			nspids[level] != target {
+			return true
+		}
+
+		inNS, err := inPidnsSubtree(namespaceFD, opts.procfs, p)
+		if err == nil && inNS {
+			found = p
+			return false
+		}
+
+		return true
+	})
+
+	return found, err
+}
+
+// pidnsLevel() returns the depth of the PID namespace of the process 'pid'
+// below the PID namespace of /proc (in which the depth is 0).
+
+func pidnsLevel(procfs string, pid string) (int, error) {
+
+	npid, _ := strconv.Atoi(pid)
+
+	nspids, err := namespacePIDs(procfs, npid)
+	if err != nil || len(nspids) == 0 {
+		return 0, &namespaceError{Op: "read NStgid", PID: pid, Err: err}
+	}
+
+	return len(nspids) - 1, nil
+}
+
+// inPidnsSubtree() returns true if the PID namespace of the process 'pid' is
+// the PID namespace referred to by 'namespaceFD' or one of its descendants,
+// which we discover by following the chain of parent namespaces upward.
+
+func inPidnsSubtree(namespaceFD int, procfs string, pid int) (bool, error) {
+
+	target, err := newNamespaceID(namespaceFD)
+	if err != nil {
+		return false, err
+	}
+
+	fd, err := openNamespaceSymlink(procfs, strconv.Itoa(pid), "pid")
+	if err != nil {
+		return false, nil // Probably, the process terminated
+	}
+
+	for {
+		ns, err := newNamespaceID(fd)
+		if err != nil {
+			syscall.Close(fd)
+			return false, err
+		}
+
+		if ns == target {
+			syscall.Close(fd)
+			return true, nil
+		}
+
+		// NS_GET_PARENT fails with EPERM when we reach the PID
+		// namespace of the caller (or the initial namespace).
+
+		parentFD, err := nsIoctl(fd, NS_GET_PARENT)
+		syscall.Close(fd)
+		if err != nil {
+			return false, nil
+		}
+		fd = parentFD
+	}
+}
+
+// watchNamespaces() implements the "--watch" option: every 'opts.watch'
+// seconds, it rescans the namespaces of all processes and redraws the display,
+// highlighting the namespaces that appeared since the previous scan and
+// listing those that disappeared. The loop ends, and the program exits
+// normally, when it is interrupted.
+
+func watchNamespaces(nsSymlinks []string, opts CmdLineOptions) {
+
+	interval := time.Duration(opts.watch) * time.Second
+	clearScreen := isTerminal(syscall.Stdout)
+
+	var prev NamespaceList
+
+	for {
+		nsi := NamespaceInfo{nsList: make(NamespaceList)}
+		statusCache = make(map[int]*procStatus)
+
+		// The context is canceled by an interrupt either during the
+		// scan or while we wait for the next one.
+
+		ctx := startScan()
+
+		err := nsi.addNamespacesForAllProcesses(ctx, nsSymlinks, opts)
+		if err == nil && opts.pinned && ctx.Err() == nil {
+			err = nsi.addPinnedNamespaces(ctx, opts)
+		}
+		if err != nil {
+			exitWithError(err)
+		}
+
+		if ctx.Err() != nil {
+			break // Don't display the results of a partial scan
+		}
+
+		nsi.addUidGidPMaps(opts)
+
+		if opts.autoWidth {
+			opts.width = getTerminalWidth(80)
+		}
+
+		gone := nsi.compareNamespaces(prev, opts)
+
+		if clearScreen {
+			fmt.Fprint(output, CLEAR_SCREEN)
+		} else if prev != nil {
+			fmt.Fprintln(output)
+		}
+		fmt.Fprintf(output, "Every %ds: namespaces_of    %s\n\n",
+			opts.watch, time.Now().Format("2006-01-02 15:04:05"))
+
+		if msg := nsi.skippedWarning(); msg != "" {
+			fmt.Fprintln(output, msg)
+			fmt.Fprintln(output)
+		}
+
+		for _, ns := range gone {
+			fmt.Fprintln(output, "Namespace disappeared:",
+				nsString(prev[ns].nsType, ns, opts))
+		}
+		if len(gone) > 0 {
+			fmt.Fprintln(output)
+		}
+
+		err = nsi.displayNamespaceHierarchies(opts)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		flushOutput()
+
+		prev = nsi.nsList
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+
+		// Each scan has its own context, which we release here rather
+		// than with a deferred call, which would keep every one of
+		// them until the loop ends.
+
+		interrupted := endScan(ctx)
+		cancelScan()
+
+		if interrupted {
+			break
+		}
+	}
+}
+
+// compareNamespaces() compares the namespaces found by the current scan with
+// those in 'prev', the list from the previous scan (nil if there was none).
+// It records the namespaces that are new in 'nsi.newNS', and returns, sorted,
+// the displayable namespaces that have disappeared.
+
+func (nsi *NamespaceInfo) compareNamespaces(prev NamespaceList,
+	opts CmdLineOptions) []NamespaceID {
+
+	nsi.newNS = make(map[NamespaceID]bool)
+
+	if prev == nil {
+		return nil
+	}
+
+	for ns := range nsi.nsList {
+		if _, fnd := prev[ns]; !fnd && ns != invisUserNS {
+			nsi.newNS[ns] = true
+		}
+	}
+
+	old := NamespaceInfo{nsList: prev}
+
+	var gone []NamespaceID
+	for ns := range prev {
+		if _, fnd := nsi.nsList[ns]; !fnd && ns != invisUserNS &&
+			old.isDisplayed(ns, opts) {
+			gone = append(gone, ns)
+		}
+	}
+
+	sort.Slice(gone, func(i, j int) bool {
+		return gone[i].inode < gone[j].inode
+	})
+
+	return gone
+}
+
 func main() {
 
 	var nsi = NamespaceInfo{nsList: make(NamespaceList)}
 
 	var opts CmdLineOptions = parseCmdLineOptions()
 
+	handleSignals(opts.useColor)
+
 	// Determine which namespace symlink files are to be processed.
 	// (By default, all namespaces are processed, but this can be
 	// changed via command-line options.)
@@ -1026,23 +6650,69 @@ func main() {
 		nsSymlinks = []string{"pid"}
 	}
 
-	// Add namespace entries for specified processes.
+	if opts.diffPIDs != nil {
+		os.Exit(diffNamespaces(opts.diffPIDs[0], opts.diffPIDs[1],
+			opts))
+	}
+
+	if opts.translatePIDs != nil {
+		os.Exit(translatePID(opts.translatePIDs[0],
+			opts.translatePIDs[1], opts))
+	}
+
+	if opts.watch > 0 {
+		watchNamespaces(nsSymlinks, opts)
+		return
+	}
+
+	if opts.capture != "" {
+		if err := openCapture(opts.capture); err != nil {
+			exitWithError(err)
+		}
+	}
+
+	// Add namespace entries for specified processes (or, with "--replay",
+	// for the processes recorded in the snapshot).
+
+	interrupted := false
+
+	scanStart := time.Now()
+
+	if opts.replay != "" {
+		procfs, err := nsi.loadReplay(opts.replay, opts)
+		if err != nil {
+			exitWithError(err)
+		}
+		opts.procfs = procfs
+
+		if opts.ownerUID >= 0 {
+			for _, ns := range nsi.nsList {
+				for _, pid := range ns.pids {
+					nsi.recordOwner(strconv.Itoa(pid), opts)
+				}
+				for _, t := range ns.threads {
+					nsi.recordOwner(strconv.Itoa(t.pid),
+						opts)
+				}
+			}
+		}
+
+	} else if len(flag.Args()) == 0 || opts.subtreePID != "" {
+		ctx := startScan()
+		defer cancelScan()
 
-	if len(flag.Args()) == 0 || opts.subtreePID != "" {
-		nsi.addNamespacesForAllProcesses(nsSymlinks, opts)
+		err := nsi.addNamespacesForAllProcesses(ctx, nsSymlinks, opts)
+		if err == nil && opts.pinned && ctx.Err() == nil {
+			err = nsi.addPinnedNamespaces(ctx, opts)
+		}
+		if err != nil {
+			exitWithError(err)
+		}
 
-		// If we scanned all processes on the system (i.e., no PID
-		// command-line arguments were supplied), then we probably have
-		// at least one PID in each user namespace. This enables us to
-		// discover the UID and GID map for each user namespace, so do
-		// that discovery in order that we can display the maps.  We
-		// don't do this if only some of the PIDs on the system are
-		// scanned, since then it's likely that we gathered information
-		// about some user namespaces without discovering any of their
-		// member processes.
+		interrupted = endScan(ctx)
 
-		if len(flag.Args()) == 0 {
-			nsi.addUidGidPMaps()
+		if msg := nsi.skippedWarning(); msg != "" {
+			logMessage(LOG_NORMAL, msg)
 		}
 
 	} else {
@@ -1052,13 +6722,82 @@ func main() {
 		// not options.)
 
 		for _, pid := range flag.Args() {
+			if strings.Contains(pid, "/") {
+				err := nsi.addNamespaceFile(pid, opts)
+				if err != nil {
+					exitWithError(err)
+				}
+				continue
+			}
+
 			for _, nsFile := range nsSymlinks {
-				nsi.addProcessNamespace(pid, nsFile, opts, true)
+				err := nsi.addProcessNamespace(pid, nsFile,
+					opts, true)
+				if err != nil {
+					exitWithError(err)
+				}
 			}
+
+			if opts.threads {
+				err := nsi.addThreadNamespaces(pid, nsSymlinks,
+					opts)
+				if err != nil {
+					exitWithError(err)
+				}
+			}
+
+			if opts.ownerUID >= 0 {
+				nsi.recordOwner(pid, opts)
+			}
+
+			nsi.stats.procDirs++
 		}
 	}
 
+	// Discover the UID and GID map of each user namespace, using the
+	// member processes that we found for it. If we scanned all processes
+	// on the system, we probably have at least one PID in each user
+	// namespace; if only some PIDs were named on the command line, then
+	// some user namespaces (e.g., the ancestors of the namespaces of those
+	// PIDs) may have no known members, and their maps are "unknown".
+	// (The maps aren't displayed by "--count", so we don't read them.)
+
+	if !opts.count {
+		nsi.addUidGidPMaps(opts)
+	}
+
+	nsi.stats.scanTime = time.Since(scanStart)
+
 	// Display the results of the namespace scan.
 
-	nsi.displayNamespaceHierarchies(opts)
+	if interrupted {
+		logMessage(LOG_QUIET, "Scan interrupted: displaying partial "+
+			"results")
+	}
+
+	renderStart := time.Now()
+
+	err := nsi.displayNamespaceHierarchies(opts)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	flushOutput()
+
+	nsi.stats.renderTime = time.Since(renderStart)
+
+	if opts.capture != "" {
+		if err := nsi.closeCapture(opts); err != nil {
+			exitWithError(fmt.Errorf("--capture=%s: %w",
+				opts.capture, err))
+		}
+	}
+
+	if opts.showStats {
+		nsi.stats.report()
+	}
+
+	if interrupted {
+		os.Exit(EXIT_INTERRUPTED)
+	}
 }
@@ -0,0 +1,2903 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// If NAMESPACES_OF_RUN_MAIN is set in the environment, the test binary runs
+// the program itself (with the binary's arguments), instead of the tests,
+// so that a test can run the program as a child process and check its exit
+// status and output; see runMain(). Similarly, if NAMESPACES_OF_SIGNAL_TEST
+// is set, the binary runs signalChild(); if NAMESPACES_OF_INTERRUPT_TEST is
+// set, it runs interruptChild(); and if NAMESPACES_OF_REDIRECT_TEST is set,
+// it runs redirectChild().
+
+func TestMain(m *testing.M) {
+
+	if mode := os.Getenv("NAMESPACES_OF_SIGNAL_TEST"); mode != "" {
+		signalChild(mode)
+	}
+
+	if dir := os.Getenv("NAMESPACES_OF_INTERRUPT_TEST"); dir != "" {
+		interruptChild(dir)
+	}
+
+	if dir := os.Getenv("NAMESPACES_OF_REDIRECT_TEST"); dir != "" {
+		redirectChild(dir)
+	}
+
+	if os.Getenv("NAMESPACES_OF_RUN_MAIN") != "" {
+		os.Args[0] = "namespaces_of"
+		flag.CommandLine = flag.NewFlagSet(os.Args[0],
+			flag.ExitOnError)
+		main()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+// runMain() runs the program, with the arguments 'args', as a child of the
+// test, and returns its standard output, its standard error, and its exit
+// status. The configuration file is not read.
+
+func runMain(tb testing.TB, args ...string) (string, string, int) {
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "NAMESPACES_OF_RUN_MAIN=1",
+		"XDG_CONFIG_HOME="+tb.TempDir())
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	status := 0
+	if errors.As(err, &exitErr) {
+		status = exitErr.ExitCode()
+	} else if err != nil {
+		tb.Fatal(err)
+	}
+
+	return stdout.String(), stderr.String(), status
+}
+
+// TestMapString checks the rendering of UID and GID maps, starting from the
+// contents of /proc/PID/uid_map and /proc/PID/gid_map files (in the format
+// in which the kernel writes them) and reading them with readMap().
+
+func TestMapString(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		file   string // Contents of the map file; "" if unwritten
+		ranges bool   // "--map-format=ranges"
+		want   string
+	}{
+		{
+			name: "initial namespace, raw",
+			file: "         0          0 4294967295\n",
+			want: "0 0 4294967295",
+		},
+		{
+			name:   "initial namespace, ranges",
+			file:   "         0          0 4294967295\n",
+			ranges: true,
+			want:   "identity",
+		},
+		{
+			name:   "unwritten map",
+			file:   "",
+			ranges: true,
+			want:   "unmapped",
+		},
+		{
+			name:   "single ID (unshare -r)",
+			file:   "         0       1000          1\n",
+			ranges: true,
+			want:   "container 0-0 => host 1000-1000",
+		},
+		{
+			name: "rootless container, raw",
+			file: "         0       1000          1\n" +
+				"         1     100000      65536\n",
+			want: "0 1000 1 1 100000 65536",
+		},
+		{
+			name: "rootless container, ranges",
+			file: "         0       1000          1\n" +
+				"         1     100000      65536\n",
+			ranges: true,
+			want: "container 0-0 => host 1000-1000, " +
+				"container 1-65536 => host 100000-165535",
+		},
+		{
+			name: "three ranges, ranges",
+			file: "         0     100000       1000\n" +
+				"      1000       1000          1\n" +
+				"      1001     101001      64535\n",
+			ranges: true,
+			want: "container 0-999 => host 100000-100999, " +
+				"container 1000-1000 => host 1000-1000, " +
+				"container 1001-65535 => host 101001-165535",
+		},
+		{
+			name:   "top of the ID range",
+			file:   "4294967294 4294967294          1\n",
+			ranges: true,
+			want: "container 4294967294-4294967294 => " +
+				"host 4294967294-4294967294",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			procfs := t.TempDir()
+
+			dir := filepath.Join(procfs, "1")
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			err := ioutil.WriteFile(filepath.Join(dir, "uid_map"),
+				[]byte(tt.file), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fnd, m := readMap(procfs, 1, "uid_map")
+			if !fnd {
+				t.Fatalf("readMap() didn't find the map")
+			}
+
+			opts := CmdLineOptions{mapRanges: tt.ranges}
+
+			if got := mapString(m, opts); got != tt.want {
+				t.Errorf("mapString(%q) = %q, want %q", m, got,
+					tt.want)
+			}
+		})
+	}
+}
+
+// TestMapStringNoMap checks that the placeholders used when a map can't be
+// read are displayed unchanged in both formats.
+
+func TestMapStringNoMap(t *testing.T) {
+
+	fnd, deleted := readMap(t.TempDir(), 1, "gid_map")
+	if fnd {
+		t.Fatalf("readMap() found a map that doesn't exist")
+	}
+
+	for _, m := range []string{deleted, "unknown"} {
+		for _, ranges := range []bool{false, true} {
+			opts := CmdLineOptions{mapRanges: ranges}
+			if got := mapString(m, opts); got != m {
+				t.Errorf("mapString(%q) with ranges=%v = %q",
+					m, ranges, got)
+			}
+		}
+	}
+}
+
+// TestWrapText checks wrapText() with empty input, words that fit and words
+// that don't, words longer than the width, a prefix, an indent, terminal
+// escape sequences, and wide and combining characters.
+
+func TestWrapText(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		text   string
+		prefix string
+		width  int
+		indent string
+		want   string
+	}{
+		{"empty", "", "", 10, "", ""},
+		{"white space only", " \t\n ", "PIDs: ", 10, "    ", ""},
+		{"fits", "aaa bbb", "", 7, "", "aaa bbb"},
+		{"wraps", "aaa bbb ccc", "", 7, "", "aaa bbb\nccc"},
+		{"white space collapsed", "a \n\t b", "", 10, "", "a b"},
+		{"long word", "abcdefghij", "", 4, "", "abcd\nefgh\nij"},
+		{"long word after short", "a abcdefgh b", "", 6, "",
+			"a\nabcdef\ngh b"},
+		{"width 0", "ab c", "", 0, "", "a\nb\nc"},
+		{"indent", "aaa bbb ccc", "", 7, "  ",
+			"  aaa bbb\n  ccc"},
+		{"indent with long word", "abcdefgh", "", 4, "\t",
+			"\tabcd\n\tefgh"},
+		{"prefix", "1 2 3 4 5", "PIDs: ", 12, "",
+			"PIDs: 1 2 3\n      4 5"},
+		{"prefix and indent", "1 2 3 4 5", "PIDs: ", 12, "    ",
+			"    PIDs: 1 2 3\n          4 5"},
+		{"prefix wider than width", "ab", "xxxxx", 3, "",
+			"xxxxxa\n     b"},
+		{"escape sequences", RED + "aaa" + NORMAL + " bbb", "", 7, "",
+			RED + "aaa" + NORMAL + " bbb"},
+		{"long word with escape sequence",
+			"ab" + RED + "cd" + NORMAL, "", 2, "",
+			"ab" + RED + "\ncd" + NORMAL},
+		{"wide characters", "日本語 テスト", "", 6, "",
+			"日本語\nテスト"},
+		{"long wide word", "日本語テ", "", 5, "", "日本\n語テ"},
+		{"combining marks", "ééé", "", 2, "",
+			"éé\né"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			got := wrapText(tc.text, tc.prefix, tc.width, tc.indent)
+			if got != tc.want {
+				t.Errorf("wrapText(%q, %q, %d, %q) =\n"+
+					"%q\nwant\n%q", tc.text, tc.prefix,
+					tc.width, tc.indent, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestVisibleWidth checks that visibleWidth() ignores terminal escape
+// sequences and combining marks, and counts wide characters as two columns.
+
+func TestVisibleWidth(t *testing.T) {
+
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{RED + "abc" + NORMAL, 3},
+		{LIGHT_BLUE + NORMAL, 0},
+		{"é", 1},
+		{"日本語", 6},
+		{"a日b", 4},
+		{"\U0001F600", 2},
+	}
+
+	for _, tc := range tests {
+		if got := visibleWidth(tc.s); got != tc.want {
+			t.Errorf("visibleWidth(%q) = %d, want %d",
+				tc.s, got, tc.want)
+		}
+	}
+}
+
+// TestColorEachLine checks that colorEachLine() colors each line from its
+// first character that is not white space or part of the tree drawing,
+// leaves empty lines alone, and restores the color after any reset within
+// a line.
+
+func TestColorEachLine(t *testing.T) {
+
+	tests := []struct {
+		name string
+		buf  string
+		want string
+	}{
+		{"empty", "", ""},
+		{"one line", "abc", RED + "abc" + NORMAL},
+		{"indent", "  abc", "  " + RED + "abc" + NORMAL},
+		{"tree", "│   ├── abc", "│   ├── " + RED + "abc" + NORMAL},
+		{"blank line", "a\n\nb",
+			RED + "a" + NORMAL + "\n\n" + RED + "b" + NORMAL},
+		{"reset", "a" + NORMAL + "b",
+			RED + "a" + NORMAL + RED + "b" + NORMAL},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			if got := colorEachLine(tc.buf, RED); got != tc.want {
+				t.Errorf("colorEachLine(%q) = %q, want %q",
+					tc.buf, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestGetTerminalWidth checks that, when standard output is not a terminal,
+// getTerminalWidth() returns the width given by COLUMNS if that is a
+// positive number, and otherwise the fallback width.
+
+func TestGetTerminalWidth(t *testing.T) {
+
+	if isTerminal(syscall.Stdout) {
+		t.Skip("standard output is a terminal")
+	}
+
+	tests := []struct {
+		columns string
+		want    int
+	}{
+		{"", 80},
+		{"132", 132},
+		{"0", 80},
+		{"-5", 80},
+		{"wide", 80},
+	}
+
+	for _, tc := range tests {
+		t.Setenv("COLUMNS", tc.columns)
+		if got := getTerminalWidth(80); got != tc.want {
+			t.Errorf("COLUMNS=%q: getTerminalWidth(80) = %d, "+
+				"want %d", tc.columns, got, tc.want)
+		}
+	}
+}
+
+// parseOptions() returns the options that parseCmdLineOptions() produces for
+// the command-line arguments 'args'.
+
+func parseOptions(tb testing.TB, args ...string) CmdLineOptions {
+
+	savedArgs, savedFlags := os.Args, flag.CommandLine
+	defer func() { os.Args, flag.CommandLine = savedArgs, savedFlags }()
+
+	os.Args = append([]string{"namespaces_of"}, args...)
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+	return parseCmdLineOptions()
+}
+
+// A 'fakeNamespaces' implements the 'namespaceOps' interface for a fake
+// namespace hierarchy, so that a scan can be tested without touching the
+// live system. It tracks the file descriptors that it hands out, so that a
+// test can check that they were all closed.
+
+type fakeNamespaces struct {
+	files    map[string]NamespaceID      // Namespace of each ns file
+	types    map[NamespaceID]int         // CLONE_NEW* type of each NS
+	users    map[NamespaceID]NamespaceID // Result of NS_GET_USERNS
+	parents  map[NamespaceID]NamespaceID // Result of NS_GET_PARENT
+	creators map[NamespaceID]int         // Creator UIDs of user NSs
+	errs     map[uintptr]error           // Errors from ioctl() operations
+	fds      map[int]NamespaceID
+	nextFD   int
+}
+
+func newFakeNamespaces() *fakeNamespaces {
+	return &fakeNamespaces{
+		files:    make(map[string]NamespaceID),
+		types:    make(map[NamespaceID]int),
+		users:    make(map[NamespaceID]NamespaceID),
+		parents:  make(map[NamespaceID]NamespaceID),
+		creators: make(map[NamespaceID]int),
+		errs:     make(map[uintptr]error),
+		fds:      make(map[int]NamespaceID),
+		nextFD:   100,
+	}
+}
+
+func (f *fakeNamespaces) open(path string) (int, error) {
+	ns, err := f.stat(path)
+	if err != nil {
+		return -1, err
+	}
+	f.nextFD++
+	f.fds[f.nextFD] = ns
+	return f.nextFD, nil
+}
+
+// stat() is called concurrently by the scan, so it only reads 'f'.
+
+func (f *fakeNamespaces) stat(path string) (NamespaceID, error) {
+	ns, fnd := f.files[path]
+	if !fnd {
+		return NamespaceID{}, syscall.ENOENT
+	}
+	return ns, nil
+}
+
+func (f *fakeNamespaces) id(fd int) (NamespaceID, error) {
+	ns, fnd := f.fds[fd]
+	if !fnd {
+		return NamespaceID{}, syscall.EBADF
+	}
+	return ns, nil
+}
+
+// ioctl() implements NS_GET_NSTYPE, and NS_GET_USERNS and NS_GET_PARENT,
+// which fail with EPERM when the result is outside the fake hierarchy (as
+// the real operations do at the root of the hierarchy). An operation that
+// has an entry in 'errs' fails with that error.
+
+func (f *fakeNamespaces) ioctl(fd int, op uintptr) (int, error) {
+	ns, fnd := f.fds[fd]
+	if !fnd {
+		return -1, syscall.EBADF
+	}
+	if err := f.errs[op]; err != nil {
+		return -1, err
+	}
+
+	var related map[NamespaceID]NamespaceID
+
+	switch op {
+	case NS_GET_NSTYPE:
+		return f.types[ns], nil
+	case NS_GET_USERNS:
+		related = f.users
+	case NS_GET_PARENT:
+		related = f.parents
+	default:
+		return -1, syscall.ENOTTY
+	}
+
+	r, fnd := related[ns]
+	if !fnd {
+		return -1, syscall.EPERM
+	}
+
+	f.nextFD++
+	f.fds[f.nextFD] = r
+	return f.nextFD, nil
+}
+
+func (f *fakeNamespaces) ownerUID(fd int) (int, error) {
+	ns, fnd := f.fds[fd]
+	if !fnd {
+		return -1, syscall.EBADF
+	}
+	return f.creators[ns], nil
+}
+
+func (f *fakeNamespaces) close(fd int) {
+	delete(f.fds, fd)
+}
+
+// useNamespaces() makes the scan use 'f' for its namespace operations until
+// the test ends.
+
+func useNamespaces(tb testing.TB, f namespaceOps) {
+
+	saved := nsOps
+	nsOps = f
+	tb.Cleanup(func() { nsOps = saved })
+}
+
+// Namespace IDs used in the fake hierarchy
+
+var (
+	rootUserNS = NamespaceID{4, 4026531837}
+	rootUTSNS  = NamespaceID{4, 4026531838}
+	rootPidNS  = NamespaceID{4, 4026531836}
+	childUser  = NamespaceID{4, 4026532205}
+	childUTSNS = NamespaceID{4, 4026532206}
+	childPidNS = NamespaceID{4, 4026532207}
+)
+
+// hierarchyFixture() creates a fixture directory that looks (to the scan)
+// like a procfs, along with a fake namespace hierarchy for the processes in
+// it, and returns the directory. In the initial user namespace (created by
+// UID 0) are processes 1 and 2; in a child user namespace created by UID
+// 1000, which owns a UTS namespace and a PID namespace (the child of the
+// initial PID namespace), are processes 300 and 301.
+
+func hierarchyFixture(tb testing.TB) (string, *fakeNamespaces) {
+
+	root := tb.TempDir()
+	f := newFakeNamespaces()
+
+	f.types[rootUserNS] = CLONE_NEWUSER
+	f.types[rootUTSNS] = CLONE_NEWUTS
+	f.types[rootPidNS] = CLONE_NEWPID
+	f.types[childUser] = CLONE_NEWUSER
+	f.types[childUTSNS] = CLONE_NEWUTS
+	f.types[childPidNS] = CLONE_NEWPID
+
+	f.users[rootUTSNS] = rootUserNS
+	f.users[rootPidNS] = rootUserNS
+	f.users[childUser] = rootUserNS
+	f.users[childUTSNS] = childUser
+	f.users[childPidNS] = childUser
+	f.parents[childPidNS] = rootPidNS
+
+	f.creators[rootUserNS] = 0
+	f.creators[childUser] = 1000
+
+	processes := []struct {
+		pid    int
+		comm   string
+		userNS NamespaceID
+		utsNS  NamespaceID
+		pidNS  NamespaceID
+		uidMap string
+		nstgid string
+	}{
+		{1, "systemd", rootUserNS, rootUTSNS, rootPidNS,
+			"0 0 4294967295", "1"},
+		{2, "bash", rootUserNS, rootUTSNS, rootPidNS,
+			"0 0 4294967295", "2"},
+		{300, "sh", childUser, childUTSNS, childPidNS,
+			"0 1000 1", "300\t1"},
+		{301, "sleep", childUser, childUTSNS, childPidNS,
+			"0 1000 1", "301\t2"},
+	}
+
+	for _, p := range processes {
+		dir := filepath.Join(root, strconv.Itoa(p.pid))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			tb.Fatal(err)
+		}
+
+		files := map[string]string{
+			"comm":    p.comm + "\n",
+			"cmdline": p.comm + "\x00",
+			"status": "Name:\t" + p.comm + "\nUid:\t0\t0\t0\t0\n" +
+				"NStgid:\t" + p.nstgid + "\n",
+			"uid_map": p.uidMap + "\n",
+			"gid_map": p.uidMap + "\n",
+		}
+		for name, text := range files {
+			err := ioutil.WriteFile(filepath.Join(dir, name),
+				[]byte(text), 0644)
+			if err != nil {
+				tb.Fatal(err)
+			}
+		}
+
+		f.files[dir+"/ns/user"] = p.userNS
+		f.files[dir+"/ns/uts"] = p.utsNS
+		f.files[dir+"/ns/pid"] = p.pidNS
+	}
+
+	return root, f
+}
+
+// TestDisplayHierarchy builds the hierarchy of hierarchyFixture() and
+// checks the displayed user namespace and PID namespace hierarchies.
+// Nothing is read from the live system.
+
+func TestDisplayHierarchy(t *testing.T) {
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"user namespaces", nil, strings.Join([]string{
+			"user {4 4026531837} <UID: 0;  " +
+				"u: 0 0 4294967295;   g: 0 0 4294967295>",
+			"        [ 1 2 ]",
+			"    user {4 4026532205} <UID: 1000;  " +
+				"u: 0 1000 1;   g: 0 1000 1>",
+			"            [ 300 301 ]",
+			"        pid {4 4026532207}",
+			"                [ 300 301 ]",
+			"        uts {4 4026532206}",
+			"                [ 300 301 ]",
+			"    pid {4 4026531836}",
+			"            [ 1 2 ]",
+			"    uts {4 4026531838}",
+			"            [ 1 2 ]",
+			""}, "\n")},
+		{"PID namespaces", []string{"--pidns"}, strings.Join([]string{
+			"pid {4 4026531836}",
+			"        [ 1 (init) 2 ]",
+			"    pid {4 4026532207}",
+			"            [ 300 (init) 301 ]",
+			""}, "\n")},
+		{"commands", []string{"--pidns", "--show-comm"},
+			strings.Join([]string{
+				"pid {4 4026531836}",
+				"        1     (init)  systemd",
+				"        2      bash",
+				"    pid {4 4026532207}",
+				"            300   (init)  sh",
+				"            301    sleep",
+				""}, "\n")},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			dir, f := hierarchyFixture(t)
+			useNamespaces(t, f)
+
+			opts := parseOptions(t, append([]string{
+				"--procfs=" + dir, "--color=never",
+				"--width=0"}, tc.args...)...)
+
+			var buf bytes.Buffer
+			saved := output
+			output = &lineWriter{out: &buf}
+			defer func() { output = saved }()
+
+			nsSymlinks := []string{"user", "uts", "pid"}
+			if opts.showPidnsHierarchy {
+				nsSymlinks = []string{"pid"}
+			}
+
+			nsi := NamespaceInfo{nsList: make(NamespaceList)}
+
+			err := nsi.addNamespacesForAllProcesses(
+				context.Background(), nsSymlinks, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nsi.addUidGidPMaps(opts)
+
+			err = nsi.displayNamespaceHierarchies(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			output.Flush()
+
+			if got := buf.String(); got != tc.want {
+				t.Errorf("displayed:\n%q\nwant:\n%q",
+					got, tc.want)
+			}
+
+			if len(f.fds) != 0 {
+				t.Errorf("%d file descriptors were left open",
+					len(f.fds))
+			}
+		})
+	}
+}
+
+// TestDisplayWideCommands displays the PID namespace hierarchy of
+// hierarchyFixture(), with the command lines, when the command names and
+// arguments contain double-width (CJK) characters and combining marks. At
+// each output width (all wide enough to leave 'minCommandWidth' columns for
+// the command), no line may be wider than the width, and the long command
+// line must be truncated (but the short one must not).
+
+func TestDisplayWideCommands(t *testing.T) {
+
+	dir, f := hierarchyFixture(t)
+	useNamespaces(t, f)
+
+	cmdlines := map[string]string{
+		"300": "漢字コマンド\x00--オプション\x00" +
+			"ファイル名ファイル名\x00",
+		"301": "cafe\u0301\x00",
+	}
+	for pid, cmdline := range cmdlines {
+		err := ioutil.WriteFile(filepath.Join(dir, pid, "cmdline"),
+			[]byte(cmdline), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for width := 45; width <= 65; width += 5 {
+		opts := parseOptions(t, "--procfs="+dir, "--color=never",
+			"--pidns", "--show-cmdline",
+			"--width="+strconv.Itoa(width))
+
+		var buf bytes.Buffer
+		saved := output
+		output = &lineWriter{out: &buf}
+
+		nsi := NamespaceInfo{nsList: make(NamespaceList)}
+		err := nsi.addNamespacesForAllProcesses(context.Background(),
+			[]string{"pid"}, opts)
+		if err == nil {
+			err = nsi.displayNamespaceHierarchies(opts)
+		}
+		output.Flush()
+		output = saved
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := buf.String()
+		for _, line := range strings.Split(out, "\n") {
+			if visibleWidth(line) > width {
+				t.Errorf("width %d: line %q is too wide", width,
+					line)
+			}
+		}
+		if !strings.Contains(out, "  漢字コマンド") ||
+			!strings.Contains(out, "…\n") {
+			t.Errorf("width %d: command line of PID 300 is not "+
+				"truncated:\n%s", width, out)
+		}
+		if !strings.Contains(out, "  cafe\u0301\n") {
+			t.Errorf("width %d: command line of PID 301 is "+
+				"altered:\n%s", width, out)
+		}
+	}
+}
+
+// If "-update" is given to the test binary, TestGolden rewrites the golden
+// files instead of comparing the output with them.
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+// checkGolden() compares 'got' with the contents of the golden file 'path'
+// (or, with "-update", writes 'got' to the file), and reports the first line
+// that differs.
+
+func checkGolden(t *testing.T, path string, got string) {
+
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := ioutil.WriteFile(path, []byte(got), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run the test with -update to create it)", err)
+	}
+	want := string(buf)
+
+	if got == want {
+		return
+	}
+
+	gotLines := strings.Split(got, "\n")
+	wantLines := strings.Split(want, "\n")
+
+	i := 0
+	for i < len(gotLines) && i < len(wantLines) &&
+		gotLines[i] == wantLines[i] {
+		i++
+	}
+
+	var g, w string
+	if i < len(gotLines) {
+		g = gotLines[i]
+	}
+	if i < len(wantLines) {
+		w = wantLines[i]
+	}
+
+	t.Errorf("output differs from %s at line %d:\ngot:  %q\n"+
+		"want: %q\n(if the change is intended, rerun the test with "+
+		"-update)", path, i+1, g, w)
+}
+
+// More namespace IDs, used in goldenFixture()
+
+var (
+	emptyUser   = NamespaceID{4, 4026532208}
+	nestedUser  = NamespaceID{4, 4026532209}
+	nestedUTSNS = NamespaceID{4, 4026532211}
+	nestedPidNS = NamespaceID{4, 4026532212}
+	orphanUTSNS = NamespaceID{4, 4026532213}
+)
+
+// goldenFixture() extends the hierarchy of hierarchyFixture() with the cases
+// that the display code treats specially: a user namespace (created by UID
+// 1000) that has no member processes, but has a child user namespace
+// (created by UID 2000) whose process, 500, is also in a UTS namespace and
+// in a PID namespace nested two levels deep; and a process, 600, whose UTS
+// namespace is owned by a user namespace that isn't visible (so that it is
+// displayed below the invisible-ancestor entry), and which has a long command
+// line. There are also enough processes (1000 to 1011) in the initial
+// namespaces for their member lists to be wrapped.
+
+func goldenFixture(tb testing.TB) (string, *fakeNamespaces) {
+
+	root, f := hierarchyFixture(tb)
+
+	f.types[emptyUser] = CLONE_NEWUSER
+	f.types[nestedUser] = CLONE_NEWUSER
+	f.types[nestedUTSNS] = CLONE_NEWUTS
+	f.types[nestedPidNS] = CLONE_NEWPID
+	f.types[orphanUTSNS] = CLONE_NEWUTS
+
+	f.users[emptyUser] = rootUserNS
+	f.users[nestedUser] = emptyUser
+	f.users[nestedUTSNS] = nestedUser
+	f.users[nestedPidNS] = nestedUser
+	f.parents[nestedPidNS] = childPidNS
+
+	f.creators[emptyUser] = 1000
+	f.creators[nestedUser] = 2000
+
+	type process struct {
+		pid     int
+		comm    string
+		userNS  NamespaceID
+		utsNS   NamespaceID
+		pidNS   NamespaceID
+		uidMap  string
+		nstgid  string
+		cmdline string
+	}
+
+	processes := []process{
+		{500, "nested", nestedUser, nestedUTSNS, nestedPidNS,
+			"0 2000 1", "500\t3\t1", "nested\x00"},
+		{600, "container", rootUserNS, orphanUTSNS, rootPidNS,
+			"0 0 4294967295", "600", "container\x00--config\x00" +
+				"/etc/container/config.json\x00--verbose\x00"},
+	}
+	for pid := 1000; pid <= 1011; pid++ {
+		processes = append(processes, process{pid, "worker",
+			rootUserNS, rootUTSNS, rootPidNS, "0 0 4294967295",
+			strconv.Itoa(pid), "worker\x00"})
+	}
+
+	for _, p := range processes {
+		dir := filepath.Join(root, strconv.Itoa(p.pid))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			tb.Fatal(err)
+		}
+
+		files := map[string]string{
+			"comm":    p.comm + "\n",
+			"cmdline": p.cmdline,
+			"status": "Name:\t" + p.comm + "\nUid:\t0\t0\t0\t0\n" +
+				"NStgid:\t" + p.nstgid + "\n",
+			"uid_map": p.uidMap + "\n",
+			"gid_map": p.uidMap + "\n",
+		}
+		for name, text := range files {
+			err := ioutil.WriteFile(filepath.Join(dir, name),
+				[]byte(text), 0644)
+			if err != nil {
+				tb.Fatal(err)
+			}
+		}
+
+		f.files[dir+"/ns/user"] = p.userNS
+		f.files[dir+"/ns/uts"] = p.utsNS
+		f.files[dir+"/ns/pid"] = p.pidNS
+	}
+
+	return root, f
+}
+
+// TestGolden displays the hierarchy of goldenFixture(), as the user
+// namespace hierarchy and as the PID namespace hierarchy (with the
+// command lines), with color and without, at two widths, and compares each
+// display with a golden file in testdata/namespaces_of. After an intended
+// change to the display, the golden files are regenerated with:
+//
+//	go test namespaces_of.go namespaces_of_test.go -run TestGolden \
+//		-update
+
+func TestGolden(t *testing.T) {
+
+	goldenDir := filepath.Join("testdata", "namespaces_of")
+
+	views := []struct {
+		name string
+		args []string
+	}{
+		{"user", nil},
+		{"pidns", []string{"--pidns", "--show-cmdline"}},
+	}
+
+	for _, v := range views {
+		for _, color := range []string{"never", "always"} {
+			for _, width := range []int{80, 40} {
+				name := v.name + "_color_" + color + "_" +
+					strconv.Itoa(width)
+
+				path := filepath.Join(goldenDir, name+".golden")
+
+				t.Run(name, func(t *testing.T) {
+					got := renderGolden(t, v.args, color,
+						width)
+					checkGolden(t, path, got)
+				})
+			}
+		}
+	}
+}
+
+// renderGolden() scans goldenFixture() and returns the display produced with
+// the options 'args', "--color='color'", and "--width='width'".
+
+func renderGolden(t *testing.T, args []string, color string,
+	width int) string {
+
+	dir, f := goldenFixture(t)
+	useNamespaces(t, f)
+
+	opts := parseOptions(t, append([]string{"--procfs=" + dir,
+		"--color=" + color, "--width=" + strconv.Itoa(width)},
+		args...)...)
+
+	var buf bytes.Buffer
+	saved := output
+	output = &lineWriter{out: &buf}
+	defer func() { output = saved }()
+
+	nsSymlinks := []string{"user", "uts", "pid"}
+	if opts.showPidnsHierarchy {
+		nsSymlinks = []string{"pid"}
+	}
+
+	nsi := NamespaceInfo{nsList: make(NamespaceList)}
+
+	err := nsi.addNamespacesForAllProcesses(context.Background(),
+		nsSymlinks, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nsi.addUidGidPMaps(opts)
+
+	if err := nsi.displayNamespaceHierarchies(opts); err != nil {
+		t.Fatal(err)
+	}
+	output.Flush()
+
+	if len(f.fds) != 0 {
+		t.Errorf("%d file descriptors were left open", len(f.fds))
+	}
+
+	return buf.String()
+}
+
+// TestScanErrorClassification checks that the errors returned by the scan
+// of hierarchyFixture() for the common failures (EPERM and ENOTTY from
+// ioctl() operations, and ENOENT when a PID named on the command line
+// doesn't exist) record the failed operation, the PID, and the namespace
+// file, and can be classified with errors.Is() and errors.As().
+
+func TestScanErrorClassification(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		op     uintptr // ioctl() operation that fails, if any
+		opErr  error   // Error from that operation
+		pid    string  // PID named on the command line, if any
+		want   syscall.Errno
+		wantOp string
+		is     []error // Sentinel errors that 'err' matches
+		isNot  []error // Sentinel errors that 'err' doesn't match
+	}{
+		{"EPERM", NS_GET_NSTYPE, syscall.EPERM, "", syscall.EPERM,
+			"ioctl(NS_GET_NSTYPE)", []error{os.ErrPermission},
+			[]error{os.ErrNotExist, errNotSupported}},
+		{"ENOTTY", NS_GET_NSTYPE, syscall.ENOTTY, "", syscall.ENOTTY,
+			"ioctl(NS_GET_NSTYPE)", []error{errNotSupported},
+			[]error{os.ErrPermission, os.ErrNotExist}},
+		{"ENOENT", 0, nil, "999", syscall.ENOENT, "open",
+			[]error{os.ErrNotExist},
+			[]error{os.ErrPermission, errNotSupported}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			dir, f := hierarchyFixture(t)
+			if tc.opErr != nil {
+				f.errs[tc.op] = tc.opErr
+			}
+			useNamespaces(t, f)
+
+			opts := parseOptions(t, "--procfs="+dir)
+			nsi := NamespaceInfo{nsList: make(NamespaceList)}
+
+			var err error
+			if tc.pid != "" {
+				err = nsi.addProcessNamespace(tc.pid, "user",
+					opts, true)
+			} else {
+				err = nsi.addNamespacesForAllProcesses(
+					context.Background(),
+					[]string{"user"}, opts)
+			}
+			if err == nil {
+				t.Fatal("the scan succeeded")
+			}
+
+			if !errors.Is(err, tc.want) {
+				t.Errorf("error %q doesn't match %v", err,
+					tc.want)
+			}
+			for _, target := range tc.is {
+				if !errors.Is(err, target) {
+					t.Errorf("error %q doesn't match %q",
+						err, target)
+				}
+			}
+			for _, target := range tc.isNot {
+				if errors.Is(err, target) {
+					t.Errorf("error %q matches %q", err,
+						target)
+				}
+			}
+
+			var errno syscall.Errno
+			if !errors.As(err, &errno) || errno != tc.want {
+				t.Errorf("errors.As(%q) gave errno %v", err,
+					errno)
+			}
+
+			var nsErr *namespaceError
+			if !errors.As(err, &nsErr) {
+				t.Fatalf("error %q is not a *namespaceError",
+					err)
+			}
+
+			// The scan may inspect the PIDs in any order, so any
+			// PID may be the one that fails
+
+			path := dir + "/" + nsErr.PID + "/ns/user"
+			if nsErr.Op != tc.wantOp || nsErr.PID == "" ||
+				(tc.pid != "" && nsErr.PID != tc.pid) ||
+				nsErr.Path != path {
+				t.Errorf("error records %q, PID %q, path %q",
+					nsErr.Op, nsErr.PID, nsErr.Path)
+			}
+
+			if len(f.fds) != 0 {
+				t.Errorf("%d file descriptors were left open",
+					len(f.fds))
+			}
+		})
+	}
+}
+
+// TestScanVanishedProcess checks that a PID directory whose namespace files
+// can't be opened (as happens when the process terminates during the scan)
+// is skipped without an error, but that the same failure for a PID named on
+// the command line is an error.
+
+func TestScanVanishedProcess(t *testing.T) {
+
+	dir, f := hierarchyFixture(t)
+	delete(f.files, dir+"/301/ns/user")
+	useNamespaces(t, f)
+
+	savedLevel := logLevel
+	logLevel = LOG_QUIET
+	defer func() { logLevel = savedLevel }()
+
+	opts := parseOptions(t, "--procfs="+dir)
+	nsi := NamespaceInfo{nsList: make(NamespaceList)}
+
+	err := nsi.addNamespacesForAllProcesses(context.Background(),
+		[]string{"user"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := nsi.nsList[childUser].pids; !reflect.DeepEqual(got,
+		[]int{300}) {
+		t.Errorf("members of the child namespace = %v, want [300]",
+			got)
+	}
+
+	err = nsi.addProcessNamespace("301", "user", opts, true)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("inspecting PID 301 gave %v, want ENOENT", err)
+	}
+}
+
+// largeNamespaces() returns a fake hierarchy of 'nsCount' user namespaces
+// for 'n' processes, along with the files (keyed by pathname) of a directory,
+// 'root', that looks (to the scan) like a procfs with those processes. In the
+// hierarchy, each user namespace has up to four children, and owns a UTS
+// namespace and a PID namespace (whose hierarchy follows that of the user
+// namespaces). The processes are spread evenly across the user namespaces.
+
+func largeNamespaces(root string, n int,
+	nsCount int) (*fakeNamespaces, map[string]string) {
+
+	f := newFakeNamespaces()
+	files := make(map[string]string)
+
+	type nsSet struct {
+		user, uts, pid NamespaceID
+		uidMap         string
+		level          int
+	}
+
+	sets := make([]nsSet, nsCount)
+	sets[0] = nsSet{rootUserNS, rootUTSNS, rootPidNS, "0 0 4294967295", 0}
+	f.creators[rootUserNS] = 0
+
+	for i := 1; i < nsCount; i++ {
+		parent := sets[(i-1)/4]
+		inode := 4026540000 + 3*uint64(i)
+		sets[i] = nsSet{NamespaceID{4, inode},
+			NamespaceID{4, inode + 1}, NamespaceID{4, inode + 2},
+			"0 " + strconv.Itoa(1000+i) + " 1", parent.level + 1}
+
+		f.users[sets[i].user] = parent.user
+		f.parents[sets[i].pid] = parent.pid
+		f.creators[sets[i].user] = 1000 + i
+	}
+
+	for _, s := range sets {
+		f.types[s.user] = CLONE_NEWUSER
+		f.types[s.uts] = CLONE_NEWUTS
+		f.types[s.pid] = CLONE_NEWPID
+		f.users[s.uts] = s.user
+		f.users[s.pid] = s.user
+	}
+
+	for pid := 1; pid <= n; pid++ {
+		s := sets[(pid-1)%nsCount]
+		name := strconv.Itoa(pid)
+		nstgid := strings.Repeat(name+"\t", s.level) + name
+		dir := filepath.Join(root, name)
+
+		files[dir+"/status"] = "Name:\tproc\nUid:\t0\t0\t0\t0\n" +
+			"NStgid:\t" + nstgid + "\n"
+		files[dir+"/uid_map"] = s.uidMap + "\n"
+		files[dir+"/gid_map"] = s.uidMap + "\n"
+
+		f.files[dir+"/ns/user"] = s.user
+		f.files[dir+"/ns/uts"] = s.uts
+		f.files[dir+"/ns/pid"] = s.pid
+	}
+
+	return f, files
+}
+
+// largeFixture() creates, in a temporary directory, the procfs-like
+// directory described by largeNamespaces(), and returns the directory along
+// with the fake namespace hierarchy.
+
+func largeFixture(tb testing.TB, n int, nsCount int) (string, *fakeNamespaces) {
+
+	root := tb.TempDir()
+	f, files := largeNamespaces(root, n, nsCount)
+
+	for path, text := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			tb.Fatal(err)
+		}
+		err := ioutil.WriteFile(path, []byte(text), 0644)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return root, f
+}
+
+// Sizes of the fixtures built by largeFixture() for the benchmarks
+
+var largeSizes = []struct {
+	processes  int
+	namespaces int
+}{
+	{1000, 10},
+	{10000, 100},
+}
+
+// scanLarge() scans the fixture 'dir' as the program does by default, and
+// returns the resulting namespace information.
+
+func scanLarge(tb testing.TB, dir string) (*NamespaceInfo, CmdLineOptions) {
+
+	opts := parseOptions(tb, "--procfs="+dir, "--color=never", "--width=0")
+	nsi := &NamespaceInfo{nsList: make(NamespaceList)}
+
+	err := nsi.addNamespacesForAllProcesses(context.Background(),
+		[]string{"user", "uts", "pid"}, opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	nsi.addUidGidPMaps(opts)
+
+	return nsi, opts
+}
+
+// BenchmarkScanLarge measures a scan of the fixtures built by
+// largeFixture(). The namespace operations are faked, so that the time is
+// that of the program's own work and of reading the fixture's files.
+
+func BenchmarkScanLarge(b *testing.B) {
+
+	for _, size := range largeSizes {
+		dir, f := largeFixture(b, size.processes, size.namespaces)
+		name := strconv.Itoa(size.processes) + " processes, " +
+			strconv.Itoa(size.namespaces) + " namespaces"
+
+		b.Run(name, func(b *testing.B) {
+
+			useNamespaces(b, f)
+
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				scanLarge(b, dir)
+			}
+		})
+	}
+}
+
+// syscallOps adds to the namespace operations of a fake hierarchy the cost
+// of the system calls that the real operations make: stat() stats the
+// namespace file, and open() opens (and closes) it, before the fake supplies
+// the namespace.
+
+type syscallOps struct {
+	*fakeNamespaces
+}
+
+func (o syscallOps) stat(path string) (NamespaceID, error) {
+	var sb syscall.Stat_t
+	if err := syscall.Stat(path, &sb); err != nil {
+		return NamespaceID{}, err
+	}
+	return o.fakeNamespaces.stat(path)
+}
+
+func (o syscallOps) open(path string) (int, error) {
+	fd, err := syscall.Open(path, syscall.O_RDONLY, 0)
+	if err != nil {
+		return -1, err
+	}
+	syscall.Close(fd)
+	return o.fakeNamespaces.open(path)
+}
+
+// syntheticProc() creates the fixture described by largeNamespaces(), adding
+// an (empty) file for each namespace file, and returns the directory along
+// with namespace operations that make the system calls that the real
+// operations would.
+
+func syntheticProc(tb testing.TB, n int, nsCount int) (string, syscallOps) {
+
+	dir, f := largeFixture(tb, n, nsCount)
+
+	for path := range f.files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return dir, syscallOps{f}
+}
+
+// addNamespacesSequentially() is the original scan of /proc, which, unlike
+// addNamespacesForAllProcesses(), opens each namespace file of each process
+// in turn. It is kept for BenchmarkScanParallel.
+
+func addNamespacesSequentially(nsi *NamespaceInfo, namespaces []string,
+	opts CmdLineOptions) error {
+
+	var scanErr error
+
+	err := forEachPIDDir(opts.procfs, func(pid string) bool {
+		for _, nsFile := range namespaces {
+			scanErr = nsi.addProcessNamespace(pid, nsFile, opts,
+				false)
+			if scanErr != nil {
+				return false
+			}
+		}
+		nsi.stats.procDirs++
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	return scanErr
+}
+
+// BenchmarkScanParallel compares the original, sequential, scan of the
+// namespace files of the processes in fixtures built by syntheticProc()
+// with the scan that stat()s them in parallel (see statProcessNamespaces()).
+// Both scans must find the same namespaces, with the same members.
+
+func BenchmarkScanParallel(b *testing.B) {
+
+	namespaces := []string{"user", "uts", "pid"}
+
+	scans := []struct {
+		name string
+		scan func(nsi *NamespaceInfo, opts CmdLineOptions) error
+	}{
+		{"sequential", func(nsi *NamespaceInfo,
+			opts CmdLineOptions) error {
+
+			return addNamespacesSequentially(nsi, namespaces, opts)
+		}},
+		{"parallel", func(nsi *NamespaceInfo,
+			opts CmdLineOptions) error {
+
+			return nsi.addNamespacesForAllProcesses(
+				context.Background(), namespaces, opts)
+		}},
+	}
+
+	for _, size := range largeSizes {
+		dir, ops := syntheticProc(b, size.processes, size.namespaces)
+		opts := parseOptions(b, "--procfs="+dir)
+
+		name := strconv.Itoa(size.processes) + " processes, " +
+			strconv.Itoa(size.namespaces) + " namespaces"
+
+		// The members of each namespace found by each scan
+
+		members := make(map[string]map[NamespaceID][]int)
+
+		for _, sc := range scans {
+			b.Run(name+"/"+sc.name, func(b *testing.B) {
+
+				useNamespaces(b, ops)
+
+				b.ReportAllocs()
+
+				var nsi *NamespaceInfo
+
+				for i := 0; i < b.N; i++ {
+					nsi = &NamespaceInfo{
+						nsList: make(NamespaceList)}
+					err := sc.scan(nsi, opts)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				b.StopTimer()
+
+				m := make(map[NamespaceID][]int)
+				for ns, attribs := range nsi.nsList {
+					pids := append([]int{}, attribs.pids...)
+					sort.Ints(pids)
+					m[ns] = pids
+				}
+				members[sc.name] = m
+			})
+		}
+
+		seq, par := members["sequential"], members["parallel"]
+		if seq != nil && par != nil && !reflect.DeepEqual(seq, par) {
+			b.Errorf("%s: the scans found different namespaces "+
+				"or members", name)
+		}
+	}
+}
+
+// BenchmarkDisplayLarge measures the display of the hierarchies of the
+// fixtures built by largeFixture(), which are scanned just once.
+
+func BenchmarkDisplayLarge(b *testing.B) {
+
+	for _, size := range largeSizes {
+		dir, f := largeFixture(b, size.processes, size.namespaces)
+		name := strconv.Itoa(size.processes) + " processes, " +
+			strconv.Itoa(size.namespaces) + " namespaces"
+
+		b.Run(name, func(b *testing.B) {
+
+			useNamespaces(b, f)
+
+			var buf bytes.Buffer
+			saved := output
+			output = &lineWriter{out: &buf}
+			defer func() { output = saved }()
+
+			nsi, opts := scanLarge(b, dir)
+			if got := len(nsi.nsList); got != 3*size.namespaces {
+				b.Fatalf("found %d namespaces, want %d", got,
+					3*size.namespaces)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				err := nsi.displayNamespaceHierarchies(opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				output.Flush()
+			}
+		})
+	}
+}
+
+// countingOps counts the namespace operations that the scan performs, so that
+// they can be compared with the scan's own statistics.
+
+type countingOps struct {
+	namespaceOps
+	opens  int
+	ioctls int
+}
+
+func (c *countingOps) open(path string) (int, error) {
+	c.opens++
+	return c.namespaceOps.open(path)
+}
+
+func (c *countingOps) ioctl(fd int, op uintptr) (int, error) {
+	c.ioctls++
+	return c.namespaceOps.ioctl(fd, op)
+}
+
+func (c *countingOps) ownerUID(fd int) (int, error) {
+	c.ioctls++
+	return c.namespaceOps.ownerUID(fd)
+}
+
+// TestScanStats checks the counters that the "--stats" option reports after
+// a scan of a fixture built by largeFixture(). Every process directory is
+// visited; each namespace needs an NS_GET_NSTYPE and an NS_GET_USERNS
+// operation, and each user namespace an NS_GET_OWNER_UID operation; and the
+// files opened are the namespace files (which, because a user namespace may
+// be found as an ancestor before its own file is reached, depend on the order
+// of the scan) plus a UID map and a GID map for each user namespace.
+
+func TestScanStats(t *testing.T) {
+
+	dir, f := largeFixture(t, 100, 10)
+	ops := &countingOps{namespaceOps: f}
+	useNamespaces(t, ops)
+
+	nsi, _ := scanLarge(t, dir)
+	s := nsi.stats
+
+	if s.procDirs == 0 || s.filesOpened == 0 || s.ioctls == 0 {
+		t.Fatalf("stats = %+v, want nonzero counters", s)
+	}
+
+	users := 0
+	for _, attribs := range nsi.nsList {
+		if attribs.nsType == CLONE_NEWUSER {
+			users++
+		}
+	}
+
+	if s.procDirs != 100 {
+		t.Errorf("procDirs = %d, want 100", s.procDirs)
+	}
+	if want := 2*len(nsi.nsList) + users; s.ioctls != want {
+		t.Errorf("ioctls = %d, want %d (%d namespaces, %d user)",
+			s.ioctls, want, len(nsi.nsList), users)
+	}
+	if s.ioctls != ops.ioctls {
+		t.Errorf("ioctls = %d, but %d were performed", s.ioctls,
+			ops.ioctls)
+	}
+	if want := ops.opens + 2*users; s.filesOpened != want {
+		t.Errorf("filesOpened = %d, want %d (%d namespace files)",
+			s.filesOpened, want, ops.opens)
+	}
+}
+
+// pidDirFixture() creates, in a temporary directory, a procfs-like directory
+// with 'n' (empty) PID directories, along with some of the nonnumeric
+// entries found in /proc, and returns the directory.
+
+func pidDirFixture(tb testing.TB, n int) string {
+
+	root := tb.TempDir()
+
+	names := []string{"self", "sys", "net", "meminfo"}
+	for pid := 1; pid <= n; pid++ {
+		names = append(names, strconv.Itoa(pid))
+	}
+
+	for _, name := range names {
+		err := os.Mkdir(filepath.Join(root, name), 0755)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+// readDirPIDs() is the original way of listing the PID directories under
+// 'dir', which reads (and sorts, and stat()s) all of the entries before the
+// first PID is processed. It is kept for BenchmarkListPIDDirs.
+
+func readDirPIDs(dir string, fn func(name string) bool) error {
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		if name[0] >= '1' && name[0] <= '9' {
+			if !fn(name) {
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// BenchmarkListPIDDirs compares the time and memory taken to list the PID
+// directories of fixtures built by pidDirFixture() (with as many processes
+// as the fixtures of BenchmarkScanLarge) by reading the whole directory with
+// ioutil.ReadDir(), as the program once did, and by reading it in batches
+// with forEachPIDDir(), as it now does.
+
+func BenchmarkListPIDDirs(b *testing.B) {
+
+	listers := []struct {
+		name string
+		list func(dir string, fn func(name string) bool) error
+	}{
+		{"ReadDir", readDirPIDs},
+		{"Readdirnames", forEachPIDDir},
+	}
+
+	for _, size := range largeSizes {
+		dir := pidDirFixture(b, size.processes)
+
+		for _, l := range listers {
+			name := strconv.Itoa(size.processes) + " processes/" +
+				l.name
+
+			b.Run(name, func(b *testing.B) {
+
+				b.ReportAllocs()
+
+				for i := 0; i < b.N; i++ {
+					n := 0
+					err := l.list(dir, func(string) bool {
+						n++
+						return true
+					})
+					if err != nil {
+						b.Fatal(err)
+					}
+					if n != size.processes {
+						b.Fatalf("%d PIDs, want %d", n,
+							size.processes)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkOutput measures the throughput of the display output, using as
+// the text the display of the 10000-process fixture of BenchmarkDisplayLarge.
+
+func BenchmarkOutput(b *testing.B) {
+
+	dir, f := largeFixture(b, 10000, 100)
+	useNamespaces(b, f)
+
+	var buf bytes.Buffer
+	saved := output
+	output = &lineWriter{out: &buf}
+	defer func() { output = saved }()
+
+	nsi, opts := scanLarge(b, dir)
+	if err := nsi.displayNamespaceHierarchies(opts); err != nil {
+		b.Fatal(err)
+	}
+	output.Flush()
+
+	benchmarkLineWriter(b, buf.Bytes())
+}
+
+// benchmarkLineWriter() measures the writing of 'text' to a pipe (whose
+// reader discards what it reads), as a series of small writes, one for each
+// word, like those made by the display functions: first with a write() for
+// each piece, as the program did before its output was buffered, and then
+// through a lineWriter.
+
+func benchmarkLineWriter(b *testing.B, text []byte) {
+
+	size := int64(len(text))
+
+	var pieces [][]byte
+	for len(text) > 0 {
+		i := bytes.IndexAny(text, " \n") + 1
+		if i == 0 {
+			i = len(text)
+		}
+		pieces = append(pieces, text[:i])
+		text = text[i:]
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, r)
+		close(done)
+	}()
+	defer func() {
+		w.Close()
+		<-done
+		r.Close()
+	}()
+
+	b.Run("unbuffered", func(b *testing.B) {
+
+		b.SetBytes(size)
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			for _, p := range pieces {
+				if _, err := w.Write(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("lineWriter", func(b *testing.B) {
+
+		lw := &lineWriter{out: w}
+
+		b.SetBytes(size)
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			for _, p := range pieces {
+				lw.Write(p)
+			}
+			if err := lw.Flush(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// openNSFile() opens the namespace file 'path', closing it when the test
+// ends.
+
+func openNSFile(tb testing.TB, path string) int {
+
+	fd, err := syscall.Open(path, syscall.O_RDONLY, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { syscall.Close(fd) })
+
+	return fd
+}
+
+// sameNamespace() returns true if the file descriptor 'fd' refers to the
+// same namespace as the namespace file 'path'.
+
+func sameNamespace(tb testing.TB, fd int, path string) bool {
+
+	var fdStat, pathStat syscall.Stat_t
+
+	if err := syscall.Fstat(fd, &fdStat); err != nil {
+		tb.Fatal(err)
+	}
+	if err := syscall.Stat(path, &pathStat); err != nil {
+		tb.Fatal(err)
+	}
+
+	return fdStat.Dev == pathStat.Dev && fdStat.Ino == pathStat.Ino
+}
+
+// inInitialUserNS() returns true if the test is running in the initial user
+// namespace.
+
+func inInitialUserNS(tb testing.TB) bool {
+
+	var sb syscall.Stat_t
+
+	if err := syscall.Stat("/proc/self/ns/user", &sb); err != nil {
+		tb.Fatal(err)
+	}
+
+	return sb.Ino == 0xEFFFFFFD // PROC_USER_INIT_INO
+}
+
+// TestNSIoctlLive checks nsIoctl() and nsGetOwnerUID() against the namespace
+// files of the test program (and of a child in a new user namespace).
+
+func TestNSIoctlLive(t *testing.T) {
+
+	t.Run("type", func(t *testing.T) {
+		fd := openNSFile(t, "/proc/self/ns/uts")
+
+		nsType, err := nsIoctl(fd, NS_GET_NSTYPE)
+		if err != nil || nsType != CLONE_NEWUTS {
+			t.Errorf("got %#x, %v; want %#x", nsType, err,
+				CLONE_NEWUTS)
+		}
+	})
+
+	t.Run("owning user namespace", func(t *testing.T) {
+		fd := openNSFile(t, "/proc/self/ns/uts")
+
+		userFD, err := nsIoctl(fd, NS_GET_USERNS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer syscall.Close(userFD)
+
+		if !sameNamespace(t, userFD, "/proc/self/ns/user") {
+			t.Error("NS_GET_USERNS did not return our " +
+				"user namespace")
+		}
+	})
+
+	child := childUserNS(t)
+	if child == "" {
+		t.Skip("no child user namespace")
+	}
+
+	t.Run("parent", func(t *testing.T) {
+		fd := openNSFile(t, child)
+
+		parentFD, err := nsIoctl(fd, NS_GET_PARENT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer syscall.Close(parentFD)
+
+		if !sameNamespace(t, parentFD, "/proc/self/ns/user") {
+			t.Error("NS_GET_PARENT did not return our " +
+				"user namespace")
+		}
+	})
+
+	t.Run("owner UID", func(t *testing.T) {
+		fd := openNSFile(t, child)
+
+		uid, err := nsGetOwnerUID(fd)
+		if err != nil || uid != os.Geteuid() {
+			t.Errorf("got %d, %v; want %d", uid, err, os.Geteuid())
+		}
+	})
+}
+
+// TestNSIoctlErrors checks that nsIoctl() and nsGetOwnerUID() return -1 and
+// the errno from the failed ioctl(), so that the callers can classify the
+// error with errors.Is() and errors.As().
+
+func TestNSIoctlErrors(t *testing.T) {
+
+	notNS, err := os.Open("/proc/self/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notNS.Close()
+
+	uts := openNSFile(t, "/proc/self/ns/uts")
+	user := openNSFile(t, "/proc/self/ns/user")
+
+	tests := []struct {
+		name        string
+		call        func() (int, error)
+		want        syscall.Errno
+		initialOnly bool // Case needs the initial user NS
+	}{
+		{"not a namespace file", func() (int, error) {
+			return nsIoctl(int(notNS.Fd()), NS_GET_NSTYPE)
+		}, syscall.ENOTTY, false},
+		{"no parent of nonhierarchical NS", func() (int, error) {
+			return nsIoctl(uts, NS_GET_PARENT)
+		}, syscall.EINVAL, false},
+		{"owner UID of non-user NS", func() (int, error) {
+			return nsGetOwnerUID(uts)
+		}, syscall.EINVAL, false},
+		{"bad file descriptor", func() (int, error) {
+			return nsIoctl(-1, NS_GET_USERNS)
+		}, syscall.EBADF, false},
+		{"parent of initial user NS", func() (int, error) {
+			return nsIoctl(user, NS_GET_PARENT)
+		}, syscall.EPERM, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			if tc.initialOnly && !inInitialUserNS(t) {
+				t.Skip("not in the initial user namespace")
+			}
+
+			ret, err := tc.call()
+			if ret != -1 || !errors.Is(err, tc.want) {
+				t.Errorf("got %d, %v; want -1, %v", ret, err,
+					tc.want)
+			}
+
+			var errno syscall.Errno
+			if !errors.As(err, &errno) {
+				t.Errorf("%T is not a syscall.Errno", err)
+			}
+		})
+	}
+}
+
+// childUserNS() starts a child process in a new user namespace, and returns
+// the pathname of the child's user namespace file, or "" if a user
+// namespace can't be created. The child is killed when the test ends.
+
+func childUserNS(tb testing.TB) string {
+
+	cmd := exec.Command("sleep", "1000")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER,
+	}
+	if err := cmd.Start(); err != nil {
+		tb.Log("can't create a user namespace:", err)
+		return ""
+	}
+
+	tb.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	return "/proc/" + strconv.Itoa(cmd.Process.Pid) + "/ns/user"
+}
+
+// Status files captured from a normal process, a kernel thread, and a process
+// in a PID namespace nested three levels below the initial PID namespace.
+// Only the fields that matter here are included (the kernel's files contain
+// about 60 lines).
+
+const statusNormal = `Name:	bash
+Umask:	0022
+State:	S (sleeping)
+Tgid:	4321
+Ngid:	0
+Pid:	4321
+PPid:	4300
+TracerPid:	0
+Uid:	1000	1000	1000	1000
+Gid:	1000	1000	1000	1000
+FDSize:	256
+Groups:	4 27 1000
+NStgid:	4321
+NSpid:	4321
+NSpgid:	4321
+NSsid:	4321
+Kthread:	0
+Threads:	1
+`
+
+const statusKthread = `Name:	kthreadd
+Umask:	0000
+State:	S (sleeping)
+Tgid:	2
+Ngid:	0
+Pid:	2
+PPid:	0
+TracerPid:	0
+Uid:	0	0	0	0
+Gid:	0	0	0	0
+FDSize:	64
+Groups:
+NStgid:	2
+NSpid:	2
+NSpgid:	0
+NSsid:	0
+Kthread:	1
+Threads:	1
+`
+
+const statusNested = `Name:	sleep
+Umask:	0022
+State:	S (sleeping)
+Tgid:	81234
+Ngid:	0
+Pid:	81234
+PPid:	81200
+TracerPid:	0
+Uid:	100000	100000	100000	100000
+Gid:	100000	100000	100000	100000
+FDSize:	64
+Groups:
+NStgid:	81234	4567	89	1
+NSpid:	81234	4567	89	1
+NSpgid:	81200	4500	1	0
+NSsid:	81200	4500	1	0
+Kthread:	0
+Threads:	1
+`
+
+// useStatusCache() empties the cache of parsed status files, restoring it
+// when the test ends.
+
+func useStatusCache(tb testing.TB) {
+
+	saved := statusCache
+	statusCache = make(map[int]*procStatus)
+	tb.Cleanup(func() { statusCache = saved })
+}
+
+// TestGetProcStatus checks the fields that getProcStatus() parses from
+// captured status files, and from a file that has neither of the fields.
+
+func TestGetProcStatus(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		status string
+		nstgid []int
+		uid    int
+	}{
+		{"normal process", statusNormal, []int{4321}, 1000},
+		{"kernel thread", statusKthread, []int{2}, 0},
+		{"nested PID namespaces", statusNested,
+			[]int{81234, 4567, 89, 1}, 100000},
+		{"no NStgid or Uid field", "Name:\tinit\n", nil, 0},
+	}
+
+	root := t.TempDir()
+	useStatusCache(t)
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			dir := filepath.Join(root, strconv.Itoa(i+1))
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			err := ioutil.WriteFile(filepath.Join(dir, "status"),
+				[]byte(tc.status), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ps, err := getProcStatus(root, i+1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(ps.nstgid, tc.nstgid) {
+				t.Errorf("nstgid = %v, want %v", ps.nstgid,
+					tc.nstgid)
+			}
+			if ps.uid != tc.uid {
+				t.Errorf("uid = %d, want %d", ps.uid, tc.uid)
+			}
+		})
+	}
+}
+
+// TestGetProcStatusCached checks that a status file is read only once: after
+// the first read, the cached values are returned even though the file has
+// gone (as it does when the process terminates). A process that has gone
+// before its file is first read gives an error that satisfies
+// os.IsNotExist().
+
+func TestGetProcStatusCached(t *testing.T) {
+
+	root := t.TempDir()
+	useStatusCache(t)
+
+	dir := filepath.Join(root, "81234")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	err := ioutil.WriteFile(filepath.Join(dir, "status"),
+		[]byte(statusNested), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := namespacePIDs(root, 81234)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := namespacePIDs(root, 81234)
+	if err != nil {
+		t.Fatalf("second namespacePIDs(): %v", err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("cached PIDs %v, first read %v", second, first)
+	}
+
+	if _, err := namespacePIDs(root, 99999); !os.IsNotExist(err) {
+		t.Errorf("namespacePIDs() of a missing PID: err = %v", err)
+	}
+}
+
+// TestParseArgs checks that parseArgs() accepts options before, after, and
+// among the nonoption arguments, keeps the value of a nonboolean option given
+// as a separate argument with the option, stops at "--", treats negative
+// numbers and a lone "-" as nonoption arguments, and leaves an unrecognized
+// option to be diagnosed by the flag package. The command line is parsed
+// against a set of test options: a boolean "-b", a string "-s", and an
+// integer "-n".
+
+func TestParseArgs(t *testing.T) {
+
+	tests := []struct {
+		name string
+		args []string
+		want []string // Nonoption arguments
+		b    bool
+		s    string
+		n    int
+		err  string // Diagnostic from the flag package, if any
+	}{
+		{"options first", []string{"-b", "-s", "x", "a", "b"},
+			[]string{"a", "b"}, true, "x", 0, ""},
+		{"options last", []string{"a", "b", "--b", "--s=x"},
+			[]string{"a", "b"}, true, "x", 0, ""},
+		{"interleaved", []string{"a", "-b", "b", "-n", "3", "c"},
+			[]string{"a", "b", "c"}, true, "", 3, ""},
+		{"--opt value", []string{"1234", "--s", "val", "5678"},
+			[]string{"1234", "5678"}, false, "val", 0, ""},
+		{"value like an option", []string{"-s", "-b", "a"},
+			[]string{"a"}, false, "-b", 0, ""},
+		{"boolean then argument", []string{"--b", "x"},
+			[]string{"x"}, true, "", 0, ""},
+		{"--", []string{"a", "-b", "--", "-s", "x", "--"},
+			[]string{"a", "-s", "x", "--"}, true, "", 0, ""},
+		{"negative numbers", []string{"-1", "a", "-n", "-3", "-22"},
+			[]string{"-1", "a", "-22"}, false, "", -3, ""},
+		{"lone -", []string{"-", "-b", "-"},
+			[]string{"-", "-"}, true, "", 0, ""},
+		{"unrecognized option", []string{"a", "--bogus"}, nil,
+			false, "", 0, "flag provided but not defined: -bogus"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			savedArgs, savedFlags := os.Args, flag.CommandLine
+			defer func() {
+				os.Args, flag.CommandLine = savedArgs,
+					savedFlags
+			}()
+
+			var diag bytes.Buffer
+			os.Args = append([]string{"prog"}, tc.args...)
+			flag.CommandLine = flag.NewFlagSet("prog",
+				flag.ContinueOnError)
+			flag.CommandLine.SetOutput(&diag)
+
+			b := flag.Bool("b", false, "")
+			s := flag.String("s", "", "")
+			n := flag.Int("n", 0, "")
+
+			parseArgs()
+
+			if tc.err != "" {
+				if !strings.Contains(diag.String(), tc.err) {
+					t.Errorf("diagnostic %q, want %q",
+						diag.String(), tc.err)
+				}
+				return
+			}
+			if diag.Len() != 0 {
+				t.Errorf("unexpected diagnostic %q",
+					diag.String())
+			}
+
+			if got := flag.Args(); !reflect.DeepEqual(got,
+				tc.want) {
+				t.Errorf("arguments %q, want %q", got, tc.want)
+			}
+			if *b != tc.b || *s != tc.s || *n != tc.n {
+				t.Errorf("-b %v, -s %q, -n %d; want %v, %q, %d",
+					*b, *s, *n, tc.b, tc.s, tc.n)
+			}
+		})
+	}
+}
+
+// writeConfig() makes a temporary directory the value of XDG_CONFIG_HOME for
+// the rest of the test and, unless 'text' is empty, creates in it a
+// configuration file that contains 'text'. It returns the pathname of the
+// configuration file.
+
+func writeConfig(t *testing.T, text string) string {
+
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+
+	path := filepath.Join(dir, "tlpi-tools", "config")
+	if text == "" {
+		return path
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// captureStderr() returns what 'fn' writes to standard error.
+
+func captureStderr(t *testing.T, fn func()) string {
+
+	f, err := ioutil.TempFile(t.TempDir(), "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	saved := os.Stderr
+	os.Stderr = f
+	fn()
+	os.Stderr = saved
+
+	buf, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(buf)
+}
+
+// defaultWidth() returns the output width that the options give by default:
+// that of the terminal if standard output is one, and otherwise 0 (no
+// limit).
+
+func defaultWidth() int {
+
+	if isTerminal(syscall.Stdout) {
+		return getTerminalWidth(80)
+	}
+
+	return 0
+}
+
+// TestConfigPrecedence checks that an option takes its built-in default
+// unless the configuration file sets it, and the value from the file unless
+// the command line sets it. "-q" on the command line also overrides "v =
+// true" in the file (rather than being rejected in combination with it);
+// options in another program's section are ignored; and "--no-config"
+// bypasses the file.
+
+func TestConfigPrecedence(t *testing.T) {
+
+	const config = "# Defaults\n" +
+		"[namespaces_of]\n" +
+		"width = 60\n" +
+		"ns-format = symlink\n" +
+		"show-cmdline = true\n" +
+		"v = true\n" +
+		"\n" +
+		"[view_v2_cgroups]\n" +
+		"width = 30\n"
+
+	width := defaultWidth()
+
+	tests := []struct {
+		name        string
+		config      string
+		args        []string
+		width       int
+		nsFormat    string
+		showCmdline bool
+		logLevel    int
+	}{
+		{"built-in defaults", "", nil, width, "full", false,
+			LOG_NORMAL},
+		{"configuration file", config, nil, 60, "symlink", true,
+			LOG_VERBOSE},
+		{"command line", config, []string{"--width=100",
+			"--ns-format=full", "--show-cmdline=false", "-q"},
+			100, "full", false, LOG_QUIET},
+		{"partly overridden", config, []string{"--width=100"},
+			100, "symlink", true, LOG_VERBOSE},
+		{"--no-config", config, []string{"--no-config"},
+			width, "full", false, LOG_NORMAL},
+		{"prefixed options", "namespaces_of.width = 50\n" +
+			"view_v2_cgroups.width = 30\n", nil,
+			50, "full", false, LOG_NORMAL},
+	}
+
+	defer func(level int) { logLevel = level }(logLevel)
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			writeConfig(t, tc.config)
+			logLevel = LOG_NORMAL
+
+			o := parseOptions(t, tc.args...)
+
+			if o.width != tc.width || o.nsFormat != tc.nsFormat ||
+				o.showCmdline != tc.showCmdline {
+				t.Errorf("width %d, ns-format %q, "+
+					"show-cmdline %v; want %d, %q, %v",
+					o.width, o.nsFormat, o.showCmdline,
+					tc.width, tc.nsFormat, tc.showCmdline)
+			}
+			if logLevel != tc.logLevel {
+				t.Errorf("log level %d, want %d", logLevel,
+					tc.logLevel)
+			}
+		})
+	}
+}
+
+// TestConfigMalformed checks that each malformed line of the configuration
+// file is reported, with its line number, as a warning, and is otherwise
+// ignored, while the well-formed lines still take effect.
+
+func TestConfigMalformed(t *testing.T) {
+
+	path := writeConfig(t, "# Defaults\n"+
+		"[namespaces_of\n"+
+		"tree = unicode\n"+
+		"[namespaces_of]\n"+
+		"width 70\n"+
+		"bogus = 1\n"+
+		"width = wide\n"+
+		"tree = ascii\n")
+
+	defer func(level int) { logLevel = level }(logLevel)
+	logLevel = LOG_NORMAL
+
+	var o CmdLineOptions
+	stderr := captureStderr(t, func() { o = parseOptions(t) })
+
+	for _, want := range []string{
+		path + ":2: malformed section header",
+		path + ":3: option \"tree\" is not in a [program] section",
+		path + ":5: expected \"option = value\"",
+		path + ":6: unknown option \"bogus\"",
+		path + ":7: bad value for \"width\"",
+	} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("stderr doesn't contain %q:\n%s", want,
+				stderr)
+		}
+	}
+
+	if o.tree != "ascii" || o.width != defaultWidth() {
+		t.Errorf("tree %q, width %d; want \"ascii\", %d", o.tree,
+			o.width, defaultWidth())
+	}
+}
+
+// TestOptionDiagnostics checks that a diagnostic for a bad command line, and
+// the usage message that follows it, are written to stderr (leaving stdout
+// empty), while the usage message requested with "--help" is written to
+// stdout.
+
+func TestOptionDiagnostics(t *testing.T) {
+
+	tests := []struct {
+		args       []string
+		wantStatus int
+		wantStderr string // Prefix of stderr
+		wantStdout string // Prefix of stdout
+	}{
+		{[]string{"--color=bogus"}, 1,
+			"Bad value for --color option: bogus\nUsage: ", ""},
+		{[]string{"-q", "-v"}, 1,
+			"'-q' can't be combined with '-v'\nUsage: ", ""},
+		{[]string{"--width=-1"}, 1,
+			"Bad value for --width option: -1\nUsage: ", ""},
+		{[]string{"--self", "1"}, 1,
+			"No PID arguments may specified in combination with " +
+				"the '--self' option\n", ""},
+		{[]string{"--help"}, 0, "", "Usage: namespaces_of "},
+	}
+
+	for _, tc := range tests {
+		t.Run(strings.Join(tc.args, " "), func(t *testing.T) {
+
+			stdout, stderr, status := runMain(t, tc.args...)
+
+			if status != tc.wantStatus {
+				t.Errorf("exit status %d; want %d", status,
+					tc.wantStatus)
+			}
+			if !strings.HasPrefix(stderr, tc.wantStderr) ||
+				(tc.wantStderr == "") != (stderr == "") {
+				t.Errorf("stderr:\n%s\nwant prefix:\n%s",
+					stderr, tc.wantStderr)
+			}
+			if !strings.HasPrefix(stdout, tc.wantStdout) ||
+				(tc.wantStdout == "") != (stdout == "") {
+				t.Errorf("stdout:\n%s\nwant prefix:\n%s",
+					stdout, tc.wantStdout)
+			}
+		})
+	}
+}
+
+// signalChild() is run (instead of the tests) in a child of the test
+// binary, by startSignalChild(). It installs the program's signal handlers
+// and, depending on 'mode', either leaves some output buffered ("display"),
+// or starts a scan that is canceled by the first signal and then leaves
+// some output buffered ("scan"), or writes to standard output until the
+// reader goes away ("pipe"). Each time that it is ready for a signal, it
+// writes "ready" to stderr.
+
+func signalChild(mode string) {
+
+	handleSignals(mode != "pipe")
+
+	switch mode {
+	case "scan":
+		ctx := startScan()
+		fmt.Fprintln(os.Stderr, "ready")
+		<-ctx.Done()
+		endScan(ctx)
+		fmt.Fprint(output, "scan canceled\npartial")
+	case "display":
+		fmt.Fprint(output, "complete line\npartial")
+	case "pipe":
+		fmt.Fprintln(os.Stderr, "ready")
+		for {
+			fmt.Println("line")
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "ready")
+	time.Sleep(10 * time.Second)
+	os.Exit(1)
+}
+
+// startSignalChild() starts the test binary as a child that runs
+// signalChild() in 'mode', with its standard output going to 'stdout'. It
+// returns the child, and a function that waits until the child is ready for
+// a signal.
+
+func startSignalChild(t *testing.T, mode string,
+	stdout io.Writer) (*exec.Cmd, func()) {
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "NAMESPACES_OF_SIGNAL_TEST="+mode)
+	cmd.Stdout = stdout
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(stderr)
+	waitReady := func() {
+		line, err := r.ReadString('\n')
+		if line != "ready\n" {
+			t.Fatalf("child wrote %q (%v), not \"ready\"", line,
+				err)
+		}
+	}
+
+	return cmd, waitReady
+}
+
+// exitStatus() waits for 'cmd' to terminate, and returns its exit status.
+
+func exitStatus(t *testing.T, cmd *exec.Cmd) int {
+
+	err := cmd.Wait()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	return 0
+}
+
+// TestSignals sends SIGINT and SIGTERM to a child that is displaying
+// output, and checks its exit status (128 plus the signal number), and that
+// its output ends with the last complete line followed by the color reset,
+// with no partial line. When a scan is in progress, the first signal
+// cancels just the scan, and the second terminates the program.
+
+func TestSignals(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		mode    string
+		signals []syscall.Signal
+		status  int
+		stdout  string
+	}{
+		{"SIGINT", "display", []syscall.Signal{syscall.SIGINT}, 130,
+			"complete line\n" + NORMAL},
+		{"SIGTERM", "display", []syscall.Signal{syscall.SIGTERM}, 143,
+			"complete line\n" + NORMAL},
+		{"scan", "scan", []syscall.Signal{syscall.SIGINT,
+			syscall.SIGINT}, 130, "scan canceled\n" + NORMAL},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			var stdout bytes.Buffer
+			cmd, waitReady := startSignalChild(t, tc.mode, &stdout)
+
+			for _, sig := range tc.signals {
+				waitReady()
+				if err := cmd.Process.Signal(sig); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if status := exitStatus(t, cmd); status != tc.status {
+				t.Errorf("exit status %d, want %d", status,
+					tc.status)
+			}
+			if got := stdout.String(); got != tc.stdout {
+				t.Errorf("stdout %q, want %q", got, tc.stdout)
+			}
+		})
+	}
+}
+
+// TestSignalBrokenPipe checks that a child whose standard output is a pipe
+// whose reader goes away (as in "namespaces_of | head") exits silently with
+// status 0.
+
+func TestSignalBrokenPipe(t *testing.T) {
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd, waitReady := startSignalChild(t, "pipe", w)
+	w.Close()
+
+	waitReady()
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if line != "line\n" {
+		t.Fatalf("read %q (%v) from the child", line, err)
+	}
+	r.Close()
+
+	if status := exitStatus(t, cmd); status != 0 {
+		t.Errorf("exit status %d, want 0", status)
+	}
+}
+
+// TestWrapTextWideAndCombining wraps text containing double-width (CJK)
+// characters and characters with combining marks at a range of widths,
+// checking that no line overflows, and that no line starts with a
+// combining mark (that is, that a character is never separated from its
+// combining marks).
+
+func TestWrapTextWideAndCombining(t *testing.T) {
+
+	texts := []string{
+		"漢字漢字漢字漢字 ひらがな カタカナ 한국어",
+		"ééééé ññ ä",
+		"mixed漢é字x 全角ＡＢＣ",
+	}
+
+	for _, text := range texts {
+		for width := 2; width <= 20; width++ {
+			out := wrapText(text, "", width, "  ")
+			checkWrapped(t, out, text, "", width, "  ")
+
+			for _, line := range strings.Split(out, "\n") {
+				r, _ := utf8.DecodeRuneInString(
+					strings.TrimLeft(line, " "))
+				if unicode.Is(unicode.Mn, r) {
+					t.Errorf("width %d: line %q starts "+
+						"with a combining mark", width,
+						line)
+				}
+			}
+		}
+	}
+}
+
+// TestTruncateTextWide checks truncateText() with double-width (CJK)
+// characters, which must not be split across the width limit, and with
+// combining marks, which must stay with the character that they modify.
+
+func TestTruncateTextWide(t *testing.T) {
+
+	const e = "e\u0301" // "é", as "e" and a combining acute accent
+
+	tests := []struct {
+		s     string
+		width int
+		want  string
+	}{
+		{"漢字", 4, "漢字"},
+		{"漢字プロセス", 7, "漢字プ…"},
+		{"漢字プロセス", 6, "漢字…"},
+		{"mixed漢字", 7, "mixed…"},
+		{"ａｂｃ", 2, "…"},
+		{e + e + e + e, 4, e + e + e + e},
+		{e + e + e + e, 3, e + e + "…"},
+		{"x" + e + "漢", 3, "x" + e + "…"},
+	}
+
+	for _, tc := range tests {
+		got := truncateText(tc.s, tc.width)
+		if got != tc.want {
+			t.Errorf("truncateText(%q, %d) = %q, want %q", tc.s,
+				tc.width, got, tc.want)
+		}
+		if visibleWidth(got) > tc.width {
+			t.Errorf("truncateText(%q, %d) = %q is too wide", tc.s,
+				tc.width, got)
+		}
+	}
+}
+
+// checkWrapped() checks the output 'out' of wrapText() for 'text': no line
+// may be wider than 'width' plus the width of 'indent', and the output must
+// contain the words of 'text' (possibly broken), in order.
+
+func checkWrapped(t *testing.T, out string, text string, prefix string,
+	width int, indent string) {
+
+	for _, line := range strings.Split(out, "\n") {
+		if visibleWidth(line) > width+visibleWidth(indent) {
+			t.Errorf("line %q is wider than %d+%d columns", line,
+				width, visibleWidth(indent))
+		}
+	}
+
+	got := strings.Join(strings.Fields(strings.TrimPrefix(out,
+		indent+prefix)), "")
+	want := strings.Join(strings.Fields(text), "")
+	if got != want {
+		t.Errorf("wrapped words %q; want %q", got, want)
+	}
+}
+
+// FuzzWrapText checks the properties of wrapText() for arbitrary text (as
+// the programs display it, after escapeName()), prefixes, indents and
+// widths: see checkWrapped(). In addition, coloring the output with
+// colorEachLine() must not change the visible text. Widths too narrow for
+// the prefix and one double-width character are not checked, since the
+// output then necessarily overflows.
+
+func FuzzWrapText(f *testing.F) {
+
+	f.Add("aaa bbb ccc", "PIDs: ", uint8(10), uint8(4))
+	f.Add("1 2 3 4 5 6 7 8 9 10 11 12", "[ ", uint8(8), uint8(0))
+	f.Add(strings.Repeat("x", 300), "", uint8(40), uint8(8))
+	f.Add("漢字漢字漢字 かな ééé", "", uint8(5), uint8(2))
+	f.Add("a\tb\nc \x1b[31mred\x1b[m", "TIDs: ", uint8(9), uint8(1))
+
+	f.Fuzz(func(t *testing.T, text string, prefix string, width uint8,
+		indentLen uint8) {
+
+		text = escapeName(text)
+		prefix = escapeName(prefix)
+		indent := strings.Repeat(" ", int(indentLen%16))
+
+		w := int(width % 100)
+		if w < visibleWidth(prefix)+2 {
+			return
+		}
+
+		out := wrapText(text, prefix, w, indent)
+		checkWrapped(t, out, text, prefix, w, indent)
+
+		colored := colorEachLine(out, RED)
+		if escapeSeqRE.ReplaceAllString(colored, "") !=
+			escapeSeqRE.ReplaceAllString(out, "") {
+			t.Errorf("coloring %q changed the visible text: %q",
+				out, colored)
+		}
+	})
+}
+
+// FuzzEscapeName checks that the output of escapeName() contains no
+// control characters, and that escaping it again leaves it unchanged.
+
+func FuzzEscapeName(f *testing.F) {
+
+	f.Add("bash")
+	f.Add("a\tb\nc\x1b[31m\x7f\u0085")
+	f.Add("漢字 é")
+	f.Add("\xff\xfe")
+
+	f.Fuzz(func(t *testing.T, name string) {
+
+		escaped := escapeName(name)
+
+		for _, r := range escaped {
+			if unicode.IsControl(r) {
+				t.Errorf("escapeName(%q) = %q contains %U",
+					name, escaped, r)
+			}
+		}
+
+		if again := escapeName(escaped); again != escaped {
+			t.Errorf("escapeName(%q) = %q; escaping again "+
+				"gives %q", name, escaped, again)
+		}
+	})
+}
+
+// FuzzTruncateText checks that truncateText() returns text that fits in the
+// width: either the whole of the (escaped) text, or a prefix of it (cut
+// between characters) followed by an ellipsis.
+
+func FuzzTruncateText(f *testing.F) {
+
+	f.Add("systemd", uint8(4))
+	f.Add(strings.Repeat("/usr/bin/long-command ", 15), uint8(30))
+	f.Add("漢字漢字 éé", uint8(3))
+
+	f.Fuzz(func(t *testing.T, s string, width uint8) {
+
+		s = escapeName(s)
+		w := int(width%100) + 1
+
+		got := truncateText(s, w)
+
+		if visibleWidth(got) > w {
+			t.Errorf("truncateText(%q, %d) = %q is too wide", s, w,
+				got)
+		}
+		if got != s && !(strings.HasSuffix(got, "…") &&
+			strings.HasPrefix(s, strings.TrimSuffix(got, "…"))) {
+			t.Errorf("truncateText(%q, %d) = %q is not a "+
+				"truncation", s, w, got)
+		}
+		if utf8.ValidString(s) && !utf8.ValidString(got) {
+			t.Errorf("truncateText(%q, %d) = %q split a character",
+				s, w, got)
+		}
+	})
+}
+
+// 'interruptingOps' is a 'namespaceOps' that, on the 'stop'th open() of a
+// namespace file, sends SIGINT to the program (as the user would, by typing
+// Control-C) and waits until the signal has canceled the scan.
+
+type interruptingOps struct {
+	namespaceOps
+	opens int
+	stop  int
+}
+
+func (o *interruptingOps) open(path string) (int, error) {
+	o.opens++
+	if o.opens == o.stop {
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+		for atomic.LoadInt32(&scanInProgress) != 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return o.namespaceOps.open(path)
+}
+
+// interruptChild() is run (instead of the tests) in a child of the test
+// binary, by TestInterruptedScan. It runs the program over the fixture
+// directory 'dir' (see largeNamespaces()), interrupting the scan when it
+// opens its thirtieth namespace file, that is, after it has found the
+// namespaces of about ten processes. The fixture has only user, UTS and PID
+// namespace files, so "-q" is used to suppress the warnings about the other
+// namespace files (but not the banner that reports the interruption).
+
+func interruptChild(dir string) {
+
+	f, _ := largeNamespaces(dir, 1000, 100)
+	nsOps = &interruptingOps{namespaceOps: f, stop: 30}
+
+	os.Args = []string{"namespaces_of", "-q", "--procfs=" + dir}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	main()
+
+	os.Exit(0)
+}
+
+// TestInterruptedScan interrupts the program during its scan of 1000
+// processes spread across 100 sets of namespaces. It checks that the
+// program displays the namespaces that it found before the interruption,
+// which are only some of them, after writing the partial-results banner to
+// stderr, and exits with the status EXIT_INTERRUPTED.
+
+func TestInterruptedScan(t *testing.T) {
+
+	dir, _ := largeFixture(t, 1000, 100)
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "NAMESPACES_OF_INTERRUPT_TEST="+dir,
+		"XDG_CONFIG_HOME="+t.TempDir())
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := exitStatus(t, cmd); status != EXIT_INTERRUPTED {
+		t.Fatalf("exit status %d, want %d; stderr:\n%s", status,
+			EXIT_INTERRUPTED, stderr.String())
+	}
+
+	banner := "Scan interrupted: displaying partial results"
+	if !strings.Contains(stderr.String(), banner) {
+		t.Errorf("stderr doesn't contain %q:\n%s", banner,
+			stderr.String())
+	}
+
+	// Each set of namespaces that was found has its user namespace
+	// displayed. The initial namespaces are always found (as the
+	// ancestors of any others).
+
+	found := 0
+	for i := 1; i < 100; i++ {
+		id := strconv.FormatUint(4026540000+3*uint64(i), 10)
+		if strings.Contains(stdout.String(), id) {
+			found++
+		}
+	}
+
+	if !strings.Contains(stdout.String(), "4026531837") ||
+		found == 0 || found >= 99 {
+		t.Errorf("found %d of the 99 nested user namespaces, want "+
+			"some but not all:\n%s", found, stdout.String())
+	}
+}
+
+// redirectChild() is run (instead of the tests) in a child of the test
+// binary, by TestRedirectedOutput. It runs the program, with the arguments
+// given to the binary, over the fixture directory 'dir' (see
+// largeNamespaces()). The fixture has only user, UTS and PID namespace
+// files, so "-q" is used to suppress the warnings about the other namespace
+// files.
+
+func redirectChild(dir string) {
+
+	nsOps, _ = largeNamespaces(dir, 1000, 10)
+
+	os.Args = append([]string{"namespaces_of", "-q", "--procfs=" + dir},
+		os.Args[1:]...)
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	main()
+
+	os.Exit(0)
+}
+
+// runRedirected() runs redirectChild() (over 'dir') with the arguments
+// 'args', with standard output redirected to a pipe or, if 'toFile' is
+// true, to a file, and returns the output. NO_COLOR is removed from the
+// environment, so that it can't be what suppresses color.
+
+func runRedirected(t *testing.T, dir string, toFile bool,
+	args ...string) string {
+
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "NO_COLOR=") {
+			env = append(env, e)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(env, "NAMESPACES_OF_REDIRECT_TEST="+dir,
+		"XDG_CONFIG_HOME="+t.TempDir())
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	path := filepath.Join(t.TempDir(), "out")
+	if toFile {
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		cmd.Stdout = f
+	}
+
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%q: %v; stderr:\n%s", args, err, stderr.String())
+	}
+
+	if !toFile {
+		return stdout.String()
+	}
+
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(out)
+}
+
+// longestMemberLine() returns the length, in characters, of the longest
+// line of 'text' that doesn't display a namespace (that is, that doesn't
+// contain a "{device inode}" ID). Only the lines that list the members of
+// the namespaces are fitted to the output width.
+
+func longestMemberLine(text string) int {
+
+	longest := 0
+	for _, line := range strings.Split(text, "\n") {
+		if strings.Contains(line, "{") {
+			continue
+		}
+		if n := utf8.RuneCountInString(line); n > longest {
+			longest = n
+		}
+	}
+
+	return longest
+}
+
+// TestRedirectedOutput runs the program with its standard output
+// redirected to a pipe and to a file. It checks that, by default, the
+// output contains no escape bytes and its member lists aren't wrapped (the
+// fixture has lists longer than 80 characters), while "--color=always"
+// and "--width" still apply.
+
+func TestRedirectedOutput(t *testing.T) {
+
+	dir, _ := largeFixture(t, 1000, 10)
+
+	for _, toFile := range []bool{false, true} {
+		name := "pipe"
+		if toFile {
+			name = "file"
+		}
+
+		t.Run(name, func(t *testing.T) {
+
+			out := runRedirected(t, dir, toFile)
+			if strings.Contains(out, "\x1b") {
+				t.Errorf("default output contains escape "+
+					"bytes:\n%q", out)
+			}
+			if longestMemberLine(out) <= 80 {
+				t.Errorf("default output is wrapped:\n%s",
+					out)
+			}
+
+			out = runRedirected(t, dir, toFile, "--color=always")
+			if !strings.Contains(out, "\x1b") {
+				t.Errorf("'--color=always' output contains "+
+					"no escape bytes:\n%s", out)
+			}
+
+			out = runRedirected(t, dir, toFile, "--width=60")
+			if strings.Contains(out, "\x1b") {
+				t.Errorf("'--width=60' output contains escape "+
+					"bytes:\n%q", out)
+			}
+			if n := longestMemberLine(out); n > 60 {
+				t.Errorf("'--width=60' output has a line of "+
+					"%d characters:\n%s", n, out)
+			}
+		})
+	}
+}
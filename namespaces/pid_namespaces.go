@@ -2,6 +2,52 @@
 
    Show the PID namespace hierarchy.
 
+   If provided with a list of PIDs, this program shows just the PID
+   namespaces of those processes (and their ancestor namespaces). If the
+   only argument is "-", the list of PIDs is read from standard input.
+   Otherwise, the program shows the PID namespaces of all processes on the
+   system.
+
+   For each PID namespace, the owning user namespace and the UID of the
+   creator of that user namespace are displayed.
+
+   The namespace of which this program is itself a member is marked with
+   the string "<-- current".
+
+   The "--no-color" option can be used to suppress the use of color
+   in the displayed output. By default, color is used, and commands shown
+   by "--show-comm" are truncated to fit the width of the terminal, only if
+   standard output is a terminal; the "--color=always" and "--width=<n>"
+   options override these defaults.
+
+   The "--ns-format=kernel" option causes namespace IDs to be displayed in
+   the same format as the /proc/PID/ns/pid symlinks (e.g., "pid:[4026531836]").
+
+   The "--scan-mounts" option causes the program to also discover PID
+   namespaces that are pinned into existence by bind mounts, and thus may
+   have no member processes.
+
+   The "--min-members=<n>" option hides namespaces that have fewer than <n>
+   member processes (but ancestors of displayed namespaces are still shown).
+
+   The "--show-comm" and "--show-user" options display the command being run
+   by, and the user that owns, each process, in columns alongside the PIDs.
+
+   After the tree, a summary of the hierarchy is displayed; the "--no-summary"
+   option suppresses this summary.
+
+   The "--dot" option displays the hierarchy in Graphviz DOT format, and the
+   "--csv" option displays the namespaces in CSV format, instead of as an
+   indented tree.
+
+   The "--proc=<dir>" option can be used to specify a procfs directory other
+   than /proc (for example, a bind mount of the procfs of another PID
+   namespace) whose PID directories are to be scanned.
+
+   Error, warning, and progress messages are written to standard error.
+   The "-q" option suppresses warnings; the "-v" option adds progress
+   messages, and, if repeated, debugging messages.
+
    The (rather more complicated) namespaces_of.go program provides a superset
    of the functionality of this program.
 
@@ -14,17 +60,47 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"unicode"
 	"unsafe"
 )
 
+// The following structure stores info from command-line options.
+
+type CmdLineOptions struct {
+	useColor bool   // Use color in the output
+	procDir  string // Root directory of the procfs to be scanned
+	dot      bool   // Display hierarchy in Graphviz DOT format
+	nsFormat string // Format of displayed namespace IDs ("raw"/"kernel")
+	scanMnts bool   // Discover namespaces pinned by bind mounts
+	minMembs int    // Hide namespaces with fewer member processes
+	showComm bool   // Show the command being run by each process
+	showUser bool   // Show the user that owns each process
+	summary  bool   // Show summary after the namespace tree
+	csv      bool   // Display namespaces in CSV format
+	width    int    // Fit output to this width (0: no limit)
+}
+
+var opts CmdLineOptions
+
 // A namespace is uniquely identified by the combination of a device ID
 // and an inode number.
 
@@ -33,11 +109,43 @@ type NamespaceID struct {
 	inode_num uint64 // ino_t
 }
 
-// For each namespace, we record the child namespaces and the member processes.
+// SymlinkString() returns the ID of the namespace 'nsid' formatted in the
+// same way as the contents of a /proc/PID/ns symlink, for example,
+// "pid:[4026531836]". 'nsType' is the namespace type ("pid" or "user").
+
+func (nsid NamespaceID) SymlinkString(nsType string) string {
+	return nsType + ":[" + strconv.FormatUint(nsid.inode_num, 10) + "]"
+}
+
+// IDString() returns the ID of the namespace 'nsid' formatted as specified by
+// the "--ns-format" option: either the kernel's symlink format, or (the
+// default) the raw device ID and inode number.
+
+func (nsid NamespaceID) IDString(nsType string) string {
+	if opts.nsFormat == "kernel" {
+		return nsid.SymlinkString(nsType)
+	}
+
+	return fmt.Sprint(nsid)
+}
+
+// For each namespace, we record the child namespaces and the member
+// processes (and, when "--scan-mounts" is specified, the bind mounts that
+// pin the namespace into existence) and the parent namespace. We also record
+// the user namespace that owns the namespace and the UID of the creator of
+// that user namespace. If the owning user namespace is not visible (because
+// it is an ancestor of the user namespace of this program), 'ownerVisible'
+// is false.
 
 type NamespaceAttribs struct {
-	children []NamespaceID // Child namespaces
-	pids     []int         // Member processes
+	children     []NamespaceID // Child namespaces
+	pids         []int         // Member processes
+	ownerUserNS  NamespaceID   // Owning user namespace
+	ownerUID     int           // UID of creator of owning user namespace
+	ownerVisible bool          // Is owning user namespace visible?
+	pinnedBy     []string      // Bind mounts that pin the namespace
+	parent       NamespaceID   // Parent namespace
+	hasParent    bool          // False for the root namespace
 }
 
 // The following map records all of the namespaces that we visit.
@@ -49,24 +157,178 @@ var NSList = make(map[NamespaceID]*NamespaceAttribs)
 // hierarchy).  We record that namespace in 'initialPidNS'.
 
 var initialPidNS NamespaceID
+var initialPidNSFound bool // True once 'initialPidNS' has been set
+
+// 'currentPidNS' records the PID namespace of which this program is itself
+// a member, so that we can highlight that namespace in the display.
+
+var currentPidNS NamespaceID
+
+// Namespace ioctl() operations (see ioctl_ns(2)).
+
+const NS_GET_USERNS = 0xb701    // Get owning user NS
+const NS_GET_PARENT = 0xb702    // Get parent NS
+const NS_GET_NSTYPE = 0xb703    // Return namespace type
+const NS_GET_OWNER_UID = 0xb704 // Return creator UID for user NS
+
+const CLONE_NEWPID = 0x20000000 // Namespace type returned by NS_GET_NSTYPE
+
+// The 'ProcReader' interface defines the operations that this program uses to
+// obtain information from the procfs, along with the operations that it
+// performs on the namespace files that it opens (which is how the hierarchy
+// is discovered). The program performs these operations only via the reader
+// in 'procReader', so that (for example) a reader that supplies information
+// from a set of test fixtures, including a fake namespace hierarchy, could be
+// substituted for the real procfs.
+
+type ProcReader interface {
+	OpenPidNS(pid string) (int, error)  // Open PID namespace file of 'pid'
+	ReadStatus(pid int) (string, error) // Read status file of 'pid'
+	ReadComm(pid int) (string, error)   // Read command name of 'pid'
+
+	// Call 'fn' for each PID directory name
+	ListProcesses(fn func(name string) bool) error
+
+	NamespaceID(fd int) (NamespaceID, error) // ID of namespace 'fd'
+	NSIoctl(fd int, op uintptr) (int, error) // ioctl() operation on 'fd'
+	OwnerUID(fd int) (int, error)            // NS_GET_OWNER_UID on 'fd'
+	Close(fd int)                            // Close namespace 'fd'
+}
+
+// 'ProcfsReader' implements the 'ProcReader' interface using the procfs
+// mounted at (or bind mounted at) 'root'.
+
+type ProcfsReader struct {
+	root string
+}
+
+var procReader ProcReader = ProcfsReader{"/proc"}
+
+// ListProcesses() calls 'fn' with the name of each PID directory in the
+// procfs. The directory is read in batches, rather than being read (and
+// sorted) in its entirety before the first PID is processed, since on a
+// large system it may contain very many entries. The PIDs are thus processed
+// in the order in which the kernel returns them. If 'fn' returns false, no
+// further PIDs are processed.
+
+func (r ProcfsReader) ListProcesses(fn func(name string) bool) error {
+
+	d, err := os.Open(r.root)
+	if err != nil {
+		return err
+	}
+
+	defer d.Close()
+
+	for {
+		names, err := d.Readdirnames(512)
+
+		for _, name := range names {
+			if name[0] >= '1' && name[0] <= '9' {
+				if !fn(name) {
+					return nil
+				}
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// OpenPidNS() returns a file descriptor that refers to the PID namespace of
+// the process 'pid'.
+
+func (r ProcfsReader) OpenPidNS(pid string) (int, error) {
+
+	nsFile := r.root + "/" + pid + "/ns/pid"
+
+	namespaceFD, err := syscall.Open(nsFile, syscall.O_RDONLY, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: nsFile, Err: err}
+	}
+
+	return namespaceFD, nil
+}
+
+// ReadStatus() returns the contents of the status file of the process 'pid'.
+
+func (r ProcfsReader) ReadStatus(pid int) (string, error) {
+
+	buf, err := ioutil.ReadFile(r.root + "/" + strconv.Itoa(pid) + "/status")
+	if err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+// ReadComm() returns the command name of the process 'pid' (from its comm
+// file), without the trailing newline.
+
+func (r ProcfsReader) ReadComm(pid int) (string, error) {
+
+	buf, err := ioutil.ReadFile(r.root + "/" + strconv.Itoa(pid) + "/comm")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(buf)), nil
+}
+
+// The namespace operations of 'ProcfsReader' are the real system calls (see
+// NewNamespaceID(), NSIoctl(), and NSGetOwnerUID()).
+
+func (ProcfsReader) NamespaceID(fd int) (NamespaceID, error) {
+	return NewNamespaceID(fd)
+}
+
+func (ProcfsReader) NSIoctl(fd int, op uintptr) (int, error) {
+	return NSIoctl(fd, op)
+}
+
+func (ProcfsReader) OwnerUID(fd int) (int, error) {
+	return NSGetOwnerUID(fd)
+}
+
+func (ProcfsReader) Close(fd int) {
+	syscall.Close(fd)
+}
+
+// 'numFilteredNS' counts the namespaces that were hidden from the display
+// because of the "--min-members" option.
+
+var numFilteredNS int
+
+// Some terminal escape sequences for displaying color output.
+
+const ESC = ""
+const RED = ESC + "[31m"
+const BOLD = ESC + "[1m"
+const NORMAL = ESC + "(B" + ESC + "[m"
+const LIGHT_BLUE = ESC + "[38;5;51m"
+const CURRENT_NS_COLOR = RED + BOLD
+const PID_COLOR = LIGHT_BLUE
 
 // Create and return a new namespace ID using the device ID and inode
 // number of the namespace referred to by 'namespaceFD'.
 
-func NewNamespaceID(namespaceFD int) NamespaceID {
+func NewNamespaceID(namespaceFD int) (NamespaceID, error) {
 	var sb syscall.Stat_t
-	var err error
 
 	// Obtain the device ID and inode number of the namespace file.
 	// These values together form the key for the 'NSList' map entry.
 
-	err = syscall.Fstat(namespaceFD, &sb)
+	err := syscall.Fstat(namespaceFD, &sb)
 	if err != nil {
-		fmt.Println("syscall.Fstat():", err)
-		os.Exit(1)
+		return NamespaceID{}, fmt.Errorf("fstat(): %w", err)
 	}
 
-	return NamespaceID{sb.Dev, sb.Ino}
+	return NamespaceID{sb.Dev, sb.Ino}, nil
 }
 
 // AddNamespace() adds the namespace referred to by the file descriptor
@@ -90,26 +352,35 @@ func NewNamespaceID(namespaceFD int) NamespaceID {
 //
 // The return value of the function is the ID of the namespace entry (i.e.,
 // the device ID and inode number corresponding to the user namespace file
-// referred to by 'namespaceFD').
-
-func AddNamespace(namespaceFD int, pid int) NamespaceID {
+// referred to by 'namespaceFD'), or an error if the namespace operations
+// failed.
 
-	const NS_GET_PARENT = 0xb702 // ioctl() to get parent namespace
+func AddNamespace(namespaceFD int, pid int) (NamespaceID, error) {
 
-	nsid := NewNamespaceID(namespaceFD)
+	nsid, err := procReader.NamespaceID(namespaceFD)
+	if err != nil {
+		return nsid, err
+	}
 
 	if _, fnd := NSList[nsid]; !fnd {
 
 		// Namespace entry does not yet exist in 'NSList' map;
 		// create it.
 
+		Log(LOG_DEBUG, "New PID namespace:", nsid)
+
 		NSList[nsid] = new(NamespaceAttribs)
 
+		// Record the user namespace that owns this namespace.
+
+		err := AddOwnerInfo(NSList[nsid], namespaceFD)
+		if err != nil {
+			return nsid, err
+		}
+
 		// Get a file descriptor for the parent namespace.
 
-		ret, _, err := syscall.Syscall(syscall.SYS_IOCTL,
-			uintptr(namespaceFD), uintptr(NS_GET_PARENT), 0)
-		parentFD := (int)((uintptr)(unsafe.Pointer(ret)))
+		parentFD, err := procReader.NSIoctl(namespaceFD, NS_GET_PARENT)
 
 		if parentFD == -1 && err == syscall.EPERM {
 
@@ -119,11 +390,11 @@ func AddNamespace(namespaceFD int, pid int) NamespaceID {
 			// PID namespace); remember it.
 
 			initialPidNS = nsid
+			initialPidNSFound = true
 
 		} else if parentFD == -1 {
 
-			fmt.Println("ioctl(NS_GET_PARENT):", err)
-			os.Exit(1)
+			return nsid, fmt.Errorf("ioctl(NS_GET_PARENT): %w", err)
 
 		} else {
 
@@ -131,14 +402,18 @@ func AddNamespace(namespaceFD int, pid int) NamespaceID {
 			// has an entry in the map. Don't record the
 			// process as being a member of that namespace.
 
-			p := AddNamespace(parentFD, -1)
+			p, err := AddNamespace(parentFD, -1)
+			procReader.Close(parentFD)
+			if err != nil {
+				return nsid, err
+			}
 
 			// Make the current namespace entry ('nsid') a child
 			// of the parent/owning user namespace entry.
 
 			NSList[p].children = append(NSList[p].children, nsid)
-
-			syscall.Close(parentFD)
+			NSList[nsid].parent = p
+			NSList[nsid].hasParent = true
 		}
 	}
 
@@ -148,120 +423,1707 @@ func AddNamespace(namespaceFD int, pid int) NamespaceID {
 		NSList[nsid].pids = append(NSList[nsid].pids, pid)
 	}
 
-	return nsid
+	return nsid, nil
+}
+
+// NSIoctl() performs the namespace ioctl() operation 'op' (one of
+// the NS_GET_* constants) on the file descriptor 'fd'. On success, it
+// returns the (nonnegative) result of the operation. On failure, it
+// returns -1 and the error (a syscall.Errno, for example, EPERM or
+// ENOTTY). See ioctl_ns(2).
+
+func NSIoctl(fd int, op uintptr) (int, error) {
+
+	ret, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), op, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+
+	return int(ret), nil
+}
+
+// NSGetOwnerUID() returns the UID of the creator of the user namespace
+// referred to by 'fd' (the NS_GET_OWNER_UID operation). On failure, it
+// returns -1 and the error.
+
+func NSGetOwnerUID(fd int) (int, error) {
+	var uid uint32 // uid_t
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		uintptr(NS_GET_OWNER_UID), uintptr(unsafe.Pointer(&uid)))
+	if errno != 0 {
+		return -1, errno
+	}
+
+	return int(uid), nil
+}
+
+// AddOwnerInfo() records in 'attribs' the ID of the user namespace that owns
+// the PID namespace referred to by 'namespaceFD', along with the UID of the
+// creator of that user namespace.
+
+func AddOwnerInfo(attribs *NamespaceAttribs, namespaceFD int) error {
+
+	userNSFD, err := procReader.NSIoctl(namespaceFD, NS_GET_USERNS)
+
+	if userNSFD == -1 {
+
+		// EPERM means that the owning user namespace is not visible
+		// (i.e., it is an ancestor of our user namespace). Any other
+		// error is unexpected.
+
+		if err != syscall.EPERM {
+			return fmt.Errorf("ioctl(NS_GET_USERNS): %w", err)
+		}
+
+		return nil
+	}
+
+	defer procReader.Close(userNSFD)
+
+	uid, err := procReader.OwnerUID(userNSFD)
+	if err != nil {
+		return fmt.Errorf("ioctl(NS_GET_OWNER_UID): %w", err)
+	}
+
+	attribs.ownerUserNS, err = procReader.NamespaceID(userNSFD)
+	if err != nil {
+		return err
+	}
+
+	attribs.ownerUID = uid
+	attribs.ownerVisible = true
+
+	return nil
 }
 
 // AddProcessNamespace() processes a single /proc/PID/ns/pid entry, creating
 // a namespace entry for that file and, as necessary, namespace entries for
-// all ancestor namespaces going back to the initial PID namespace.  'pid'
-// is a string containing a PID.
+// all ancestor namespaces going back to the initial PID namespace. 'pid' is
+// a string containing a PID.
 
-func AddProcessNamespace(pid string) {
+func AddProcessNamespace(pid string) error {
 
 	// Obtain a file descriptor that refers to the PID namespace
 	// corresponding to 'pid'.
 
-	namespaceFD, err := syscall.Open("/proc/"+pid+"/ns/pid",
-		syscall.O_RDONLY, 0)
-
-	if namespaceFD < 0 {
-		fmt.Println("open("+"/proc/"+pid+"/ns/pid):", err)
-		os.Exit(1)
+	namespaceFD, err := procReader.OpenPidNS(pid)
+	if err != nil {
+		return err
 	}
 
+	defer procReader.Close(namespaceFD)
+
 	// Add namespace entry for this namespace, and all of its ancestor
 	// PID namespaces.
 
 	npid, _ := strconv.Atoi(pid)
-	AddNamespace(namespaceFD, npid)
 
-	syscall.Close(namespaceFD)
+	_, err = AddNamespace(namespaceFD, npid)
+	if err != nil {
+		return fmt.Errorf("PID %s: %w", pid, err)
+	}
+
+	return nil
+}
+
+// ScanProcesses() adds the PID namespaces of the processes named in 'names'
+// (or, if 'names' is nil, of all of the processes listed by 'procReader') to
+// the 'NSList' map, and returns the number of processes whose namespaces were
+// added. If 'ctx' is canceled, the remaining processes are skipped. When all
+// processes are being scanned, a process that terminates between being listed
+// and having its namespace file opened (so that the open fails with ENOENT) is
+// silently skipped; any other error ends the scan.
+
+func ScanProcesses(ctx context.Context, names []string) (int, error) {
+
+	numScanned := 0
+	var scanErr error
+
+	scanPID := func(name string) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+
+		err := AddProcessNamespace(name)
+		if names == nil && errors.Is(err, syscall.ENOENT) {
+			Log(LOG_DEBUG, "PID "+name+" terminated during the "+
+				"scan")
+			return true
+		}
+		if err != nil {
+			scanErr = err
+			return false
+		}
+
+		numScanned++
+
+		return true
+	}
+
+	if names == nil {
+		err := procReader.ListProcesses(scanPID)
+		if err != nil {
+			return numScanned, fmt.Errorf("ListProcesses(): %w", err)
+		}
+	} else {
+		for _, name := range names {
+			if !scanPID(name) {
+				break
+			}
+		}
+	}
+
+	return numScanned, scanErr
+}
+
+// For each process whose /proc/PID/status file we have parsed, we record
+// the fields of that file that are of interest to us.
+
+type ProcStatus struct {
+	nstgid []int // PIDs in each PID namespace ('NStgid' field)
+	uid    int   // Effective UID ('Uid' field), or -1 if not known
 }
 
-// PrintAllPIDsFor() looks up the 'NStgid' field in the /proc/PID/status
-// file of 'pid' and displays the set of PIDs contained in that field
+// The parsed status file of each process, cached so that the file is read
+// at most once per process.
+
+var StatusCache = make(map[int]*ProcStatus)
+
+// A regular expression used to split a /proc/PID/status line into the field
+// name and the field value.
 
-func PrintAllPIDsFor(pid int) {
+var statusFieldSepRE = regexp.MustCompile(":[ \t]*")
 
-	sfile := "/proc/" + strconv.Itoa(pid) + "/status"
+// GetProcStatus() returns the fields of interest from the /proc/PID/status
+// file of 'pid'.
 
-	file, err := os.Open(sfile)
+func GetProcStatus(pid int) (*ProcStatus, error) {
+
+	if ps, fnd := StatusCache[pid]; fnd {
+		return ps, nil
+	}
+
+	status, err := procReader.ReadStatus(pid)
 	if err != nil {
-		// Probably, the process terminated between the time we
-		// accessed the namespace files and the time we tried to
-		// open /proc/PID/status.
-		fmt.Print("[can't open " + sfile + "]")
-		return
+		return nil, err
+	}
+
+	// Scan file line by line, looking for the 'NStgid:' and 'Uid:'
+	// entries.
+
+	ps := &ProcStatus{uid: -1}
+
+	s := bufio.NewScanner(strings.NewReader(status))
+	for s.Scan() {
+		if strings.HasPrefix(s.Text(), "NStgid:") {
+			tokens := statusFieldSepRE.Split(s.Text(), 2)
+			for _, f := range strings.Fields(tokens[1]) {
+				p, _ := strconv.Atoi(f)
+				ps.nstgid = append(ps.nstgid, p)
+			}
+		} else if strings.HasPrefix(s.Text(), "Uid:") {
+			tokens := strings.Fields(s.Text())
+			if len(tokens) > 2 {
+				ps.uid, _ = strconv.Atoi(tokens[2])
+			}
+		}
+	}
+
+	StatusCache[pid] = ps
+
+	return ps, nil
+}
+
+// GetNStgid() returns the set of PIDs contained in the 'NStgid' field of the
+// /proc/PID/status file of 'pid'. The PIDs are returned in order, starting
+// with the PID in the initial PID namespace.
+
+func GetNStgid(pid int) ([]int, error) {
+
+	ps, err := GetProcStatus(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	return ps.nstgid, nil
+}
+
+// The exit status used when the scan discovered no PID namespaces.
+
+const EXIT_NO_NAMESPACES = 2
+
+// CheckScanFoundNamespaces() checks that the scan discovered at least one PID
+// namespace, including the topmost namespace ('initialPidNS'), from which the
+// display starts. If it didn't, a diagnostic that explains what was scanned,
+// and the likely causes, is logged, and EXIT_NO_NAMESPACES is returned.
+// Otherwise, 0 is returned.
+
+func CheckScanFoundNamespaces() int {
+
+	if len(NSList) > 0 && initialPidNSFound {
+		return 0
 	}
 
-	defer file.Close() // Close file on return from this function.
+	Log(LOG_QUIET, "No PID namespaces were discovered by "+
+		"scanning the PID directories under "+opts.procDir+".")
+	Log(LOG_QUIET, "Perhaps "+opts.procDir+" is not a procfs "+
+		"mount (check the --proc option), or it is mounted")
+	Log(LOG_QUIET, "with options (e.g., \"hidepid\") that "+
+		"hide the PID directories of other processes.")
+
+	return EXIT_NO_NAMESPACES
+}
+
+// AddPinnedNamespaces() scans /proc/self/mountinfo for nsfs mounts, and adds
+// each PID namespace that is bind mounted in this way to the 'NSList' map,
+// recording the mount point as pinning the namespace. Mounts of other types
+// of namespace are silently ignored; mount points that can't be opened are
+// reported, but are otherwise ignored.
+
+func AddPinnedNamespaces() {
+
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		Log(LOG_QUIET, "os.Open(/proc/self/mountinfo):", err)
+		os.Exit(1)
+	}
 
-	re := regexp.MustCompile(":[ \t]*")
+	defer file.Close()
 
-	// Scan file line by line, looking for 'NStgid:' entry, and print
-	// corresponding set of PIDs.
+	// Each line of mountinfo has the form:
+	//
+	//   ID PARENT-ID MAJ:MIN ROOT MOUNT-POINT OPTIONS [TAGS...] - FSTYPE ...
+	//
+	// See proc(5).
 
 	s := bufio.NewScanner(file)
 	for s.Scan() {
-		match, _ := regexp.MatchString("^NStgid:", s.Text())
-		if match {
-			tokens := re.Split(s.Text(), -1)
-			fmt.Print("[", tokens[1], "]  ")
+		fields := strings.Fields(s.Text())
 
-			break
+		sep := 6
+		for sep < len(fields) && fields[sep] != "-" {
+			sep++
+		}
+
+		if len(fields) < 5 || sep+1 >= len(fields) ||
+			fields[sep+1] != "nsfs" {
+			continue
+		}
+
+		mountPoint := UnescapeMountPath(fields[4])
+
+		namespaceFD, err := syscall.Open(mountPoint,
+			syscall.O_RDONLY, 0)
+		if err != nil {
+			Log(LOG_NORMAL, "Can't open pinned namespace "+
+				mountPoint+": "+err.Error())
+			continue
+		}
+
+		nsType, _ := procReader.NSIoctl(namespaceFD, NS_GET_NSTYPE)
+
+		if nsType == CLONE_NEWPID {
+			nsid, err := AddNamespace(namespaceFD, -1)
+			if err != nil {
+				procReader.Close(namespaceFD)
+				Log(LOG_QUIET, mountPoint+":", err)
+				os.Exit(1)
+			}
+			NSList[nsid].pinnedBy =
+				append(NSList[nsid].pinnedBy, mountPoint)
 		}
+
+		procReader.Close(namespaceFD)
 	}
 }
 
-// Print a sorted list of the PIDs that are members of a namespace.
+// UnescapeMountPath() converts the octal escapes (e.g., "\040" for a space)
+// that are used for special characters in the pathnames shown in
+// /proc/PID/mountinfo back into the characters that they represent.
 
-func PrintMemberPIDs(indent string, pids []int) {
+func UnescapeMountPath(path string) string {
 
-	sort.Ints(pids)
+	var result []byte
 
-	for _, pid := range pids {
-		fmt.Print(indent + "        ")
-		PrintAllPIDsFor(pid)
-		fmt.Println()
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			c, err := strconv.ParseUint(path[i+1:i+4], 8, 8)
+			if err == nil {
+				result = append(result, byte(c))
+				i += 3
+				continue
+			}
+		}
+		result = append(result, path[i])
 	}
+
+	return string(result)
 }
 
-// DisplayNamespaceTree() recursively displays the namespace tree rooted at
-// 'nsid'. 'level' is our current level in the tree, and is used to produce
-// suitably indented output.
+// PIDChainFor() looks up the 'NStgid' field in the /proc/PID/status file of
+// 'pid' and returns a string containing the set of PIDs in that field.
 
-func DisplayNamespaceTree(nsid NamespaceID, level int) {
+func PIDChainFor(pid int) string {
 
-	indent := strings.Repeat(" ", level*4)
+	chain, err := GetNStgid(pid)
+	if err != nil {
+		// Probably, the process terminated between the time we
+		// accessed the namespace files and the time we tried to
+		// open /proc/PID/status.
+		return "[can't open " + opts.procDir + "/" + strconv.Itoa(pid) +
+			"/status]"
+	}
 
-	fmt.Println(indent, nsid)
+	return "[" + FormatPIDChain(chain) + "]"
+}
 
-	PrintMemberPIDs(indent, NSList[nsid].pids)
+// FormatPIDChain() returns a string containing the PIDs in 'chain',
+// separated by spaces.
 
-	for _, child := range NSList[nsid].children {
-		DisplayNamespaceTree(child, level+1)
+func FormatPIDChain(chain []int) string {
+
+	s := make([]string, len(chain))
+	for i, p := range chain {
+		s[i] = strconv.Itoa(p)
 	}
+
+	return strings.Join(s, " ")
 }
 
-func main() {
+// CommandFor() returns the command name of the process 'pid'.
 
-	// Fetch a list of the filenames under /proc.
+func CommandFor(pid int) string {
 
-	files, err := ioutil.ReadDir("/proc")
+	comm, err := procReader.ReadComm(pid)
 	if err != nil {
-		fmt.Println("ioutil.Readdir():", err)
-		os.Exit(1)
+		// Probably, the process terminated between the time we
+		// accessed the namespace files and the time we tried to
+		// open /proc/PID/comm.
+		return "[can't open " + opts.procDir + "/" + strconv.Itoa(pid) +
+			"/comm]"
 	}
 
-	// Process each /proc/PID (PID starts with a digit).
+	return EscapeName(comm)
+}
+
+// Usernames that have already been looked up, indexed by UID.
 
-	for _, f := range files {
-		if f.Name()[0] >= '1' && f.Name()[0] <= '9' {
-			AddProcessNamespace(f.Name())
-		}
+var usernameCache = make(map[int]string)
+
+// UserFor() returns the name of the user that is the effective UID of the
+// process 'pid'. If the UID has no corresponding user name, the UID itself
+// is returned as a string.
+
+func UserFor(pid int) string {
+
+	ps, err := GetProcStatus(pid)
+	if err != nil || ps.uid == -1 {
+		return "?"
 	}
 
-	// Display the namespace tree rooted at the initial PID namespace.
+	if name, fnd := usernameCache[ps.uid]; fnd {
+		return name
+	}
+
+	name := strconv.Itoa(ps.uid)
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+
+	usernameCache[ps.uid] = name
+
+	return name
+}
 
-	DisplayNamespaceTree(initialPidNS, 0)
+// Print a sorted list of the PIDs that are members of a namespace. Each PID
+// is displayed along with its PIDs in all of the PID namespaces of which it
+// is a member, optionally followed by the command that the process is running
+// and the user that owns the process. The output is displayed in columns
+// that are aligned within the namespace.
+
+func PrintMemberPIDs(indent string, pids []int) {
+
+	// A namespace may have no member processes that we know of (for
+	// example, an ancestor of a namespace named by a PID argument, or a
+	// namespace found by "--scan-mounts"), in which case there is no
+	// table to display.
+
+	if len(pids) == 0 {
+		return
+	}
+
+	sort.Ints(pids)
+
+	// Build a table containing one row for each member process, with
+	// each row containing a cell for each of the displayed columns.
+
+	var rows [][]string
+
+	for _, pid := range pids {
+		chain := PIDChainFor(pid)
+		if opts.useColor {
+			chain = PID_COLOR + chain + NORMAL
+		}
+
+		row := []string{chain}
+
+		if opts.showComm {
+			row = append(row, CommandFor(pid))
+		}
+		if opts.showUser {
+			row = append(row, UserFor(pid))
+		}
+
+		rows = append(rows, row)
+	}
+
+	// If we are showing the command, and the output width (see
+	// 'opts.width') is too narrow to show all of the columns, truncate
+	// the command column.
+
+	totalIndent := indent + strings.Repeat(" ", 8)
+	widths := ColumnWidths(rows)
+
+	if opts.showComm && opts.width > 0 {
+		const minCommWidth = 8
+
+		avail := opts.width - len(totalIndent)
+		for i, w := range widths {
+			if i != 1 {
+				avail -= w + 2
+			}
+		}
+
+		if avail < minCommWidth {
+			avail = minCommWidth
+		}
+
+		if widths[1] > avail {
+			widths[1] = avail
+			for _, row := range rows {
+				row[1] = TruncateText(row[1], avail)
+			}
+		}
+	}
+
+	for _, row := range rows {
+		fmt.Fprintln(output, totalIndent+FormatColumns(row, widths))
+	}
+}
+
+// An expression that matches terminal escape sequences.
+
+var escapeSeqRE = regexp.MustCompile(ESC + `(\[[0-9;]*[A-Za-z]|\(B)`)
+
+// VisibleWidth() returns the number of terminal columns occupied by 's',
+// ignoring any terminal escape sequences.
+
+func VisibleWidth(s string) int {
+	width := 0
+	for _, r := range escapeSeqRE.ReplaceAllString(s, "") {
+		width += RuneWidth(r)
+	}
+	return width
+}
+
+// Ranges of characters that occupy two terminal columns: the East Asian
+// Wide and Fullwidth characters (see Unicode Standard Annex #11) and the
+// emoji. The table covers the commonly used blocks, rather than being
+// exhaustive.
+
+var wideRanges = [][2]rune{
+	{0x1100, 0x115F},   // Hangul Jamo initial consonants
+	{0x2E80, 0x303E},   // CJK radicals, symbols and punctuation
+	{0x3041, 0x33FF},   // Hiragana, Katakana, ..., CJK compatibility
+	{0x3400, 0x4DBF},   // CJK unified ideographs extension A
+	{0x4E00, 0x9FFF},   // CJK unified ideographs
+	{0xA000, 0xA4CF},   // Yi
+	{0xAC00, 0xD7A3},   // Hangul syllables
+	{0xF900, 0xFAFF},   // CJK compatibility ideographs
+	{0xFE30, 0xFE4F},   // CJK compatibility forms
+	{0xFF00, 0xFF60},   // Fullwidth forms
+	{0xFFE0, 0xFFE6},   // Fullwidth signs
+	{0x1F300, 0x1F64F}, // Pictographs and emoticons
+	{0x1F900, 0x1F9FF}, // Supplemental symbols and pictographs
+	{0x20000, 0x3FFFD}, // CJK unified ideographs extension B onward
+}
+
+// RuneWidth() returns the number of terminal columns occupied by 'r': 0 for
+// combining marks and other zero-width characters, 2 for wide characters
+// (see 'wideRanges'), and 1 for everything else.
+
+func RuneWidth(r rune) int {
+	if unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf) {
+		return 0
+	}
+
+	for _, wr := range wideRanges {
+		if r >= wr[0] && r <= wr[1] {
+			return 2
+		}
+	}
+
+	return 1
+}
+
+// EscapeName() returns a copy of 'name' (a command name) in which control
+// characters are replaced by C-style escapes, so that they can't disturb
+// the layout of the output or the terminal.
+
+func EscapeName(name string) string {
+	var b strings.Builder
+
+	for _, r := range name {
+		switch {
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case unicode.IsControl(r):
+			fmt.Fprintf(&b, `\x%02x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+// ColumnWidths() returns the widths of each column in the table 'rows'.
+// The width of a column is the visible width of its widest cell.
+
+func ColumnWidths(rows [][]string) []int {
+
+	var widths []int
+
+	for _, row := range rows {
+		for i, cell := range row {
+			if i >= len(widths) {
+				widths = append(widths, 0)
+			}
+			if w := VisibleWidth(cell); w > widths[i] {
+				widths[i] = w
+			}
+		}
+	}
+
+	return widths
+}
+
+// FormatColumns() returns a string containing the cells in 'row', each cell
+// padded to the width specified in the corresponding element of 'widths', and
+// separated by two spaces. The last cell is not padded.
+
+func FormatColumns(row []string, widths []int) string {
+
+	line := ""
+
+	for i, cell := range row {
+		if i > 0 {
+			line += "  "
+		}
+
+		line += cell
+		if i < len(row)-1 {
+			line += strings.Repeat(" ", widths[i]-VisibleWidth(cell))
+		}
+	}
+
+	return line
+}
+
+// TruncateText() returns 's' truncated so that it occupies at most 'width'
+// terminal columns, using an ellipsis to indicate that truncation occurred.
+// 's' is cut only between characters, and a character is never separated
+// from any combining marks that follow it.
+
+func TruncateText(s string, width int) string {
+
+	if VisibleWidth(s) <= width {
+		return s
+	}
+
+	result := ""
+	col := 0
+	for _, r := range s {
+		w := RuneWidth(r)
+		if col+w > width-1 { // Leave room for the ellipsis
+			break
+		}
+		result += string(r)
+		col += w
+	}
+
+	return result + "…"
+}
+
+// IsTerminal() returns true if the file descriptor 'fd' refers to
+// a terminal.
+
+func IsTerminal(fd int) bool {
+	var t syscall.Termios
+
+	_, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		uintptr(syscall.TCGETS), uintptr(unsafe.Pointer(&t)))
+
+	return err == 0
+}
+
+// Discover width of terminal, so that we can format output suitably. If the
+// width can't be determined, or the terminal reports a width of 0 (as some
+// pseudoterminals do), assume 80 columns.
+
+func GetTerminalWidth() int {
+	type winsize struct {
+		row    uint16
+		col    uint16
+		xpixel uint16
+		ypixel uint16
+	}
+	var ws winsize
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL,
+		uintptr(syscall.Stdout), uintptr(syscall.TIOCGWINSZ),
+		uintptr(unsafe.Pointer(&ws)))
+
+	if errno != 0 || ws.col == 0 { // Perhaps stdout is not a terminal
+		return 80
+	}
+
+	return int(ws.col)
+}
+
+// DisplayNamespaceTree() recursively displays the namespace tree rooted at
+// 'nsid'. 'level' is our current level in the tree, and is used to produce
+// suitably indented output.
+
+func DisplayNamespaceTree(nsid NamespaceID, level int) {
+
+	// If neither this namespace nor any of its descendants has enough
+	// member processes to satisfy the "--min-members" option, hide the
+	// entire subtree. (But always show the root of the tree.)
+
+	if level > 0 && !SubtreePassesFilter(nsid) {
+		numFilteredNS += CountNamespaces(nsid)
+		return
+	}
+
+	indent := strings.Repeat(" ", level*4)
+
+	fmt.Fprint(output, indent, " ", nsid.IDString("pid"))
+
+	// If this namespace has too few members to be displayed, but is shown
+	// because it is an ancestor of a namespace that is displayed, say so.
+
+	passesFilter := PassesFilter(nsid)
+	if !passesFilter {
+		fmt.Fprint(output, "  (filtered)")
+	}
+
+	// Display the owning user namespace.
+
+	attribs := NSList[nsid]
+	if attribs.ownerVisible {
+		fmt.Fprint(output, "  owned by ",
+			attribs.ownerUserNS.SymlinkString("user"),
+			" (UID ", attribs.ownerUID, ")")
+	} else {
+		fmt.Fprint(output, "  owned by invisible ancestor user NS")
+	}
+
+	// If the namespace is pinned by bind mounts, say so.
+
+	if len(attribs.pinnedBy) > 0 {
+		fmt.Fprint(output, "  (pinned by ",
+			strings.Join(attribs.pinnedBy, ", "))
+		if len(attribs.pids) == 0 {
+			fmt.Fprint(output, ", no processes")
+		}
+		fmt.Fprint(output, ")")
+	}
+
+	// If this is the namespace that this program is in, say so.
+
+	if nsid == currentPidNS {
+		if opts.useColor {
+			fmt.Fprint(output, CURRENT_NS_COLOR)
+		}
+		fmt.Fprint(output, " <-- current")
+		if opts.useColor {
+			fmt.Fprint(output, NORMAL)
+		}
+	}
+
+	fmt.Fprintln(output)
+
+	if passesFilter {
+		PrintMemberPIDs(indent, NSList[nsid].pids)
+	}
+
+	for _, child := range NSList[nsid].children {
+		DisplayNamespaceTree(child, level+1)
+	}
+}
+
+// SortChildren() sorts the children of every namespace by inode number, so
+// that the output doesn't depend on the order in which the scan discovered
+// them (which follows the order of the /proc directory entries).
+
+func SortChildren() {
+	for _, attribs := range NSList {
+		children := attribs.children
+		sort.Slice(children, func(i, j int) bool {
+			return children[i].inode_num < children[j].inode_num
+		})
+	}
+}
+
+// PassesFilter() returns true if the namespace 'nsid' has at least as many
+// member processes as were specified in the "--min-members" option.
+
+func PassesFilter(nsid NamespaceID) bool {
+	return len(NSList[nsid].pids) >= opts.minMembs
+}
+
+// SubtreePassesFilter() returns true if the namespace 'nsid' or any of its
+// descendants passes the "--min-members" filter.
+
+func SubtreePassesFilter(nsid NamespaceID) bool {
+
+	if PassesFilter(nsid) {
+		return true
+	}
+
+	for _, child := range NSList[nsid].children {
+		if SubtreePassesFilter(child) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CountNamespaces() returns the number of namespaces in the subtree rooted
+// at 'nsid'.
+
+func CountNamespaces(nsid NamespaceID) int {
+
+	cnt := 1
+	for _, child := range NSList[nsid].children {
+		cnt += CountNamespaces(child)
+	}
+
+	return cnt
+}
+
+// The 'Summary' structure records summary statistics about the namespace
+// hierarchy.
+
+type Summary struct {
+	numNS       int         // Number of PID namespaces
+	maxDepth    int         // Maximum nesting depth (root is depth 0)
+	numProcs    int         // Total number of member processes
+	largestNS   NamespaceID // Namespace with the most member processes
+	largestSize int         // Number of member processes in 'largestNS'
+}
+
+// AddToSummary() recursively walks the namespace tree rooted at 'nsid'
+// (which is at depth 'level' in the hierarchy), accumulating statistics about
+// the namespaces in the tree in 'sum'.
+
+func AddToSummary(sum *Summary, nsid NamespaceID, level int) {
+
+	sum.numNS++
+	sum.numProcs += len(NSList[nsid].pids)
+
+	if level > sum.maxDepth {
+		sum.maxDepth = level
+	}
+
+	if sum.numNS == 1 || len(NSList[nsid].pids) > sum.largestSize {
+		sum.largestNS = nsid
+		sum.largestSize = len(NSList[nsid].pids)
+	}
+
+	for _, child := range NSList[nsid].children {
+		AddToSummary(sum, child, level+1)
+	}
+}
+
+// DisplaySummary() displays summary statistics about the PID namespace
+// hierarchy.
+
+func DisplaySummary() {
+
+	var sum Summary
+
+	AddToSummary(&sum, initialPidNS, 0)
+
+	fmt.Fprintln(output)
+	fmt.Fprintln(output, "PID namespaces:      ", sum.numNS)
+	fmt.Fprintln(output, "Maximum depth:       ", sum.maxDepth)
+	fmt.Fprintln(output, "Processes scanned:   ", sum.numProcs)
+	fmt.Fprintln(output, "Most members:        ",
+		sum.largestNS.IDString("pid"),
+		"("+strconv.Itoa(sum.largestSize)+" processes)")
+
+	if opts.minMembs > 0 {
+		fmt.Fprintln(output, "Hidden by filter:    ", numFilteredNS)
+	}
+}
+
+// DisplayNamespaceCSV() displays the namespace tree rooted at 'root' in CSV
+// format, with one row per namespace. The rows are in depth-first order, so
+// that each parent precedes its children.
+
+func DisplayNamespaceCSV(root NamespaceID) {
+
+	w := csv.NewWriter(output)
+
+	w.Write([]string{"device", "inode", "parent_device", "parent_inode",
+		"level", "member_count", "member_pids"})
+
+	WriteNamespaceCSVRows(w, root, 0)
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		Log(LOG_QUIET, "csv.Writer:", err)
+		os.Exit(1)
+	}
+}
+
+// WriteNamespaceCSVRows() recursively writes the CSV rows for the namespace
+// tree rooted at 'nsid', which is at depth 'level' in the hierarchy.
+
+func WriteNamespaceCSVRows(w *csv.Writer, nsid NamespaceID, level int) {
+
+	attribs := NSList[nsid]
+
+	parentDev, parentIno := "", ""
+	if attribs.hasParent {
+		parentDev = strconv.FormatUint(attribs.parent.device, 10)
+		parentIno = strconv.FormatUint(attribs.parent.inode_num, 10)
+	}
+
+	sort.Ints(attribs.pids)
+
+	pids := make([]string, len(attribs.pids))
+	for i, pid := range attribs.pids {
+		pids[i] = strconv.Itoa(pid)
+	}
+
+	w.Write([]string{
+		strconv.FormatUint(nsid.device, 10),
+		strconv.FormatUint(nsid.inode_num, 10),
+		parentDev,
+		parentIno,
+		strconv.Itoa(level),
+		strconv.Itoa(len(attribs.pids)),
+		strings.Join(pids, ";"),
+	})
+
+	for _, child := range attribs.children {
+		WriteNamespaceCSVRows(w, child, level+1)
+	}
+}
+
+// DisplayNamespaceDot() displays the namespace tree rooted at 'root' as a
+// Graphviz DOT digraph. Each namespace is a node labeled with its ID and its
+// number of member processes, and there is an edge from each parent namespace
+// to each of its children.
+
+func DisplayNamespaceDot(root NamespaceID) {
+
+	fmt.Fprintln(output, "digraph pid_namespaces {")
+	fmt.Fprintln(output, "    node [shape=box];")
+
+	DisplayNamespaceDotNodes(root)
+
+	fmt.Fprintln(output, "}")
+}
+
+// DisplayNamespaceDotNodes() recursively displays the DOT node and edge
+// statements for the namespace tree rooted at 'nsid'.
+
+func DisplayNamespaceDotNodes(nsid NamespaceID) {
+
+	label := nsid.SymlinkString("pid") + "\\n" +
+		strconv.Itoa(len(NSList[nsid].pids)) + " procs"
+
+	// If the init process of the namespace is visible, add its command
+	// name to the label.
+
+	if comm := InitCommandFor(nsid); comm != "" {
+		escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+		label += "\\ninit: " + escaper.Replace(comm)
+	}
+
+	fmt.Fprintf(output, "    %s [label=\"%s\"];\n", DotNodeName(nsid),
+		label)
+
+	for _, child := range NSList[nsid].children {
+		fmt.Fprintf(output, "    %s -> %s;\n", DotNodeName(nsid),
+			DotNodeName(child))
+	}
+
+	for _, child := range NSList[nsid].children {
+		DisplayNamespaceDotNodes(child)
+	}
+}
+
+// DotNodeName() returns the name used for the namespace 'nsid' in DOT output.
+
+func DotNodeName(nsid NamespaceID) string {
+	return "ns_" + strconv.FormatUint(nsid.device, 10) + "_" +
+		strconv.FormatUint(nsid.inode_num, 10)
+}
+
+// InitCommandFor() returns the command name of the init process (i.e., the
+// process that has the PID 1 in the namespace) of the namespace 'nsid', or an
+// empty string if that process is not visible.
+
+func InitCommandFor(nsid NamespaceID) string {
+
+	for _, pid := range NSList[nsid].pids {
+		chain, err := GetNStgid(pid)
+		if err != nil || len(chain) == 0 || chain[len(chain)-1] != 1 {
+			continue
+		}
+
+		comm, err := procReader.ReadComm(pid)
+		if err != nil {
+			return ""
+		}
+
+		return EscapeName(comm)
+	}
+
+	return ""
+}
+
+// FindCurrentNamespace() records the ID of the PID namespace of which this
+// program is a member in 'currentPidNS'.
+
+func FindCurrentNamespace() {
+	var sb syscall.Stat_t
+
+	err := syscall.Stat("/proc/self/ns/pid", &sb)
+	if err != nil {
+		Log(LOG_QUIET, "syscall.Stat(/proc/self/ns/pid):", err)
+		os.Exit(1)
+	}
+
+	currentPidNS = NamespaceID{sb.Dev, sb.Ino}
+}
+
+// TargetPIDs() returns the list of PIDs that were specified as command-line
+// arguments or, if the only command-line argument is "-", the list of PIDs
+// read from standard input. If there are no command-line arguments, nil is
+// returned. All of the PIDs are validated before any of them are processed,
+// so that an invalid PID doesn't produce a partial result.
+
+func TargetPIDs() []string {
+
+	pids := flag.Args()
+
+	if len(pids) == 0 {
+		return nil
+	}
+
+	if len(pids) == 1 && pids[0] == "-" {
+		buf, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			Log(LOG_QUIET, "Error reading standard input:", err)
+			os.Exit(1)
+		}
+
+		pids = strings.Fields(string(buf))
+
+		if len(pids) == 0 {
+			ShowUsageAndExit(1)
+		}
+	}
+
+	for _, pid := range pids {
+		if n, err := strconv.Atoi(pid); err != nil || n <= 0 {
+			Log(LOG_QUIET, "Invalid PID: \""+pid+"\"")
+			os.Exit(1)
+		}
+	}
+
+	return pids
+}
+
+// Display output is accumulated in 'output' and written to standard output
+// in large chunks, rather than with a write() for each of the many small
+// fmt.Fprint() calls that build it. Operations on the buffer are serialized,
+// so that the signal handler can safely write out what has been buffered if
+// the program is interrupted.
+
+type LineWriter struct {
+	mu  sync.Mutex
+	buf []byte
+	out io.Writer
+}
+
+const outputBufSize = 64 * 1024
+
+var output = &LineWriter{out: os.Stdout}
+
+// Write() appends 'p' to the buffer. Once the buffer has grown large, the
+// complete lines that it contains are written out.
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= outputBufSize {
+		err := w.writeLines()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// writeLines() writes out the complete lines in the buffer, keeping any
+// partial last line. The caller must hold 'w.mu'.
+
+func (w *LineWriter) writeLines() error {
+	n := bytes.LastIndexByte(w.buf, '\n') + 1
+	_, err := w.out.Write(w.buf[:n])
+	w.buf = w.buf[:copy(w.buf, w.buf[n:])]
+	return err
+}
+
+// Flush() writes out everything in the buffer.
+
+func (w *LineWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, err := w.out.Write(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+// interrupt() is called when the program is interrupted by a signal. It
+// writes out the complete lines in the buffer, discarding any partial last
+// line so that the output doesn't stop part way through a line, and then
+// writes 'trailer'. 'w.mu' is left locked, so that no further output is
+// written before the program exits.
+
+func (w *LineWriter) interrupt(trailer string) {
+	w.mu.Lock()
+	w.writeLines()
+	io.WriteString(w.out, trailer)
+}
+
+// FlushOutput() writes out any output still buffered in 'output'. An error is
+// fatal, except for EPIPE (the reader of our output went away), which is
+// treated as a successful exit.
+
+func FlushOutput() {
+	err := output.Flush()
+	if errors.Is(err, syscall.EPIPE) {
+		os.Exit(0)
+	}
+	if err != nil {
+		Log(LOG_QUIET, "Error writing standard output:", err)
+		os.Exit(1)
+	}
+}
+
+// While the scan is in progress, SIGINT and SIGTERM cancel it (see
+// HandleSignals()) rather than terminating the program, so that the results
+// gathered so far can still be displayed. 'scanInProgress' (which is
+// accessed atomically) is 1 while the scan can be canceled.
+
+var scanInProgress int32
+var cancelScan context.CancelFunc
+
+// The exit status used when the scan was interrupted, so that only
+// partial results were displayed.
+
+const EXIT_INTERRUPTED = 3
+
+// StartScan() returns the context to be checked by the scan, which is canceled
+// if the program is interrupted before EndScan() is called.
+
+func StartScan() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelScan = cancel
+	atomic.StoreInt32(&scanInProgress, 1)
+	return ctx
+}
+
+// EndScan() marks the end of the scan that uses 'ctx', and returns true if
+// the scan was interrupted.
+
+func EndScan(ctx context.Context) bool {
+	atomic.StoreInt32(&scanInProgress, 0)
+	return ctx.Err() != nil
+}
+
+// HandleSignals() arranges for the program to terminate cleanly if it is
+// interrupted. If a scan is in progress, SIGINT or SIGTERM cancels the scan
+// (see StartScan()); otherwise, the complete lines of buffered output are
+// written out and the terminal color is reset (if we are using color), so that
+// the shell prompt isn't left colored, and the program exits with the
+// conventional status of 128 plus the signal number. On SIGPIPE (the reader of
+// our output went away, as in "pid_namespaces | head"), the program exits
+// silently with status 0.
+
+func HandleSignals(useColor bool) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM,
+		syscall.SIGPIPE)
+
+	go func() {
+		for sig := range sigChan {
+			if sig == syscall.SIGPIPE {
+				os.Exit(0)
+			}
+
+			// While the scan is in progress, the first SIGINT
+			// or SIGTERM just cancels it.
+
+			if atomic.CompareAndSwapInt32(&scanInProgress, 1, 0) {
+				cancelScan()
+				continue
+			}
+
+			trailer := ""
+			if useColor {
+				trailer = NORMAL
+			}
+			output.interrupt(trailer)
+
+			os.Exit(128 + int(sig.(syscall.Signal)))
+		}
+	}()
+}
+
+// Diagnostic messages are written to stderr, so that they don't become mixed
+// with the program's output (in particular, the CSV and DOT output). Which
+// messages are displayed depends on the logging level, which is selected
+// with the "-q" and "-v" options.
+
+const (
+	LOG_QUIET   = iota // Errors only
+	LOG_NORMAL         // Errors and warnings (the default)
+	LOG_VERBOSE        // Also progress messages
+	LOG_DEBUG          // Also debugging messages
+)
+
+var logLevel = LOG_NORMAL
+
+// Where diagnostic messages are written: stderr, except in tests.
+
+var logOutput io.Writer = os.Stderr
+
+// Log() writes its arguments (formatted as for fmt.Println()) to 'logOutput',
+// if 'level' is no higher than the current logging level.
+
+func Log(level int, a ...interface{}) {
+	if level <= logLevel {
+		fmt.Fprintln(logOutput, a...)
+	}
+}
+
+// 'LogLevelFlag' implements the "-v" option, each occurrence of which raises
+// the logging level by one step.
+
+type LogLevelFlag struct{}
+
+func (LogLevelFlag) String() string   { return "" }
+func (LogLevelFlag) IsBoolFlag() bool { return true }
+
+func (LogLevelFlag) Set(value string) error {
+	v, err := strconv.ParseBool(value)
+	if err == nil && v && logLevel < LOG_DEBUG {
+		logLevel++
+	}
+	return err
+}
+
+// Shell completion. The "--generate-completion=bash|zsh" option (which is
+// deliberately left out of the usage message) writes a completion script for
+// this program to stdout. The script is built from the options registered
+// with the flag package, so that it can't drift from them.
+//
+// 'completionActions' says how the values of particular options are
+// completed, and 'argAction' says how command-line arguments are completed.
+// An action is "pid" (PIDs from /proc), "dir", "" (no completion), or a
+// space-separated list of the words that are permitted.
+
+var completionActions = map[string]string{
+	"proc":        "dir",
+	"ns-format":   "raw kernel",
+	"min-members": "",
+	"color":       "auto always never",
+	"width":       "",
+}
+
+const argAction = "pid"
+
+// BashAction() returns bash code that completes the word in '$cur' according to
+// 'action'.
+
+func BashAction(action string) string {
+	switch action {
+	case "":
+		return ""
+	case "pid":
+		return `COMPREPLY=( $(compgen -W "$(ls /proc | ` +
+			`grep '^[0-9]')" -- "$cur") )`
+	case "dir":
+		return `COMPREPLY=( $(compgen -d -- "$cur") )`
+	default:
+		return `COMPREPLY=( $(compgen -W "` + action + `" -- "$cur") )`
+	}
+}
+
+// ZshAction() returns the zsh _arguments action corresponding to 'action'.
+
+func ZshAction(action string) string {
+	switch action {
+	case "":
+		return " "
+	case "pid":
+		return "_pids"
+	case "dir":
+		return "_files -/"
+	default:
+		return "(" + action + ")"
+	}
+}
+
+// GenerateCompletion() writes a completion script for 'shell' ("bash" or "zsh")
+// to stdout.
+
+func GenerateCompletion(shell string) {
+	const prog = "pid_namespaces"
+
+	// Options are completed with a double dash, except for the
+	// single-letter ones such as "-q".
+
+	dashes := func(name string) string {
+		if len(name) == 1 {
+			return "-" + name
+		}
+		return "--" + name
+	}
+
+	var names []string
+	var flags []*flag.Flag
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name != "generate-completion" {
+			names = append(names, dashes(f.Name))
+			flags = append(flags, f)
+		}
+	})
+
+	isBool := func(f *flag.Flag) bool {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		return ok && b.IsBoolFlag()
+	}
+
+	if shell == "zsh" {
+		quoter := strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`,
+			":", `\:`)
+
+		fmt.Println("#compdef " + prog)
+		fmt.Println()
+		fmt.Println("_arguments \\")
+		for _, f := range flags {
+			spec := dashes(f.Name)
+			if !isBool(f) {
+				spec += "="
+			}
+			spec += "[" + quoter.Replace(f.Usage) + "]"
+			if !isBool(f) {
+				spec += ":" + f.Name + ":" +
+					ZshAction(completionActions[f.Name])
+			}
+			fmt.Println("\t'" + spec + "' \\")
+		}
+		fmt.Println("\t'*:argument:" + ZshAction(argAction) + "'")
+		return
+	}
+
+	// Go's flag package accepts both "--opt=value" and "--opt value";
+	// bash splits the former into three words at the '='.
+
+	fmt.Println(`_` + prog + `()
+{
+	local cur prev opt
+	cur=${COMP_WORDS[COMP_CWORD]}
+	prev=${COMP_WORDS[COMP_CWORD-1]}
+	COMPREPLY=()
+
+	if [ "$cur" = "=" ]; then
+		opt=$prev
+		cur=
+	elif [ "$prev" = "=" ]; then
+		opt=${COMP_WORDS[COMP_CWORD-2]}
+	else
+		opt=$prev
+	fi
+
+	case $opt in`)
+
+	for _, f := range flags {
+		if !isBool(f) {
+			fmt.Println("\t-" + f.Name + "|--" + f.Name + ")")
+			action := BashAction(completionActions[f.Name])
+			if action != "" {
+				fmt.Println("\t\t" + strings.Replace(action,
+					"\n", "\n\t\t", -1))
+			}
+			fmt.Println("\t\treturn ;;")
+		}
+	}
+
+	fmt.Println(`	esac
+
+	case $cur in
+	-*)
+		COMPREPLY=( $(compgen -W "` + strings.Join(names, " ") + `" \
+			-- "$cur") )
+		return ;;
+	esac
+
+	` + strings.Replace(BashAction(argAction), "\n", "\n\t", -1) + `
+}
+complete -F _` + prog + ` ` + prog)
+}
+
+// ShowUsageAndExit() prints a command-line usage message for this program and
+// terminates the program with the specified 'status' value.
+
+func ShowUsageAndExit(status int) {
+
+	// The usage message is a diagnostic, written to stderr, unless it
+	// was asked for with "--help".
+
+	out := os.Stdout
+	if status != 0 {
+		out = os.Stderr
+	}
+
+	fmt.Fprintln(out,
+		`Usage: pid_namespaces [options] [<pid>... | -]
+
+Show the PID namespace hierarchy, along with the member processes of each
+namespace. If PIDs are specified as command-line arguments, only the
+namespaces of those processes (and their ancestor namespaces) are shown; if
+the only argument is "-", the PIDs are read from standard input. For each
+namespace, the owning user namespace and the UID of the creator of that user
+namespace are shown. The namespace of which this program is a member is
+marked with "<-- current". After the hierarchy, a summary of the hierarchy is
+shown. Error, warning, and progress messages are written to standard error.
+
+Options:
+
+-q		Don't display warning messages (for example, about pinned
+		namespaces that can't be opened). Error messages are still
+		displayed.
+-v		Display progress messages. If specified twice, also display
+		debugging messages.
+
+--color=<when>	Use color in the displayed output "always", "never", or
+		only if standard output is a terminal ("auto", the default).
+		Can't be combined with '--no-color'.
+--csv		Display the namespaces in CSV format, with one row per
+		namespace. The columns are: device, inode, parent_device,
+		parent_inode, level, member_count, and member_pids (a
+		semicolon-separated list).
+--dot		Display the hierarchy as a Graphviz DOT digraph (instead of
+		as an indented tree).
+--min-members=<n>
+		Hide namespaces that have fewer than <n> member processes.
+		Ancestors of displayed namespaces are still shown (marked
+		"(filtered)", and without their member processes), so that
+		the tree remains connected. The summary shows the number of
+		namespaces that were hidden.
+--no-color	Suppress the use of color in the displayed output.
+--no-summary	Don't display the summary (number of namespaces, maximum
+		nesting depth, number of processes, and the namespace with
+		the most members) that follows the namespace tree.
+--ns-format=<fmt>
+		Display namespace IDs in the specified format: "raw" (the
+		default) shows the device ID and inode number, for example,
+		"{4 4026531836}"; "kernel" shows the ID in the same format as
+		a /proc/PID/ns/pid symlink, for example, "pid:[4026531836]".
+--proc=<dir>	Scan the PID directories under <dir> instead of under /proc.
+		This allows, for example, inspection of a procfs from another
+		PID namespace that has been bind mounted at <dir>. <dir> need
+		not be a real procfs mount: it is enough that each
+		<dir>/PID/ns/pid is a (bind mounted) namespace file, since
+		the namespace ioctl() operations work on any such file.
+--scan-mounts	Also discover PID namespaces that are pinned into existence
+		by bind mounts (found via /proc/self/mountinfo). Such
+		namespaces may have no member processes.
+--show-comm	Display the command being run by each process. If the
+		terminal (or the width given by '--width') is too narrow,
+		the command is truncated.
+--show-user	Display the user that owns (i.e., is the effective UID of)
+		each process.
+--width=<n>	Fit the output in <n> columns. By default, the output is
+		fitted to the width of the terminal, or not limited at all
+		if standard output is not a terminal.
+
+If no PID namespaces are discovered, the program exits with the status 2.`)
+
+	os.Exit(status)
+}
+
+// ParseArgs() parses the command line in the same way as flag.Parse(), except
+// that options may also appear after (or among) the nonoption arguments, so
+// that, for example, "pid_namespaces 1234 --no-color" works as expected. An
+// argument of "--" ends the options: all later arguments are nonoption
+// arguments. A negative number, and a lone "-", are nonoption arguments. Any
+// other argument that starts with '-' is treated as an option, so that the flag
+// package diagnoses it if it is unrecognized.
+
+func ParseArgs() {
+	var options, nonOptions []string
+
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if arg == "--" {
+			nonOptions = append(nonOptions, args[i+1:]...)
+			break
+		}
+
+		if _, err := strconv.Atoi(arg); err == nil || len(arg) < 2 ||
+			arg[0] != '-' {
+			nonOptions = append(nonOptions, arg)
+			continue
+		}
+
+		options = append(options, arg)
+
+		// An option that takes a value may have the value in the
+		// following argument, which must stay with the option.
+
+		name := strings.TrimLeft(arg, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+
+		f := flag.Lookup(name)
+		if f == nil || i+1 == len(args) {
+			continue
+		}
+
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		if !ok || !b.IsBoolFlag() {
+			i++
+			options = append(options, args[i])
+		}
+	}
+
+	options = append(options, "--")
+	flag.CommandLine.Parse(append(options, nonOptions...))
+}
+
+// ParseCmdLineOptions() parses command-line options and returns them
+// conveniently packaged in a structure.
+
+func ParseCmdLineOptions() CmdLineOptions {
+
+	var opts CmdLineOptions
+
+	helpPtr := flag.Bool("help", false, "Show detailed usage message")
+	completionPtr := flag.String("generate-completion", "",
+		"Write a bash or zsh completion script")
+	quietPtr := flag.Bool("q", false, "Display only error messages")
+	flag.Var(LogLevelFlag{}, "v", "Display progress messages "+
+		"(repeat for debugging messages)")
+	noColorPtr := flag.Bool("no-color", false,
+		"Don't use color in output display")
+	procPtr := flag.String("proc", "/proc", "Root directory of procfs "+
+		"to be scanned")
+	dotPtr := flag.Bool("dot", false, "Display hierarchy in Graphviz "+
+		"DOT format")
+	scanMountsPtr := flag.Bool("scan-mounts", false, "Also show PID "+
+		"namespaces pinned by bind mounts")
+	minMembersPtr := flag.Int("min-members", 0, "Hide namespaces with "+
+		"fewer than this many member processes")
+	showCommPtr := flag.Bool("show-comm", false,
+		"Show command run by each PID")
+	showUserPtr := flag.Bool("show-user", false,
+		"Show user that owns each PID")
+	csvPtr := flag.Bool("csv", false, "Display namespaces in CSV format")
+	noSummaryPtr := flag.Bool("no-summary", false,
+		"Don't show summary after the namespace tree")
+	nsFormatPtr := flag.String("ns-format", "raw", "Format of displayed "+
+		"namespace IDs (\"raw\" or \"kernel\")")
+	colorPtr := flag.String("color", "auto", "When to use color "+
+		"(\"auto\", \"always\", or \"never\")")
+	widthPtr := flag.Int("width", 0, "Fit output in this many columns")
+
+	ParseArgs()
+
+	if *helpPtr {
+		ShowUsageAndExit(0)
+	}
+
+	if *completionPtr != "" {
+		if *completionPtr != "bash" && *completionPtr != "zsh" {
+			Log(LOG_QUIET, "Bad value for --generate-completion "+
+				"option: "+*completionPtr)
+			ShowUsageAndExit(1)
+		}
+		GenerateCompletion(*completionPtr)
+		os.Exit(0)
+	}
+
+	if *quietPtr {
+		if logLevel != LOG_NORMAL {
+			Log(LOG_QUIET, "'-q' can't be combined with '-v'")
+			ShowUsageAndExit(1)
+		}
+		logLevel = LOG_QUIET
+	}
+
+	// By default, color is used, and output is wrapped to the width of the
+	// terminal, only if standard output is a terminal. The "--color" and
+	// "--width" options override these defaults.
+
+	isTTY := IsTerminal(syscall.Stdout)
+
+	if *colorPtr != "auto" && *noColorPtr {
+		Log(LOG_QUIET, "'--no-color' can't be combined with '--color'")
+		ShowUsageAndExit(1)
+	}
+
+	switch *colorPtr {
+	case "auto":
+		opts.useColor = isTTY && !*noColorPtr
+	case "always":
+		opts.useColor = true
+	case "never":
+		opts.useColor = false
+	default:
+		Log(LOG_QUIET, "Bad value for --color option: "+*colorPtr)
+		ShowUsageAndExit(1)
+	}
+
+	if *widthPtr < 0 {
+		Log(LOG_QUIET, "Bad value for --width option: "+
+			strconv.Itoa(*widthPtr))
+		ShowUsageAndExit(1)
+	}
+
+	opts.width = *widthPtr
+	if opts.width == 0 && isTTY {
+		opts.width = GetTerminalWidth()
+	}
+
+	opts.procDir = filepath.Clean(*procPtr)
+	opts.dot = *dotPtr
+	opts.nsFormat = *nsFormatPtr
+	opts.scanMnts = *scanMountsPtr
+	opts.minMembs = *minMembersPtr
+	opts.showComm = *showCommPtr
+	opts.showUser = *showUserPtr
+	opts.summary = !*noSummaryPtr
+	opts.csv = *csvPtr
+
+	if opts.csv && opts.dot {
+		Log(LOG_QUIET, "'--csv' and '--dot' can't be specified "+
+			"together")
+		ShowUsageAndExit(1)
+	}
+
+	if opts.nsFormat != "raw" && opts.nsFormat != "kernel" {
+		Log(LOG_QUIET, "Bad value for --ns-format option: "+
+			opts.nsFormat)
+		ShowUsageAndExit(1)
+	}
+
+	return opts
+}
+
+func main() {
+
+	opts = ParseCmdLineOptions()
+
+	HandleSignals(opts.useColor)
+
+	FindCurrentNamespace()
+
+	// Unless "--proc" names another directory, 'procReader' is left as
+	// it is (which lets the tests supply a fake reader).
+
+	if opts.procDir != "/proc" {
+		procReader = ProcfsReader{opts.procDir}
+	}
+
+	// Process either the PIDs specified on the command line (or on
+	// standard input), or each PID directory under the procfs directory.
+
+	names := TargetPIDs()
+
+	ctx := StartScan()
+	defer cancelScan()
+
+	numScanned, err := ScanProcesses(ctx, names)
+	if err != nil {
+		Log(LOG_QUIET, err)
+		os.Exit(1)
+	}
+
+	Log(LOG_VERBOSE, "Scanned "+strconv.Itoa(numScanned)+
+		" processes; found "+strconv.Itoa(len(NSList))+
+		" PID namespaces")
+
+	// Optionally, add the PID namespaces that are pinned by bind mounts.
+
+	if opts.scanMnts && ctx.Err() == nil {
+		AddPinnedNamespaces()
+	}
+
+	interrupted := EndScan(ctx)
+
+	SortChildren()
+
+	// If the scan discovered nothing, there is nothing to display.
+
+	if status := CheckScanFoundNamespaces(); status != 0 {
+		os.Exit(status)
+	}
+
+	// Display the namespace tree rooted at the initial PID namespace.
+
+	if interrupted {
+		Log(LOG_QUIET, "Scan interrupted: displaying partial results")
+	}
+
+	if opts.dot {
+		DisplayNamespaceDot(initialPidNS)
+	} else if opts.csv {
+		DisplayNamespaceCSV(initialPidNS)
+	} else {
+		DisplayNamespaceTree(initialPidNS, 0)
+
+		if opts.summary {
+			DisplaySummary()
+		}
+	}
+
+	FlushOutput()
+
+	if interrupted {
+		os.Exit(EXIT_INTERRUPTED)
+	}
 }
@@ -0,0 +1,286 @@
+//go:build integration
+
+package main
+
+// Integration tests, which run the built program against PID namespaces
+// that the tests create. They need root privilege (and are skipped without
+// it), so they are built only with the "integration" tag:
+//
+//	go test -tags integration pid_namespaces.go pid_namespaces_test.go \
+//		pid_namespaces_integration_test.go
+//
+// Each namespace is kept alive only by a child process that is killed when
+// the test ends, so nothing is left behind even if a test fails.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// requirePrivilege() skips the test unless it is run by root.
+
+func requirePrivilege(t *testing.T) {
+
+	if os.Geteuid() != 0 {
+		t.Skip("integration tests need root privilege")
+	}
+}
+
+// buildProgram() builds the program 'src' into a temporary directory, and
+// returns the pathname of the executable.
+
+func buildProgram(t *testing.T, src string) string {
+
+	bin := filepath.Join(t.TempDir(), strings.TrimSuffix(src, ".go"))
+
+	out, err := exec.Command("go", "build", "-o", bin, src).CombinedOutput()
+	if err != nil {
+		t.Fatalf("go build %s: %v\n%s", src, err, out)
+	}
+
+	return bin
+}
+
+// startHelper() starts the helper process 'cmd', which is killed when the
+// test ends, and returns its PID as a string. The helper's diagnostics go to
+// the test's standard error.
+
+func startHelper(t *testing.T, cmd *exec.Cmd) string {
+
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	return strconv.Itoa(cmd.Process.Pid)
+}
+
+// waitForComm() waits until the process 'pid' is running the command
+// 'comm' (that is, until the helper has finished building the namespaces
+// and has executed its final command). The test fails if the helper exits
+// (becomes a zombie) first.
+
+func waitForComm(t *testing.T, pid string, comm string) {
+
+	deadline := time.Now().Add(10 * time.Second)
+
+	for time.Now().Before(deadline) {
+		buf, err := ioutil.ReadFile("/proc/" + pid + "/comm")
+		if err == nil && strings.TrimSpace(string(buf)) == comm {
+			return
+		}
+
+		stat, err := ioutil.ReadFile("/proc/" + pid + "/stat")
+		i := strings.LastIndex(string(stat), ")")
+		if err == nil && i > 0 && strings.HasPrefix(
+			string(stat[i:]), ") Z") {
+			t.Fatalf("PID %s exited before executing %q", pid,
+				comm)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("PID %s did not execute %q", pid, comm)
+}
+
+// waitForDescendant() waits until the process 'pid' has a chain of 'depth'
+// descendants (each the first child of the one before) of which the last is
+// running the command 'comm', and returns the PID of that last descendant.
+
+func waitForDescendant(t *testing.T, pid string, depth int,
+	comm string) string {
+
+	deadline := time.Now().Add(10 * time.Second)
+
+	for time.Now().Before(deadline) {
+		p := pid
+		for i := 0; i < depth && p != ""; i++ {
+			buf, _ := ioutil.ReadFile("/proc/" + p + "/task/" + p +
+				"/children")
+			p = ""
+			fields := strings.Fields(string(buf))
+			if len(fields) > 0 {
+				p = fields[0]
+			}
+		}
+
+		if p != "" {
+			buf, err := ioutil.ReadFile("/proc/" + p + "/comm")
+			if err == nil &&
+				strings.TrimSpace(string(buf)) == comm {
+				return p
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("PID %s has no descendant at depth %d executing %q", pid,
+		depth, comm)
+	return ""
+}
+
+// openNamespace() opens the namespace file 'path', closing it when the test
+// ends.
+
+func openNamespace(t *testing.T, path string) int {
+
+	fd, err := syscall.Open(path, syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+
+	return fd
+}
+
+// namespaceIDOf() returns the ID (in the program's "{dev inode}" format) of
+// the namespace referred to by the file descriptor 'fd'.
+
+func namespaceIDOf(t *testing.T, fd int) string {
+
+	var sb syscall.Stat_t
+
+	if err := syscall.Fstat(fd, &sb); err != nil {
+		t.Fatal(err)
+	}
+
+	return fmt.Sprintf("{%d %d}", sb.Dev, sb.Ino)
+}
+
+// runProgram() runs 'bin' with the arguments 'args', and returns its
+// standard output, failing the test if the program fails.
+
+func runProgram(t *testing.T, bin string, args ...string) string {
+
+	var stderr strings.Builder
+
+	cmd := exec.Command(bin, args...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%s %s: %v\n%s", filepath.Base(bin),
+			strings.Join(args, " "), err, stderr.String())
+	}
+
+	return string(out)
+}
+
+// findLine() returns the index of the first line of 'lines' that contains
+// all of 'fragments', failing the test if there is none.
+
+func findLine(t *testing.T, lines []string, fragments ...string) int {
+
+	for i, line := range lines {
+		found := true
+		for _, f := range fragments {
+			if !strings.Contains(line, f) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return i
+		}
+	}
+
+	t.Fatalf("no line contains %q in:\n%s", fragments,
+		strings.Join(lines, "\n"))
+	return -1
+}
+
+// indentOf() returns the number of leading spaces in 'line'.
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// TestIntegrationTwoLevelPidNS creates a PID namespace (with its own mount
+// namespace and procfs, so that the program sees it as the initial
+// namespace) containing a child PID namespace that in turn contains a
+// grandchild PID namespace. It runs the program inside the first namespace,
+// and checks that it shows the three namespaces at the right levels, with
+// their member processes.
+
+func TestIntegrationTwoLevelPidNS(t *testing.T) {
+
+	requirePrivilege(t)
+	bin := buildProgram(t, "pid_namespaces.go")
+
+	// The procfs mount mustn't propagate to the test's mount namespace.
+
+	cmd := exec.Command("sh", "-c", "mount --make-rprivate / && "+
+		"mount -t proc proc /proc && exec sleep 1000")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWPID | syscall.CLONE_NEWNS,
+	}
+	initPID := startHelper(t, cmd)
+	waitForComm(t, initPID, "sleep")
+
+	// Killing 'initPID' (the init process of the first namespace) kills
+	// all of the processes in the descendant namespaces too.
+
+	enter := []string{"--target", initPID, "--pid", "--mount"}
+
+	helper := startHelper(t, exec.Command("nsenter", append(enter,
+		"unshare", "--pid", "--fork",
+		"unshare", "--pid", "--fork", "sleep", "1000")...))
+	pid := waitForDescendant(t, helper, 3, "sleep")
+
+	fd := openNamespace(t, "/proc/"+pid+"/ns/pid")
+
+	parentFD, err := NSIoctl(fd, NS_GET_PARENT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(parentFD)
+
+	ids := [3]string{
+		namespaceIDOf(t, openNamespace(t, "/proc/"+initPID+"/ns/pid")),
+		namespaceIDOf(t, parentFD),
+		namespaceIDOf(t, fd),
+	}
+
+	out := runProgram(t, "nsenter", append(enter, bin, "--color=never",
+		"--show-comm")...)
+	lines := strings.Split(out, "\n")
+
+	levels := [3]int{
+		findLine(t, lines, ids[0], "<-- current"),
+		findLine(t, lines, ids[1]),
+		findLine(t, lines, ids[2]),
+	}
+
+	for i := 1; i < 3; i++ {
+		if levels[i] < levels[i-1] || indentOf(lines[levels[i]]) <=
+			indentOf(lines[levels[i-1]]) {
+			t.Errorf("%s is not displayed below its parent %s:\n%s",
+				ids[i], ids[i-1], out)
+		}
+	}
+
+	if !strings.HasSuffix(lines[levels[0]+1], "[1]  sleep") {
+		t.Errorf("init of %s is not displayed:\n%s", ids[0], out)
+	}
+	if !strings.HasSuffix(lines[levels[1]+1], " 1]  unshare") {
+		t.Errorf("init of %s is not displayed:\n%s", ids[1], out)
+	}
+	if !strings.HasSuffix(lines[levels[2]+1], " 2 1]  sleep") {
+		t.Errorf("PID %s is not displayed as a member of %s:\n%s",
+			pid, ids[2], out)
+	}
+}
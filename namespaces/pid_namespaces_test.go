@@ -0,0 +1,2192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// If PID_NAMESPACES_SIGNAL_TEST is set in the environment, the test
+// binary runs signalChild() instead of the tests, so that a test can check
+// how the program's signal handlers behave in a child process. Similarly,
+// if PID_NAMESPACES_INTERRUPT_TEST is set, it runs interruptChild(), and
+// if PID_NAMESPACES_REDIRECT_TEST is set, it runs redirectChild().
+
+func TestMain(m *testing.M) {
+
+	if mode := os.Getenv("PID_NAMESPACES_SIGNAL_TEST"); mode != "" {
+		signalChild(mode)
+	}
+
+	if stop := os.Getenv("PID_NAMESPACES_INTERRUPT_TEST"); stop != "" {
+		interruptChild(stop)
+	}
+
+	if os.Getenv("PID_NAMESPACES_REDIRECT_TEST") != "" {
+		redirectChild()
+	}
+
+	os.Exit(m.Run())
+}
+
+// Status files captured from a normal process, a kernel thread, and a process
+// in a PID namespace nested three levels below the initial PID namespace.
+// Only the fields that matter here are included (the kernel's files contain
+// about 60 lines).
+
+const statusNormal = `Name:	bash
+Umask:	0022
+State:	S (sleeping)
+Tgid:	4321
+Ngid:	0
+Pid:	4321
+PPid:	4300
+TracerPid:	0
+Uid:	1000	1000	1000	1000
+Gid:	1000	1000	1000	1000
+FDSize:	256
+Groups:	4 27 1000
+NStgid:	4321
+NSpid:	4321
+NSpgid:	4321
+NSsid:	4321
+Kthread:	0
+Threads:	1
+`
+
+const statusKthread = `Name:	kthreadd
+Umask:	0000
+State:	S (sleeping)
+Tgid:	2
+Ngid:	0
+Pid:	2
+PPid:	0
+TracerPid:	0
+Uid:	0	0	0	0
+Gid:	0	0	0	0
+FDSize:	64
+Groups:
+NStgid:	2
+NSpid:	2
+NSpgid:	0
+NSsid:	0
+Kthread:	1
+Threads:	1
+`
+
+const statusNested = `Name:	sleep
+Umask:	0022
+State:	S (sleeping)
+Tgid:	81234
+Ngid:	0
+Pid:	81234
+PPid:	81200
+TracerPid:	0
+Uid:	100000	100000	100000	100000
+Gid:	100000	100000	100000	100000
+FDSize:	64
+Groups:
+NStgid:	81234	4567	89	1
+NSpid:	81234	4567	89	1
+NSpgid:	81200	4500	1	0
+NSsid:	81200	4500	1	0
+Kthread:	0
+Threads:	1
+`
+
+// writeProcFixture() creates, under 'root', a PID directory for 'pid'
+// containing the files (for example, "status") named in 'files'.
+
+func writeProcFixture(tb testing.TB, root string, pid int,
+	files map[string]string) {
+
+	dir := filepath.Join(root, strconv.Itoa(pid))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		tb.Fatal(err)
+	}
+
+	for name, contents := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name),
+			[]byte(contents), 0644)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// resetScan() empties the namespace list and the caches of information read
+// from the procfs.
+
+func resetScan() {
+
+	NSList = make(map[NamespaceID]*NamespaceAttribs)
+	initialPidNS = NamespaceID{}
+	initialPidNSFound = false
+	StatusCache = make(map[int]*ProcStatus)
+}
+
+// useReader() makes 'r' the reader through which the program accesses the
+// procfs, and empties the namespace list and the caches of information read
+// from the procfs, for the duration of the test.
+
+func useReader(tb testing.TB, r ProcReader) {
+
+	saved := procReader
+
+	procReader = r
+	resetScan()
+
+	tb.Cleanup(func() {
+		procReader = saved
+		resetScan()
+	})
+}
+
+// selfPidNS() returns the ID of the PID namespace of the test program.
+
+func selfPidNS(tb testing.TB) NamespaceID {
+	var sb syscall.Stat_t
+
+	if err := syscall.Stat("/proc/self/ns/pid", &sb); err != nil {
+		tb.Fatal(err)
+	}
+
+	return NamespaceID{sb.Dev, sb.Ino}
+}
+
+// listProcesses() returns the names that 'r' lists as PID directories.
+
+func listProcesses(tb testing.TB, r ProcReader) []string {
+
+	var names []string
+
+	err := r.ListProcesses(func(name string) bool {
+		names = append(names, name)
+		return true
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return names
+}
+
+// originalNStgid() parses a status file in the way that the program did
+// before the parsing was cached: a regular expression was compiled for each
+// file and matched against each line, and the field value was displayed as
+// it appeared in the file.
+
+func originalNStgid(status string) string {
+
+	re := regexp.MustCompile(":[ \t]*")
+
+	for _, line := range strings.Split(status, "\n") {
+		match, _ := regexp.MatchString("^NStgid:", line)
+		if match {
+			tokens := re.Split(line, -1)
+			return strings.Join(strings.Fields(tokens[1]), " ")
+		}
+	}
+
+	return ""
+}
+
+// TestGetProcStatus checks the fields parsed from captured status files, and
+// checks that the PID chain is the same as was shown before the parsing was
+// cached.
+
+func TestGetProcStatus(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		status string
+		nstgid []int
+		uid    int
+	}{
+		{"normal process", statusNormal, []int{4321}, 1000},
+		{"kernel thread", statusKthread, []int{2}, 0},
+		{"nested PID namespaces", statusNested,
+			[]int{81234, 4567, 89, 1}, 100000},
+		{"no NStgid or Uid field", "Name:\tinit\n", nil, -1},
+	}
+
+	root := t.TempDir()
+	useReader(t, ProcfsReader{root})
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pid := i + 1
+			writeProcFixture(t, root, pid,
+				map[string]string{"status": tt.status})
+
+			ps, err := GetProcStatus(pid)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(ps.nstgid, tt.nstgid) {
+				t.Errorf("nstgid = %v, want %v", ps.nstgid,
+					tt.nstgid)
+			}
+			if ps.uid != tt.uid {
+				t.Errorf("uid = %d, want %d", ps.uid, tt.uid)
+			}
+
+			got := FormatPIDChain(ps.nstgid)
+			if want := originalNStgid(tt.status); got != want {
+				t.Errorf("PID chain %q, was %q", got, want)
+			}
+		})
+	}
+}
+
+// TestGetProcStatusCached checks that a status file is read only once: after
+// the first read, the cached values are returned even though the file has
+// gone (as it does when the process terminates).
+
+func TestGetProcStatusCached(t *testing.T) {
+
+	root := t.TempDir()
+	useReader(t, ProcfsReader{root})
+
+	writeProcFixture(t, root, 81234,
+		map[string]string{"status": statusNested})
+
+	first, err := GetNStgid(81234)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(filepath.Join(root, "81234")); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := GetNStgid(81234)
+	if err != nil {
+		t.Fatalf("second GetNStgid(): %v", err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("cached chain %v, first read %v", second, first)
+	}
+
+	if _, err := GetNStgid(99999); !os.IsNotExist(err) {
+		t.Errorf("GetNStgid() of a missing PID: err = %v", err)
+	}
+}
+
+// statusFixture() creates, under a temporary directory, the status files of
+// 'n' processes (a mixture of the captured files above), and returns the
+// directory.
+
+func statusFixture(b *testing.B, n int) string {
+
+	root := b.TempDir()
+	statuses := []string{statusNormal, statusKthread, statusNested}
+
+	for pid := 1; pid <= n; pid++ {
+		writeProcFixture(b, root, pid,
+			map[string]string{"status": statuses[pid%3]})
+	}
+
+	return root
+}
+
+// BenchmarkGetProcStatus measures the parsing of the status files of 1000
+// processes, with each file parsed once, as happens in a scan.
+
+func BenchmarkGetProcStatus(b *testing.B) {
+
+	const n = 1000
+
+	useReader(b, ProcfsReader{statusFixture(b, n)})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		StatusCache = make(map[int]*ProcStatus)
+		for pid := 1; pid <= n; pid++ {
+			GetProcStatus(pid)
+		}
+	}
+}
+
+// BenchmarkOriginalNStgid measures the parsing of the same files in the way
+// that the program did before the parsing was cached, for comparison with
+// BenchmarkGetProcStatus.
+
+func BenchmarkOriginalNStgid(b *testing.B) {
+
+	const n = 1000
+
+	root := statusFixture(b, n)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for pid := 1; pid <= n; pid++ {
+			buf, _ := ioutil.ReadFile(filepath.Join(root,
+				strconv.Itoa(pid), "status"))
+			originalNStgid(string(buf))
+		}
+	}
+}
+
+// TestParseArgs checks that ParseArgs() accepts options before, after, and
+// among the nonoption arguments, keeps the value of a nonboolean option given
+// as a separate argument with the option, stops at "--", treats negative
+// numbers and a lone "-" as nonoption arguments, and leaves an unrecognized
+// option to be diagnosed by the flag package. The command line is parsed
+// against a set of test options: a boolean "-b", a string "-s", and an
+// integer "-n".
+
+func TestParseArgs(t *testing.T) {
+
+	tests := []struct {
+		name string
+		args []string
+		want []string // Nonoption arguments
+		b    bool
+		s    string
+		n    int
+		err  string // Diagnostic from the flag package, if any
+	}{
+		{"options first", []string{"-b", "-s", "x", "a", "b"},
+			[]string{"a", "b"}, true, "x", 0, ""},
+		{"options last", []string{"a", "b", "--b", "--s=x"},
+			[]string{"a", "b"}, true, "x", 0, ""},
+		{"interleaved", []string{"a", "-b", "b", "-n", "3", "c"},
+			[]string{"a", "b", "c"}, true, "", 3, ""},
+		{"--opt value", []string{"1234", "--s", "val", "5678"},
+			[]string{"1234", "5678"}, false, "val", 0, ""},
+		{"value like an option", []string{"-s", "-b", "a"},
+			[]string{"a"}, false, "-b", 0, ""},
+		{"boolean then argument", []string{"--b", "x"},
+			[]string{"x"}, true, "", 0, ""},
+		{"--", []string{"a", "-b", "--", "-s", "x", "--"},
+			[]string{"a", "-s", "x", "--"}, true, "", 0, ""},
+		{"negative numbers", []string{"-1", "a", "-n", "-3", "-22"},
+			[]string{"-1", "a", "-22"}, false, "", -3, ""},
+		{"lone -", []string{"-", "-b", "-"},
+			[]string{"-", "-"}, true, "", 0, ""},
+		{"unrecognized option", []string{"a", "--bogus"}, nil,
+			false, "", 0, "flag provided but not defined: -bogus"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			savedArgs, savedFlags := os.Args, flag.CommandLine
+			defer func() {
+				os.Args, flag.CommandLine = savedArgs,
+					savedFlags
+			}()
+
+			var diag bytes.Buffer
+			os.Args = append([]string{"prog"}, tc.args...)
+			flag.CommandLine = flag.NewFlagSet("prog",
+				flag.ContinueOnError)
+			flag.CommandLine.SetOutput(&diag)
+
+			b := flag.Bool("b", false, "")
+			s := flag.String("s", "", "")
+			n := flag.Int("n", 0, "")
+
+			ParseArgs()
+
+			if tc.err != "" {
+				if !strings.Contains(diag.String(), tc.err) {
+					t.Errorf("diagnostic %q, want %q",
+						diag.String(), tc.err)
+				}
+				return
+			}
+			if diag.Len() != 0 {
+				t.Errorf("unexpected diagnostic %q",
+					diag.String())
+			}
+
+			if got := flag.Args(); !reflect.DeepEqual(got,
+				tc.want) {
+				t.Errorf("arguments %q, want %q", got, tc.want)
+			}
+			if *b != tc.b || *s != tc.s || *n != tc.n {
+				t.Errorf("-b %v, -s %q, -n %d; want %v, %q, %d",
+					*b, *s, *n, tc.b, tc.s, tc.n)
+			}
+		})
+	}
+}
+
+// TestProcOptionProcfs checks "--proc" with a real procfs: the PID
+// directories of /proc include that of the test program, whose PID namespace
+// is discovered through the reader.
+
+func TestProcOptionProcfs(t *testing.T) {
+
+	useReader(t, ProcfsReader{"/proc"})
+
+	self := strconv.Itoa(os.Getpid())
+
+	found := false
+	for _, name := range listProcesses(t, procReader) {
+		if name == self {
+			found = true
+		}
+		if _, err := strconv.Atoi(name); err != nil {
+			t.Errorf("ListProcesses() returned %q", name)
+		}
+	}
+	if !found {
+		t.Errorf("ListProcesses() didn't return our PID (%s)", self)
+	}
+
+	if err := AddProcessNamespace(self); err != nil {
+		t.Fatal(err)
+	}
+
+	attribs, fnd := NSList[selfPidNS(t)]
+	if !fnd {
+		t.Fatal("our PID namespace wasn't discovered")
+	}
+	if len(attribs.pids) != 1 || attribs.pids[0] != os.Getpid() {
+		t.Errorf("members = %v, want [%s]", attribs.pids, self)
+	}
+	if !initialPidNSFound {
+		t.Error("the initial PID namespace wasn't found")
+	}
+
+	chain, err := GetNStgid(os.Getpid())
+	if err != nil || len(chain) == 0 {
+		t.Fatalf("GetNStgid() = %v, %v", chain, err)
+	}
+	if chain[len(chain)-1] != os.Getpid() {
+		t.Errorf("chain %v doesn't end with our PID", chain)
+	}
+}
+
+// TestProcOptionNonProcfs checks "--proc" with a directory that is not a
+// procfs: each PID directory contains a symbolic link to a namespace file
+// (which serves as well as a bind mount would, since the namespace ioctl()
+// operations work on the file that it refers to) and a status file. Entries
+// that aren't PID directories are ignored.
+
+func TestProcOptionNonProcfs(t *testing.T) {
+
+	root := t.TempDir()
+
+	for _, pid := range []int{100, 200} {
+		writeProcFixture(t, root, pid, map[string]string{
+			"status": "NStgid:\t" + strconv.Itoa(pid) + "\n",
+		})
+
+		nsDir := filepath.Join(root, strconv.Itoa(pid), "ns")
+		if err := os.Mkdir(nsDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := os.Symlink("/proc/self/ns/pid",
+			filepath.Join(nsDir, "pid"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"self", "sys", "0README"} {
+		if err := os.Mkdir(filepath.Join(root, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	useReader(t, ProcfsReader{root})
+
+	names := listProcesses(t, procReader)
+	sort.Strings(names)
+	if want := []string{"100", "200"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ListProcesses() = %v, want %v", names, want)
+	}
+
+	for _, name := range names {
+		if err := AddProcessNamespace(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	attribs, fnd := NSList[selfPidNS(t)]
+	if !fnd {
+		t.Fatal("the linked PID namespace wasn't discovered")
+	}
+	sort.Ints(attribs.pids)
+	if want := []int{100, 200}; !reflect.DeepEqual(attribs.pids, want) {
+		t.Errorf("members = %v, want %v", attribs.pids, want)
+	}
+
+	if got := PIDChainFor(200); got != "[200]" {
+		t.Errorf("PIDChainFor(200) = %q, want \"[200]\"", got)
+	}
+
+	savedOpts := opts
+	opts.procDir = root
+	defer func() { opts = savedOpts }()
+
+	want := "[can't open " + root + "/300/status]"
+	if got := PIDChainFor(300); got != want {
+		t.Errorf("PIDChainFor(300) = %q, want %q", got, want)
+	}
+}
+
+// 'fakeReader' implements the 'ProcReader' interface from in-memory fixtures:
+// a set of processes, each a member of a PID namespace in a fake hierarchy.
+// The "file descriptors" that it returns are indexes into 'fds', which
+// records the namespace to which each refers.
+
+type fakeReader struct {
+	pids     []string               // Listed PID directories
+	members  map[string]NamespaceID // PID namespace of each PID
+	openErr  map[string]error       // Error from OpenPidNS() for a PID
+	status   map[int]string         // Contents of status files
+	comm     map[int]string         // Contents of comm files
+	parents  map[NamespaceID]NamespaceID
+	owners   map[NamespaceID]NamespaceID // Owning user NS, if visible
+	creators map[NamespaceID]int         // Creator UID of user NSs
+	ioctlErr error                       // Error from NS_GET_PARENT, if any
+	fds      map[int]NamespaceID
+	nextFD   int
+}
+
+func newFakeReader() *fakeReader {
+	return &fakeReader{
+		members:  make(map[string]NamespaceID),
+		openErr:  make(map[string]error),
+		status:   make(map[int]string),
+		comm:     make(map[int]string),
+		parents:  make(map[NamespaceID]NamespaceID),
+		owners:   make(map[NamespaceID]NamespaceID),
+		creators: make(map[NamespaceID]int),
+		fds:      make(map[int]NamespaceID),
+		nextFD:   100,
+	}
+}
+
+// addProcess() adds a process, 'pid', that is a member of the PID namespace
+// 'ns', and gives it a status file showing 'nstgid'.
+
+func (r *fakeReader) addProcess(pid int, ns NamespaceID, nstgid string) {
+	name := strconv.Itoa(pid)
+	r.pids = append(r.pids, name)
+	r.members[name] = ns
+	r.status[pid] = "Name:\tsleep\nUid:\t0\t0\t0\t0\nNStgid:\t" +
+		nstgid + "\n"
+	r.comm[pid] = "sleep"
+}
+
+func (r *fakeReader) newFD(ns NamespaceID) int {
+	r.nextFD++
+	r.fds[r.nextFD] = ns
+	return r.nextFD
+}
+
+func (r *fakeReader) ListProcesses(fn func(name string) bool) error {
+	for _, name := range r.pids {
+		if !fn(name) {
+			break
+		}
+	}
+	return nil
+}
+
+func (r *fakeReader) OpenPidNS(pid string) (int, error) {
+	if err := r.openErr[pid]; err != nil {
+		return -1, &os.PathError{Op: "open",
+			Path: "/fake/" + pid + "/ns/pid", Err: err}
+	}
+	ns, fnd := r.members[pid]
+	if !fnd {
+		return -1, syscall.ENOENT
+	}
+	return r.newFD(ns), nil
+}
+
+func (r *fakeReader) ReadStatus(pid int) (string, error) {
+	status, fnd := r.status[pid]
+	if !fnd {
+		return "", syscall.ENOENT
+	}
+	return status, nil
+}
+
+func (r *fakeReader) ReadComm(pid int) (string, error) {
+	comm, fnd := r.comm[pid]
+	if !fnd {
+		return "", syscall.ENOENT
+	}
+	return comm, nil
+}
+
+func (r *fakeReader) NamespaceID(fd int) (NamespaceID, error) {
+	ns, fnd := r.fds[fd]
+	if !fnd {
+		return NamespaceID{}, syscall.EBADF
+	}
+	return ns, nil
+}
+
+// NSIoctl() implements NS_GET_PARENT and NS_GET_USERNS, which fail with
+// EPERM when the parent or owner is outside the fake hierarchy (as the real
+// operations do for a namespace that isn't visible), and NS_GET_NSTYPE.
+
+func (r *fakeReader) NSIoctl(fd int, op uintptr) (int, error) {
+	ns, fnd := r.fds[fd]
+	if !fnd {
+		return -1, syscall.EBADF
+	}
+
+	switch op {
+	case NS_GET_PARENT:
+		if r.ioctlErr != nil {
+			return -1, r.ioctlErr
+		}
+		if parent, fnd := r.parents[ns]; fnd {
+			return r.newFD(parent), nil
+		}
+	case NS_GET_USERNS:
+		if owner, fnd := r.owners[ns]; fnd {
+			return r.newFD(owner), nil
+		}
+	case NS_GET_NSTYPE:
+		return CLONE_NEWPID, nil
+	default:
+		return -1, syscall.ENOTTY
+	}
+
+	return -1, syscall.EPERM
+}
+
+func (r *fakeReader) OwnerUID(fd int) (int, error) {
+	ns, fnd := r.fds[fd]
+	if !fnd {
+		return -1, syscall.EBADF
+	}
+	return r.creators[ns], nil
+}
+
+func (r *fakeReader) Close(fd int) {
+	delete(r.fds, fd)
+}
+
+// checkClosed() reports an error if any of the file descriptors returned by
+// 'r' weren't closed.
+
+func (r *fakeReader) checkClosed(tb testing.TB) {
+	if len(r.fds) != 0 {
+		tb.Errorf("%d file descriptors were left open", len(r.fds))
+	}
+}
+
+// Namespace IDs used in the fake hierarchies.
+
+var (
+	rootPidNS  = NamespaceID{4, 4026531836}
+	childPidNS = NamespaceID{4, 4026532300}
+	otherPidNS = NamespaceID{4, 4026532400}
+	rootUserNS = NamespaceID{4, 4026531837}
+	childUser  = NamespaceID{4, 4026532299}
+)
+
+// twoLevelReader() returns a fake reader for a hierarchy with two levels: the
+// root PID namespace, with processes 1 and 2, and a child namespace (owned by
+// a child user namespace created by UID 1000), with the processes 300 and 301
+// (PIDs 1 and 2 in the child).
+
+func twoLevelReader() *fakeReader {
+	r := newFakeReader()
+
+	r.parents[childPidNS] = rootPidNS
+	r.owners[rootPidNS] = rootUserNS
+	r.owners[childPidNS] = childUser
+	r.creators[rootUserNS] = 0
+	r.creators[childUser] = 1000
+
+	r.addProcess(1, rootPidNS, "1")
+	r.addProcess(2, rootPidNS, "2")
+	r.addProcess(300, childPidNS, "300\t1")
+	r.addProcess(301, childPidNS, "301\t2")
+
+	return r
+}
+
+// TestScanTwoLevels checks that a scan builds the hierarchy, the member lists,
+// and the ownership information of a two-level hierarchy.
+
+func TestScanTwoLevels(t *testing.T) {
+
+	r := twoLevelReader()
+	useReader(t, r)
+
+	n, err := ScanProcesses(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("scanned %d processes, want 4", n)
+	}
+
+	if len(NSList) != 2 {
+		t.Fatalf("found %d namespaces, want 2", len(NSList))
+	}
+	if !initialPidNSFound || initialPidNS != rootPidNS {
+		t.Errorf("initialPidNS = %v (found %v), want %v",
+			initialPidNS, initialPidNSFound, rootPidNS)
+	}
+
+	root := NSList[rootPidNS]
+	child := NSList[childPidNS]
+
+	if !reflect.DeepEqual(root.children, []NamespaceID{childPidNS}) {
+		t.Errorf("root children = %v", root.children)
+	}
+	if root.hasParent {
+		t.Error("the root namespace has a parent")
+	}
+	if !child.hasParent || child.parent != rootPidNS {
+		t.Errorf("child parent = %v (%v)", child.parent,
+			child.hasParent)
+	}
+
+	if !reflect.DeepEqual(root.pids, []int{1, 2}) {
+		t.Errorf("root members = %v", root.pids)
+	}
+	if !reflect.DeepEqual(child.pids, []int{300, 301}) {
+		t.Errorf("child members = %v", child.pids)
+	}
+
+	if !child.ownerVisible || child.ownerUserNS != childUser ||
+		child.ownerUID != 1000 {
+		t.Errorf("child owner = %v (UID %d, visible %v)",
+			child.ownerUserNS, child.ownerUID, child.ownerVisible)
+	}
+
+	if got := PIDChainFor(300); got != "[300 1]" {
+		t.Errorf("PIDChainFor(300) = %q", got)
+	}
+
+	r.checkClosed(t)
+}
+
+// TestScanVanishedProcess checks that a process that terminates after being
+// listed, so that opening its namespace file fails with ENOENT, is skipped
+// without ending the scan, but that the same failure is an error for a PID
+// named on the command line.
+
+func TestScanVanishedProcess(t *testing.T) {
+
+	r := twoLevelReader()
+	r.pids = append([]string{"250"}, r.pids...)
+	r.openErr["250"] = syscall.ENOENT
+	useReader(t, r)
+
+	n, err := ScanProcesses(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("ScanProcesses(): %v", err)
+	}
+	if n != 4 {
+		t.Errorf("scanned %d processes, want 4", n)
+	}
+	if len(NSList) != 2 {
+		t.Errorf("found %d namespaces, want 2", len(NSList))
+	}
+
+	_, err = ScanProcesses(context.Background(), []string{"1", "250"})
+	if !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("named PID 250: err = %v, want ENOENT", err)
+	}
+
+	r.checkClosed(t)
+}
+
+// TestScanRootEPERM checks that the namespace for which NS_GET_PARENT fails
+// with EPERM becomes 'initialPidNS', even when it isn't the real initial
+// namespace (as when the program runs in a child PID namespace, whose parent
+// isn't visible), and that an unexpected ioctl() error is returned rather
+// than ending the program.
+
+func TestScanRootEPERM(t *testing.T) {
+
+	r := newFakeReader()
+	r.parents[otherPidNS] = childPidNS
+	r.addProcess(1, childPidNS, "1")
+	r.addProcess(7, otherPidNS, "7\t1")
+	useReader(t, r)
+
+	if _, err := ScanProcesses(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if !initialPidNSFound || initialPidNS != childPidNS {
+		t.Errorf("initialPidNS = %v (found %v), want %v",
+			initialPidNS, initialPidNSFound, childPidNS)
+	}
+	if NSList[childPidNS].ownerVisible {
+		t.Error("owner of the topmost namespace is visible")
+	}
+
+	r.checkClosed(t)
+
+	r = newFakeReader()
+	r.addProcess(1, rootPidNS, "1")
+	r.ioctlErr = syscall.EIO
+	useReader(t, r)
+
+	_, err := ScanProcesses(context.Background(), nil)
+	if !errors.Is(err, syscall.EIO) {
+		t.Errorf("err = %v, want EIO", err)
+	}
+	if initialPidNSFound {
+		t.Error("initialPidNS was set after an ioctl() error")
+	}
+
+	r.checkClosed(t)
+}
+
+// captureLog() arranges for diagnostic messages to be written to the returned
+// buffer, rather than to stderr, for the duration of the test.
+
+func captureLog(tb testing.TB) *bytes.Buffer {
+
+	var buf bytes.Buffer
+
+	saved := logOutput
+	logOutput = &buf
+	tb.Cleanup(func() { logOutput = saved })
+
+	return &buf
+}
+
+// TestScanEmpty checks that a scan of a procfs that lists no PID directories
+// produces a diagnostic that names the directory that was scanned, and the
+// exit status for "no namespaces", rather than a crash.
+
+func TestScanEmpty(t *testing.T) {
+
+	r := newFakeReader()
+	useReader(t, r)
+	stderr := captureLog(t)
+
+	savedOpts := opts
+	opts.procDir = "/tmp/container-proc"
+	defer func() { opts = savedOpts }()
+
+	n, err := ScanProcesses(context.Background(), nil)
+	if err != nil || n != 0 {
+		t.Fatalf("ScanProcesses() = %d, %v", n, err)
+	}
+
+	if status := CheckScanFoundNamespaces(); status != 2 {
+		t.Errorf("exit status %d, want 2", status)
+	}
+
+	msg := stderr.String()
+	for _, want := range []string{
+		"No PID namespaces were discovered",
+		"under /tmp/container-proc.",
+		"check the --proc option",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("diagnostic doesn't contain %q:\n%s", want, msg)
+		}
+	}
+
+	// After a successful scan, there is no diagnostic.
+
+	useReader(t, twoLevelReader())
+	stderr.Reset()
+
+	ScanProcesses(context.Background(), nil)
+	if status := CheckScanFoundNamespaces(); status != 0 {
+		t.Errorf("exit status %d after a scan, want 0", status)
+	}
+	if stderr.Len() != 0 {
+		t.Errorf("unexpected diagnostic: %s", stderr)
+	}
+}
+
+// captureOutput() makes the display functions write to a buffer, which is
+// returned, rather than to standard output.
+
+func captureOutput(tb testing.TB) *bytes.Buffer {
+
+	var buf bytes.Buffer
+
+	saved := output
+	output = &LineWriter{out: &buf}
+	tb.Cleanup(func() { output = saved })
+
+	return &buf
+}
+
+// TestDisplayTwoLevels builds the two-level hierarchy of twoLevelReader()
+// from the fake procfs, and checks the displayed tree, with and without the
+// command names. Nothing is read from the live system.
+
+func TestDisplayTwoLevels(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		showComm bool
+		want     string
+	}{
+		{"PIDs", false,
+			" {4 4026531836}  owned by user:[4026531837] (UID 0)\n" +
+				"        [1]\n" +
+				"        [2]\n" +
+				"     {4 4026532300}  owned by " +
+				"user:[4026532299] (UID 1000)\n" +
+				"            [300 1]\n" +
+				"            [301 2]\n"},
+		{"commands", true,
+			" {4 4026531836}  owned by user:[4026531837] (UID 0)\n" +
+				"        [1]  systemd\n" +
+				"        [2]  kthreadd\n" +
+				"     {4 4026532300}  owned by " +
+				"user:[4026532299] (UID 1000)\n" +
+				"            [300 1]  sh\n" +
+				"            [301 2]  sleep\n"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			r := twoLevelReader()
+			r.comm[1] = "systemd"
+			r.comm[2] = "kthreadd"
+			r.comm[300] = "sh"
+
+			useReader(t, r)
+			buf := captureOutput(t)
+
+			savedOpts := opts
+			opts.showComm = tc.showComm
+			defer func() { opts = savedOpts }()
+
+			_, err := ScanProcesses(context.Background(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			SortChildren()
+			DisplayNamespaceTree(initialPidNS, 0)
+			output.Flush()
+
+			if got := buf.String(); got != tc.want {
+				t.Errorf("displayed:\n%s\nwant:\n%s",
+					got, tc.want)
+			}
+		})
+	}
+}
+
+// If "-update" is given to the test binary, TestGolden rewrites the golden
+// files instead of comparing the output with them.
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+// checkGolden() compares 'got' with the contents of the golden file 'path'
+// (or, with "-update", writes 'got' to the file), and reports the first line
+// that differs.
+
+func checkGolden(t *testing.T, path string, got string) {
+
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := ioutil.WriteFile(path, []byte(got), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run the test with -update to create it)", err)
+	}
+	want := string(buf)
+
+	if got == want {
+		return
+	}
+
+	gotLines := strings.Split(got, "\n")
+	wantLines := strings.Split(want, "\n")
+
+	i := 0
+	for i < len(gotLines) && i < len(wantLines) &&
+		gotLines[i] == wantLines[i] {
+		i++
+	}
+
+	var g, w string
+	if i < len(gotLines) {
+		g = gotLines[i]
+	}
+	if i < len(wantLines) {
+		w = wantLines[i]
+	}
+
+	t.Errorf("output differs from %s at line %d:\ngot:  %q\n"+
+		"want: %q\n(if the change is intended, rerun the test with "+
+		"-update)", path, i+1, g, w)
+}
+
+// More namespace IDs, used in goldenReader()
+
+var (
+	emptyPidNS = NamespaceID{4, 4026532301}
+	deepPidNS  = NamespaceID{4, 4026532302}
+)
+
+// goldenReader() extends the hierarchy of twoLevelReader() with the cases
+// that the display code treats specially: below the child namespace, a
+// namespace that has no member processes, and, below that, a namespace whose
+// owning user namespace isn't visible, with process 700, whose command name
+// is long enough to be truncated in narrow output.
+
+func goldenReader() *fakeReader {
+	r := twoLevelReader()
+
+	r.parents[emptyPidNS] = childPidNS
+	r.parents[deepPidNS] = emptyPidNS
+	r.owners[emptyPidNS] = childUser
+
+	r.addProcess(700, deepPidNS, "700\t5\t1\t1")
+
+	r.comm[1] = "systemd"
+	r.comm[2] = "kthreadd"
+	r.comm[300] = "sh"
+	r.comm[700] = "kworker/u16:3-ev"
+
+	return r
+}
+
+// TestGolden displays the hierarchy of goldenReader(), with and without the
+// command names, with color and without, at two widths, and compares each
+// display (the tree and the summary) with a golden file in
+// testdata/pid_namespaces. The program is taken to be in the child
+// namespace, which is marked as the current one. After an intended change
+// to the display, the golden files are regenerated with:
+//
+//	go test pid_namespaces.go pid_namespaces_test.go -run TestGolden \
+//		-update
+
+func TestGolden(t *testing.T) {
+
+	goldenDir := filepath.Join("testdata", "pid_namespaces")
+
+	for _, showComm := range []bool{false, true} {
+		for _, useColor := range []bool{false, true} {
+			for _, width := range []int{80, 40} {
+				name := "pids"
+				if showComm {
+					name = "comm"
+				}
+				if useColor {
+					name += "_color"
+				}
+				name += "_" + strconv.Itoa(width)
+
+				path := filepath.Join(goldenDir, name+".golden")
+
+				t.Run(name, func(t *testing.T) {
+					got := renderGolden(t, CmdLineOptions{
+						showComm: showComm,
+						useColor: useColor,
+						width:    width,
+						summary:  true,
+					})
+					checkGolden(t, path, got)
+				})
+			}
+		}
+	}
+}
+
+// renderGolden() scans goldenReader() and returns the display produced with
+// the options 'o'.
+
+func renderGolden(t *testing.T, o CmdLineOptions) string {
+
+	r := goldenReader()
+	useReader(t, r)
+	buf := captureOutput(t)
+
+	savedOpts, savedCurrent := opts, currentPidNS
+	opts, currentPidNS = o, childPidNS
+	defer func() { opts, currentPidNS = savedOpts, savedCurrent }()
+
+	if _, err := ScanProcesses(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	SortChildren()
+	DisplayNamespaceTree(initialPidNS, 0)
+	if opts.summary {
+		DisplaySummary()
+	}
+	output.Flush()
+
+	r.checkClosed(t)
+
+	return buf.String()
+}
+
+// largeReader() returns a fake reader for a hierarchy of 'nsCount' PID
+// namespaces, in which each namespace has up to four children, with 'n'
+// processes spread evenly across the namespaces. Each child namespace is
+// owned by a user namespace created by a different UID. A process's PID is
+// the same in each of the namespaces of which it is a member.
+
+func largeReader(n int, nsCount int) *fakeReader {
+	r := newFakeReader()
+
+	ids := make([]NamespaceID, nsCount)
+	levels := make([]int, nsCount)
+
+	ids[0] = rootPidNS
+	r.owners[rootPidNS] = rootUserNS
+	r.creators[rootUserNS] = 0
+
+	for i := 1; i < nsCount; i++ {
+		ids[i] = NamespaceID{4, 4026532000 + uint64(i)}
+		levels[i] = levels[(i-1)/4] + 1
+		r.parents[ids[i]] = ids[(i-1)/4]
+
+		owner := NamespaceID{4, 4026534000 + uint64(i)}
+		r.owners[ids[i]] = owner
+		r.creators[owner] = 1000 + i
+	}
+
+	for pid := 1; pid <= n; pid++ {
+		i := (pid - 1) % nsCount
+		name := strconv.Itoa(pid)
+		r.addProcess(pid, ids[i],
+			strings.Repeat(name+"\t", levels[i])+name)
+	}
+
+	return r
+}
+
+// Sizes of the hierarchies built by largeReader() for the benchmarks
+
+var largeSizes = []struct {
+	processes  int
+	namespaces int
+}{
+	{1000, 10},
+	{10000, 100},
+	{100000, 1000},
+}
+
+// BenchmarkScanLarge measures a scan, through the reader interface, of the
+// hierarchies built by largeReader(). Because nothing is read from the live
+// system, it measures just the program's own work.
+
+func BenchmarkScanLarge(b *testing.B) {
+
+	for _, size := range largeSizes {
+		name := strconv.Itoa(size.processes) + " processes, " +
+			strconv.Itoa(size.namespaces) + " namespaces"
+
+		b.Run(name, func(b *testing.B) {
+
+			r := largeReader(size.processes, size.namespaces)
+			useReader(b, r)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				resetScan()
+				_, err := ScanProcesses(context.Background(),
+					nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDisplayLarge measures the display, with the command names, of
+// the hierarchies built by largeReader(), which are scanned just once.
+
+func BenchmarkDisplayLarge(b *testing.B) {
+
+	for _, size := range largeSizes {
+		name := strconv.Itoa(size.processes) + " processes, " +
+			strconv.Itoa(size.namespaces) + " namespaces"
+
+		b.Run(name, func(b *testing.B) {
+
+			r := largeReader(size.processes, size.namespaces)
+			useReader(b, r)
+			buf := captureOutput(b)
+
+			savedOpts := opts
+			opts.showComm = true
+			defer func() { opts = savedOpts }()
+
+			_, err := ScanProcesses(context.Background(), nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(NSList) != size.namespaces {
+				b.Fatalf("found %d namespaces, want %d",
+					len(NSList), size.namespaces)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				SortChildren()
+				DisplayNamespaceTree(initialPidNS, 0)
+				output.Flush()
+			}
+		})
+	}
+}
+
+// pidDirFixture() creates, in a temporary directory, a procfs-like directory
+// with 'n' (empty) PID directories, along with some of the nonnumeric
+// entries found in /proc, and returns the directory.
+
+func pidDirFixture(tb testing.TB, n int) string {
+
+	root := tb.TempDir()
+
+	names := []string{"self", "sys", "net", "meminfo"}
+	for pid := 1; pid <= n; pid++ {
+		names = append(names, strconv.Itoa(pid))
+	}
+
+	for _, name := range names {
+		err := os.Mkdir(filepath.Join(root, name), 0755)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+// readDirPIDs() is the original way of listing the PID directories under
+// 'dir', which reads (and sorts, and stat()s) all of the entries before the
+// first PID is processed. It is kept for BenchmarkListPIDDirs.
+
+func readDirPIDs(dir string, fn func(name string) bool) error {
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		if name[0] >= '1' && name[0] <= '9' {
+			if !fn(name) {
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// listPIDDirs() lists the PID directories under 'dir' with
+// ProcfsReader.ListProcesses().
+
+func listPIDDirs(dir string, fn func(name string) bool) error {
+	return ProcfsReader{dir}.ListProcesses(fn)
+}
+
+// BenchmarkListPIDDirs compares the time and memory taken to list the PID
+// directories of fixtures built by pidDirFixture() (with as many processes
+// as the fixtures of BenchmarkScanLarge) by reading the whole directory with
+// ioutil.ReadDir(), as the program once did, and by reading it in batches
+// with ProcfsReader.ListProcesses(), as it now does.
+
+func BenchmarkListPIDDirs(b *testing.B) {
+
+	listers := []struct {
+		name string
+		list func(dir string, fn func(name string) bool) error
+	}{
+		{"ReadDir", readDirPIDs},
+		{"Readdirnames", listPIDDirs},
+	}
+
+	for _, size := range largeSizes {
+		dir := pidDirFixture(b, size.processes)
+
+		for _, l := range listers {
+			name := strconv.Itoa(size.processes) + " processes/" +
+				l.name
+
+			b.Run(name, func(b *testing.B) {
+
+				b.ReportAllocs()
+
+				for i := 0; i < b.N; i++ {
+					n := 0
+					err := l.list(dir, func(string) bool {
+						n++
+						return true
+					})
+					if err != nil {
+						b.Fatal(err)
+					}
+					if n != size.processes {
+						b.Fatalf("%d PIDs, want %d", n,
+							size.processes)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkOutput measures the throughput of the display output, using as
+// the text the display, with the command names, of the 10000-process
+// hierarchy of BenchmarkDisplayLarge.
+
+func BenchmarkOutput(b *testing.B) {
+
+	useReader(b, largeReader(10000, 100))
+	buf := captureOutput(b)
+
+	savedOpts := opts
+	opts.showComm = true
+	defer func() { opts = savedOpts }()
+
+	if _, err := ScanProcesses(context.Background(), nil); err != nil {
+		b.Fatal(err)
+	}
+	SortChildren()
+	DisplayNamespaceTree(initialPidNS, 0)
+	output.Flush()
+
+	benchmarkLineWriter(b, buf.Bytes())
+}
+
+// benchmarkLineWriter() measures the writing of 'text' to a pipe (whose
+// reader discards what it reads), as a series of small writes, one for each
+// word, like those made by the display functions: first with a write() for
+// each piece, as the program did before its output was buffered, and then
+// through a LineWriter.
+
+func benchmarkLineWriter(b *testing.B, text []byte) {
+
+	size := int64(len(text))
+
+	var pieces [][]byte
+	for len(text) > 0 {
+		i := bytes.IndexAny(text, " \n") + 1
+		if i == 0 {
+			i = len(text)
+		}
+		pieces = append(pieces, text[:i])
+		text = text[i:]
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, r)
+		close(done)
+	}()
+	defer func() {
+		w.Close()
+		<-done
+		r.Close()
+	}()
+
+	b.Run("unbuffered", func(b *testing.B) {
+
+		b.SetBytes(size)
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			for _, p := range pieces {
+				if _, err := w.Write(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("LineWriter", func(b *testing.B) {
+
+		lw := &LineWriter{out: w}
+
+		b.SetBytes(size)
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			for _, p := range pieces {
+				lw.Write(p)
+			}
+			if err := lw.Flush(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestTruncateTextWide checks TruncateText() with double-width (CJK)
+// characters, which must not be split across the width limit, and with
+// combining marks, which must stay with the character that they modify.
+
+func TestTruncateTextWide(t *testing.T) {
+
+	const e = "e\u0301" // "é", as "e" and a combining acute accent
+
+	tests := []struct {
+		s     string
+		width int
+		want  string
+	}{
+		{"漢字", 4, "漢字"},
+		{"漢字プロセス", 7, "漢字プ…"},
+		{"漢字プロセス", 6, "漢字…"},
+		{"mixed漢字", 7, "mixed…"},
+		{"ａｂｃ", 2, "…"},
+		{e + e + e + e, 4, e + e + e + e},
+		{e + e + e + e, 3, e + e + "…"},
+		{"x" + e + "漢", 3, "x" + e + "…"},
+	}
+
+	for _, tc := range tests {
+		got := TruncateText(tc.s, tc.width)
+		if got != tc.want {
+			t.Errorf("TruncateText(%q, %d) = %q, want %q", tc.s,
+				tc.width, got, tc.want)
+		}
+		if VisibleWidth(got) > tc.width {
+			t.Errorf("TruncateText(%q, %d) = %q is too wide", tc.s,
+				tc.width, got)
+		}
+	}
+}
+
+// TestDisplayWideCommands displays the hierarchy of twoLevelReader(), with
+// the command names, when the names contain double-width (CJK) characters
+// and combining marks. At each output width (all wide enough to leave the
+// minimum width for the command column), no member line may be wider than
+// the width, and the command column of the members of each namespace must
+// start in the same terminal column.
+
+func TestDisplayWideCommands(t *testing.T) {
+
+	comms := map[int]string{
+		1:   "systemd",
+		2:   "cafe\u0301",
+		300: "漢字プロセス名前長い",
+		301: "短い",
+	}
+
+	for width := 30; width <= 40; width += 2 {
+		r := twoLevelReader()
+		for pid, comm := range comms {
+			r.comm[pid] = comm
+		}
+
+		useReader(t, r)
+		buf := captureOutput(t)
+
+		savedOpts := opts
+		opts.showComm = true
+		opts.width = width
+
+		_, err := ScanProcesses(context.Background(), nil)
+		if err == nil {
+			SortChildren()
+			DisplayNamespaceTree(initialPidNS, 0)
+			output.Flush()
+		}
+		opts = savedOpts
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The column in which the command starts, keyed by the
+		// indent of the member line
+
+		commandCol := make(map[int]int)
+
+		for _, line := range strings.Split(buf.String(), "\n") {
+			trimmed := strings.TrimLeft(line, " ")
+			if !strings.HasPrefix(trimmed, "[") {
+				continue
+			}
+
+			if VisibleWidth(line) > width {
+				t.Errorf("width %d: line %q is too wide", width,
+					line)
+			}
+
+			i := strings.Index(line, "]") + 1
+			col := i + len(line[i:]) -
+				len(strings.TrimLeft(line[i:], " "))
+			indent := len(line) - len(trimmed)
+			if c, fnd := commandCol[indent]; fnd && c != col {
+				t.Errorf("width %d: command in line %q starts "+
+					"in column %d, not %d", width, line,
+					col, c)
+			}
+			commandCol[indent] = col
+		}
+
+		if !strings.Contains(buf.String(), "]  漢字") ||
+			!strings.Contains(buf.String(), "…\n") {
+			t.Errorf("width %d: the command of PID 300 is not "+
+				"truncated:\n%s", width, buf.String())
+		}
+	}
+}
+
+// openNSFile() opens the namespace file 'path', closing it when the test
+// ends.
+
+func openNSFile(tb testing.TB, path string) int {
+
+	fd, err := syscall.Open(path, syscall.O_RDONLY, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { syscall.Close(fd) })
+
+	return fd
+}
+
+// sameNamespace() returns true if the file descriptor 'fd' refers to the
+// same namespace as the namespace file 'path'.
+
+func sameNamespace(tb testing.TB, fd int, path string) bool {
+
+	var fdStat, pathStat syscall.Stat_t
+
+	if err := syscall.Fstat(fd, &fdStat); err != nil {
+		tb.Fatal(err)
+	}
+	if err := syscall.Stat(path, &pathStat); err != nil {
+		tb.Fatal(err)
+	}
+
+	return fdStat.Dev == pathStat.Dev && fdStat.Ino == pathStat.Ino
+}
+
+// inInitialUserNS() returns true if the test is running in the initial user
+// namespace.
+
+func inInitialUserNS(tb testing.TB) bool {
+
+	var sb syscall.Stat_t
+
+	if err := syscall.Stat("/proc/self/ns/user", &sb); err != nil {
+		tb.Fatal(err)
+	}
+
+	return sb.Ino == 0xEFFFFFFD // PROC_USER_INIT_INO
+}
+
+// TestNSIoctlLive checks NSIoctl() and NSGetOwnerUID() against the namespace
+// files of the test program (and of a child in a new user namespace).
+
+func TestNSIoctlLive(t *testing.T) {
+
+	t.Run("type", func(t *testing.T) {
+		fd := openNSFile(t, "/proc/self/ns/pid")
+
+		nsType, err := NSIoctl(fd, NS_GET_NSTYPE)
+		if err != nil || nsType != CLONE_NEWPID {
+			t.Errorf("got %#x, %v; want %#x", nsType, err,
+				CLONE_NEWPID)
+		}
+	})
+
+	t.Run("owning user namespace", func(t *testing.T) {
+		fd := openNSFile(t, "/proc/self/ns/uts")
+
+		userFD, err := NSIoctl(fd, NS_GET_USERNS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer syscall.Close(userFD)
+
+		if !sameNamespace(t, userFD, "/proc/self/ns/user") {
+			t.Error("NS_GET_USERNS did not return our " +
+				"user namespace")
+		}
+	})
+
+	child := childUserNS(t)
+	if child == "" {
+		t.Skip("no child user namespace")
+	}
+
+	t.Run("parent", func(t *testing.T) {
+		fd := openNSFile(t, child)
+
+		parentFD, err := NSIoctl(fd, NS_GET_PARENT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer syscall.Close(parentFD)
+
+		if !sameNamespace(t, parentFD, "/proc/self/ns/user") {
+			t.Error("NS_GET_PARENT did not return our " +
+				"user namespace")
+		}
+	})
+
+	t.Run("owner UID", func(t *testing.T) {
+		fd := openNSFile(t, child)
+
+		uid, err := NSGetOwnerUID(fd)
+		if err != nil || uid != os.Geteuid() {
+			t.Errorf("got %d, %v; want %d", uid, err, os.Geteuid())
+		}
+	})
+}
+
+// TestNSIoctlErrors checks that NSIoctl() and NSGetOwnerUID() return -1 and
+// the errno from the failed ioctl(), so that the callers can classify the
+// error with errors.Is() and errors.As().
+
+func TestNSIoctlErrors(t *testing.T) {
+
+	notNS, err := os.Open("/proc/self/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notNS.Close()
+
+	uts := openNSFile(t, "/proc/self/ns/uts")
+	user := openNSFile(t, "/proc/self/ns/user")
+
+	tests := []struct {
+		name        string
+		call        func() (int, error)
+		want        syscall.Errno
+		initialOnly bool // Case needs the initial user NS
+	}{
+		{"not a namespace file", func() (int, error) {
+			return NSIoctl(int(notNS.Fd()), NS_GET_NSTYPE)
+		}, syscall.ENOTTY, false},
+		{"no parent of nonhierarchical NS", func() (int, error) {
+			return NSIoctl(uts, NS_GET_PARENT)
+		}, syscall.EINVAL, false},
+		{"owner UID of non-user NS", func() (int, error) {
+			return NSGetOwnerUID(uts)
+		}, syscall.EINVAL, false},
+		{"bad file descriptor", func() (int, error) {
+			return NSIoctl(-1, NS_GET_USERNS)
+		}, syscall.EBADF, false},
+		{"parent of initial user NS", func() (int, error) {
+			return NSIoctl(user, NS_GET_PARENT)
+		}, syscall.EPERM, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			if tc.initialOnly && !inInitialUserNS(t) {
+				t.Skip("not in the initial user namespace")
+			}
+
+			ret, err := tc.call()
+			if ret != -1 || !errors.Is(err, tc.want) {
+				t.Errorf("got %d, %v; want -1, %v", ret, err,
+					tc.want)
+			}
+
+			var errno syscall.Errno
+			if !errors.As(err, &errno) {
+				t.Errorf("%T is not a syscall.Errno", err)
+			}
+		})
+	}
+}
+
+// childUserNS() starts a child process in a new user namespace, and returns
+// the pathname of the child's user namespace file, or "" if a user
+// namespace can't be created. The child is killed when the test ends.
+
+func childUserNS(tb testing.TB) string {
+
+	cmd := exec.Command("sleep", "1000")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER,
+	}
+	if err := cmd.Start(); err != nil {
+		tb.Log("can't create a user namespace:", err)
+		return ""
+	}
+
+	tb.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	return "/proc/" + strconv.Itoa(cmd.Process.Pid) + "/ns/user"
+}
+
+// FuzzEscapeName checks that the output of EscapeName() contains no
+// control characters, and that escaping it again leaves it unchanged.
+
+func FuzzEscapeName(f *testing.F) {
+
+	f.Add("bash")
+	f.Add("a\tb\nc\x1b[31m\x7f\u0085")
+	f.Add("漢字 é")
+	f.Add("\xff\xfe")
+
+	f.Fuzz(func(t *testing.T, name string) {
+
+		escaped := EscapeName(name)
+
+		for _, r := range escaped {
+			if unicode.IsControl(r) {
+				t.Errorf("EscapeName(%q) = %q contains %U",
+					name, escaped, r)
+			}
+		}
+
+		if again := EscapeName(escaped); again != escaped {
+			t.Errorf("EscapeName(%q) = %q; escaping again "+
+				"gives %q", name, escaped, again)
+		}
+	})
+}
+
+// FuzzTruncateText checks that TruncateText() returns text that fits in the
+// width: either the whole of the (escaped) text, or a prefix of it (cut
+// between characters) followed by an ellipsis.
+
+func FuzzTruncateText(f *testing.F) {
+
+	f.Add("systemd", uint8(4))
+	f.Add(strings.Repeat("/usr/bin/long-command ", 15), uint8(30))
+	f.Add("漢字漢字 éé", uint8(3))
+
+	f.Fuzz(func(t *testing.T, s string, width uint8) {
+
+		s = EscapeName(s)
+		w := int(width%100) + 1
+
+		got := TruncateText(s, w)
+
+		if VisibleWidth(got) > w {
+			t.Errorf("TruncateText(%q, %d) = %q is too wide", s, w,
+				got)
+		}
+		if got != s && !(strings.HasSuffix(got, "…") &&
+			strings.HasPrefix(s, strings.TrimSuffix(got, "…"))) {
+			t.Errorf("TruncateText(%q, %d) = %q is not a "+
+				"truncation", s, w, got)
+		}
+		if utf8.ValidString(s) && !utf8.ValidString(got) {
+			t.Errorf("TruncateText(%q, %d) = %q split a character",
+				s, w, got)
+		}
+	})
+}
+
+// signalChild() is run (instead of the tests) in a child of the test
+// binary, by startSignalChild(). It installs the program's signal handlers
+// and, depending on 'mode', either leaves some output buffered ("display"),
+// or starts a scan that is canceled by the first signal and then leaves
+// some output buffered ("scan"), or writes to standard output until the
+// reader goes away ("pipe"). Each time that it is ready for a signal, it
+// writes "ready" to stderr.
+
+func signalChild(mode string) {
+
+	HandleSignals(mode != "pipe")
+
+	switch mode {
+	case "scan":
+		ctx := StartScan()
+		fmt.Fprintln(os.Stderr, "ready")
+		<-ctx.Done()
+		EndScan(ctx)
+		fmt.Fprint(output, "scan canceled\npartial")
+	case "display":
+		fmt.Fprint(output, "complete line\npartial")
+	case "pipe":
+		fmt.Fprintln(os.Stderr, "ready")
+		for {
+			fmt.Println("line")
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "ready")
+	time.Sleep(10 * time.Second)
+	os.Exit(1)
+}
+
+// startSignalChild() starts the test binary as a child that runs
+// signalChild() in 'mode', with its standard output going to 'stdout'. It
+// returns the child, and a function that waits until the child is ready for
+// a signal.
+
+func startSignalChild(t *testing.T, mode string,
+	stdout io.Writer) (*exec.Cmd, func()) {
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "PID_NAMESPACES_SIGNAL_TEST="+mode)
+	cmd.Stdout = stdout
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(stderr)
+	waitReady := func() {
+		line, err := r.ReadString('\n')
+		if line != "ready\n" {
+			t.Fatalf("child wrote %q (%v), not \"ready\"", line,
+				err)
+		}
+	}
+
+	return cmd, waitReady
+}
+
+// exitStatus() waits for 'cmd' to terminate, and returns its exit status.
+
+func exitStatus(t *testing.T, cmd *exec.Cmd) int {
+
+	err := cmd.Wait()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	return 0
+}
+
+// TestSignals sends SIGINT and SIGTERM to a child that is displaying
+// output, and checks its exit status (128 plus the signal number), and that
+// its output ends with the last complete line followed by the color reset,
+// with no partial line. When a scan is in progress, the first signal
+// cancels just the scan, and the second terminates the program.
+
+func TestSignals(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		mode    string
+		signals []syscall.Signal
+		status  int
+		stdout  string
+	}{
+		{"SIGINT", "display", []syscall.Signal{syscall.SIGINT}, 130,
+			"complete line\n" + NORMAL},
+		{"SIGTERM", "display", []syscall.Signal{syscall.SIGTERM}, 143,
+			"complete line\n" + NORMAL},
+		{"scan", "scan", []syscall.Signal{syscall.SIGINT,
+			syscall.SIGINT}, 130, "scan canceled\n" + NORMAL},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			var stdout bytes.Buffer
+			cmd, waitReady := startSignalChild(t, tc.mode, &stdout)
+
+			for _, sig := range tc.signals {
+				waitReady()
+				if err := cmd.Process.Signal(sig); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if status := exitStatus(t, cmd); status != tc.status {
+				t.Errorf("exit status %d, want %d", status,
+					tc.status)
+			}
+			if got := stdout.String(); got != tc.stdout {
+				t.Errorf("stdout %q, want %q", got, tc.stdout)
+			}
+		})
+	}
+}
+
+// TestSignalBrokenPipe checks that a child whose standard output is a pipe
+// whose reader goes away (as in "pid_namespaces | head") exits silently with
+// status 0.
+
+func TestSignalBrokenPipe(t *testing.T) {
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd, waitReady := startSignalChild(t, "pipe", w)
+	w.Close()
+
+	waitReady()
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if line != "line\n" {
+		t.Fatalf("read %q (%v) from the child", line, err)
+	}
+	r.Close()
+
+	if status := exitStatus(t, cmd); status != 0 {
+		t.Errorf("exit status %d, want 0", status)
+	}
+}
+
+// 'interruptingReader' is a 'ProcReader' that, when it lists the process
+// 'stop', sends SIGINT to the program (as the user would, by typing
+// Control-C) and waits until the signal has canceled the scan.
+
+type interruptingReader struct {
+	ProcReader
+	stop string
+}
+
+func (r interruptingReader) ListProcesses(fn func(name string) bool) error {
+	return r.ProcReader.ListProcesses(func(name string) bool {
+		if name == r.stop {
+			syscall.Kill(os.Getpid(), syscall.SIGINT)
+			for atomic.LoadInt32(&scanInProgress) != 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		return fn(name)
+	})
+}
+
+// interruptChild() is run (instead of the tests) in a child of the test
+// binary, by TestInterruptedScan. It runs the program over the hierarchy
+// built by largeReader(), interrupting the scan when it reaches the process
+// 'stop'.
+
+func interruptChild(stop string) {
+
+	procReader = interruptingReader{largeReader(1000, 100), stop}
+
+	os.Args = []string{"pid_namespaces"}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	main()
+
+	os.Exit(0)
+}
+
+// TestInterruptedScan interrupts the program when its scan of 1000
+// processes spread across 100 PID namespaces reaches PID 51, so that only
+// the first 50 namespaces have been found. It checks that the program
+// displays just those namespaces, after writing the partial-results banner
+// to stderr, and exits with the status EXIT_INTERRUPTED.
+
+func TestInterruptedScan(t *testing.T) {
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "PID_NAMESPACES_INTERRUPT_TEST=51")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := exitStatus(t, cmd); status != EXIT_INTERRUPTED {
+		t.Fatalf("exit status %d, want %d; stderr:\n%s", status,
+			EXIT_INTERRUPTED, stderr.String())
+	}
+
+	banner := "Scan interrupted: displaying partial results"
+	if !strings.Contains(stderr.String(), banner) {
+		t.Errorf("stderr doesn't contain %q:\n%s", banner,
+			stderr.String())
+	}
+
+	for i := 1; i < 100; i++ {
+		id := strconv.FormatUint(4026532000+uint64(i), 10)
+		found := strings.Contains(stdout.String(), id)
+		if found != (i < 50) {
+			t.Errorf("namespace %s displayed: %v, want %v\n%s", id,
+				found, i < 50, stdout.String())
+		}
+	}
+}
+
+// redirectChild() is run (instead of the tests) in a child of the test
+// binary, by TestRedirectedOutput. It runs the program with "--show-comm"
+// and the arguments given to the binary, over the hierarchy built by
+// largeReader(), in which every process is given a command name that is
+// longer than a line.
+
+func redirectChild() {
+
+	r := largeReader(1000, 10)
+	for pid := range r.comm {
+		r.comm[pid] = strings.Repeat("long-command-name-", 5)
+	}
+	procReader = r
+
+	os.Args = append([]string{"pid_namespaces", "--show-comm"},
+		os.Args[1:]...)
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	main()
+
+	os.Exit(0)
+}
+
+// runRedirected() runs redirectChild() with the arguments 'args', with
+// standard output redirected to a pipe or, if 'toFile' is true, to a file,
+// and returns the output. NO_COLOR is removed from the environment, so that
+// it can't be what suppresses color.
+
+func runRedirected(t *testing.T, toFile bool, args ...string) string {
+
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "NO_COLOR=") {
+			env = append(env, e)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(env, "PID_NAMESPACES_REDIRECT_TEST=1")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	path := filepath.Join(t.TempDir(), "out")
+	if toFile {
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		cmd.Stdout = f
+	}
+
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%q: %v; stderr:\n%s", args, err, stderr.String())
+	}
+
+	if !toFile {
+		return stdout.String()
+	}
+
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(out)
+}
+
+// longestMemberLine() returns the length, in characters, of the longest
+// line of 'text' that doesn't display a namespace (that is, that doesn't
+// contain a "{device inode}" ID). Only the lines that list the members of
+// the namespaces are fitted to the output width.
+
+func longestMemberLine(text string) int {
+
+	longest := 0
+	for _, line := range strings.Split(text, "\n") {
+		if strings.Contains(line, "{") {
+			continue
+		}
+		if n := utf8.RuneCountInString(line); n > longest {
+			longest = n
+		}
+	}
+
+	return longest
+}
+
+// TestRedirectedOutput runs the program with its standard output
+// redirected to a pipe and to a file. It checks that, by default, the
+// output contains no escape bytes and its commands aren't truncated (the
+// fixture's commands are longer than 80 characters), while
+// "--color=always" and "--width" still apply.
+
+func TestRedirectedOutput(t *testing.T) {
+
+	for _, toFile := range []bool{false, true} {
+		name := "pipe"
+		if toFile {
+			name = "file"
+		}
+
+		t.Run(name, func(t *testing.T) {
+
+			out := runRedirected(t, toFile)
+			if strings.Contains(out, "\x1b") {
+				t.Errorf("default output contains escape "+
+					"bytes:\n%q", out)
+			}
+			if longestMemberLine(out) <= 80 {
+				t.Errorf("default output is truncated:\n%s",
+					out)
+			}
+
+			out = runRedirected(t, toFile, "--color=always")
+			if !strings.Contains(out, "\x1b") {
+				t.Errorf("'--color=always' output contains "+
+					"no escape bytes:\n%s", out)
+			}
+
+			out = runRedirected(t, toFile, "--width=60")
+			if strings.Contains(out, "\x1b") {
+				t.Errorf("'--width=60' output contains escape "+
+					"bytes:\n%q", out)
+			}
+			if n := longestMemberLine(out); n > 60 {
+				t.Errorf("'--width=60' output has a line of "+
+					"%d characters:\n%s", n, out)
+			}
+		})
+	}
+}
@@ -1,9 +1,83 @@
 /* userns_overview.go
 
    Display a hierarchical view of the user namespaces on the system
-   along with the member processes for each namespace.  This requires
+   along with the member processes for each namespace. If PIDs are
+   supplied as command-line arguments, then only the namespaces of
+   those processes (and their ancestors) are shown.  This requires
    features new in Linux 4.9. See the ioctl_ns(2) man page.
    (http://man7.org/linux/man-pages/man7/namespaces.7.html)
+   On older kernels, the program falls back to listing each user
+   namespace along with its member processes, without the hierarchy.
+   On Linux 4.9 and 4.10, which lack NS_GET_OWNER_UID, the hierarchy is
+   shown, but the creator UIDs are shown as "unknown".
+
+   Each namespace is shown with the UID of its creator, its nesting
+   level (the root of the displayed tree is level 0), and its numbers
+   of child and descendant namespaces. If this program is run inside
+   a user namespace, the ancestors of that namespace are not visible,
+   and the root of the tree is marked as the topmost visible namespace.
+
+   Color is used to highlight the namespaces and their member PIDs,
+   unless the "--no-color" option is specified or the output is not a
+   terminal. Likewise, the PID lists are wrapped to fit an 80-column
+   display only if the output is a terminal. The "--color=always" and
+   "--width=<n>" options override these defaults.
+
+   The "--output=<file>" option writes the output to the specified
+   file instead of standard output.
+
+   The UID and GID maps and the setgroups state ("allow" or "deny") of
+   each user namespace are also displayed; the "--no-maps" option
+   suppresses this. A namespace whose UID map does not map UID 0 is
+   marked "[no root mapping]", and one whose UID map is empty is
+   marked "[unmapped]". If sibling namespaces map overlapping ranges of
+   UIDs or GIDs in their parent namespace, a warning is displayed.
+
+   The "--json" option displays the namespace tree as a JSON document.
+   The "--csv" option displays one CSV record per namespace.
+   The "--dot" option displays the hierarchy in Graphviz DOT format.
+   The "--count" option displays only summary counts, rather than the
+   namespace tree.
+
+   The "--no-pids" option suppresses the display of the member processes
+   of each namespace.
+
+   The "--owned-counts" option displays, for each user namespace, the
+   number of nonuser namespaces of each type that the namespace owns.
+
+   The "--uid=<user>" option restricts the display to the namespaces
+   created by the specified user, and their descendants; the namespaces
+   created by the user are marked with a '*'. The JSON output is filtered
+   in the same way (with the ancestors that are included as context marked
+   as such), and the CSV output contains only the selected namespaces.
+
+   The "--show-comm" option displays the member processes one per line,
+   along with the command being run by each process.
+
+   The "--show-members-uids" option displays, for each user namespace,
+   the effective UIDs of its member processes, with a count of the
+   processes running under each UID.
+
+   The "--show-leader" option displays, for each user namespace, the
+   member process with the earliest start time (which is probably the
+   process that created the namespace), along with its command.
+
+   The "--subtree=<pid>" option restricts the display to the subtree
+   rooted at the user namespace of the specified process.
+
+   The "--scan-mounts" option additionally discovers user namespaces
+   that have no member processes, but are pinned into existence by
+   bind mounts.
+
+   The user namespace of which this program is a member is marked with
+   the string "<-- current".
+
+   The "--max-depth=<n>" option limits the display to the namespaces
+   at most <n> levels below the root of the tree.
+
+   Error, warning, and progress messages are written to standard error.
+   The "-q" option suppresses warnings; the "-v" option adds progress
+   messages, and, if repeated, debugging messages.
 
    For an expanded version of this program, see namespaces_of.go.
 
@@ -15,16 +89,55 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"os/user"
+	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"unicode"
 	"unsafe"
 )
 
+// Info from command-line options
+
+type CmdLineOptions struct {
+	useColor    bool     // Use color in the output
+	showMaps    bool     // Show UID and GID maps of each namespace
+	showPids    bool     // Show member PIDs of each namespace
+	showComm    bool     // Show command run by each member process
+	showLeader  bool     // Show oldest member process of each NS
+	json        bool     // Display the namespace tree as JSON
+	csv         bool     // Display the namespaces as CSV
+	count       bool     // Display only summary counts
+	dot         bool     // Display hierarchy in Graphviz DOT format
+	maxDepth    int      // Display at most this many levels (-1: all)
+	ownedCounts bool     // Count nonuser NSs owned by each namespace
+	memberUIDs  bool     // Show the UIDs of the member processes
+	filterUID   int      // Show only NSs created by this UID (-1: all)
+	pids        []string // PIDs whose namespaces are to be shown
+	subtreePID  string   // Show only subtree of this PID's user NS
+	scanMounts  bool     // Discover NSs pinned by bind mounts
+	outputFile  string   // Write output to this file ("-": stdout)
+	colorMode   string   // When to use color ("auto", "always", ...)
+	wrapWidth   int      // Wrap PID lists to this width (0: don't wrap)
+}
+
 // A namespace is identified by device ID and inode number
 
 type NamespaceID struct {
@@ -32,12 +145,41 @@ type NamespaceID struct {
 	inode_num uint64 // ino_t
 }
 
+// SymlinkString() returns the ID of the namespace 'nsid' formatted in
+// the same way as the contents of a /proc/PID/ns/user symlink, for
+// example, "user:[4026531837]".
+
+func (nsid NamespaceID) SymlinkString() string {
+	return "user:[" + strconv.FormatUint(nsid.inode_num, 10) + "]"
+}
+
 // A namespace has associated attributes: a set of
-// child namespaces and a set of member processes
+// child namespaces, a set of member processes, the
+// namespace's UID and GID maps, a count (for each type)
+// of the nonuser namespaces that it owns, and the nesting
+// level of the namespace (the root of the tree is level 0),
+// the total number of descendants of the namespace, the UID
+// of the namespace's creator, and the parent namespace
 
 type NamespaceAttribs struct {
-	children []NamespaceID // Child namespaces
-	pids     []int         // Member processes
+	level          int            // Nesting level
+	parent         NamespaceID    // Parent namespace
+	hasParent      bool           // False for the topmost namespace
+	descendants    int            // Number of descendant namespaces
+	descendantPids int            // Number of processes in descendants
+	creatorUID     int            // UID of creator of namespace
+	display        int            // Display state (see FilterNamespaces())
+	children       []NamespaceID  // Child namespaces
+	pids           []int          // Member processes
+	uidMap         string         // UID map
+	gidMap         string         // GID map
+	uidRanges      []MapRange     // Parsed UID map
+	uidMapRead     bool           // True if 'uidRanges' is valid
+	gidRanges      []MapRange     // Parsed GID map
+	setgroups      string         // Contents of /proc/PID/setgroups
+	owned          map[string]int // Owned nonuser NSs, by type
+	memberUIDs     map[int]int    // Member process counts, by euid
+	pinnedBy       []string       // Bind mounts that pin the namespace
 }
 
 // The following map records all of the namespaces that
@@ -49,6 +191,205 @@ var NSList = make(map[NamespaceID]*NamespaceAttribs)
 // namespaces (the root of the user namespace hierarchy).
 
 var initialNS NamespaceID
+var initialNSFound bool // True once 'initialNS' has been set
+
+// The output of the display functions is written to 'output', which
+// is standard output, unless the "--output" option was specified
+
+var output io.Writer = os.Stdout
+
+// 'currentNS' records the user namespace of which this program is
+// itself a member, so that we can highlight that namespace in the
+// display.
+
+var currentNS NamespaceID
+
+// The root of the displayed tree. This is 'initialNS', unless the
+// "--subtree" option was specified.
+
+var displayRoot NamespaceID
+
+// On kernels older than Linux 4.9, the namespace ioctl() operations
+// are not available, and the relationships between namespaces can't
+// be discovered. In that case, we fall back to a "flat" mode in which
+// namespaces are merely distinguished by device ID and inode number.
+
+var flatMode bool
+
+// On Linux 4.9 and 4.10, NS_GET_PARENT is available, but NS_GET_OWNER_UID
+// is not, so that the tree can be shown, but the creator UIDs (recorded
+// as -1) are unknown.
+
+var creatorsUnknown bool
+
+// The maximum nesting level of any namespace
+
+var maxLevel int
+
+// The directory where procfs is mounted, as shown in messages. This is
+// always "/proc" when the program runs, but the tests point it (and
+// 'procReader') at a directory of fixture files.
+
+var procDir = "/proc"
+
+// The 'ProcReader' interface defines the operations that this program uses
+// to obtain information from the procfs, along with the operations that it
+// performs on the namespace files that it opens (which is how the hierarchy
+// is discovered). The program performs these operations only via the reader
+// in 'procReader', so that a reader that supplies information from a set of
+// test fixtures, including a fake namespace hierarchy, can be substituted
+// for the real procfs. In the calls, 'pid' is the name of a PID directory
+// (or "self"), and 'nsType' is the name of a file in its ns directory.
+
+type ProcReader interface {
+
+	// stat() the namespace file, using the buffer 'sb'
+	StatNS(pid string, nsType string, sb *syscall.Stat_t) (NamespaceID,
+		error)
+
+	// Open the namespace file
+	OpenNS(pid string, nsType string) (int, error)
+
+	// Read a file in the PID directory
+	ReadFile(pid string, fileName string) ([]byte, error)
+
+	// Call 'fn' for each PID directory name
+	ListProcesses(fn func(name string) bool) error
+
+	NamespaceID(fd int) (NamespaceID, error) // ID of namespace 'fd'
+	NSIoctl(fd int, op uintptr) (int, error) // ioctl() operation on 'fd'
+	OwnerUID(fd int) (int, error)            // NS_GET_OWNER_UID on 'fd'
+	Close(fd int)                            // Close namespace 'fd'
+}
+
+// 'ProcfsReader' implements the 'ProcReader' interface using the procfs
+// mounted at 'root'. Errors are returned as the bare errno values of the
+// failed system calls.
+
+type ProcfsReader struct {
+	root string
+}
+
+var procReader ProcReader = ProcfsReader{"/proc"}
+
+func (r ProcfsReader) StatNS(pid string, nsType string,
+	sb *syscall.Stat_t) (NamespaceID, error) {
+
+	err := syscall.Stat(r.root+"/"+pid+"/ns/"+nsType, sb)
+	if err != nil {
+		return NamespaceID{}, err
+	}
+
+	return NamespaceID{sb.Dev, sb.Ino}, nil
+}
+
+func (r ProcfsReader) OpenNS(pid string, nsType string) (int, error) {
+	return syscall.Open(r.root+"/"+pid+"/ns/"+nsType, syscall.O_RDONLY, 0)
+}
+
+func (r ProcfsReader) ReadFile(pid string, fileName string) ([]byte, error) {
+	return ioutil.ReadFile(r.root + "/" + pid + "/" + fileName)
+}
+
+func (r ProcfsReader) ListProcesses(fn func(name string) bool) error {
+	return ForEachPIDDir(r.root, fn)
+}
+
+// The namespace operations of 'ProcfsReader' are the real system calls
+// (see NSIoctl() and NSGetOwnerUID()).
+
+func (ProcfsReader) NamespaceID(fd int) (NamespaceID, error) {
+	var sb syscall.Stat_t
+
+	if err := syscall.Fstat(fd, &sb); err != nil {
+		return NamespaceID{}, err
+	}
+
+	return NamespaceID{sb.Dev, sb.Ino}, nil
+}
+
+func (ProcfsReader) NSIoctl(fd int, op uintptr) (int, error) {
+	return NSIoctl(fd, op)
+}
+
+func (ProcfsReader) OwnerUID(fd int) (int, error) {
+	return NSGetOwnerUID(fd)
+}
+
+func (ProcfsReader) Close(fd int) {
+	syscall.Close(fd)
+}
+
+// The number of goroutines among which the stat() calls on the
+// /proc/PID/ns/user files are shared when scanning all processes (see
+// ScanProcesses()). If this is 1, the processes are inspected one at a
+// time, in the main goroutine.
+
+var scanWorkers = runtime.GOMAXPROCS(0)
+
+// The number of /proc/PID entries handed to the workers at a time
+
+const scanBatchSize = 512
+
+// The inode number of the initial user namespace is fixed
+// (PROC_USER_INIT_INO in the kernel source). If the topmost
+// namespace that we discover has a different inode number, then
+// this program is running inside a user namespace whose ancestors
+// are not visible to it.
+
+const PROC_USER_INIT_INO = 0xEFFFFFFD
+
+// Namespace ioctl() operations (see ioctl_ns(2))
+
+const NS_GET_USERNS = 0xb701    // Get owning user NS
+const NS_GET_PARENT = 0xb702    // Get parent NS
+const NS_GET_NSTYPE = 0xb703    // Return namespace type
+const NS_GET_OWNER_UID = 0xb704 // Return creator UID for user NS
+
+const CLONE_NEWUSER = 0x10000000 // Namespace type returned by NS_GET_NSTYPE
+
+// Display states of a namespace when filtering by creator UID
+
+const (
+	DISPLAY_FULL    = iota // Display namespace and its member PIDs
+	DISPLAY_CONTEXT        // Display (dimmed) namespace as context only
+	DISPLAY_NONE           // Don't display namespace
+)
+
+// The nonuser namespace types, as named in /proc/PID/ns
+
+var nonuserNamespaceTypes = []string{"cgroup", "ipc", "mnt", "net",
+	"pid", "uts"}
+
+// The nonuser namespaces that have already been counted
+// by CountOwnedNamespaces()
+
+var seenNonuserNS = make(map[NamespaceID]bool)
+
+// Some terminal escape sequences for displaying color output
+
+const ESC = ""
+const RED = ESC + "[31m"
+const YELLOW = ESC + "[93m"
+const BOLD = ESC + "[1m"
+const LIGHT_BLUE = ESC + "[38;5;51m"
+const GRAY = ESC + "[38;5;240m"
+const NORMAL = ESC + "(B" + ESC + "[m"
+const PID_COLOR = LIGHT_BLUE
+const CONTEXT_COLOR = GRAY
+const USERNS_COLOR = YELLOW + BOLD
+const WARNING_COLOR = RED
+const CURRENT_NS_COLOR = RED + BOLD
+
+// A buffer for stat() calls on namespace files, reused for each
+// call rather than being allocated afresh
+
+var nsStat syscall.Stat_t
+
+// The number of /proc/PID entries that we could not read
+// because we lacked permission
+
+var numUnreadable int
 
 // AddNamespace adds a PID to the list of PIDs associated with
 // the user namespace referred to by 'namespaceFD'.
@@ -70,20 +411,16 @@ var initialNS NamespaceID
 // the user namespace file referred to by 'namespaceFD').
 
 func AddNamespace(namespaceFD int, pid int) NamespaceID {
-	const NS_GET_PARENT = 0xb702 // ioctl() to get namespace parent
-	var sb syscall.Stat_t
 
 	// Obtain the device ID and inode number of the namespace file.
 	// These values together form the key for the 'NSList' map entry.
 
-	err := syscall.Fstat(namespaceFD, &sb)
+	nsid, err := procReader.NamespaceID(namespaceFD)
 	if err != nil {
-		fmt.Println("syscall.Fstat():", err)
+		Log(LOG_QUIET, "syscall.Fstat():", err)
 		os.Exit(1)
 	}
 
-	nsid := NamespaceID{sb.Dev, sb.Ino}
-
 	if _, fnd := NSList[nsid]; fnd {
 
 		// Namespace already exists; nothing to do
@@ -92,26 +429,52 @@ func AddNamespace(namespaceFD int, pid int) NamespaceID {
 
 		// Namespace entry does not yet exist; create it
 
+		Log(LOG_DEBUG, "New user namespace:", nsid)
+
 		NSList[nsid] = new(NamespaceAttribs)
 
+		NSList[nsid].creatorUID = -1
+
+		if flatMode {
+
+			// No ioctl() support; nothing more to discover
+
+			return AddPID(nsid, pid)
+		}
+
+		// Record the UID of the creator of the namespace
+
+		uid, err := procReader.OwnerUID(namespaceFD)
+		if err == syscall.ENOTTY {
+			if !creatorsUnknown {
+				Log(LOG_NORMAL, "This kernel doesn't support "+
+					"NS_GET_OWNER_UID (Linux 4.11 or "+
+					"later is required); creator UIDs "+
+					"are unknown")
+				creatorsUnknown = true
+			}
+		} else if err != nil {
+			Log(LOG_QUIET, "ioctl(NS_GET_OWNER_UID):", err)
+			os.Exit(1)
+		} else {
+			NSList[nsid].creatorUID = uid
+		}
+
 		// Get file descriptor for parent user namespace
 
-		r, _, err := syscall.Syscall(syscall.SYS_IOCTL,
-			uintptr(namespaceFD), uintptr(NS_GET_PARENT), 0)
-		parentFD := (int)((uintptr)(unsafe.Pointer(r)))
+		parentFD, err := procReader.NSIoctl(namespaceFD, NS_GET_PARENT)
 
 		if parentFD == -1 {
 			switch err {
 			case syscall.EPERM:
 				// This is the initial NS; remember it
 				initialNS = nsid
+				initialNSFound = true
 			case syscall.ENOTTY:
-				fmt.Println("This kernel doesn't support " +
-					"namespace ioctl() operations")
-				os.Exit(1)
+				flatMode = true
 			default:
 				// Unexpected error; bail
-				fmt.Println("ioctl():", err)
+				Log(LOG_QUIET, "ioctl():", err)
 				os.Exit(1)
 			}
 		} else {
@@ -123,15 +486,60 @@ func AddNamespace(namespaceFD int, pid int) NamespaceID {
 			p := AddNamespace(parentFD, -1)
 
 			// Make the current namespace entry ('nsid') a child of
-			// the parent namespace entry
+			// the parent namespace entry, one level deeper
 
 			NSList[p].children = append(NSList[p].children, nsid)
+			NSList[nsid].parent = p
+			NSList[nsid].hasParent = true
+
+			NSList[nsid].level = NSList[p].level + 1
+			if NSList[nsid].level > maxLevel {
+				maxLevel = NSList[nsid].level
+			}
 
-			syscall.Close(parentFD)
+			procReader.Close(parentFD)
 		}
 	}
 
-	// Add PID to PID list for this namespace entry
+	return AddPID(nsid, pid)
+}
+
+// NSIoctl() performs the namespace ioctl() operation 'op' (one of
+// the NS_GET_* constants) on the file descriptor 'fd'. On success, it
+// returns the (nonnegative) result of the operation. On failure, it
+// returns -1 and the error (a syscall.Errno, for example, EPERM or
+// ENOTTY). See ioctl_ns(2).
+
+func NSIoctl(fd int, op uintptr) (int, error) {
+
+	ret, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), op, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+
+	return int(ret), nil
+}
+
+// NSGetOwnerUID() returns the UID of the creator of the user namespace
+// referred to by 'fd' (the NS_GET_OWNER_UID operation). On failure, it
+// returns -1 and the error.
+
+func NSGetOwnerUID(fd int) (int, error) {
+	var uid uint32 // uid_t
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		uintptr(NS_GET_OWNER_UID), uintptr(unsafe.Pointer(&uid)))
+	if errno != 0 {
+		return -1, errno
+	}
+
+	return int(uid), nil
+}
+
+// AddPID() adds 'pid' to the list of member PIDs of the namespace
+// 'nsid' (unless 'pid' is -1), and returns 'nsid'.
+
+func AddPID(nsid NamespaceID, pid int) NamespaceID {
 
 	if pid > 0 {
 		NSList[nsid].pids = append(NSList[nsid].pids, pid)
@@ -140,99 +548,2443 @@ func AddNamespace(namespaceFD int, pid int) NamespaceID {
 	return nsid
 }
 
+// StatUserNS() uses stat() to obtain the ID of the user namespace of
+// the process whose /proc/PID directory is named 'name'. 'sb' is the
+// buffer used for the stat() call; each goroutine that calls this
+// function has its own buffer, which it reuses for every call.
+
+func StatUserNS(name string, sb *syscall.Stat_t) (NamespaceID, error) {
+	return procReader.StatNS(name, "user", sb)
+}
+
 // ProcessProcFile processes a single /proc/PID entry, creating
 // a namespace entry for this PID's /proc/PID/ns/user file
 // (and, as necessary, namespace entries for all ancestor namespaces
 // going back to the initial user namespace).
 // 'name' is the name of a PID directory under /proc.
+//
+// Most processes are members of a namespace that we have already
+// seen (typically, the initial user namespace), so the caller first
+// stat()s the namespace file (see StatUserNS()), passing the result
+// in 'nsid' and 'statErr'; the file is opened (in order to perform
+// ioctl() operations) only if it refers to a namespace not yet in
+// 'NSList'.
+//
+// The function returns the ID of the process's user namespace, and
+// a boolean that is false if the process was skipped.
+
+func ProcessProcFile(name string, nsid NamespaceID, statErr error,
+	isCmdLineArg bool) (NamespaceID, bool) {
+
+	pid, _ := strconv.Atoi(name)
+
+	if statErr != nil {
+		ProcFileError(name, isCmdLineArg, "stat", statErr)
+		return NamespaceID{}, false
+	}
 
-func ProcessProcFile(name string) {
+	if ns, fnd := NSList[nsid]; fnd {
+		ns.pids = append(ns.pids, pid)
+		return nsid, true
+	}
 
 	// Obtain a file descriptor that refers to the user namespace
 	// of this process
 
-	namespaceFD, err := syscall.Open("/proc/"+name+"/ns/user",
-		syscall.O_RDONLY, 0)
-
-	if namespaceFD < 0 {
-		fmt.Println("open():", err)
-		os.Exit(1)
+	namespaceFD, err := procReader.OpenNS(name, "user")
+	if err != nil {
+		ProcFileError(name, isCmdLineArg, "open", err)
+		return NamespaceID{}, false
 	}
 
-	pid, _ := strconv.Atoi(name)
+	nsid = AddNamespace(namespaceFD, pid)
 
-	AddNamespace(namespaceFD, pid)
+	procReader.Close(namespaceFD)
 
-	syscall.Close(namespaceFD)
+	return nsid, true
 }
 
-// DisplayNamespaceTree() recursively displays the namespace
-// tree rooted at 'nsid'. 'level' is our current level in the
-// tree, and is used for producing suitably indented output.
+// ProcFileError() handles the error 'err' returned by the system call
+// 'syscallName' when applied to the /proc/PID/ns/user file of the
+// process whose /proc/PID directory is named 'name'.
+//
+// If 'isCmdLineArg' is true, 'name' was specified on the command
+// line, and any error is fatal. Otherwise, if the process has
+// terminated (ENOENT), the entry is silently skipped. If we don't
+// have permission to access the namespace file (EACCES), the entry
+// is skipped, but counted in 'numUnreadable'. Any other error is
+// fatal.
 
-func DisplayNamespaceTree(nsid NamespaceID, level int) {
+func ProcFileError(name string, isCmdLineArg bool, syscallName string,
+	err error) {
 
-	indent := strings.Repeat(" ", level*4)
+	if isCmdLineArg {
+		if err == syscall.ENOENT {
+			Log(LOG_QUIET, "No such process: PID "+name)
+		} else {
+			Log(LOG_QUIET, "Can't inspect PID "+name+":", err)
+		}
+		os.Exit(1)
+	}
 
-	// Display the namespace ID (device ID + inode number)
+	switch err {
+	case syscall.ENOENT:
+		// Process terminated while we were scanning /proc
+		Log(LOG_DEBUG, "PID "+name+" terminated during scan")
+	case syscall.EACCES:
+		numUnreadable++
+	default:
+		Log(LOG_QUIET, syscallName+"("+procDir+"/"+name+"/ns/user):",
+			err)
+		os.Exit(1)
+	}
+}
 
-	fmt.Print(indent)
-	fmt.Println(nsid)
+// CountOwnedNamespaces() inspects each of the nonuser namespaces
+// of the process whose /proc/PID directory is named 'name'. For
+// each namespace that has not already been seen, the count of
+// namespaces of that type owned by the owning user namespace is
+// incremented. (Namespaces whose owner is not visible, because it
+// is an ancestor of our user namespace, are not counted.)
 
-	// Print a sorted list of the PIDs that are members of this
-	// namespace. We do a bit of a dance here to produce a list
-	// of PIDs that is suitably wrapped and indented, rather than
-	// a long single-line list.
+func CountOwnedNamespaces(name string) {
 
-	sort.Ints(NSList[nsid].pids)
-	base := len(indent) + 25
-	col := base
-	for i, p := range NSList[nsid].pids {
-		if i == 0 || col >= 80 && col > base+32 {
-			col = base
-			if i > 0 {
-				fmt.Println()
-			}
-			fmt.Print(indent)
-			fmt.Print("            ")
-			if i == 0 {
-				fmt.Print("PIDs: ")
+	for _, nsType := range nonuserNamespaceTypes {
+		namespaceFD, err := procReader.OpenNS(name, nsType)
+		if err != nil {
+			// The process terminated, or we lack permission
+			continue
+		}
+
+		nsid, err := procReader.NamespaceID(namespaceFD)
+		if err != nil {
+			Log(LOG_QUIET, "syscall.Fstat():", err)
+			os.Exit(1)
+		}
+
+		if !seenNonuserNS[nsid] {
+			seenNonuserNS[nsid] = true
+
+			ownerFD, err := procReader.NSIoctl(namespaceFD,
+				NS_GET_USERNS)
+
+			if ownerFD == -1 {
+				if err != syscall.EPERM {
+					Log(LOG_QUIET,
+						"ioctl(NS_GET_USERNS):", err)
+					os.Exit(1)
+				}
 			} else {
-				fmt.Print("      ")
+
+				// Make sure the owning user namespace
+				// has an entry in the map
+
+				owner := AddNamespace(ownerFD, -1)
+
+				if NSList[owner].owned == nil {
+					NSList[owner].owned = make(map[string]int)
+				}
+				NSList[owner].owned[nsType]++
+
+				procReader.Close(ownerFD)
 			}
 		}
-		fmt.Print(strconv.Itoa(p) + " ")
-		col += len(strconv.Itoa(p)) + 1
+
+		procReader.Close(namespaceFD)
 	}
-	fmt.Println()
+}
 
-	// Recursively display the child namespaces
+// OwnedCountsString() returns a string describing the numbers of
+// each type of nonuser namespace owned by the user namespace 'nsid'.
+
+func OwnedCountsString(nsid NamespaceID) string {
+
+	var counts []string
+
+	for _, nsType := range nonuserNamespaceTypes {
+		if n := NSList[nsid].owned[nsType]; n > 0 {
+			counts = append(counts, strconv.Itoa(n)+" "+nsType)
+		}
+	}
 
-	for _, v := range NSList[nsid].children {
-		DisplayNamespaceTree(v, level+1)
+	if len(counts) == 0 {
+		return "nothing"
 	}
+
+	return strings.Join(counts, ", ")
 }
 
-func main() {
+// CountDescendants() records the number of descendants of each
+// namespace in 'NSList', and the total number of member processes of
+// those descendants. This is done in a single bottom-up pass:
+// the namespaces are visited in order of decreasing nesting level,
+// so that the counts for each of a namespace's children are known
+// by the time that the namespace itself is visited.
+
+func CountDescendants() {
+
+	var nsids []NamespaceID
+	for nsid := range NSList {
+		nsids = append(nsids, nsid)
+	}
+
+	sort.Slice(nsids, func(i, j int) bool {
+		return NSList[nsids[i]].level > NSList[nsids[j]].level
+	})
+
+	for _, nsid := range nsids {
+		ns := NSList[nsid]
+		ns.descendants = 0
+		ns.descendantPids = 0
+		for _, child := range ns.children {
+			ns.descendants += 1 + NSList[child].descendants
+			ns.descendantPids += len(NSList[child].pids) +
+				NSList[child].descendantPids
+		}
+	}
+}
+
+// FilterNamespaces() sets the display state of each namespace in
+// the tree rooted at 'nsid' according to the creator UID specified
+// by the "--uid" option: namespaces created by that UID, and their
+// descendants, are displayed in full; the ancestors of those
+// namespaces are displayed (dimmed) to provide context; and all
+// other namespaces are not displayed. 'inMatch' is true if an
+// ancestor of 'nsid' was created by the specified UID. The return
+// value is true if any namespace in the tree is to be displayed.
+
+func FilterNamespaces(nsid NamespaceID, inMatch bool, uid int) bool {
+
+	ns := NSList[nsid]
+
+	inMatch = inMatch || ns.creatorUID == uid
 
-	// Fetch a list of the filenames under /proc.
+	shown := false
+	for _, child := range ns.children {
+		if FilterNamespaces(child, inMatch, uid) {
+			shown = true
+		}
+	}
+
+	if inMatch {
+		ns.display = DISPLAY_FULL
+	} else if shown {
+		ns.display = DISPLAY_CONTEXT
+	} else {
+		ns.display = DISPLAY_NONE
+	}
+
+	return ns.display != DISPLAY_NONE
+}
+
+// ReadProcFile() reads the contents of the file 'fileName' in the
+// /proc/PID directory of the process with the specified 'pid'. The
+// returned string contains the file contents with white space
+// compressed.
 
-	files, err := ioutil.ReadDir("/proc")
+func ReadProcFile(pid int, fileName string) (bool, string) {
+
+	buf, err := procReader.ReadFile(strconv.Itoa(pid), fileName)
 	if err != nil {
-		fmt.Println("ioutil.Readdir():", err)
+
+		// Probably, the process terminated between the
+		// time we accessed the namespace files and the
+		// time we tried to open the file.
+
+		return false, ""
+	}
+
+	space := regexp.MustCompile(`\s+`)
+	return true, space.ReplaceAllString(strings.TrimSpace(string(buf)), " ")
+}
+
+// A 'MapRange' is one line of a UID or GID map
+
+type MapRange struct {
+	inside  uint64 // First ID inside the namespace
+	outside uint64 // First ID in the parent namespace
+	length  uint64 // Number of IDs in the range
+}
+
+// ParseMap() parses the text of a UID or GID map (in which white space
+// may have been compressed), returning the list of ranges in the map.
+// The returned boolean is false if 'text' is not a well-formed map.
+
+func ParseMap(text string) ([]MapRange, bool) {
+
+	fields := strings.Fields(text)
+	if len(fields)%3 != 0 {
+		return nil, false
+	}
+
+	ranges := []MapRange{}
+
+	for i := 0; i < len(fields); i += 3 {
+		var vals [3]uint64
+
+		for j := range vals {
+			v, err := strconv.ParseUint(fields[i+j], 10, 32)
+			if err != nil {
+				return nil, false
+			}
+			vals[j] = v
+		}
+
+		ranges = append(ranges, MapRange{vals[0], vals[1], vals[2]})
+	}
+
+	return ranges, true
+}
+
+// FormatMap() returns the string used to display the map 'ranges':
+// the fields of each range, separated by single spaces.
+
+func FormatMap(ranges []MapRange) string {
+
+	var fields []string
+	for _, r := range ranges {
+		fields = append(fields, strconv.FormatUint(r.inside, 10),
+			strconv.FormatUint(r.outside, 10),
+			strconv.FormatUint(r.length, 10))
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// ReadMap() reads and parses the UID or GID map of the process with
+// the specified 'pid'. 'mapName' is either "uid_map" or "gid_map".
+
+func ReadMap(pid int, mapName string) (bool, []MapRange) {
+
+	fnd, text := ReadProcFile(pid, mapName)
+	if !fnd {
+		return false, nil
+	}
+
+	ranges, ok := ParseMap(text)
+	if !ok {
+		Log(LOG_QUIET, "Malformed "+mapName+" for PID "+
+			strconv.Itoa(pid)+": "+text)
 		os.Exit(1)
 	}
 
-	// Process each /proc/PID (PID starts with a digit)
+	return true, ranges
+}
+
+// MapsRoot() returns true if one of the ranges in 'ranges' maps ID 0
+// inside the namespace.
+
+func MapsRoot(ranges []MapRange) bool {
+
+	for _, r := range ranges {
+		if r.inside == 0 && r.length > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RangesOverlap() returns true if the outside (parent namespace) IDs
+// of the ranges 'a' and 'b' overlap. Adjacent ranges don't overlap.
+
+func RangesOverlap(a, b MapRange) bool {
+
+	return a.length > 0 && b.length > 0 &&
+		a.outside < b.outside+b.length &&
+		b.outside < a.outside+a.length
+}
+
+// OutsideRangeString() returns a string describing the range of
+// outside IDs covered by 'r', in the form "first-last".
+
+func OutsideRangeString(r MapRange) string {
+
+	return strconv.FormatUint(r.outside, 10) + "-" +
+		strconv.FormatUint(r.outside+r.length-1, 10)
+}
+
+// MapOverlaps() returns a list of strings describing the overlaps
+// between the outside ID ranges of the maps 'aRanges' and 'bRanges'
+// of the namespaces 'a' and 'b'. 'idType' is "UID" or "GID".
+
+func MapOverlaps(a, b NamespaceID, aRanges, bRanges []MapRange,
+	idType string) []string {
+
+	var overlaps []string
 
-	for _, f := range files {
-		if f.Name()[0] >= '1' && f.Name()[0] <= '9' {
-			ProcessProcFile(f.Name())
+	for _, ar := range aRanges {
+		for _, br := range bRanges {
+			if !RangesOverlap(ar, br) {
+				continue
+			}
+
+			overlaps = append(overlaps, fmt.Sprint(a)+
+				" and "+fmt.Sprint(b)+": "+idType+
+				" ranges "+OutsideRangeString(ar)+
+				" and "+OutsideRangeString(br))
 		}
 	}
 
-	// Display the namespace tree rooted at the initial
-	// user namespace
+	return overlaps
+}
+
+// SiblingMapOverlaps() returns a list of strings describing each
+// case where two sibling namespaces (namespaces with the same parent)
+// map overlapping ranges of outside UIDs or GIDs. Such overlaps mean
+// that files created by users in one namespace may be owned by users
+// in the other namespace.
+
+func SiblingMapOverlaps() []string {
+
+	var overlaps []string
+
+	var parents []NamespaceID
+	for nsid := range NSList {
+		parents = append(parents, nsid)
+	}
+	SortNamespaceIDs(parents)
+
+	for _, parent := range parents {
+		children := SortedChildren(parent)
+
+		for i, a := range children {
+			for _, b := range children[i+1:] {
+				nsa, nsb := NSList[a], NSList[b]
+
+				overlaps = append(overlaps,
+					MapOverlaps(a, b, nsa.uidRanges,
+						nsb.uidRanges, "UID")...)
+				overlaps = append(overlaps,
+					MapOverlaps(a, b, nsa.gidRanges,
+						nsb.gidRanges, "GID")...)
+			}
+		}
+	}
+
+	return overlaps
+}
+
+// RootMappingString() returns a warning string if the UID map of the
+// namespace 'nsid' does not map UID 0 ("[no root mapping]") or is empty
+// ("[unmapped]"), and otherwise (or if the map could not be read)
+// returns an empty string.
+
+func RootMappingString(nsid NamespaceID) string {
+
+	ns := NSList[nsid]
+
+	switch {
+	case !ns.uidMapRead:
+		return ""
+	case len(ns.uidRanges) == 0:
+		return "[unmapped]"
+	case !MapsRoot(ns.uidRanges):
+		return "[no root mapping]"
+	default:
+		return ""
+	}
+}
+
+// AddUidGidMaps() adds the UID and GID maps for all of the namespaces
+// in 'NSList'. For each namespace, we walk through the list of member
+// PIDs until we can successfully read a /proc/PID/[ug]id_map file.
+// (We try all PIDs in the list because some PIDs may have terminated
+// already.) If none of the PIDs could be read, the map is shown as
+// "deleted"; if the namespace has no member PIDs, the map is shown as
+// "unknown". The setgroups state ("allow" or "deny") of each namespace
+// is read from /proc/PID/setgroups in the same way; if it can't be
+// read, it is shown as "?".
+
+func AddUidGidMaps() {
+
+	for _, ns := range NSList {
+		ns.uidMap = "unknown"
+		ns.gidMap = "unknown"
+		ns.setgroups = "?"
+
+		if len(ns.pids) == 0 {
+			continue
+		}
+
+		ns.uidMap = "deleted"
+		ns.gidMap = "deleted"
+
+		for _, pid := range ns.pids {
+			if fnd, val := ReadMap(pid, "uid_map"); fnd {
+				ns.uidMap = FormatMap(val)
+				ns.uidRanges = val
+				ns.uidMapRead = true
+				break
+			}
+		}
+
+		for _, pid := range ns.pids {
+			if fnd, val := ReadMap(pid, "gid_map"); fnd {
+				ns.gidMap = FormatMap(val)
+				ns.gidRanges = val
+				break
+			}
+		}
+
+		for _, pid := range ns.pids {
+			if fnd, val := ReadProcFile(pid, "setgroups"); fnd {
+				ns.setgroups = val
+				break
+			}
+		}
+	}
+}
+
+// Display output is accumulated in a LineWriter and written out in large
+// chunks. Operations on the buffer are serialized, so that the signal handler
+// (see HandleSignals()) can safely write out what has been buffered if the
+// program is interrupted.
+
+type LineWriter struct {
+	mu  sync.Mutex
+	buf []byte
+	out io.Writer
+}
+
+const outputBufSize = 64 * 1024
+
+// Write() appends 'p' to the buffer. Once the buffer has grown large, the
+// complete lines that it contains are written out.
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= outputBufSize {
+		err := w.writeLines()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// writeLines() writes out the complete lines in the buffer, keeping any
+// partial last line. The caller must hold 'w.mu'.
+
+func (w *LineWriter) writeLines() error {
+	n := bytes.LastIndexByte(w.buf, '\n') + 1
+	_, err := w.out.Write(w.buf[:n])
+	w.buf = w.buf[:copy(w.buf, w.buf[n:])]
+	return err
+}
+
+// Flush() writes out everything in the buffer.
+
+func (w *LineWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, err := w.out.Write(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+// interrupt() is called when the program is interrupted by a signal. It
+// writes out the complete lines in the buffer, discarding any partial last
+// line so that the output doesn't stop part way through a line, and then
+// writes 'trailer'. 'w.mu' is left locked, so that no further output is
+// written before the program exits.
+
+func (w *LineWriter) interrupt(trailer string) {
+	w.mu.Lock()
+	w.writeLines()
+	io.WriteString(w.out, trailer)
+}
+
+// While the scan is in progress, SIGINT and SIGTERM cancel it (see
+// HandleSignals()) rather than terminating the program, so that the results
+// gathered so far can still be displayed. 'scanInProgress' (which is
+// accessed atomically) is 1 while the scan can be canceled.
+
+var scanInProgress int32
+var cancelScan context.CancelFunc
+
+// The exit status used when the scan was interrupted, so that only
+// partial results were displayed.
+
+const EXIT_INTERRUPTED = 3
+
+// StartScan() returns the context to be checked by the scan, which is canceled
+// if the program is interrupted before EndScan() is called.
+
+func StartScan() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelScan = cancel
+	atomic.StoreInt32(&scanInProgress, 1)
+	return ctx
+}
+
+// EndScan() marks the end of the scan that uses 'ctx', and returns true if
+// the scan was interrupted.
+
+func EndScan(ctx context.Context) bool {
+	atomic.StoreInt32(&scanInProgress, 0)
+	return ctx.Err() != nil
+}
+
+// HandleSignals() arranges for the program to terminate cleanly if it is
+// interrupted. If a scan is in progress, SIGINT or SIGTERM cancels the scan
+// (see StartScan()); otherwise, the complete lines of buffered output are
+// written out and the terminal color is reset (if we are using color), so that
+// the shell prompt isn't left colored, and the program exits with the
+// conventional status of 128 plus the signal number. On SIGPIPE (the reader of
+// our output went away, as in "userns_overview | head"), the program exits
+// silently with status 0.
+
+func HandleSignals(useColor bool, w *LineWriter) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM,
+		syscall.SIGPIPE)
+
+	go func() {
+		for sig := range sigChan {
+			if sig == syscall.SIGPIPE {
+				os.Exit(0)
+			}
+
+			// While the scan is in progress, the first SIGINT
+			// or SIGTERM just cancels it.
+
+			if atomic.CompareAndSwapInt32(&scanInProgress, 1, 0) {
+				cancelScan()
+				continue
+			}
+
+			trailer := ""
+			if useColor {
+				trailer = NORMAL
+			}
+			w.interrupt(trailer)
+
+			os.Exit(128 + int(sig.(syscall.Signal)))
+		}
+	}()
+}
+
+// Diagnostic messages are written to stderr, so that they don't
+// become mixed with the program's output. Which messages are
+// displayed depends on the logging level, which is selected with
+// the "-q" and "-v" options.
+
+const (
+	LOG_QUIET   = iota // Errors only
+	LOG_NORMAL         // Errors and warnings (the default)
+	LOG_VERBOSE        // Also progress messages
+	LOG_DEBUG          // Also debugging messages
+)
+
+var logLevel = LOG_NORMAL
+
+// Log() writes its arguments (formatted as for fmt.Println()) to
+// stderr, if 'level' is no higher than the current logging level.
+
+func Log(level int, a ...interface{}) {
+	if level <= logLevel {
+		fmt.Fprintln(os.Stderr, a...)
+	}
+}
+
+// 'LogLevelFlag' implements the "-v" option, each occurrence of
+// which raises the logging level by one step.
+
+type LogLevelFlag struct{}
+
+func (LogLevelFlag) String() string   { return "" }
+func (LogLevelFlag) IsBoolFlag() bool { return true }
+
+func (LogLevelFlag) Set(value string) error {
+	v, err := strconv.ParseBool(value)
+	if err == nil && v && logLevel < LOG_DEBUG {
+		logLevel++
+	}
+	return err
+}
+
+// IsTerminal() returns true if the file descriptor 'fd' refers to
+// a terminal.
+
+func IsTerminal(fd int) bool {
+	var t syscall.Termios
+
+	_, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		uintptr(syscall.TCGETS), uintptr(unsafe.Pointer(&t)))
+
+	return err == 0
+}
+
+// LookupUID() returns the UID corresponding to 'name', which is
+// either a numeric UID or a user name.
+
+func LookupUID(name string) int {
+
+	if uid, err := strconv.Atoi(name); err == nil && uid >= 0 {
+		return uid
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		Log(LOG_QUIET, "Bad user for --uid option: "+name)
+		ShowUsageAndExit(1)
+	}
+
+	uid, _ := strconv.Atoi(u.Uid)
+
+	return uid
+}
+
+// Shell completion. The "--generate-completion=bash|zsh" option (which is
+// deliberately left out of the usage message) writes a completion script for
+// this program to stdout. The script is built from the options registered
+// with the flag package, so that it can't drift from them.
+//
+// 'completionActions' says how the values of particular options are
+// completed, and 'argAction' says how command-line arguments are completed.
+// An action is "pid" (PIDs from /proc), "file", "" (no completion), or a
+// space-separated list of the words that are permitted.
+
+var completionActions = map[string]string{
+	"subtree":   "pid",
+	"output":    "file",
+	"uid":       "",
+	"max-depth": "",
+	"color":     "auto always never",
+	"width":     "",
+}
+
+const argAction = "pid"
+
+// BashAction() returns bash code that completes the word in '$cur' according to
+// 'action'.
+
+func BashAction(action string) string {
+	switch action {
+	case "":
+		return ""
+	case "pid":
+		return `COMPREPLY=( $(compgen -W "$(ls /proc | ` +
+			`grep '^[0-9]')" -- "$cur") )`
+	case "file":
+		return `COMPREPLY=( $(compgen -f -- "$cur") )`
+	default:
+		return `COMPREPLY=( $(compgen -W "` + action + `" -- "$cur") )`
+	}
+}
+
+// ZshAction() returns the zsh _arguments action corresponding to 'action'.
+
+func ZshAction(action string) string {
+	switch action {
+	case "":
+		return " "
+	case "pid":
+		return "_pids"
+	case "file":
+		return "_files"
+	default:
+		return "(" + action + ")"
+	}
+}
+
+// GenerateCompletion() writes a completion script for 'shell' ("bash" or "zsh")
+// to stdout.
+
+func GenerateCompletion(shell string) {
+	const prog = "userns_overview"
+
+	// Options are completed with a double dash, except for the
+	// single-letter ones such as "-q".
+
+	dashes := func(name string) string {
+		if len(name) == 1 {
+			return "-" + name
+		}
+		return "--" + name
+	}
+
+	var names []string
+	var flags []*flag.Flag
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name != "generate-completion" {
+			names = append(names, dashes(f.Name))
+			flags = append(flags, f)
+		}
+	})
+
+	isBool := func(f *flag.Flag) bool {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		return ok && b.IsBoolFlag()
+	}
+
+	if shell == "zsh" {
+		quoter := strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`,
+			":", `\:`)
+
+		fmt.Println("#compdef " + prog)
+		fmt.Println()
+		fmt.Println("_arguments \\")
+		for _, f := range flags {
+			spec := dashes(f.Name)
+			if !isBool(f) {
+				spec += "="
+			}
+			spec += "[" + quoter.Replace(f.Usage) + "]"
+			if !isBool(f) {
+				spec += ":" + f.Name + ":" +
+					ZshAction(completionActions[f.Name])
+			}
+			fmt.Println("\t'" + spec + "' \\")
+		}
+		fmt.Println("\t'*:argument:" + ZshAction(argAction) + "'")
+		return
+	}
+
+	// Go's flag package accepts both "--opt=value" and "--opt value";
+	// bash splits the former into three words at the '='.
+
+	fmt.Println(`_` + prog + `()
+{
+	local cur prev opt
+	cur=${COMP_WORDS[COMP_CWORD]}
+	prev=${COMP_WORDS[COMP_CWORD-1]}
+	COMPREPLY=()
+
+	if [ "$cur" = "=" ]; then
+		opt=$prev
+		cur=
+	elif [ "$prev" = "=" ]; then
+		opt=${COMP_WORDS[COMP_CWORD-2]}
+	else
+		opt=$prev
+	fi
+
+	case $opt in`)
+
+	for _, f := range flags {
+		if !isBool(f) {
+			fmt.Println("\t-" + f.Name + "|--" + f.Name + ")")
+			action := BashAction(completionActions[f.Name])
+			if action != "" {
+				fmt.Println("\t\t" + strings.Replace(action,
+					"\n", "\n\t\t", -1))
+			}
+			fmt.Println("\t\treturn ;;")
+		}
+	}
+
+	fmt.Println(`	esac
+
+	case $cur in
+	-*)
+		COMPREPLY=( $(compgen -W "` + strings.Join(names, " ") + `" \
+			-- "$cur") )
+		return ;;
+	esac
+
+	` + strings.Replace(BashAction(argAction), "\n", "\n\t", -1) + `
+}
+complete -F _` + prog + ` ` + prog)
+}
+
+// ShowUsageAndExit() prints a command-line usage message for this
+// program and terminates the program with the specified 'status' value.
+
+func ShowUsageAndExit(status int) {
+
+	// The usage message is a diagnostic, written to stderr, unless it
+	// was asked for with "--help".
+
+	out := os.Stdout
+	if status != 0 {
+		out = os.Stderr
+	}
+
+	fmt.Fprintln(out,
+		`Usage: userns_overview [options] [<pid>...]
+
+Display a hierarchical view of the user namespaces on the system, along with
+the member processes and the UID and GID maps of each namespace. If PIDs are
+specified, then only the user namespaces of those processes (and their
+ancestor namespaces) are shown.
+
+Options:
+
+-q		Don't display warning messages (for example, about pinned
+		namespaces that can't be opened). Error messages are
+		still displayed.
+-v		Display progress messages. If specified twice, also
+		display debugging messages.
+
+--color=<when>	Use color in the displayed output "always", "never", or
+		only if the output is a terminal ("auto", the default).
+		Can't be combined with '--no-color'.
+--count		Display only a summary: the total number of user
+		namespaces, the maximum nesting level, the number of
+		namespaces created by each UID, and the total number of
+		member processes.
+--csv		Display one CSV record per namespace, with the fields
+		device, inode, parent_device, parent_inode, level,
+		creator_uid, member_pid_count, and member_pids (a
+		semicolon-separated list). Parents precede their
+		children. Can't be combined with '--json'.
+--dot		Display the hierarchy as a Graphviz DOT digraph (instead of
+		a tree), suitable for rendering with, for example,
+		"dot -Tsvg". The initial user namespace is drawn with a
+		double border.
+--help		Display this usage message.
+--json		Display the namespace tree as a JSON document, in which
+		each namespace is an object containing its device ID,
+		inode number, UID and GID maps, member PIDs, and child
+		namespaces. If no namespaces could be discovered, an
+		empty object is displayed.
+--max-depth=<n>	Display only the namespaces at most <n> levels below
+		the root of the tree. Each subtree that is not displayed
+		is summarized by a line showing its numbers of namespaces
+		and processes.
+--no-color	Suppress the use of color in the displayed output. (By
+		default, color is used only if the output is a terminal.)
+--no-maps	Suppress the display of the UID and GID maps and the
+		setgroups state of each namespace, and of the markers
+		for namespaces that have no mapping for UID 0.
+--no-pids	Suppress the display of the processes that are members
+		of each namespace.
+--output=<file>	Write the output to <file> ("-" means standard output).
+		If the output is not a terminal, then, unless overridden
+		by '--color' and '--width', color is not used, and the PID
+		list of each namespace is displayed on a single line.
+--owned-counts	For each namespace, display the number of nonuser
+		namespaces of each type that it owns (for example, "owns:
+		2 net, 1 mnt, 1 pid"). This requires inspecting every
+		namespace of every process, and so makes the scan slower.
+--scan-mounts	Also discover user namespaces that are pinned into
+		existence by bind mounts (see /proc/self/mountinfo),
+		even if they have no member processes.
+--show-comm	Display the member processes one per line, along with the
+		command being run by each process.
+--show-leader	For each namespace, display the member process that has
+		the earliest start time (usually the process that created
+		the namespace), along with the command that it is running.
+--show-members-uids
+		For each namespace, display the effective UIDs (as seen
+		from outside the namespace) of its member processes, and
+		the number of processes with each UID.
+--subtree=<pid>	Show only the subtree rooted at the user namespace of
+		the process <pid>. This option can't be combined with
+		PID arguments.
+--uid=<user>	Show only the namespaces created by <user> (a UID or a user
+		name), and their descendants. The ancestors of those
+		namespaces are shown (dimmed, and without their member
+		processes) to provide context. The namespaces created by
+		<user> are marked with a '*'. With '--json', the context
+		namespaces have the attribute "context": true; with
+		'--csv', they are omitted.
+--width=<n>	Wrap the PID list of each namespace to fit in <n> columns.
+		By default, the lists are wrapped to fit an 80-column
+		display if the output is a terminal, and not wrapped
+		otherwise.`)
+
+	os.Exit(status)
+}
+
+// ParseArgs() parses the command line in the same way as flag.Parse(), except
+// that options may also appear after (or among) the nonoption arguments, so
+// that, for example, "userns_overview 1234 --no-color" works as expected. An
+// argument of "--" ends the options: all later arguments are nonoption
+// arguments. A negative number, and a lone "-", are nonoption arguments. Any
+// other argument that starts with '-' is treated as an option, so that the flag
+// package diagnoses it if it is unrecognized.
+
+func ParseArgs() {
+	var options, nonOptions []string
+
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if arg == "--" {
+			nonOptions = append(nonOptions, args[i+1:]...)
+			break
+		}
+
+		if _, err := strconv.Atoi(arg); err == nil || len(arg) < 2 ||
+			arg[0] != '-' {
+			nonOptions = append(nonOptions, arg)
+			continue
+		}
+
+		options = append(options, arg)
+
+		// An option that takes a value may have the value in the
+		// following argument, which must stay with the option.
+
+		name := strings.TrimLeft(arg, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+
+		f := flag.Lookup(name)
+		if f == nil || i+1 == len(args) {
+			continue
+		}
+
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		if !ok || !b.IsBoolFlag() {
+			i++
+			options = append(options, args[i])
+		}
+	}
+
+	options = append(options, "--")
+	flag.CommandLine.Parse(append(options, nonOptions...))
+}
+
+// ParseCmdLineOptions() parses command-line options and returns
+// them conveniently packaged in a structure.
+
+func ParseCmdLineOptions() CmdLineOptions {
+
+	var opts CmdLineOptions
+
+	// An unknown option produces the usage message
+
+	flag.Usage = func() { ShowUsageAndExit(1) }
+
+	helpPtr := flag.Bool("help", false, "Show detailed usage message")
+	completionPtr := flag.String("generate-completion", "",
+		"Write a bash or zsh completion script")
+	quietPtr := flag.Bool("q", false, "Display only error messages")
+	flag.Var(LogLevelFlag{}, "v", "Display progress messages "+
+		"(repeat for debugging messages)")
+	jsonPtr := flag.Bool("json", false, "Display namespace tree as JSON")
+	csvPtr := flag.Bool("csv", false, "Display namespaces as CSV")
+	countPtr := flag.Bool("count", false, "Display only summary counts")
+	maxDepthPtr := flag.Int("max-depth", -1, "Display at most this "+
+		"many levels below the root")
+	dotPtr := flag.Bool("dot", false, "Display hierarchy in Graphviz "+
+		"DOT format")
+	noColorPtr := flag.Bool("no-color", false,
+		"Don't use color in output display")
+	noMapsPtr := flag.Bool("no-maps", false,
+		"Don't show UID and GID maps of each namespace")
+	memberUIDsPtr := flag.Bool("show-members-uids", false,
+		"Show effective UIDs of member processes")
+	ownedCountsPtr := flag.Bool("owned-counts", false,
+		"Show counts of nonuser namespaces owned by each namespace")
+	uidPtr := flag.String("uid", "", "Show only namespaces created "+
+		"by specified user (UID or user name)")
+	noPidsPtr := flag.Bool("no-pids", false,
+		"Don't show PIDs that are members of each namespace")
+	showCommPtr := flag.Bool("show-comm", false,
+		"Show command run by each PID")
+	showLeaderPtr := flag.Bool("show-leader", false,
+		"Show oldest member process of each namespace")
+	scanMountsPtr := flag.Bool("scan-mounts", false, "Discover "+
+		"namespaces pinned by bind mounts")
+	outputPtr := flag.String("output", "-", "Write output to file")
+	subtreePtr := flag.String("subtree", "", "Show only the subtree "+
+		"rooted at the user namespace of specified PID")
+	colorPtr := flag.String("color", "auto", "When to use color "+
+		"(\"auto\", \"always\", or \"never\")")
+	widthPtr := flag.Int("width", 0, "Wrap PID lists to this many columns")
+
+	ParseArgs()
+
+	if *helpPtr {
+		ShowUsageAndExit(0)
+	}
+
+	if *completionPtr != "" {
+		if *completionPtr != "bash" && *completionPtr != "zsh" {
+			Log(LOG_QUIET, "Bad value for --generate-completion "+
+				"option: "+*completionPtr)
+			ShowUsageAndExit(1)
+		}
+		GenerateCompletion(*completionPtr)
+		os.Exit(0)
+	}
+
+	if *quietPtr {
+		if logLevel != LOG_NORMAL {
+			Log(LOG_QUIET, "'-q' can't be combined with '-v'")
+			ShowUsageAndExit(1)
+		}
+		logLevel = LOG_QUIET
+	}
+
+	for _, pid := range flag.Args() {
+		if n, err := strconv.Atoi(pid); err != nil || n <= 0 {
+			Log(LOG_QUIET, "Bad PID: "+pid)
+			ShowUsageAndExit(1)
+		}
+	}
+
+	opts.pids = flag.Args()
+
+	if *subtreePtr != "" {
+		if len(opts.pids) > 0 {
+			Log(LOG_QUIET, "'--subtree' can't be combined with "+
+				"PID arguments")
+			ShowUsageAndExit(1)
+		}
+
+		n, err := strconv.Atoi(*subtreePtr)
+		if err != nil || n <= 0 {
+			Log(LOG_QUIET, "Bad PID: "+*subtreePtr)
+			ShowUsageAndExit(1)
+		}
+
+		opts.subtreePID = *subtreePtr
+	}
+
+	// Whether the output is a terminal is known only once it has been
+	// opened, so main() makes the final decision about color and
+	// wrapping.
+
+	if *colorPtr != "auto" && *noColorPtr {
+		Log(LOG_QUIET, "'--no-color' can't be combined with '--color'")
+		ShowUsageAndExit(1)
+	}
+
+	if *colorPtr != "auto" && *colorPtr != "always" &&
+		*colorPtr != "never" {
+		Log(LOG_QUIET, "Bad value for --color option: "+*colorPtr)
+		ShowUsageAndExit(1)
+	}
+
+	if *widthPtr < 0 {
+		Log(LOG_QUIET, "Bad value for --width option: "+
+			strconv.Itoa(*widthPtr))
+		ShowUsageAndExit(1)
+	}
+
+	opts.colorMode = *colorPtr
+	opts.useColor = *colorPtr != "never" && !*noColorPtr
+	opts.wrapWidth = *widthPtr
+	opts.outputFile = *outputPtr
+	opts.showMaps = !*noMapsPtr
+	opts.showPids = !*noPidsPtr
+	opts.showComm = *showCommPtr
+	opts.scanMounts = *scanMountsPtr
+	opts.showLeader = *showLeaderPtr
+	opts.json = *jsonPtr
+	opts.csv = *csvPtr
+	opts.count = *countPtr
+	opts.dot = *dotPtr
+	opts.maxDepth = *maxDepthPtr
+
+	if opts.maxDepth < -1 {
+		Log(LOG_QUIET, "Bad value for '--max-depth': "+
+			strconv.Itoa(opts.maxDepth))
+		ShowUsageAndExit(1)
+	}
+	opts.ownedCounts = *ownedCountsPtr
+	opts.memberUIDs = *memberUIDsPtr
+
+	opts.filterUID = -1
+	if *uidPtr != "" {
+		opts.filterUID = LookupUID(*uidPtr)
+	}
+
+	numFormats := 0
+	for _, f := range []bool{opts.json, opts.csv, opts.count, opts.dot} {
+		if f {
+			numFormats++
+		}
+	}
+	if numFormats > 1 {
+		Log(LOG_QUIET, "Only one of '--json', '--csv', '--count', "+
+			"and '--dot' can be specified")
+		ShowUsageAndExit(1)
+	}
+
+	// Color and one-per-line display don't apply to JSON, CSV,
+	// and DOT output
+
+	if opts.json || opts.csv || opts.dot {
+		opts.useColor = false
+		opts.showComm = false
+		opts.showLeader = false
+	}
+
+	if !opts.showPids && opts.showComm {
+		Log(LOG_QUIET, "'--no-pids' can't be combined with "+
+			"'--show-comm'")
+		ShowUsageAndExit(1)
+	}
+
+	return opts
+}
+
+// DisplayPIDsAsList() displays the PIDs in 'pids' as a list with
+// multiple PIDs per line. We do a bit of a dance here to produce a
+// list of PIDs that is suitably wrapped and indented, rather than a
+// long single-line list. (The color sequences occupy no space on
+// the terminal, and so are not counted in 'col'.) If 'opts.wrapWidth'
+// is 0, all of the PIDs are displayed on a single line; otherwise, a
+// line is ended before a PID (and its trailing space) that would take
+// it past that width, though each line has at least one PID.
+
+func DisplayPIDsAsList(indent string, pids []int, opts CmdLineOptions) {
+
+	base := len(indent) + len("            PIDs: ")
+	col := base
+	for i, p := range pids {
+		pidWidth := len(strconv.Itoa(p)) + 1
+		if i == 0 || opts.wrapWidth > 0 && col > base &&
+			col+pidWidth > opts.wrapWidth {
+			col = base
+			if i > 0 {
+				if opts.useColor {
+					fmt.Fprint(output, NORMAL)
+				}
+				fmt.Fprintln(output)
+			}
+			fmt.Fprint(output, indent)
+			fmt.Fprint(output, "            ")
+			if opts.useColor {
+				fmt.Fprint(output, PID_COLOR)
+			}
+			if i == 0 {
+				fmt.Fprint(output, "PIDs: ")
+			} else {
+				fmt.Fprint(output, "      ")
+			}
+		}
+		fmt.Fprint(output, strconv.Itoa(p)+" ")
+		col += pidWidth
+	}
+	if opts.useColor && len(pids) > 0 {
+		fmt.Fprint(output, NORMAL)
+	}
+	fmt.Fprintln(output)
+}
+
+// DisplayPIDsOnePerLine() displays the PIDs in 'pids' one per line,
+// each followed by the name of the command being run by the process.
+
+func DisplayPIDsOnePerLine(indent string, pids []int,
+	opts CmdLineOptions) {
+
+	for _, pid := range pids {
+		fmt.Fprint(output, indent+"            ")
+
+		if opts.useColor {
+			fmt.Fprint(output, PID_COLOR)
+		}
+		fmt.Fprintf(output, "%-5d", pid)
+		if opts.useColor {
+			fmt.Fprint(output, NORMAL)
+		}
+
+		// Print the command being run by the process. Probably,
+		// if we can't read /proc/PID/comm, the process terminated
+		// after we scanned /proc.
+
+		buf, err := procReader.ReadFile(strconv.Itoa(pid), "comm")
+		if err != nil {
+			fmt.Fprintln(output, "  [can't open "+procDir+"/"+
+				strconv.Itoa(pid)+"/comm]")
+		} else {
+			comm := strings.TrimSuffix(string(buf), "\n")
+			fmt.Fprintln(output, "  "+EscapeName(comm))
+		}
+	}
+}
+
+// ReadStartTime() returns the start time (in clock ticks since boot)
+// and the command name of the process 'pid', as recorded in
+// /proc/PID/stat. The returned boolean is false if the file could
+// not be read or parsed (probably because the process has exited).
+
+func ReadStartTime(pid int) (uint64, string, bool) {
+
+	buf, err := procReader.ReadFile(strconv.Itoa(pid), "stat")
+	if err != nil {
+		return 0, "", false
+	}
+
+	// The command name is enclosed in parentheses, and may itself
+	// contain spaces and parentheses, so locate the fields that
+	// follow it by searching for the last ')'. The first field after
+	// the command name is field 3 (state); the start time is field 22.
+
+	stat := string(buf)
+	lparen := strings.Index(stat, "(")
+	rparen := strings.LastIndex(stat, ")")
+	if lparen < 0 || rparen < lparen {
+		return 0, "", false
+	}
+
+	fields := strings.Fields(stat[rparen+1:])
+	if len(fields) < 20 {
+		return 0, "", false
+	}
+
+	startTime, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+
+	return startTime, EscapeName(stat[lparen+1 : rparen]), true
+}
+
+// EscapeName() returns a copy of 'name' (a command name) in which control
+// characters are replaced by C-style escapes, so that they can't disturb
+// the layout of the output or the terminal.
+
+func EscapeName(name string) string {
+	var b strings.Builder
+
+	for _, r := range name {
+		switch {
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case unicode.IsControl(r):
+			fmt.Fprintf(&b, `\x%02x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+// LeaderString() returns a string describing the member of the
+// namespace 'nsid' that has the earliest start time. If two
+// processes have the same start time, the one with the lower PID is
+// chosen.
+
+func LeaderString(nsid NamespaceID) string {
+
+	if len(NSList[nsid].pids) == 0 {
+		return "(no direct members)"
+	}
+
+	found := false
+	var leaderPID int
+	var leaderStart uint64
+	var leaderComm string
+
+	for _, pid := range NSList[nsid].pids {
+		startTime, comm, ok := ReadStartTime(pid)
+		if !ok {
+			continue
+		}
+
+		if !found || startTime < leaderStart ||
+			(startTime == leaderStart && pid < leaderPID) {
+			found = true
+			leaderPID = pid
+			leaderStart = startTime
+			leaderComm = comm
+		}
+	}
+
+	if !found {
+		return "(members exited during scan)"
+	}
+
+	return "leader: " + strconv.Itoa(leaderPID) + " (" + leaderComm + ")"
+}
+
+// DisplayNamespaceTree() recursively displays the namespace
+// tree rooted at 'nsid'. 'level' is our current level in the
+// tree, and is used for producing suitably indented output.
+
+func DisplayNamespaceTree(nsid NamespaceID, level int, opts CmdLineOptions) {
+
+	display := NSList[nsid].display
+	if display == DISPLAY_NONE {
+		return
+	}
+
+	indent := strings.Repeat(" ", level*4)
+
+	// Display the namespace ID (device ID + inode number).
+	// Namespaces that are displayed only to provide context
+	// for the namespaces selected by "--uid" are dimmed.
+
+	fmt.Fprint(output, indent)
+	if opts.useColor {
+		if display == DISPLAY_CONTEXT {
+			fmt.Fprint(output, CONTEXT_COLOR)
+		} else {
+			fmt.Fprint(output, USERNS_COLOR)
+		}
+	}
+	fmt.Fprint(output, nsid)
+
+	// Mark the namespaces that were created by the "--uid" user, so
+	// that they can be distinguished even without color
+
+	if opts.filterUID >= 0 && NSList[nsid].creatorUID == opts.filterUID {
+		fmt.Fprint(output, "*")
+	}
+
+	// In flat mode, the creator UID and the relationships
+	// between namespaces are unknown
+
+	if !flatMode {
+
+		// Display the UID of the namespace creator
+
+		fmt.Fprint(output, "  <UID: ",
+			CreatorString(NSList[nsid].creatorUID), ">")
+
+		// Display the nesting level
+
+		fmt.Fprint(output, "  level ", NSList[nsid].level)
+		if nsid == initialNS && nsid.inode_num != PROC_USER_INIT_INO {
+			fmt.Fprint(output,
+				", topmost visible (ancestors hidden)")
+		} else if nsid == displayRoot && nsid != initialNS {
+			fmt.Fprint(output,
+				", subtree root (ancestors not shown)")
+		}
+
+		// Display the number of child and descendant namespaces
+
+		fmt.Fprint(output, "  (children: ", len(NSList[nsid].children),
+			", descendants: ", NSList[nsid].descendants, ")")
+	}
+
+	// Display the UID and GID maps, and the setgroups state
+
+	if opts.showMaps {
+		fmt.Fprint(output, "  u: "+NSList[nsid].uidMap+";  g: "+
+			NSList[nsid].gidMap+";  sg: "+NSList[nsid].setgroups)
+	}
+
+	// Display the counts of owned nonuser namespaces
+
+	if opts.ownedCounts {
+		fmt.Fprint(output, "  owns: "+OwnedCountsString(nsid))
+	}
+
+	// Display the effective UIDs of the member processes
+
+	if opts.memberUIDs {
+		fmt.Fprint(output, "  member UIDs: "+MemberUIDsString(nsid))
+	}
+
+	// Display the oldest member process
+
+	if opts.showLeader {
+		fmt.Fprint(output, "  "+LeaderString(nsid))
+	}
+
+	// If the namespace is pinned by bind mounts, say so
+
+	if len(NSList[nsid].pinnedBy) > 0 {
+		fmt.Fprint(output, "  (pinned by "+
+			strings.Join(NSList[nsid].pinnedBy, ", "))
+		if len(NSList[nsid].pids) == 0 {
+			fmt.Fprint(output, ", no member processes")
+		}
+		fmt.Fprint(output, ")")
+	}
+	if opts.useColor {
+		fmt.Fprint(output, NORMAL)
+	}
+
+	// Flag namespaces that have no superuser
+
+	if opts.showMaps {
+		if warning := RootMappingString(nsid); warning != "" {
+			fmt.Fprint(output, "  ")
+			if opts.useColor {
+				fmt.Fprint(output, WARNING_COLOR)
+			}
+			fmt.Fprint(output, warning)
+			if opts.useColor {
+				fmt.Fprint(output, NORMAL)
+			}
+		}
+	}
+
+	// If this is the namespace that this program is in, say so
+
+	if nsid == currentNS {
+		if opts.useColor {
+			fmt.Fprint(output, CURRENT_NS_COLOR)
+		}
+		fmt.Fprint(output, " <-- current")
+		if opts.useColor {
+			fmt.Fprint(output, NORMAL)
+		}
+	}
+	fmt.Fprintln(output)
+
+	// Print a sorted list of the PIDs that are members of this
+	// namespace
+
+	sort.Ints(NSList[nsid].pids)
+
+	if !opts.showPids || display == DISPLAY_CONTEXT {
+		// Don't display PIDs
+	} else if opts.showComm {
+		DisplayPIDsOnePerLine(indent, NSList[nsid].pids, opts)
+	} else {
+		DisplayPIDsAsList(indent, NSList[nsid].pids, opts)
+	}
+
+	// If we have reached the maximum display depth, summarize the
+	// descendants rather than displaying them
+
+	if opts.maxDepth >= 0 && level >= opts.maxDepth {
+		if NSList[nsid].descendants > 0 {
+			fmt.Fprintln(output, indent+"    … "+
+				strconv.Itoa(NSList[nsid].descendants)+
+				" more namespaces, "+
+				strconv.Itoa(NSList[nsid].descendantPids)+
+				" processes")
+		}
+		return
+	}
+
+	// Recursively display the child namespaces
+
+	for _, v := range SortedChildren(nsid) {
+		DisplayNamespaceTree(v, level+1, opts)
+	}
+}
+
+// The 'NamespaceJSON' structure is used to produce the JSON
+// representation of a namespace and (recursively) its descendants
+
+type NamespaceJSON struct {
+	Device   uint64           `json:"device"`
+	Inode    uint64           `json:"inode"`
+	Level    int              `json:"level"`
+	NumDesc  int              `json:"descendants"`
+	Creator  int              `json:"creator_uid"`
+	UidMap   *string          `json:"uid_map,omitempty"`
+	GidMap   *string          `json:"gid_map,omitempty"`
+	SetGrps  *string          `json:"setgroups,omitempty"`
+	Owns     map[string]int   `json:"owns,omitempty"`
+	MemUIDs  map[int]int      `json:"member_uids,omitempty"`
+	PIDs     []int            `json:"pids,omitempty"`
+	Context  bool             `json:"context,omitempty"`
+	Children []*NamespaceJSON `json:"children"`
+}
+
+// SortNamespaceIDs() sorts 'nsids' by device ID and inode number
+
+func SortNamespaceIDs(nsids []NamespaceID) {
+
+	sort.Slice(nsids, func(i, j int) bool {
+		if nsids[i].device != nsids[j].device {
+			return nsids[i].device < nsids[j].device
+		}
+		return nsids[i].inode_num < nsids[j].inode_num
+	})
+}
+
+// SortedChildren() returns the children of the namespace 'nsid',
+// sorted by device ID and inode number, so that the output is stable
+// from one run to the next.
+
+func SortedChildren(nsid NamespaceID) []NamespaceID {
+
+	children := append([]NamespaceID(nil), NSList[nsid].children...)
+	SortNamespaceIDs(children)
+
+	return children
+}
+
+// BuildNamespaceJSON() returns the JSON representation of the
+// namespace tree rooted at 'nsid'. Child namespaces are ordered by
+// device ID and inode number, so that the output is deterministic.
+
+func BuildNamespaceJSON(nsid NamespaceID, opts CmdLineOptions) *NamespaceJSON {
+
+	ns := NSList[nsid]
+
+	nj := &NamespaceJSON{Device: nsid.device, Inode: nsid.inode_num,
+		Level: ns.level, NumDesc: ns.descendants,
+		Creator:  ns.creatorUID,
+		Children: []*NamespaceJSON{},
+		Context:  ns.display == DISPLAY_CONTEXT}
+
+	if opts.showMaps {
+		nj.UidMap = &ns.uidMap
+		nj.GidMap = &ns.gidMap
+		nj.SetGrps = &ns.setgroups
+	}
+
+	if opts.ownedCounts {
+		nj.Owns = ns.owned
+	}
+
+	if opts.memberUIDs {
+		nj.MemUIDs = ns.memberUIDs
+	}
+
+	if opts.showPids {
+		sort.Ints(ns.pids)
+		nj.PIDs = ns.pids
+	}
+
+	for _, child := range SortedChildren(nsid) {
+		if NSList[child].display != DISPLAY_NONE {
+			nj.Children = append(nj.Children,
+				BuildNamespaceJSON(child, opts))
+		}
+	}
+
+	return nj
+}
+
+// DisplayNamespacesJSON() displays the namespace tree rooted at
+// the initial user namespace as a JSON document.
+
+func DisplayNamespacesJSON(opts CmdLineOptions) {
+
+	buf, err := json.MarshalIndent(BuildNamespaceJSON(displayRoot, opts),
+		"", "    ")
+	if err != nil {
+		Log(LOG_QUIET, "json.MarshalIndent():", err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintln(output, string(buf))
+}
+
+// UnescapeMountPath() converts the octal escapes (e.g., "\040" for a
+// space) that are used for special characters in the pathnames shown
+// in /proc/PID/mountinfo back into the characters that they represent.
+
+func UnescapeMountPath(path string) string {
+
+	var result []byte
+
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+4 <= len(path) {
+			c, err := strconv.ParseUint(path[i+1:i+4], 8, 8)
+			if err == nil {
+				result = append(result, byte(c))
+				i += 3
+				continue
+			}
+		}
+		result = append(result, path[i])
+	}
+
+	return string(result)
+}
+
+// AddPinnedNamespaces() scans /proc/self/mountinfo for nsfs mounts, and
+// adds each user namespace that is bind mounted in this way to the
+// 'NSList' map (along with its ancestors), recording the mount point
+// as pinning the namespace. Mounts of other types of namespace are
+// silently ignored; mount points that can't be opened are reported
+// (once), but are otherwise ignored.
+
+func AddPinnedNamespaces() {
+
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		Log(LOG_QUIET, "os.Open(/proc/self/mountinfo):", err)
+		os.Exit(1)
+	}
+
+	defer file.Close()
+
+	reported := make(map[string]bool)
+
+	// Each line of mountinfo has the form:
+	//
+	//   ID PARENT-ID MAJ:MIN ROOT MOUNT-POINT OPTIONS [TAGS...] - FSTYPE ...
+	//
+	// See proc(5).
+
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+
+		sep := 6
+		for sep < len(fields) && fields[sep] != "-" {
+			sep++
+		}
+
+		if len(fields) < 5 || sep+1 >= len(fields) ||
+			fields[sep+1] != "nsfs" {
+			continue
+		}
+
+		mountPoint := UnescapeMountPath(fields[4])
+
+		namespaceFD, err := syscall.Open(mountPoint,
+			syscall.O_RDONLY, 0)
+		if err != nil {
+			if !reported[mountPoint] {
+				Log(LOG_NORMAL, "Can't open pinned namespace "+
+					mountPoint+": "+err.Error())
+				reported[mountPoint] = true
+			}
+			continue
+		}
+
+		nsType, _ := NSIoctl(namespaceFD, NS_GET_NSTYPE)
+
+		if nsType == CLONE_NEWUSER {
+			nsid := AddNamespace(namespaceFD, -1)
+			NSList[nsid].pinnedBy =
+				append(NSList[nsid].pinnedBy, mountPoint)
+		}
+
+		syscall.Close(namespaceFD)
+	}
+}
+
+// FindCurrentNamespace() records the ID of the user namespace of which
+// this program is a member in 'currentNS'.
+
+func FindCurrentNamespace() {
+
+	nsid, err := procReader.StatNS("self", "user", &nsStat)
+	if err != nil {
+		Log(LOG_QUIET, "syscall.Stat("+procDir+"/self/ns/user):", err)
+		os.Exit(1)
+	}
+
+	currentNS = nsid
+}
+
+// SubtreeRoot() returns the ID of the user namespace of the process
+// whose /proc/PID directory is named 'name'. Any error is fatal.
+
+func SubtreeRoot(name string) NamespaceID {
+
+	namespaceFD, err := procReader.OpenNS(name, "user")
+	if err != nil {
+		if err == syscall.ENOENT {
+			Log(LOG_QUIET, "No such process: PID "+name)
+		} else {
+			Log(LOG_QUIET, "Can't inspect PID "+name+":", err)
+		}
+		os.Exit(1)
+	}
+
+	// The scan of /proc has normally already created an entry for
+	// this namespace, but the process may have been created after
+	// the scan; AddNamespace() ensures that the entry exists.
+
+	nsid := AddNamespace(namespaceFD, -1)
+
+	procReader.Close(namespaceFD)
+
+	return nsid
+}
+
+// WriteNamespaceCSV() writes a CSV record for the namespace 'nsid' and
+// then (recursively) for each of its descendants, so that parents
+// precede their children.
+
+func WriteNamespaceCSV(w *csv.Writer, nsid NamespaceID) {
+
+	ns := NSList[nsid]
+
+	parentDev, parentIno := "", ""
+	if ns.hasParent {
+		parentDev = strconv.FormatUint(ns.parent.device, 10)
+		parentIno = strconv.FormatUint(ns.parent.inode_num, 10)
+	}
+
+	sort.Ints(ns.pids)
+
+	var pids []string
+	for _, pid := range ns.pids {
+		pids = append(pids, strconv.Itoa(pid))
+	}
+
+	// With "--uid", the namespaces that would be displayed only as
+	// context are omitted
+
+	if ns.display == DISPLAY_FULL {
+		w.Write([]string{
+			strconv.FormatUint(nsid.device, 10),
+			strconv.FormatUint(nsid.inode_num, 10),
+			parentDev, parentIno,
+			strconv.Itoa(ns.level),
+			strconv.Itoa(ns.creatorUID),
+			strconv.Itoa(len(ns.pids)),
+			strings.Join(pids, ";")})
+	}
+
+	for _, child := range SortedChildren(nsid) {
+		if NSList[child].display != DISPLAY_NONE {
+			WriteNamespaceCSV(w, child)
+		}
+	}
+}
+
+// DisplayNamespacesCSV() displays the namespaces as CSV, with a
+// header record. If 'withRecords' is false, only the header is
+// displayed.
+
+func DisplayNamespacesCSV(withRecords bool) {
+
+	w := csv.NewWriter(output)
+
+	w.Write([]string{"device", "inode", "parent_device",
+		"parent_inode", "level", "creator_uid", "member_pid_count",
+		"member_pids"})
+
+	if withRecords {
+		WriteNamespaceCSV(w, displayRoot)
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		Log(LOG_QUIET, "csv.Writer:", err)
+		os.Exit(1)
+	}
+}
+
+// The 'ProcStatus' structure records the fields that we need from
+// a /proc/PID/status file
+
+type ProcStatus struct {
+	euid int // Effective UID
+}
+
+// ReadProcStatus() reads the /proc/PID/status file of the process
+// whose /proc/PID directory is named 'name', extracting all of the
+// fields recorded in 'ProcStatus' in a single pass over the file.
+// The returned boolean is false if the file could not be read (for
+// example, because the process has terminated).
+
+func ReadProcStatus(name string) (ProcStatus, bool) {
+
+	var status ProcStatus
+
+	buf, err := procReader.ReadFile(name, "status")
+	if err != nil {
+		return status, false
+	}
+
+	foundUid := false
+
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "Uid:":
+
+			// The fields are the real, effective, saved set,
+			// and filesystem UIDs
+
+			if len(fields) < 3 {
+				return status, false
+			}
+			status.euid, err = strconv.Atoi(fields[2])
+			if err != nil {
+				return status, false
+			}
+			foundUid = true
+		}
+	}
+
+	return status, foundUid
+}
+
+// MemberUIDsString() returns a string summarizing the effective UIDs
+// of the member processes of the namespace 'nsid', in the form
+// "0 (12 procs), 1000 (3 procs)".
+
+func MemberUIDsString(nsid NamespaceID) string {
+
+	memberUIDs := NSList[nsid].memberUIDs
+
+	var uids []int
+	for uid := range memberUIDs {
+		uids = append(uids, uid)
+	}
+	sort.Ints(uids)
+
+	var list []string
+	for _, uid := range uids {
+		list = append(list, strconv.Itoa(uid)+" ("+
+			strconv.Itoa(memberUIDs[uid])+" procs)")
+	}
+
+	if len(list) == 0 {
+		return "none"
+	}
+
+	return strings.Join(list, ", ")
+}
+
+// ProcessProcess() gathers the information about the process whose
+// /proc/PID directory is named 'name'. See ProcessProcFile() for
+// an explanation of 'isCmdLineArg'.
+
+func ProcessProcess(name string, isCmdLineArg bool, opts CmdLineOptions) {
+
+	nsid, err := StatUserNS(name, &nsStat)
+	RecordProcess(name, nsid, err, isCmdLineArg, opts)
+}
+
+// RecordProcess() adds the process whose /proc/PID directory is named
+// 'name' to 'NSList', given the result ('nsid' and 'statErr') of
+// StatUserNS() for the process. Since this function updates 'NSList',
+// it must be called only from the main goroutine.
+
+func RecordProcess(name string, nsid NamespaceID, statErr error,
+	isCmdLineArg bool, opts CmdLineOptions) {
+
+	nsid, ok := ProcessProcFile(name, nsid, statErr, isCmdLineArg)
+	if !ok {
+		return
+	}
+
+	// Record the effective UID of the process. If the process has
+	// already terminated, just skip it.
+
+	if opts.memberUIDs {
+		if status, ok := ReadProcStatus(name); ok {
+			ns := NSList[nsid]
+			if ns.memberUIDs == nil {
+				ns.memberUIDs = make(map[int]int)
+			}
+			ns.memberUIDs[status.euid]++
+		}
+	}
+
+	if opts.ownedCounts && !flatMode {
+		CountOwnedNamespaces(name)
+	}
+}
+
+// ForEachPIDDir() calls 'fn' with the name of each PID directory under 'dir'.
+// The directory is read in batches, rather than being read (and sorted) in
+// its entirety before the first PID is processed, since on a large system
+// it may contain very many entries. The PIDs are thus processed in the order
+// in which the kernel returns them. If 'fn' returns false, no further PIDs
+// are processed.
+
+func ForEachPIDDir(dir string, fn func(name string) bool) error {
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	defer d.Close()
+
+	for {
+		names, err := d.Readdirnames(512)
+
+		for _, name := range names {
+			if name[0] >= '1' && name[0] <= '9' {
+				if !fn(name) {
+					return nil
+				}
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ScanProcesses() records each of the processes listed by 'procReader'
+// in 'NSList', and returns the number of processes that were inspected.
+// If 'ctx' is canceled, the scan stops early.
+//
+// The directory is read in batches. When 'scanWorkers' is greater than
+// 1, the namespace files of each batch are stat()ed by a pool of
+// goroutines, after which the main goroutine, which alone updates
+// 'NSList', records the processes in the order in which they were read
+// from the directory. Since it is only for a process in a namespace
+// not yet seen that any further work (opening the namespace file and
+// performing ioctl() operations) is needed, this spreads most of the
+// work of the scan across the workers, while giving the same results
+// as the sequential scan.
+
+func ScanProcesses(ctx context.Context, opts CmdLineOptions) (int, error) {
+
+	numScanned := 0
+
+	if scanWorkers <= 1 {
+		err := procReader.ListProcesses(func(name string) bool {
+			if ctx.Err() != nil {
+				return false
+			}
+
+			ProcessProcess(name, false, opts)
+			numScanned++
+
+			return true
+		})
+
+		return numScanned, err
+	}
+
+	var batch []string
+	ids := make([]NamespaceID, scanBatchSize)
+	errs := make([]error, scanBatchSize)
+
+	processBatch := func() bool {
+		StatUserNSBatch(batch, ids, errs)
+
+		for i, name := range batch {
+			if ctx.Err() != nil {
+				return false
+			}
+
+			RecordProcess(name, ids[i], errs[i], false, opts)
+			numScanned++
+		}
+
+		batch = batch[:0]
+		return true
+	}
+
+	err := procReader.ListProcesses(func(name string) bool {
+		batch = append(batch, name)
+		if len(batch) < scanBatchSize {
+			return true
+		}
+
+		return processBatch()
+	})
+	if err == nil && len(batch) > 0 {
+		processBatch()
+	}
+
+	return numScanned, err
+}
+
+// StatUserNSBatch() calls StatUserNS() for each of the processes in
+// 'names', sharing the calls among 'scanWorkers' goroutines. The
+// results for 'names[i]' are placed in 'ids[i]' and 'errs[i]'.
+
+func StatUserNSBatch(names []string, ids []NamespaceID, errs []error) {
+
+	next := int32(-1)
+
+	var wg sync.WaitGroup
+
+	for w := 0; w < scanWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var sb syscall.Stat_t
+
+			for {
+				i := int(atomic.AddInt32(&next, 1))
+				if i >= len(names) {
+					return
+				}
+
+				ids[i], errs[i] = StatUserNS(names[i], &sb)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// ScanNamespaces() scans all of the /proc/PID entries (or just
+// those for the PIDs specified on the command line), building the
+// 'NSList' map of namespaces and their member processes. If 'ctx' is
+// canceled, the scan stops early, leaving the entries built so far.
+
+func ScanNamespaces(ctx context.Context, opts CmdLineOptions) {
+
+	// If PIDs were specified on the command line, process just
+	// those PIDs
+
+	if len(opts.pids) > 0 {
+		for _, name := range opts.pids {
+			ProcessProcess(name, true, opts)
+		}
+	} else {
+
+		// Process each /proc/PID
+
+		numScanned, err := ScanProcesses(ctx, opts)
+		if err != nil {
+			Log(LOG_QUIET, "Scanning "+procDir+":", err)
+			os.Exit(1)
+		}
+
+		Log(LOG_VERBOSE, "Scanned "+strconv.Itoa(numScanned)+
+			" processes ("+strconv.Itoa(numUnreadable)+
+			" unreadable); found "+strconv.Itoa(len(NSList))+
+			" user namespaces")
+	}
+
+	// Optionally, add the user namespaces that are pinned by bind
+	// mounts
+
+	if opts.scanMounts && ctx.Err() == nil {
+		AddPinnedNamespaces()
+	}
+
+	// Determine the root of the tree that is to be displayed
+
+	displayRoot = initialNS
+	if opts.subtreePID != "" {
+		displayRoot = SubtreeRoot(opts.subtreePID)
+	}
+
+	CountDescendants()
+
+	// Discover the UID and GID maps and setgroups state of each
+	// namespace
+
+	if opts.showMaps {
+		AddUidGidMaps()
+	}
+}
+
+// DisplayNamespaces() displays the namespace tree rooted at the
+// initial user namespace.
+
+func DisplayNamespaces(opts CmdLineOptions) {
+
+	DisplayNamespaceTree(displayRoot, 0, opts)
+
+	// Warn about sibling namespaces with overlapping ID mappings
+
+	if opts.showMaps {
+		overlaps := SiblingMapOverlaps()
+		if len(overlaps) > 0 {
+			fmt.Fprintln(output)
+			fmt.Fprintln(output, "WARNING: sibling namespaces "+
+				"with overlapping ID mappings:")
+			for _, o := range overlaps {
+				fmt.Fprintln(output, "    "+o)
+			}
+		}
+	}
+
+	fmt.Fprintln(output)
+	fmt.Fprintln(output, "maximum nesting level: "+strconv.Itoa(maxLevel)+
+		" (the kernel limit is 32)")
+}
+
+// DisplayFlatNamespaces() displays each of the namespaces in 'NSList'
+// along with its member processes, without any hierarchy. This is
+// used when the kernel doesn't support the namespace ioctl()
+// operations.
+
+func DisplayFlatNamespaces(opts CmdLineOptions) {
+
+	fmt.Fprintln(output, "This kernel doesn't support namespace "+
+		"ioctl() operations, so the")
+	fmt.Fprintln(output, "parent/child relationships of the user "+
+		"namespaces can't be determined.")
+	fmt.Fprintln(output)
+
+	var nsids []NamespaceID
+	for nsid := range NSList {
+		nsids = append(nsids, nsid)
+	}
+	SortNamespaceIDs(nsids)
+
+	for _, nsid := range nsids {
+		DisplayNamespaceTree(nsid, 0, opts)
+	}
+}
+
+// WarnUnreadable() reports the number of processes that were skipped
+// because their /proc/PID/ns/user files could not be read. The warning
+// is logged (to stderr), rather than being displayed with the output,
+// so that it doesn't corrupt the JSON, CSV, or DOT output, and so that
+// it isn't lost in any output mode.
+
+func WarnUnreadable() {
+
+	if numUnreadable > 0 {
+		Log(LOG_NORMAL, "skipped "+strconv.Itoa(numUnreadable)+
+			" unreadable processes (run as root for "+
+			"complete output)")
+	}
+}
+
+// DisplayNamespaceDot() displays the namespace tree rooted at 'root' as
+// a Graphviz DOT digraph. Each namespace is a node labeled with its ID,
+// its creator UID, and its number of member processes, and there is an
+// edge from each parent namespace to each of its children.
+
+func DisplayNamespaceDot(root NamespaceID) {
+
+	fmt.Fprintln(output, "digraph user_namespaces {")
+	fmt.Fprintln(output, "    node [shape=box];")
+
+	DisplayNamespaceDotNodes(root)
+
+	fmt.Fprintln(output, "}")
+}
+
+// DisplayNamespaceDotNodes() recursively displays the DOT node and edge
+// statements for the namespace tree rooted at 'nsid'.
+
+func DisplayNamespaceDotNodes(nsid NamespaceID) {
+
+	ns := NSList[nsid]
+
+	label := nsid.SymlinkString() + "\\nUID: " +
+		CreatorString(ns.creatorUID) + "\\n" +
+		strconv.Itoa(len(ns.pids)) + " procs"
+
+	// The initial user namespace is drawn with a double border
+
+	attrs := ""
+	if nsid == initialNS {
+		attrs = ", peripheries=2"
+	}
+
+	fmt.Fprintf(output, "    %s [label=\"%s\"%s];\n", DotNodeName(nsid),
+		label, attrs)
+
+	children := SortedChildren(nsid)
+
+	for _, child := range children {
+		fmt.Fprintf(output, "    %s -> %s;\n", DotNodeName(nsid),
+			DotNodeName(child))
+	}
+
+	for _, child := range children {
+		DisplayNamespaceDotNodes(child)
+	}
+}
+
+// DotNodeName() returns the name used for the namespace 'nsid' in DOT
+// output.
+
+func DotNodeName(nsid NamespaceID) string {
+	return "ns_" + strconv.FormatUint(nsid.device, 10) + "_" +
+		strconv.FormatUint(nsid.inode_num, 10)
+}
+
+// CreatorString() returns the creator UID 'uid' as a string, or "unknown"
+// if the kernel couldn't tell us the creator (see 'creatorsUnknown').
+
+func CreatorString(uid int) string {
+
+	if uid < 0 {
+		return "unknown"
+	}
+
+	return strconv.Itoa(uid)
+}
+
+// DisplayCounts() displays summary counts for the namespaces in
+// 'NSList': the number of namespaces, the maximum nesting level, the
+// number of namespaces created by each UID (in descending order of
+// count), and the total number of member processes.
+
+func DisplayCounts() {
+
+	creators := make(map[int]int)
+	numPids := 0
+
+	for _, ns := range NSList {
+		creators[ns.creatorUID]++
+		numPids += len(ns.pids)
+	}
+
+	var uids []int
+	for uid := range creators {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool {
+		if creators[uids[i]] != creators[uids[j]] {
+			return creators[uids[i]] > creators[uids[j]]
+		}
+		return uids[i] < uids[j]
+	})
+
+	fmt.Fprintln(output, "user namespaces: "+strconv.Itoa(len(NSList)))
+	fmt.Fprintln(output, "maximum nesting level: "+strconv.Itoa(maxLevel))
+	fmt.Fprintln(output, "namespaces per creator UID:")
+	for _, uid := range uids {
+		fmt.Fprintln(output, "    "+CreatorString(uid)+": "+
+			strconv.Itoa(creators[uid]))
+	}
+	fmt.Fprintln(output, "member processes: "+strconv.Itoa(numPids))
+}
+
+// OpenOutput() opens the file named 'fileName' for the program's
+// output ("-" means standard output). Any error is fatal.
+
+func OpenOutput(fileName string) *os.File {
+
+	if fileName == "-" {
+		return os.Stdout
+	}
+
+	file, err := os.Create(fileName)
+	if err != nil {
+		Log(LOG_QUIET, "Can't open output file "+fileName+": "+
+			err.Error())
+		os.Exit(1)
+	}
+
+	return file
+}
+
+// CloseOutput() flushes the buffered output in 'w' to 'file' (which
+// was opened using the name 'fileName'), and closes 'file' if it is
+// not standard output. Any error is fatal, except EPIPE (the reader
+// of our output went away), which is treated as a successful exit.
+
+func CloseOutput(w *LineWriter, file *os.File, fileName string) {
+
+	err := w.Flush()
+	if err == nil && file != os.Stdout {
+		err = file.Close()
+	}
+
+	if errors.Is(err, syscall.EPIPE) {
+		os.Exit(0)
+	}
+
+	if err != nil {
+		if fileName == "-" {
+			fileName = "standard output"
+		}
+		Log(LOG_QUIET, "Error writing "+fileName+": "+err.Error())
+		os.Exit(1)
+	}
+}
+
+// DisplayOutput() displays the namespaces in the format selected by
+// 'opts', and returns the program's exit status.
+
+func DisplayOutput(opts CmdLineOptions) int {
+
+	if flatMode && len(NSList) > 0 {
+		if opts.json || opts.csv || opts.count || opts.dot ||
+			opts.ownedCounts || opts.filterUID >= 0 ||
+			opts.subtreePID != "" {
+			Log(LOG_QUIET, "The '--json', '--csv', '--count', "+
+				"'--dot', '--owned-counts', '--subtree', "+
+				"and '--uid' options require namespace "+
+				"ioctl() operations, which this kernel "+
+				"doesn't support")
+			return 1
+		}
+
+		DisplayFlatNamespaces(opts)
+		return 0
+	}
+
+	// If we could not read any /proc/PID entry, we have no
+	// namespace tree to display
+
+	if len(NSList) == 0 || !initialNSFound {
+		if opts.json {
+			fmt.Fprintln(output, "{}")
+			return 1
+		}
+		if opts.csv {
+			DisplayNamespacesCSV(false)
+			return 1
+		}
+
+		Log(LOG_QUIET, "Could not discover any user namespaces: "+
+			"no /proc/PID/ns/user file could be read")
+		return 1
+	}
+
+	// If filtering by creator UID, select the namespaces to be
+	// displayed, always showing at least the root of the tree for
+	// context
+
+	if opts.filterUID >= 0 && creatorsUnknown {
+		Log(LOG_QUIET, "The '--uid' option requires the "+
+			"NS_GET_OWNER_UID ioctl() operation, which this "+
+			"kernel doesn't support")
+		return 1
+	}
+
+	if opts.filterUID >= 0 {
+		if !FilterNamespaces(displayRoot, false, opts.filterUID) {
+			NSList[displayRoot].display = DISPLAY_CONTEXT
+		}
+	}
+
+	if opts.json {
+		DisplayNamespacesJSON(opts)
+	} else if opts.csv {
+		DisplayNamespacesCSV(true)
+	} else if opts.count {
+		DisplayCounts()
+	} else if opts.dot {
+		DisplayNamespaceDot(displayRoot)
+	} else {
+		DisplayNamespaces(opts)
+	}
+
+	return 0
+}
+
+func main() {
+
+	opts := ParseCmdLineOptions()
+
+	// Unless overridden by "--color" or "--width", decorations are used
+	// only if the output is a terminal
+
+	file := OpenOutput(opts.outputFile)
+	if !IsTerminal(int(file.Fd())) {
+		if opts.colorMode == "auto" {
+			opts.useColor = false
+		}
+	} else if opts.wrapWidth == 0 {
+		opts.wrapWidth = 80
+	}
+
+	w := &LineWriter{out: file}
+	output = w
+
+	HandleSignals(opts.useColor, w)
+
+	FindCurrentNamespace()
+
+	ctx := StartScan()
+	defer cancelScan()
+
+	ScanNamespaces(ctx, opts)
+
+	interrupted := EndScan(ctx)
+	if interrupted {
+		Log(LOG_QUIET, "Scan interrupted: displaying partial results")
+	}
+
+	status := DisplayOutput(opts)
+	if interrupted && status == 0 {
+		status = EXIT_INTERRUPTED
+	}
+
+	CloseOutput(w, file, opts.outputFile)
+
+	WarnUnreadable()
 
-	DisplayNamespaceTree(initialNS, 0)
+	os.Exit(status)
 }
@@ -0,0 +1,237 @@
+//go:build integration
+
+package main
+
+// Integration tests, which run the built program against user namespaces
+// that the tests create. They need root privilege (and are skipped without
+// it), so they are built only with the "integration" tag:
+//
+//	go test -tags integration userns_overview.go userns_overview_test.go \
+//		userns_overview_integration_test.go
+//
+// Each namespace is kept alive only by a child process that is killed when
+// the test ends, so nothing is left behind even if a test fails.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// requirePrivilege() skips the test unless it is run by root.
+
+func requirePrivilege(t *testing.T) {
+
+	if os.Geteuid() != 0 {
+		t.Skip("integration tests need root privilege")
+	}
+}
+
+// buildProgram() builds the program 'src' into a temporary directory, and
+// returns the pathname of the executable.
+
+func buildProgram(t *testing.T, src string) string {
+
+	bin := filepath.Join(t.TempDir(), strings.TrimSuffix(src, ".go"))
+
+	out, err := exec.Command("go", "build", "-o", bin, src).CombinedOutput()
+	if err != nil {
+		t.Fatalf("go build %s: %v\n%s", src, err, out)
+	}
+
+	return bin
+}
+
+// startHelper() starts the helper process 'cmd', which is killed when the
+// test ends, and returns its PID as a string. The helper's diagnostics go to
+// the test's standard error.
+
+func startHelper(t *testing.T, cmd *exec.Cmd) string {
+
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	return strconv.Itoa(cmd.Process.Pid)
+}
+
+// waitForComm() waits until the process 'pid' is running the command
+// 'comm' (that is, until the helper has finished building the namespaces
+// and has executed its final command). The test fails if the helper exits
+// (becomes a zombie) first.
+
+func waitForComm(t *testing.T, pid string, comm string) {
+
+	deadline := time.Now().Add(10 * time.Second)
+
+	for time.Now().Before(deadline) {
+		buf, err := ioutil.ReadFile("/proc/" + pid + "/comm")
+		if err == nil && strings.TrimSpace(string(buf)) == comm {
+			return
+		}
+
+		stat, err := ioutil.ReadFile("/proc/" + pid + "/stat")
+		i := strings.LastIndex(string(stat), ")")
+		if err == nil && i > 0 && strings.HasPrefix(
+			string(stat[i:]), ") Z") {
+			t.Fatalf("PID %s exited before executing %q", pid,
+				comm)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("PID %s did not execute %q", pid, comm)
+}
+
+// openNamespace() opens the namespace file 'path', closing it when the test
+// ends.
+
+func openNamespace(t *testing.T, path string) int {
+
+	fd, err := syscall.Open(path, syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+
+	return fd
+}
+
+// namespaceIDOf() returns the ID (in the program's "{dev inode}" format) of
+// the namespace referred to by the file descriptor 'fd'.
+
+func namespaceIDOf(t *testing.T, fd int) string {
+
+	var sb syscall.Stat_t
+
+	if err := syscall.Fstat(fd, &sb); err != nil {
+		t.Fatal(err)
+	}
+
+	return fmt.Sprintf("{%d %d}", sb.Dev, sb.Ino)
+}
+
+// runProgram() runs 'bin' with the arguments 'args', and returns its
+// standard output, failing the test if the program fails.
+
+func runProgram(t *testing.T, bin string, args ...string) string {
+
+	var stderr strings.Builder
+
+	cmd := exec.Command(bin, args...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%s %s: %v\n%s", filepath.Base(bin),
+			strings.Join(args, " "), err, stderr.String())
+	}
+
+	return string(out)
+}
+
+// findLine() returns the index of the first line of 'lines' that contains
+// all of 'fragments', failing the test if there is none.
+
+func findLine(t *testing.T, lines []string, fragments ...string) int {
+
+	for i, line := range lines {
+		found := true
+		for _, f := range fragments {
+			if !strings.Contains(line, f) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return i
+		}
+	}
+
+	t.Fatalf("no line contains %q in:\n%s", fragments,
+		strings.Join(lines, "\n"))
+	return -1
+}
+
+// indentOf() returns the number of leading spaces in 'line'.
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// TestIntegrationNestedUserNS creates a user namespace whose UID and GID
+// maps map 0-999 to 100000-100999, and, inside it, a nested user namespace
+// created by root in the first namespace; each namespace has one member
+// process. It checks that the program shows the nested namespace below its
+// parent, with the creator UIDs (as seen from the initial namespace), the
+// maps, and the member processes.
+
+func TestIntegrationNestedUserNS(t *testing.T) {
+
+	requirePrivilege(t)
+	bin := buildProgram(t, "userns_overview.go")
+
+	idMap := []syscall.SysProcIDMap{
+		{ContainerID: 0, HostID: 100000, Size: 1000},
+	}
+
+	cmd := exec.Command("sleep", "1000")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER,
+		UidMappings: idMap,
+		GidMappings: idMap,
+	}
+	parentPID := startHelper(t, cmd)
+
+	// nsenter(1) switches to UID 0 and GID 0 in the namespace, so that
+	// the nested namespace is created by (host) UID 100000.
+
+	pid := startHelper(t, exec.Command("nsenter", "--user",
+		"--target", parentPID, "unshare", "--user", "sleep", "1000"))
+	waitForComm(t, pid, "sleep")
+
+	fd := openNamespace(t, "/proc/"+pid+"/ns/user")
+
+	parentFD, err := NSIoctl(fd, NS_GET_PARENT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(parentFD)
+
+	nested := namespaceIDOf(t, fd)
+	parent := namespaceIDOf(t, parentFD)
+
+	out := runProgram(t, bin, "--color=never")
+	lines := strings.Split(out, "\n")
+
+	p := findLine(t, lines, parent, "<UID: 0>", "u: 0 100000 1000;",
+		"g: 0 100000 1000;")
+	n := findLine(t, lines, nested, "<UID: 100000>")
+
+	if n < p || indentOf(lines[n]) <= indentOf(lines[p]) {
+		t.Errorf("%s is not displayed below its parent %s:\n%s",
+			nested, parent, out)
+	}
+
+	if findLine(t, lines, "PIDs: "+parentPID+" ") != p+1 {
+		t.Errorf("PID %s is not displayed as a member of %s:\n%s",
+			parentPID, parent, out)
+	}
+	if findLine(t, lines, "PIDs: "+pid+" ") != n+1 {
+		t.Errorf("PID %s is not displayed as a member of %s:\n%s",
+			pid, nested, out)
+	}
+}
@@ -0,0 +1,2003 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// If USERNS_OVERVIEW_SIGNAL_TEST is set in the environment, the test
+// binary runs signalChild() instead of the tests, so that a test can check
+// how the program's signal handlers behave in a child process. Similarly,
+// if USERNS_OVERVIEW_INTERRUPT_TEST is set, it runs interruptChild(), and
+// if USERNS_OVERVIEW_REDIRECT_TEST is set, it runs redirectChild().
+
+func TestMain(m *testing.M) {
+
+	if mode := os.Getenv("USERNS_OVERVIEW_SIGNAL_TEST"); mode != "" {
+		signalChild(mode)
+	}
+
+	if stop := os.Getenv("USERNS_OVERVIEW_INTERRUPT_TEST"); stop != "" {
+		interruptChild(stop)
+	}
+
+	if os.Getenv("USERNS_OVERVIEW_REDIRECT_TEST") != "" {
+		redirectChild()
+	}
+
+	os.Exit(m.Run())
+}
+
+// TestParseMap checks ParseMap() against well-formed maps, including the
+// empty map of a namespace whose map hasn't been written yet and maps with
+// several ranges, and against malformed text.
+
+func TestParseMap(t *testing.T) {
+
+	tests := []struct {
+		name string
+		text string
+		want []MapRange
+		ok   bool
+	}{
+		{"empty", "", []MapRange{}, true},
+		{"blank", " \n\t", []MapRange{}, true},
+		{"identity", "0 0 4294967295",
+			[]MapRange{{0, 0, 4294967295}}, true},
+		{"single", "0 1000 1", []MapRange{{0, 1000, 1}}, true},
+		{"multi-range", "0 1000 1 1 100000 65536 70000 200000 10",
+			[]MapRange{{0, 1000, 1}, {1, 100000, 65536},
+				{70000, 200000, 10}}, true},
+		{"kernel layout",
+			"         0       1000          1\n" +
+				"         1     100000      65536\n",
+			[]MapRange{{0, 1000, 1}, {1, 100000, 65536}}, true},
+		{"short line", "0 1000", nil, false},
+		{"extra field", "0 1000 1 2", nil, false},
+		{"not a number", "0 root 1", nil, false},
+		{"negative", "0 -1 1", nil, false},
+		{"hex", "0 0x3e8 1", nil, false},
+		{"too big", "0 0 4294967296", nil, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			got, ok := ParseMap(tc.text)
+			if ok != tc.ok {
+				t.Fatalf("ParseMap(%q) ok = %v, want %v",
+					tc.text, ok, tc.ok)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ParseMap(%q) = %v, want %v",
+					tc.text, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestFormatMapRoundTrip checks that FormatMap() produces text that
+// ParseMap() turns back into the same ranges.
+
+func TestFormatMapRoundTrip(t *testing.T) {
+
+	for _, text := range []string{"", "0 1000 1",
+		"0 1000 1 1 100000 65536"} {
+
+		ranges, ok := ParseMap(text)
+		if !ok {
+			t.Fatalf("ParseMap(%q) failed", text)
+		}
+		if got := FormatMap(ranges); got != text {
+			t.Errorf("FormatMap(ParseMap(%q)) = %q", text, got)
+		}
+	}
+}
+
+// Status files captured from a normal process, a kernel thread, and a process
+// in a PID namespace nested three levels below the initial PID namespace.
+// Only the fields that matter here are included (the kernel's files contain
+// about 60 lines).
+
+const statusNormal = `Name:	bash
+Umask:	0022
+State:	S (sleeping)
+Tgid:	4321
+Ngid:	0
+Pid:	4321
+PPid:	4300
+TracerPid:	0
+Uid:	1000	1000	1000	1000
+Gid:	1000	1000	1000	1000
+FDSize:	256
+Groups:	4 27 1000
+NStgid:	4321
+NSpid:	4321
+NSpgid:	4321
+NSsid:	4321
+Kthread:	0
+Threads:	1
+`
+
+const statusKthread = `Name:	kthreadd
+Umask:	0000
+State:	S (sleeping)
+Tgid:	2
+Ngid:	0
+Pid:	2
+PPid:	0
+TracerPid:	0
+Uid:	0	0	0	0
+Gid:	0	0	0	0
+FDSize:	64
+Groups:
+NStgid:	2
+NSpid:	2
+NSpgid:	0
+NSsid:	0
+Kthread:	1
+Threads:	1
+`
+
+const statusNested = `Name:	sleep
+Umask:	0022
+State:	S (sleeping)
+Tgid:	81234
+Ngid:	0
+Pid:	81234
+PPid:	81200
+TracerPid:	0
+Uid:	100000	100000	100000	100000
+Gid:	100000	100000	100000	100000
+FDSize:	64
+Groups:
+NStgid:	81234	4567	89	1
+NSpid:	81234	4567	89	1
+NSpgid:	81200	4500	1	0
+NSsid:	81200	4500	1	0
+Kthread:	0
+Threads:	1
+`
+
+// TestReadProcStatus checks the effective UID that ReadProcStatus() parses
+// from captured status files, and that a file whose 'Uid' field is missing
+// or malformed, or that has gone (as it does when the process terminates),
+// is reported as unreadable.
+
+func TestReadProcStatus(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		status string
+		euid   int
+		ok     bool
+	}{
+		{"normal process", statusNormal, 1000, true},
+		{"kernel thread", statusKthread, 0, true},
+		{"nested PID namespaces", statusNested, 100000, true},
+		{"no Uid field", "Name:\tinit\n", 0, false},
+		{"short Uid field", "Uid:\t1000\n", 0, false},
+		{"bad Uid field", "Uid:\t1000\tx\t1000\t1000\n", 0, false},
+	}
+
+	root := t.TempDir()
+	useProcDir(t, root)
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			name := strconv.Itoa(i + 1)
+			dir := filepath.Join(root, name)
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			err := ioutil.WriteFile(filepath.Join(dir, "status"),
+				[]byte(tc.status), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			status, ok := ReadProcStatus(name)
+			if ok != tc.ok || ok && status.euid != tc.euid {
+				t.Errorf("ReadProcStatus() = %d, %v; want "+
+					"%d, %v", status.euid, ok, tc.euid,
+					tc.ok)
+			}
+		})
+	}
+
+	if _, ok := ReadProcStatus("99999"); ok {
+		t.Error("ReadProcStatus() of a missing PID succeeded")
+	}
+}
+
+// TestParseArgs checks that ParseArgs() accepts options before, after, and
+// among the nonoption arguments, keeps the value of a nonboolean option given
+// as a separate argument with the option, stops at "--", treats negative
+// numbers and a lone "-" as nonoption arguments, and leaves an unrecognized
+// option to be diagnosed by the flag package. The command line is parsed
+// against a set of test options: a boolean "-b", a string "-s", and an
+// integer "-n".
+
+func TestParseArgs(t *testing.T) {
+
+	tests := []struct {
+		name string
+		args []string
+		want []string // Nonoption arguments
+		b    bool
+		s    string
+		n    int
+		err  string // Diagnostic from the flag package, if any
+	}{
+		{"options first", []string{"-b", "-s", "x", "a", "b"},
+			[]string{"a", "b"}, true, "x", 0, ""},
+		{"options last", []string{"a", "b", "--b", "--s=x"},
+			[]string{"a", "b"}, true, "x", 0, ""},
+		{"interleaved", []string{"a", "-b", "b", "-n", "3", "c"},
+			[]string{"a", "b", "c"}, true, "", 3, ""},
+		{"--opt value", []string{"1234", "--s", "val", "5678"},
+			[]string{"1234", "5678"}, false, "val", 0, ""},
+		{"value like an option", []string{"-s", "-b", "a"},
+			[]string{"a"}, false, "-b", 0, ""},
+		{"boolean then argument", []string{"--b", "x"},
+			[]string{"x"}, true, "", 0, ""},
+		{"--", []string{"a", "-b", "--", "-s", "x", "--"},
+			[]string{"a", "-s", "x", "--"}, true, "", 0, ""},
+		{"negative numbers", []string{"-1", "a", "-n", "-3", "-22"},
+			[]string{"-1", "a", "-22"}, false, "", -3, ""},
+		{"lone -", []string{"-", "-b", "-"},
+			[]string{"-", "-"}, true, "", 0, ""},
+		{"unrecognized option", []string{"a", "--bogus"}, nil,
+			false, "", 0, "flag provided but not defined: -bogus"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			savedArgs, savedFlags := os.Args, flag.CommandLine
+			defer func() {
+				os.Args, flag.CommandLine = savedArgs,
+					savedFlags
+			}()
+
+			var diag bytes.Buffer
+			os.Args = append([]string{"prog"}, tc.args...)
+			flag.CommandLine = flag.NewFlagSet("prog",
+				flag.ContinueOnError)
+			flag.CommandLine.SetOutput(&diag)
+
+			b := flag.Bool("b", false, "")
+			s := flag.String("s", "", "")
+			n := flag.Int("n", 0, "")
+
+			ParseArgs()
+
+			if tc.err != "" {
+				if !strings.Contains(diag.String(), tc.err) {
+					t.Errorf("diagnostic %q, want %q",
+						diag.String(), tc.err)
+				}
+				return
+			}
+			if diag.Len() != 0 {
+				t.Errorf("unexpected diagnostic %q",
+					diag.String())
+			}
+
+			if got := flag.Args(); !reflect.DeepEqual(got,
+				tc.want) {
+				t.Errorf("arguments %q, want %q", got, tc.want)
+			}
+			if *b != tc.b || *s != tc.s || *n != tc.n {
+				t.Errorf("-b %v, -s %q, -n %d; want %v, %q, %d",
+					*b, *s, *n, tc.b, tc.s, tc.n)
+			}
+		})
+	}
+}
+
+// resetScan() empties the results of any earlier scan.
+
+func resetScan() {
+
+	NSList = make(map[NamespaceID]*NamespaceAttribs)
+	seenNonuserNS = make(map[NamespaceID]bool)
+	initialNS = NamespaceID{}
+	initialNSFound = false
+	currentNS = NamespaceID{}
+	displayRoot = NamespaceID{}
+	flatMode = false
+	creatorsUnknown = false
+	maxLevel = 0
+	numUnreadable = 0
+}
+
+// useReader() makes the program obtain its information from 'r', and
+// empties the results of any earlier scan. The previous settings are
+// restored when the test ends.
+
+func useReader(tb testing.TB, r ProcReader) {
+
+	savedReader, savedDir := procReader, procDir
+	savedWorkers := scanWorkers
+
+	procReader = r
+	resetScan()
+
+	tb.Cleanup(func() {
+		procReader, procDir = savedReader, savedDir
+		scanWorkers = savedWorkers
+		resetScan()
+	})
+}
+
+// useProcDir() makes 'dir' the procfs that is scanned (see useReader()).
+
+func useProcDir(tb testing.TB, dir string) {
+
+	useReader(tb, ProcfsReader{dir})
+	procDir = dir
+}
+
+// childUserNS() starts a process in a new user namespace, and returns the
+// path of its /proc/PID/ns/user file, or "" if user namespaces can't be
+// created here. The process is killed when the test ends.
+
+func childUserNS(tb testing.TB) string {
+
+	cmd := exec.Command("sleep", "1000")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER,
+	}
+	if err := cmd.Start(); err != nil {
+		tb.Log("can't create a user namespace:", err)
+		return ""
+	}
+
+	tb.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	return "/proc/" + strconv.Itoa(cmd.Process.Pid) + "/ns/user"
+}
+
+// procFixture() creates a directory that looks (to the scan) like a procfs
+// with 'n' processes, and returns its path. Each process's ns/user file is
+// a symlink to a real namespace file, so that stat(), open(), and the
+// namespace ioctl() operations behave as they do under /proc. Most
+// processes are members of the test program's own user namespace; every
+// 100th is a member of one of the namespaces in 'others'; and every 50th
+// has no ns directory, like a process that exited during the scan. Each
+// process has a status file giving one of a few effective UIDs, and
+// there are also some nonnumeric entries that the scan must ignore.
+
+func procFixture(tb testing.TB, n int, others []string) string {
+
+	root := tb.TempDir()
+
+	for _, name := range []string{"self", "sys", "0README"} {
+		err := os.Mkdir(filepath.Join(root, name), 0755)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	for pid := 1; pid <= n; pid++ {
+		dir := filepath.Join(root, strconv.Itoa(pid))
+
+		status := "Name:\tproc\nUid:\t0\t" + strconv.Itoa(pid%3*1000) +
+			"\t0\t0\n"
+		if err := os.Mkdir(dir, 0755); err != nil {
+			tb.Fatal(err)
+		}
+		err := ioutil.WriteFile(filepath.Join(dir, "status"),
+			[]byte(status), 0644)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		if pid%50 == 0 {
+			continue
+		}
+
+		target := "/proc/self/ns/user"
+		if pid%100 == 1 && len(others) > 0 {
+			target = others[pid/100%len(others)]
+		}
+
+		if err := os.Mkdir(filepath.Join(dir, "ns"), 0755); err != nil {
+			tb.Fatal(err)
+		}
+		err = os.Symlink(target, filepath.Join(dir, "ns", "user"))
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+// fixtureNamespaces() returns the namespace files of the processes in
+// a fixture: two new user namespaces, if they can be created.
+
+func fixtureNamespaces(tb testing.TB) []string {
+
+	var others []string
+
+	for i := 0; i < 2; i++ {
+		if ns := childUserNS(tb); ns != "" {
+			others = append(others, ns)
+		}
+	}
+
+	return others
+}
+
+// scanFixture() scans the procfs set by useProcDir() with 'workers' scan
+// workers, and returns the number of processes inspected along with the
+// resulting 'NSList'.
+
+func scanFixture(tb testing.TB, workers int,
+	opts CmdLineOptions) (int, map[NamespaceID]*NamespaceAttribs) {
+
+	scanWorkers = workers
+	resetScan()
+
+	n, err := ScanProcesses(context.Background(), opts)
+	if err != nil {
+		tb.Fatal("ScanProcesses():", err)
+	}
+
+	return n, NSList
+}
+
+// TestScanParallelMatchesSequential checks that a scan in which the
+// namespace files are stat()ed by several workers finds the same
+// namespaces, with the same member processes (in the same order) and the
+// same member UIDs, as a sequential scan of the same directory. The
+// fixture is larger than a batch, so that several batches, the last of
+// them partial, are processed.
+
+func TestScanParallelMatchesSequential(t *testing.T) {
+
+	others := fixtureNamespaces(t)
+	useProcDir(t, procFixture(t, 3*scanBatchSize+17, others))
+	opts := CmdLineOptions{memberUIDs: true, filterUID: -1}
+
+	seqN, seq := scanFixture(t, 1, opts)
+	if len(seq) < 1+len(others) {
+		t.Errorf("found %d namespaces, want at least %d",
+			len(seq), 1+len(others))
+	}
+
+	for _, workers := range []int{2, 4, 16} {
+		t.Run(strconv.Itoa(workers)+" workers", func(t *testing.T) {
+
+			parN, par := scanFixture(t, workers, opts)
+
+			if parN != seqN {
+				t.Errorf("scanned %d processes, sequential "+
+					"scan scanned %d", parN, seqN)
+			}
+			if !reflect.DeepEqual(par, seq) {
+				t.Errorf("parallel scan found %v,\n"+
+					"sequential scan found %v", par, seq)
+			}
+		})
+	}
+
+	// The processes without an ns directory are skipped, but counted
+	// as scanned
+
+	if want := 3*scanBatchSize + 17; seqN != want {
+		t.Errorf("scanned %d processes, want %d", seqN, want)
+	}
+
+	members := 0
+	for _, ns := range seq {
+		members += len(ns.pids)
+	}
+	if want := seqN - seqN/50; members != want {
+		t.Errorf("found %d member processes, want %d", members, want)
+	}
+}
+
+// TestScanCanceled checks that a parallel scan stops when its context is
+// canceled.
+
+func TestScanCanceled(t *testing.T) {
+
+	useProcDir(t, procFixture(t, 2*scanBatchSize, nil))
+	scanWorkers = 4
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	n, err := ScanProcesses(ctx, CmdLineOptions{filterUID: -1})
+	if err != nil || n != 0 {
+		t.Errorf("ScanProcesses() = %d, %v; want 0, nil", n, err)
+	}
+}
+
+// BenchmarkScanProcesses measures a scan of a fixture of 10000 processes,
+// sequentially and with several numbers of workers.
+
+func BenchmarkScanProcesses(b *testing.B) {
+
+	useProcDir(b, procFixture(b, 10000, fixtureNamespaces(b)))
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(strconv.Itoa(workers)+" workers", func(b *testing.B) {
+
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				scanFixture(b, workers,
+					CmdLineOptions{filterUID: -1})
+			}
+		})
+	}
+}
+
+// TestRangesOverlap checks RangesOverlap() for disjoint, adjacent, partly
+// overlapping, nested, identical, and empty ranges. Only the outside IDs
+// matter; the inside IDs are chosen to differ from them.
+
+func TestRangesOverlap(t *testing.T) {
+
+	tests := []struct {
+		name string
+		a, b MapRange
+		want bool
+	}{
+		{"disjoint", MapRange{0, 1000, 10}, MapRange{0, 2000, 10},
+			false},
+		{"adjacent", MapRange{0, 1000, 10}, MapRange{0, 1010, 10},
+			false},
+		{"adjacent single IDs", MapRange{0, 1000, 1},
+			MapRange{0, 1001, 1}, false},
+		{"last ID shared", MapRange{0, 1000, 11},
+			MapRange{0, 1010, 10}, true},
+		{"partial", MapRange{0, 100000, 65536},
+			MapRange{0, 150000, 65536}, true},
+		{"nested", MapRange{0, 100000, 65536},
+			MapRange{1, 100010, 5}, true},
+		{"nested at start", MapRange{0, 100000, 65536},
+			MapRange{0, 100000, 1}, true},
+		{"nested at end", MapRange{0, 100000, 65536},
+			MapRange{0, 165535, 1}, true},
+		{"identical", MapRange{0, 1000, 1}, MapRange{5, 1000, 1},
+			true},
+		{"same inside IDs only", MapRange{0, 1000, 1},
+			MapRange{0, 2000, 1}, false},
+		{"empty", MapRange{0, 1000, 0}, MapRange{0, 1000, 10},
+			false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			if got := RangesOverlap(tc.a, tc.b); got != tc.want {
+				t.Errorf("RangesOverlap(%v, %v) = %v, want %v",
+					tc.a, tc.b, got, tc.want)
+			}
+			if got := RangesOverlap(tc.b, tc.a); got != tc.want {
+				t.Errorf("RangesOverlap(%v, %v) = %v, want %v",
+					tc.b, tc.a, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestMapOverlaps checks that MapOverlaps() reports each overlapping pair of
+// ranges of two multi-range maps, and nothing for maps whose ranges are
+// merely adjacent.
+
+func TestMapOverlaps(t *testing.T) {
+
+	a := NamespaceID{4, 4026532205}
+	b := NamespaceID{4, 4026532206}
+
+	tests := []struct {
+		name   string
+		aMap   string
+		bMap   string
+		wanted []string
+	}{
+		{"adjacent", "0 1000 1 1 100000 65536",
+			"0 1001 1 1 165536 65536", nil},
+		{"nested", "0 1000 1 1 100000 65536",
+			"0 1001 1 1 100100 10",
+			[]string{"{4 4026532205} and {4 4026532206}: UID " +
+				"ranges 100000-165535 and 100100-100109"}},
+		{"several", "0 1000 2 2 100000 65536",
+			"0 1001 1 1 100000 1",
+			[]string{"{4 4026532205} and {4 4026532206}: UID " +
+				"ranges 1000-1001 and 1001-1001",
+				"{4 4026532205} and {4 4026532206}: UID " +
+					"ranges 100000-165535 and " +
+					"100000-100000"}},
+		{"empty map", "", "0 1000 1", nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			aRanges, _ := ParseMap(tc.aMap)
+			bRanges, _ := ParseMap(tc.bMap)
+
+			got := MapOverlaps(a, b, aRanges, bRanges, "UID")
+			if !reflect.DeepEqual(got, tc.wanted) {
+				t.Errorf("MapOverlaps() = %q, want %q",
+					got, tc.wanted)
+			}
+		})
+	}
+}
+
+// A 'fakeReader' is a ProcReader that supplies the information about a set
+// of processes, and a namespace hierarchy, from maps, so that a scan can be
+// tested without touching the live system. It tracks the file descriptors
+// that it hands out, so that a test can check that they were all closed.
+
+type fakeReader struct {
+	pids     []string                          // Listed PID directories
+	ns       map[string]map[string]NamespaceID // Namespaces of each PID
+	files    map[string]map[string]string      // Other files of each PID
+	parents  map[NamespaceID]NamespaceID       // Parent user NSs
+	owners   map[NamespaceID]NamespaceID       // Owners of nonuser NSs
+	creators map[NamespaceID]int               // Creator UIDs of user NSs
+	fds      map[int]NamespaceID
+	nextFD   int
+}
+
+func newFakeReader() *fakeReader {
+	return &fakeReader{
+		ns:       make(map[string]map[string]NamespaceID),
+		files:    make(map[string]map[string]string),
+		parents:  make(map[NamespaceID]NamespaceID),
+		owners:   make(map[NamespaceID]NamespaceID),
+		creators: make(map[NamespaceID]int),
+		fds:      make(map[int]NamespaceID),
+		nextFD:   100,
+	}
+}
+
+// addProcess() adds the process 'pid', running 'comm' as 'uid', as a
+// member of the user namespace 'userNS', whose maps (as shown in the
+// process's uid_map and gid_map files) are 'idMap' and whose setgroups
+// state is 'setgroups'. The process's start time is its PID.
+
+func (r *fakeReader) addProcess(pid int, comm string, uid int,
+	userNS NamespaceID, idMap string, setgroups string) {
+
+	name := strconv.Itoa(pid)
+	r.pids = append(r.pids, name)
+	r.ns[name] = map[string]NamespaceID{"user": userNS}
+	r.files[name] = map[string]string{
+		"comm": comm + "\n",
+		"status": "Name:\t" + comm + "\nUid:\t" + strconv.Itoa(uid) +
+			"\t" + strconv.Itoa(uid) + "\t0\t0\n",
+		"stat": name + " (" + comm + ") S 1 " + name + " " + name +
+			" 0 -1 4194560 0 0 0 0 0 0 0 0 20 0 1 0 " + name +
+			" 0 0\n",
+		"uid_map":   idMap,
+		"gid_map":   idMap,
+		"setgroups": setgroups + "\n",
+	}
+}
+
+func (r *fakeReader) newFD(ns NamespaceID) int {
+	r.nextFD++
+	r.fds[r.nextFD] = ns
+	return r.nextFD
+}
+
+func (r *fakeReader) StatNS(pid string, nsType string,
+	sb *syscall.Stat_t) (NamespaceID, error) {
+
+	ns, fnd := r.ns[pid][nsType]
+	if !fnd {
+		return NamespaceID{}, syscall.ENOENT
+	}
+	return ns, nil
+}
+
+func (r *fakeReader) OpenNS(pid string, nsType string) (int, error) {
+	ns, err := r.StatNS(pid, nsType, nil)
+	if err != nil {
+		return -1, err
+	}
+	return r.newFD(ns), nil
+}
+
+func (r *fakeReader) ReadFile(pid string, fileName string) ([]byte, error) {
+	text, fnd := r.files[pid][fileName]
+	if !fnd {
+		return nil, syscall.ENOENT
+	}
+	return []byte(text), nil
+}
+
+func (r *fakeReader) ListProcesses(fn func(name string) bool) error {
+	for _, name := range r.pids {
+		if !fn(name) {
+			break
+		}
+	}
+	return nil
+}
+
+func (r *fakeReader) NamespaceID(fd int) (NamespaceID, error) {
+	ns, fnd := r.fds[fd]
+	if !fnd {
+		return NamespaceID{}, syscall.EBADF
+	}
+	return ns, nil
+}
+
+// NSIoctl() implements NS_GET_PARENT and NS_GET_USERNS, which fail with
+// EPERM when the parent or owner is outside the fake hierarchy (as the
+// real operations do at the root of the hierarchy), and NS_GET_NSTYPE.
+
+func (r *fakeReader) NSIoctl(fd int, op uintptr) (int, error) {
+	ns, fnd := r.fds[fd]
+	if !fnd {
+		return -1, syscall.EBADF
+	}
+
+	switch op {
+	case NS_GET_PARENT:
+		if parent, fnd := r.parents[ns]; fnd {
+			return r.newFD(parent), nil
+		}
+	case NS_GET_USERNS:
+		if owner, fnd := r.owners[ns]; fnd {
+			return r.newFD(owner), nil
+		}
+	case NS_GET_NSTYPE:
+		return CLONE_NEWUSER, nil
+	default:
+		return -1, syscall.ENOTTY
+	}
+
+	return -1, syscall.EPERM
+}
+
+func (r *fakeReader) OwnerUID(fd int) (int, error) {
+	ns, fnd := r.fds[fd]
+	if !fnd {
+		return -1, syscall.EBADF
+	}
+	return r.creators[ns], nil
+}
+
+func (r *fakeReader) Close(fd int) {
+	delete(r.fds, fd)
+}
+
+// checkClosed() reports an error if any of the file descriptors returned
+// by 'r' weren't closed.
+
+func (r *fakeReader) checkClosed(tb testing.TB) {
+	if len(r.fds) != 0 {
+		tb.Errorf("%d file descriptors were left open", len(r.fds))
+	}
+}
+
+// Namespace IDs used in the fake hierarchy
+
+var (
+	rootUserNS  = NamespaceID{4, PROC_USER_INIT_INO}
+	rootlessNS  = NamespaceID{4, 4026532205}
+	nestedNS    = NamespaceID{4, 4026532210}
+	containerNS = NamespaceID{4, 4026532206}
+	rootNetNS   = NamespaceID{4, 4026531840}
+	childNetNS  = NamespaceID{4, 4026532300}
+)
+
+// hierarchyReader() returns a fake reader for a hierarchy with three
+// levels: the initial user namespace, with processes 1 and 2; a namespace
+// created by UID 1000 (as "unshare -r" does), with processes 300 and 301;
+// a namespace nested inside that one, with process 400; and a sibling of
+// the UID 1000 namespace, created by UID 1001 with a range of subordinate
+// IDs, with process 500. Process 300 is also a member of a network
+// namespace owned by its user namespace. The program itself is process 2.
+
+func hierarchyReader() *fakeReader {
+	r := newFakeReader()
+
+	r.parents[rootlessNS] = rootUserNS
+	r.parents[nestedNS] = rootlessNS
+	r.parents[containerNS] = rootUserNS
+	r.creators[rootUserNS] = 0
+	r.creators[rootlessNS] = 1000
+	r.creators[nestedNS] = 0
+	r.creators[containerNS] = 1001
+	r.owners[rootNetNS] = rootUserNS
+	r.owners[childNetNS] = rootlessNS
+
+	const initialMap = "         0          0 4294967295\n"
+	const rootlessMap = "         0       1000          1\n"
+	const nestedMap = "         0          0          1\n"
+	const containerMap = "         0       1001          1\n" +
+		"         1     100000      65536\n"
+
+	r.addProcess(1, "systemd", 0, rootUserNS, initialMap, "allow")
+	r.addProcess(2, "userns_overview", 1000, rootUserNS, initialMap,
+		"allow")
+	r.addProcess(300, "bash", 0, rootlessNS, rootlessMap, "deny")
+	r.addProcess(301, "sleep", 0, rootlessNS, rootlessMap, "deny")
+	r.addProcess(400, "sh", 0, nestedNS, nestedMap, "deny")
+	r.addProcess(500, "init", 0, containerNS, containerMap, "allow")
+
+	for _, pid := range r.pids {
+		r.ns[pid]["net"] = rootNetNS
+	}
+	r.ns["300"]["net"] = childNetNS
+	r.ns["self"] = r.ns["2"]
+
+	return r
+}
+
+// captureOutput() makes the display functions write to a buffer, which is
+// returned, rather than to standard output.
+
+func captureOutput(tb testing.TB) *bytes.Buffer {
+
+	var buf bytes.Buffer
+
+	saved := output
+	output = &buf
+	tb.Cleanup(func() { output = saved })
+
+	return &buf
+}
+
+// TestDisplayHierarchy builds the hierarchy of hierarchyReader() from the
+// fake procfs, and checks the tree that is displayed, with and without
+// the details of each namespace. Nothing is read from the live system.
+
+func TestDisplayHierarchy(t *testing.T) {
+
+	tests := []struct {
+		name string
+		opts CmdLineOptions
+		want string
+	}{
+		{"PIDs", CmdLineOptions{showPids: true, maxDepth: -1,
+			filterUID: -1}, strings.Join([]string{
+			"{4 4026531837}  <UID: 0>  level 0  " +
+				"(children: 2, descendants: 3) <-- current",
+			"            PIDs: 1 2 ",
+			"    {4 4026532205}  <UID: 1000>  level 1  " +
+				"(children: 1, descendants: 1)",
+			"                PIDs: 300 301 ",
+			"        {4 4026532210}  <UID: 0>  level 2  " +
+				"(children: 0, descendants: 0)",
+			"                    PIDs: 400 ",
+			"    {4 4026532206}  <UID: 1001>  level 1  " +
+				"(children: 0, descendants: 0)",
+			"                PIDs: 500 ",
+			"",
+			"maximum nesting level: 2 (the kernel limit is 32)",
+			""}, "\n")},
+		{"details", CmdLineOptions{showMaps: true, showPids: true,
+			showComm: true, showLeader: true, ownedCounts: true,
+			memberUIDs: true, maxDepth: -1, filterUID: -1},
+			strings.Join([]string{
+				"{4 4026531837}  <UID: 0>  level 0  " +
+					"(children: 2, descendants: 3)  " +
+					"u: 0 0 4294967295;  " +
+					"g: 0 0 4294967295;  sg: allow  " +
+					"owns: 1 net  " +
+					"member UIDs: 0 (1 procs), " +
+					"1000 (1 procs)  leader: 1 (systemd) " +
+					"<-- current",
+				"            1      systemd",
+				"            2      userns_overview",
+				"    {4 4026532205}  <UID: 1000>  level 1  " +
+					"(children: 1, descendants: 1)  " +
+					"u: 0 1000 1;  g: 0 1000 1;  " +
+					"sg: deny  owns: 1 net  " +
+					"member UIDs: 0 (2 procs)  " +
+					"leader: 300 (bash)",
+				"                300    bash",
+				"                301    sleep",
+				"        {4 4026532210}  <UID: 0>  level 2  " +
+					"(children: 0, descendants: 0)  " +
+					"u: 0 0 1;  g: 0 0 1;  sg: deny  " +
+					"owns: nothing  " +
+					"member UIDs: 0 (1 procs)  " +
+					"leader: 400 (sh)",
+				"                    400    sh",
+				"    {4 4026532206}  <UID: 1001>  level 1  " +
+					"(children: 0, descendants: 0)  " +
+					"u: 0 1001 1 1 100000 65536;  " +
+					"g: 0 1001 1 1 100000 65536;  " +
+					"sg: allow  owns: nothing  " +
+					"member UIDs: 0 (1 procs)  " +
+					"leader: 500 (init)",
+				"                500    init",
+				"",
+				"maximum nesting level: 2 (the kernel limit " +
+					"is 32)",
+				""}, "\n")},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			r := hierarchyReader()
+			useReader(t, r)
+			buf := captureOutput(t)
+
+			FindCurrentNamespace()
+			ScanNamespaces(context.Background(), tc.opts)
+
+			if status := DisplayOutput(tc.opts); status != 0 {
+				t.Errorf("DisplayOutput() returned %d", status)
+			}
+
+			if got := buf.String(); got != tc.want {
+				t.Errorf("displayed:\n%s\nwant:\n%s",
+					got, tc.want)
+			}
+
+			r.checkClosed(t)
+		})
+	}
+}
+
+// If "-update" is given to the test binary, TestGolden rewrites the golden
+// files instead of comparing the output with them.
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+// checkGolden() compares 'got' with the contents of the golden file 'path'
+// (or, with "-update", writes 'got' to the file), and reports the first line
+// that differs.
+
+func checkGolden(t *testing.T, path string, got string) {
+
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := ioutil.WriteFile(path, []byte(got), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run the test with -update to create it)", err)
+	}
+	want := string(buf)
+
+	if got == want {
+		return
+	}
+
+	gotLines := strings.Split(got, "\n")
+	wantLines := strings.Split(want, "\n")
+
+	i := 0
+	for i < len(gotLines) && i < len(wantLines) &&
+		gotLines[i] == wantLines[i] {
+		i++
+	}
+
+	var g, w string
+	if i < len(gotLines) {
+		g = gotLines[i]
+	}
+	if i < len(wantLines) {
+		w = wantLines[i]
+	}
+
+	t.Errorf("output differs from %s at line %d:\ngot:  %q\n"+
+		"want: %q\n(if the change is intended, rerun the test with "+
+		"-update)", path, i+1, g, w)
+}
+
+// More namespace IDs, used in goldenReader() and hiddenReader()
+
+var (
+	emptyNS = NamespaceID{4, 4026532207}
+	deepNS  = NamespaceID{4, 4026532208}
+)
+
+// goldenReader() extends the hierarchy of hierarchyReader() with the cases
+// that the display code treats specially: below the namespace created by UID
+// 1001, a namespace that has no member processes, and, below that, one with
+// process 600; and enough processes (1000 to 1019) in the initial namespace
+// for its PID list to be wrapped.
+
+func goldenReader() *fakeReader {
+	r := hierarchyReader()
+
+	const deepMap = "         0     100000          1\n"
+
+	r.parents[emptyNS] = containerNS
+	r.parents[deepNS] = emptyNS
+	r.creators[emptyNS] = 1001
+	r.creators[deepNS] = 100000
+
+	r.addProcess(600, "app", 0, deepNS, deepMap, "deny")
+	r.ns["600"]["net"] = rootNetNS
+
+	const initialMap = "         0          0 4294967295\n"
+
+	for pid := 1000; pid <= 1019; pid++ {
+		r.addProcess(pid, "worker", 0, rootUserNS, initialMap,
+			"allow")
+		r.ns[strconv.Itoa(pid)]["net"] = rootNetNS
+	}
+
+	return r
+}
+
+// hiddenReader() returns a fake reader for the view from inside a container:
+// the topmost visible namespace is the one created by UID 1001 (its parent,
+// the initial namespace, isn't visible), and it has process 500 (the
+// program itself), with the namespaces of goldenReader() below it.
+
+func hiddenReader() *fakeReader {
+	r := newFakeReader()
+
+	const containerMap = "         0       1001          1\n" +
+		"         1     100000      65536\n"
+	const deepMap = "         0     100000          1\n"
+
+	r.parents[emptyNS] = containerNS
+	r.parents[deepNS] = emptyNS
+	r.creators[containerNS] = 1001
+	r.creators[emptyNS] = 1001
+	r.creators[deepNS] = 100000
+
+	r.addProcess(500, "init", 0, containerNS, containerMap, "allow")
+	r.addProcess(600, "app", 0, deepNS, deepMap, "deny")
+	r.ns["self"] = r.ns["500"]
+
+	return r
+}
+
+// TestGolden displays the hierarchies of goldenReader() (with just the PIDs,
+// and with the maps and the commands too) and hiddenReader(), with color
+// and without, at two widths, and compares each display with a golden file
+// in testdata/userns_overview. After an intended change to the display, the
+// golden files are regenerated with:
+//
+//	go test userns_overview.go userns_overview_test.go -run TestGolden \
+//		-update
+
+func TestGolden(t *testing.T) {
+
+	goldenDir := filepath.Join("testdata", "userns_overview")
+
+	views := []struct {
+		name   string
+		reader func() *fakeReader
+		opts   CmdLineOptions
+	}{
+		{"pids", goldenReader, CmdLineOptions{showPids: true}},
+		{"details", goldenReader, CmdLineOptions{showPids: true,
+			showMaps: true, showComm: true}},
+		{"hidden", hiddenReader, CmdLineOptions{showPids: true,
+			showMaps: true}},
+	}
+
+	for _, v := range views {
+		for _, useColor := range []bool{false, true} {
+			for _, width := range []int{80, 40} {
+				name := v.name
+				if useColor {
+					name += "_color"
+				}
+				name += "_" + strconv.Itoa(width)
+
+				o := v.opts
+				o.useColor = useColor
+				o.wrapWidth = width
+				o.maxDepth = -1
+				o.filterUID = -1
+
+				path := filepath.Join(goldenDir, name+".golden")
+
+				t.Run(name, func(t *testing.T) {
+					got := renderGolden(t, v.reader(), o)
+					checkGolden(t, path, got)
+				})
+			}
+		}
+	}
+}
+
+// renderGolden() scans the hierarchy of 'r' and returns the display produced
+// with the options 'o'.
+
+func renderGolden(t *testing.T, r *fakeReader, o CmdLineOptions) string {
+
+	useReader(t, r)
+	buf := captureOutput(t)
+
+	FindCurrentNamespace()
+	ScanNamespaces(context.Background(), o)
+
+	if status := DisplayOutput(o); status != 0 {
+		t.Errorf("DisplayOutput() returned %d", status)
+	}
+
+	r.checkClosed(t)
+
+	return buf.String()
+}
+
+// largeReader() returns a fake reader for a hierarchy of 'nsCount' user
+// namespaces, in which each namespace has up to four children, with 'n'
+// processes spread evenly across the namespaces. Each child namespace is
+// created by a different UID, and has a two-range map. The program itself
+// is process 1, a member of the initial namespace.
+
+func largeReader(n int, nsCount int) *fakeReader {
+	r := newFakeReader()
+
+	const initialMap = "         0          0 4294967295\n"
+
+	ids := make([]NamespaceID, nsCount)
+	maps := make([]string, nsCount)
+
+	ids[0] = rootUserNS
+	maps[0] = initialMap
+	r.creators[rootUserNS] = 0
+
+	for i := 1; i < nsCount; i++ {
+		uid := 1000 + i
+		ids[i] = NamespaceID{4, 4026532000 + uint64(i)}
+		maps[i] = "         0 " + strconv.Itoa(uid) + "          1\n" +
+			"         1 " + strconv.Itoa(100000*i) + "      65536\n"
+		r.parents[ids[i]] = ids[(i-1)/4]
+		r.creators[ids[i]] = uid
+	}
+
+	for pid := 1; pid <= n; pid++ {
+		i := (pid - 1) % nsCount
+		r.addProcess(pid, "proc", pid%3*1000, ids[i], maps[i], "allow")
+	}
+	r.ns["self"] = r.ns["1"]
+
+	return r
+}
+
+// Sizes of the hierarchies built by largeReader() for the benchmarks
+
+var largeSizes = []struct {
+	processes  int
+	namespaces int
+}{
+	{1000, 10},
+	{10000, 100},
+	{100000, 1000},
+}
+
+// BenchmarkScanLarge measures a (sequential) scan, through the reader
+// interface, of the hierarchies built by largeReader(). Because nothing is
+// read from the live system, it measures just the program's own work.
+
+func BenchmarkScanLarge(b *testing.B) {
+
+	for _, size := range largeSizes {
+		name := strconv.Itoa(size.processes) + " processes, " +
+			strconv.Itoa(size.namespaces) + " namespaces"
+
+		b.Run(name, func(b *testing.B) {
+
+			r := largeReader(size.processes, size.namespaces)
+			useReader(b, r)
+			scanWorkers = 1
+			opts := CmdLineOptions{maxDepth: -1, filterUID: -1}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				resetScan()
+				FindCurrentNamespace()
+				ScanNamespaces(context.Background(), opts)
+			}
+		})
+	}
+}
+
+// BenchmarkDisplayLarge measures the display, with the member PIDs, of the
+// hierarchies built by largeReader(), which are scanned just once.
+
+func BenchmarkDisplayLarge(b *testing.B) {
+
+	for _, size := range largeSizes {
+		name := strconv.Itoa(size.processes) + " processes, " +
+			strconv.Itoa(size.namespaces) + " namespaces"
+
+		b.Run(name, func(b *testing.B) {
+
+			r := largeReader(size.processes, size.namespaces)
+			useReader(b, r)
+			buf := captureOutput(b)
+			opts := CmdLineOptions{showPids: true, maxDepth: -1,
+				filterUID: -1}
+
+			FindCurrentNamespace()
+			ScanNamespaces(context.Background(), opts)
+			if len(NSList) != size.namespaces {
+				b.Fatalf("found %d namespaces, want %d",
+					len(NSList), size.namespaces)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				if status := DisplayOutput(opts); status != 0 {
+					b.Fatalf("DisplayOutput() returned %d",
+						status)
+				}
+			}
+		})
+	}
+}
+
+// pidDirFixture() creates, in a temporary directory, a procfs-like directory
+// with 'n' (empty) PID directories, along with some of the nonnumeric
+// entries found in /proc, and returns the directory.
+
+func pidDirFixture(tb testing.TB, n int) string {
+
+	root := tb.TempDir()
+
+	names := []string{"self", "sys", "net", "meminfo"}
+	for pid := 1; pid <= n; pid++ {
+		names = append(names, strconv.Itoa(pid))
+	}
+
+	for _, name := range names {
+		err := os.Mkdir(filepath.Join(root, name), 0755)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+// readDirPIDs() is the original way of listing the PID directories under
+// 'dir', which reads (and sorts, and stat()s) all of the entries before the
+// first PID is processed. It is kept for BenchmarkListPIDDirs.
+
+func readDirPIDs(dir string, fn func(name string) bool) error {
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		if name[0] >= '1' && name[0] <= '9' {
+			if !fn(name) {
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// BenchmarkListPIDDirs compares the time and memory taken to list the PID
+// directories of fixtures built by pidDirFixture() (with as many processes
+// as the fixtures of BenchmarkScanLarge) by reading the whole directory with
+// ioutil.ReadDir(), as the program once did, and by reading it in batches
+// with ForEachPIDDir(), as it now does.
+
+func BenchmarkListPIDDirs(b *testing.B) {
+
+	listers := []struct {
+		name string
+		list func(dir string, fn func(name string) bool) error
+	}{
+		{"ReadDir", readDirPIDs},
+		{"Readdirnames", ForEachPIDDir},
+	}
+
+	for _, size := range largeSizes {
+		dir := pidDirFixture(b, size.processes)
+
+		for _, l := range listers {
+			name := strconv.Itoa(size.processes) + " processes/" +
+				l.name
+
+			b.Run(name, func(b *testing.B) {
+
+				b.ReportAllocs()
+
+				for i := 0; i < b.N; i++ {
+					n := 0
+					err := l.list(dir, func(string) bool {
+						n++
+						return true
+					})
+					if err != nil {
+						b.Fatal(err)
+					}
+					if n != size.processes {
+						b.Fatalf("%d PIDs, want %d", n,
+							size.processes)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkOutput measures the throughput of the display output, using as
+// the text the display, with the member PIDs, of the 10000-process
+// hierarchy of BenchmarkDisplayLarge.
+
+func BenchmarkOutput(b *testing.B) {
+
+	useReader(b, largeReader(10000, 100))
+	buf := captureOutput(b)
+	opts := CmdLineOptions{showPids: true, maxDepth: -1, filterUID: -1}
+
+	FindCurrentNamespace()
+	ScanNamespaces(context.Background(), opts)
+	if status := DisplayOutput(opts); status != 0 {
+		b.Fatalf("DisplayOutput() returned %d", status)
+	}
+
+	benchmarkLineWriter(b, buf.Bytes())
+}
+
+// benchmarkLineWriter() measures the writing of 'text' to a pipe (whose
+// reader discards what it reads), as a series of small writes, one for each
+// word, like those made by the display functions: first with a write() for
+// each piece, as the program did before its output was buffered, and then
+// through a LineWriter.
+
+func benchmarkLineWriter(b *testing.B, text []byte) {
+
+	size := int64(len(text))
+
+	var pieces [][]byte
+	for len(text) > 0 {
+		i := bytes.IndexAny(text, " \n") + 1
+		if i == 0 {
+			i = len(text)
+		}
+		pieces = append(pieces, text[:i])
+		text = text[i:]
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, r)
+		close(done)
+	}()
+	defer func() {
+		w.Close()
+		<-done
+		r.Close()
+	}()
+
+	b.Run("unbuffered", func(b *testing.B) {
+
+		b.SetBytes(size)
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			for _, p := range pieces {
+				if _, err := w.Write(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("LineWriter", func(b *testing.B) {
+
+		lw := &LineWriter{out: w}
+
+		b.SetBytes(size)
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			for _, p := range pieces {
+				lw.Write(p)
+			}
+			if err := lw.Flush(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// openNSFile() opens the namespace file 'path', closing it when the test
+// ends.
+
+func openNSFile(tb testing.TB, path string) int {
+
+	fd, err := syscall.Open(path, syscall.O_RDONLY, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { syscall.Close(fd) })
+
+	return fd
+}
+
+// sameNamespace() returns true if the file descriptor 'fd' refers to the
+// same namespace as the namespace file 'path'.
+
+func sameNamespace(tb testing.TB, fd int, path string) bool {
+
+	var fdStat, pathStat syscall.Stat_t
+
+	if err := syscall.Fstat(fd, &fdStat); err != nil {
+		tb.Fatal(err)
+	}
+	if err := syscall.Stat(path, &pathStat); err != nil {
+		tb.Fatal(err)
+	}
+
+	return fdStat.Dev == pathStat.Dev && fdStat.Ino == pathStat.Ino
+}
+
+// inInitialUserNS() returns true if the test is running in the initial user
+// namespace.
+
+func inInitialUserNS(tb testing.TB) bool {
+
+	var sb syscall.Stat_t
+
+	if err := syscall.Stat("/proc/self/ns/user", &sb); err != nil {
+		tb.Fatal(err)
+	}
+
+	return sb.Ino == PROC_USER_INIT_INO
+}
+
+// TestNSIoctlLive checks NSIoctl() and NSGetOwnerUID() against the namespace
+// files of the test program (and of a child in a new user namespace).
+
+func TestNSIoctlLive(t *testing.T) {
+
+	t.Run("type", func(t *testing.T) {
+		fd := openNSFile(t, "/proc/self/ns/user")
+
+		nsType, err := NSIoctl(fd, NS_GET_NSTYPE)
+		if err != nil || nsType != CLONE_NEWUSER {
+			t.Errorf("got %#x, %v; want %#x", nsType, err,
+				CLONE_NEWUSER)
+		}
+	})
+
+	t.Run("owning user namespace", func(t *testing.T) {
+		fd := openNSFile(t, "/proc/self/ns/uts")
+
+		userFD, err := NSIoctl(fd, NS_GET_USERNS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer syscall.Close(userFD)
+
+		if !sameNamespace(t, userFD, "/proc/self/ns/user") {
+			t.Error("NS_GET_USERNS did not return our " +
+				"user namespace")
+		}
+	})
+
+	child := childUserNS(t)
+	if child == "" {
+		t.Skip("no child user namespace")
+	}
+
+	t.Run("parent", func(t *testing.T) {
+		fd := openNSFile(t, child)
+
+		parentFD, err := NSIoctl(fd, NS_GET_PARENT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer syscall.Close(parentFD)
+
+		if !sameNamespace(t, parentFD, "/proc/self/ns/user") {
+			t.Error("NS_GET_PARENT did not return our " +
+				"user namespace")
+		}
+	})
+
+	t.Run("owner UID", func(t *testing.T) {
+		fd := openNSFile(t, child)
+
+		uid, err := NSGetOwnerUID(fd)
+		if err != nil || uid != os.Geteuid() {
+			t.Errorf("got %d, %v; want %d", uid, err, os.Geteuid())
+		}
+	})
+}
+
+// TestNSIoctlErrors checks that NSIoctl() and NSGetOwnerUID() return -1 and
+// the errno from the failed ioctl(), so that the callers can classify the
+// error with errors.Is() and errors.As().
+
+func TestNSIoctlErrors(t *testing.T) {
+
+	notNS, err := os.Open("/proc/self/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notNS.Close()
+
+	uts := openNSFile(t, "/proc/self/ns/uts")
+	user := openNSFile(t, "/proc/self/ns/user")
+
+	tests := []struct {
+		name        string
+		call        func() (int, error)
+		want        syscall.Errno
+		initialOnly bool // Case needs the initial user NS
+	}{
+		{"not a namespace file", func() (int, error) {
+			return NSIoctl(int(notNS.Fd()), NS_GET_NSTYPE)
+		}, syscall.ENOTTY, false},
+		{"no parent of nonhierarchical NS", func() (int, error) {
+			return NSIoctl(uts, NS_GET_PARENT)
+		}, syscall.EINVAL, false},
+		{"owner UID of non-user NS", func() (int, error) {
+			return NSGetOwnerUID(uts)
+		}, syscall.EINVAL, false},
+		{"bad file descriptor", func() (int, error) {
+			return NSIoctl(-1, NS_GET_USERNS)
+		}, syscall.EBADF, false},
+		{"parent of initial user NS", func() (int, error) {
+			return NSIoctl(user, NS_GET_PARENT)
+		}, syscall.EPERM, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			if tc.initialOnly && !inInitialUserNS(t) {
+				t.Skip("not in the initial user namespace")
+			}
+
+			ret, err := tc.call()
+			if ret != -1 || !errors.Is(err, tc.want) {
+				t.Errorf("got %d, %v; want -1, %v", ret, err,
+					tc.want)
+			}
+
+			var errno syscall.Errno
+			if !errors.As(err, &errno) {
+				t.Errorf("%T is not a syscall.Errno", err)
+			}
+		})
+	}
+}
+
+// FuzzEscapeName checks that the output of EscapeName() contains no
+// control characters, and that escaping it again leaves it unchanged.
+
+func FuzzEscapeName(f *testing.F) {
+
+	f.Add("bash")
+	f.Add("a\tb\nc\x1b[31m\x7f\u0085")
+	f.Add("漢字 é")
+	f.Add("\xff\xfe")
+
+	f.Fuzz(func(t *testing.T, name string) {
+
+		escaped := EscapeName(name)
+
+		for _, r := range escaped {
+			if unicode.IsControl(r) {
+				t.Errorf("EscapeName(%q) = %q contains %U",
+					name, escaped, r)
+			}
+		}
+
+		if again := EscapeName(escaped); again != escaped {
+			t.Errorf("EscapeName(%q) = %q; escaping again "+
+				"gives %q", name, escaped, again)
+		}
+	})
+}
+
+// signalChild() is run (instead of the tests) in a child of the test
+// binary, by startSignalChild(). It installs the program's signal handlers
+// and, depending on 'mode', either leaves some output buffered ("display"),
+// or starts a scan that is canceled by the first signal and then leaves
+// some output buffered ("scan"), or writes to standard output until the
+// reader goes away ("pipe"). Each time that it is ready for a signal, it
+// writes "ready" to stderr.
+
+func signalChild(mode string) {
+
+	w := &LineWriter{out: os.Stdout}
+	output = w
+	HandleSignals(mode != "pipe", w)
+
+	switch mode {
+	case "scan":
+		ctx := StartScan()
+		fmt.Fprintln(os.Stderr, "ready")
+		<-ctx.Done()
+		EndScan(ctx)
+		fmt.Fprint(output, "scan canceled\npartial")
+	case "display":
+		fmt.Fprint(output, "complete line\npartial")
+	case "pipe":
+		fmt.Fprintln(os.Stderr, "ready")
+		for {
+			fmt.Println("line")
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "ready")
+	time.Sleep(10 * time.Second)
+	os.Exit(1)
+}
+
+// startSignalChild() starts the test binary as a child that runs
+// signalChild() in 'mode', with its standard output going to 'stdout'. It
+// returns the child, and a function that waits until the child is ready for
+// a signal.
+
+func startSignalChild(t *testing.T, mode string,
+	stdout io.Writer) (*exec.Cmd, func()) {
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "USERNS_OVERVIEW_SIGNAL_TEST="+mode)
+	cmd.Stdout = stdout
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(stderr)
+	waitReady := func() {
+		line, err := r.ReadString('\n')
+		if line != "ready\n" {
+			t.Fatalf("child wrote %q (%v), not \"ready\"", line,
+				err)
+		}
+	}
+
+	return cmd, waitReady
+}
+
+// exitStatus() waits for 'cmd' to terminate, and returns its exit status.
+
+func exitStatus(t *testing.T, cmd *exec.Cmd) int {
+
+	err := cmd.Wait()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	return 0
+}
+
+// TestSignals sends SIGINT and SIGTERM to a child that is displaying
+// output, and checks its exit status (128 plus the signal number), and that
+// its output ends with the last complete line followed by the color reset,
+// with no partial line. When a scan is in progress, the first signal
+// cancels just the scan, and the second terminates the program.
+
+func TestSignals(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		mode    string
+		signals []syscall.Signal
+		status  int
+		stdout  string
+	}{
+		{"SIGINT", "display", []syscall.Signal{syscall.SIGINT}, 130,
+			"complete line\n" + NORMAL},
+		{"SIGTERM", "display", []syscall.Signal{syscall.SIGTERM}, 143,
+			"complete line\n" + NORMAL},
+		{"scan", "scan", []syscall.Signal{syscall.SIGINT,
+			syscall.SIGINT}, 130, "scan canceled\n" + NORMAL},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			var stdout bytes.Buffer
+			cmd, waitReady := startSignalChild(t, tc.mode, &stdout)
+
+			for _, sig := range tc.signals {
+				waitReady()
+				if err := cmd.Process.Signal(sig); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if status := exitStatus(t, cmd); status != tc.status {
+				t.Errorf("exit status %d, want %d", status,
+					tc.status)
+			}
+			if got := stdout.String(); got != tc.stdout {
+				t.Errorf("stdout %q, want %q", got, tc.stdout)
+			}
+		})
+	}
+}
+
+// TestSignalBrokenPipe checks that a child whose standard output is a pipe
+// whose reader goes away (as in "userns_overview | head") exits silently with
+// status 0.
+
+func TestSignalBrokenPipe(t *testing.T) {
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd, waitReady := startSignalChild(t, "pipe", w)
+	w.Close()
+
+	waitReady()
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if line != "line\n" {
+		t.Fatalf("read %q (%v) from the child", line, err)
+	}
+	r.Close()
+
+	if status := exitStatus(t, cmd); status != 0 {
+		t.Errorf("exit status %d, want 0", status)
+	}
+}
+
+// 'interruptingReader' is a 'ProcReader' that, when it lists the process
+// 'stop', sends SIGINT to the program (as the user would, by typing
+// Control-C) and waits until the signal has canceled the scan.
+
+type interruptingReader struct {
+	ProcReader
+	stop string
+}
+
+func (r interruptingReader) ListProcesses(fn func(name string) bool) error {
+	return r.ProcReader.ListProcesses(func(name string) bool {
+		if name == r.stop {
+			syscall.Kill(os.Getpid(), syscall.SIGINT)
+			for atomic.LoadInt32(&scanInProgress) != 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		return fn(name)
+	})
+}
+
+// interruptChild() is run (instead of the tests) in a child of the test
+// binary, by TestInterruptedScan. It runs the program over the hierarchy
+// built by largeReader(), interrupting the scan when it reaches the process
+// 'stop'. The scan is sequential, so that the processes before 'stop' are
+// exactly those that were scanned.
+
+func interruptChild(stop string) {
+
+	procReader = interruptingReader{largeReader(1000, 100), stop}
+	scanWorkers = 1
+
+	os.Args = []string{"userns_overview"}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	main()
+
+	os.Exit(0)
+}
+
+// TestInterruptedScan interrupts the program when its scan of 1000
+// processes spread across 100 user namespaces reaches PID 51, so that only
+// the first 50 namespaces have been found. It checks that the program
+// displays just those namespaces, after writing the partial-results banner
+// to stderr, and exits with the status EXIT_INTERRUPTED.
+
+func TestInterruptedScan(t *testing.T) {
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "USERNS_OVERVIEW_INTERRUPT_TEST=51")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := exitStatus(t, cmd); status != EXIT_INTERRUPTED {
+		t.Fatalf("exit status %d, want %d; stderr:\n%s", status,
+			EXIT_INTERRUPTED, stderr.String())
+	}
+
+	banner := "Scan interrupted: displaying partial results"
+	if !strings.Contains(stderr.String(), banner) {
+		t.Errorf("stderr doesn't contain %q:\n%s", banner,
+			stderr.String())
+	}
+
+	for i := 1; i < 100; i++ {
+		id := strconv.FormatUint(4026532000+uint64(i), 10)
+		found := strings.Contains(stdout.String(), id)
+		if found != (i < 50) {
+			t.Errorf("namespace %s displayed: %v, want %v\n%s", id,
+				found, i < 50, stdout.String())
+		}
+	}
+}
+
+// redirectChild() is run (instead of the tests) in a child of the test
+// binary, by TestRedirectedOutput. It runs the program, with the arguments
+// given to the binary, over the hierarchy built by largeReader().
+
+func redirectChild() {
+
+	procReader = largeReader(1000, 10)
+
+	os.Args = append([]string{"userns_overview"}, os.Args[1:]...)
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	main()
+
+	os.Exit(0)
+}
+
+// runRedirected() runs redirectChild() with the arguments 'args', with
+// standard output redirected to a pipe or, if 'toFile' is true, to a file,
+// and returns the output. NO_COLOR is removed from the environment, so that
+// it can't be what suppresses color.
+
+func runRedirected(t *testing.T, toFile bool, args ...string) string {
+
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "NO_COLOR=") {
+			env = append(env, e)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(env, "USERNS_OVERVIEW_REDIRECT_TEST=1")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	path := filepath.Join(t.TempDir(), "out")
+	if toFile {
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		cmd.Stdout = f
+	}
+
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%q: %v; stderr:\n%s", args, err, stderr.String())
+	}
+
+	if !toFile {
+		return stdout.String()
+	}
+
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(out)
+}
+
+// longestMemberLine() returns the length, in characters, of the longest
+// line of 'text' that doesn't display a namespace (that is, that doesn't
+// contain a "{device inode}" ID). Only the lines that list the members of
+// the namespaces are fitted to the output width.
+
+func longestMemberLine(text string) int {
+
+	longest := 0
+	for _, line := range strings.Split(text, "\n") {
+		if strings.Contains(line, "{") {
+			continue
+		}
+		if n := utf8.RuneCountInString(line); n > longest {
+			longest = n
+		}
+	}
+
+	return longest
+}
+
+// TestRedirectedOutput runs the program with its standard output
+// redirected to a pipe and to a file. It checks that, by default, the
+// output contains no escape bytes and its member lists aren't wrapped (the
+// fixture has lists longer than 80 characters), while "--color=always"
+// and "--width" still apply.
+
+func TestRedirectedOutput(t *testing.T) {
+
+	for _, toFile := range []bool{false, true} {
+		name := "pipe"
+		if toFile {
+			name = "file"
+		}
+
+		t.Run(name, func(t *testing.T) {
+
+			out := runRedirected(t, toFile)
+			if strings.Contains(out, "\x1b") {
+				t.Errorf("default output contains escape "+
+					"bytes:\n%q", out)
+			}
+			if longestMemberLine(out) <= 80 {
+				t.Errorf("default output is wrapped:\n%s",
+					out)
+			}
+
+			out = runRedirected(t, toFile, "--color=always")
+			if !strings.Contains(out, "\x1b") {
+				t.Errorf("'--color=always' output contains "+
+					"no escape bytes:\n%s", out)
+			}
+
+			out = runRedirected(t, toFile, "--width=60")
+			if strings.Contains(out, "\x1b") {
+				t.Errorf("'--width=60' output contains escape "+
+					"bytes:\n%q", out)
+			}
+			if n := longestMemberLine(out); n > 60 {
+				t.Errorf("'--width=60' output has a line of "+
+					"%d characters:\n%s", n, out)
+			}
+		})
+	}
+}